@@ -0,0 +1,116 @@
+// Micro-benchmarks of the audio hot path: batching ffmpeg's output into
+// chunks, base64-encoding them into append frames, and fanning broadcasts out
+// to stream clients. Each case is warmed up, then run for about a second;
+// compare the rates of two runs on the same machine to spot a regression.
+import { BunRuntime } from "@effect/platform-bun";
+import { Console, Effect, Queue, Stream } from "effect";
+import { inputFormatSpec } from "../src/AudioFormat.js";
+import { batchByBytes } from "../src/AudioSource.js";
+import { Broadcaster } from "../src/Broadcaster.js";
+import { makeBufferPool } from "../src/BufferPool.js";
+import { encodeBase64Into } from "../src/OpenAIRealtime.js";
+
+const RUN_MS = 1000;
+const WARMUP_RUNS = 50;
+
+const spec = inputFormatSpec("pcm");
+// ffmpeg flushes every packet, so its pipe is read in small pieces.
+const PIPE_BYTES = 320;
+const SECOND_OF_AUDIO = Array.from(
+  { length: Math.ceil(spec.bytesPerSecond / PIPE_BYTES) },
+  () => new Uint8Array(PIPE_BYTES).map(() => (Math.random() * 256) | 0)
+);
+
+const CLIENTS = 100;
+const MESSAGES_PER_RUN = 100;
+
+// Runs `op` repeatedly and reports runs per second, and throughput when each
+// run processes `bytes`.
+const bench = (
+  name: string,
+  bytes: number | null,
+  op: Effect.Effect<void>
+) =>
+  Effect.gen(function* () {
+    yield* Effect.repeatN(op, WARMUP_RUNS);
+    const start = performance.now();
+    let runs = 0;
+    while (performance.now() - start < RUN_MS) {
+      yield* op;
+      runs++;
+    }
+    const seconds = (performance.now() - start) / 1000;
+    const rate = runs / seconds;
+    yield* Console.log(
+      `${name.padEnd(40)} ${rate.toFixed(0).padStart(10)} runs/s` +
+        (bytes === null
+          ? ""
+          : `  ${((rate * bytes) / 1_048_576).toFixed(1).padStart(8)} MiB/s`)
+    );
+  });
+
+const batching = Effect.gen(function* () {
+  const pool = yield* makeBufferPool(Math.floor(spec.bytesPerSecond / 50));
+  const bytes = SECOND_OF_AUDIO.reduce((n, c) => n + c.length, 0);
+  yield* bench(
+    "batch 1s of pipe output into 20ms chunks",
+    bytes,
+    Stream.fromIterable(SECOND_OF_AUDIO).pipe(
+      batchByBytes(pool, Math.floor(spec.bytesPerSecond / 50)),
+      Stream.runForEach((chunk) => Effect.sync(() => pool.release(chunk)))
+    )
+  );
+});
+
+const encoding = Effect.gen(function* () {
+  const chunk = SECOND_OF_AUDIO[0]!.subarray(
+    0,
+    Math.floor(spec.bytesPerSecond / 50)
+  );
+  const frame = Buffer.allocUnsafe(Math.ceil(chunk.length / 3) * 4);
+  yield* bench(
+    "base64 a 20ms chunk in place",
+    chunk.length,
+    Effect.sync(() => {
+      encodeBase64Into(chunk, frame, 0);
+    })
+  );
+  // What the in-place encoder is meant to beat.
+  yield* bench(
+    "base64 a 20ms chunk with Buffer",
+    chunk.length,
+    Effect.sync(() => {
+      Buffer.from(chunk).toString("base64");
+    })
+  );
+});
+
+const fanOut = Effect.gen(function* () {
+  const broadcaster = yield* Broadcaster;
+  const queues = yield* Effect.forEach(
+    Array.from({ length: CLIENTS }, (_, i) => i),
+    (i) => broadcaster.subscribeClient("sse", null, `bench-${i}`)
+  );
+  const delta = {
+    type: "delta",
+    responseId: "resp_bench",
+    task: "commentary",
+    source: "franceinfo",
+    audioOffsetMs: 15_000,
+    text: "Et bien sûr, tout va très bien.",
+  } as const;
+  yield* bench(
+    `publish ${MESSAGES_PER_RUN} deltas to ${CLIENTS} clients`,
+    null,
+    Effect.gen(function* () {
+      for (let i = 0; i < MESSAGES_PER_RUN; i++) {
+        yield* broadcaster.publish(delta);
+      }
+      yield* Effect.forEach(queues, Queue.takeAll, { discard: true });
+    })
+  );
+}).pipe(Effect.scoped, Effect.provide(Broadcaster.Default));
+
+BunRuntime.runMain(
+  Effect.all([batching, encoding, fanOut], { discard: true })
+);
@@ -0,0 +1,158 @@
+// Package funnyradio is a client for the Funny Radio HTTP API: the audio
+// sources, the message stream, transcript search and the effective
+// configuration.
+//
+//	client, err := funnyradio.New("http://localhost:3000",
+//		funnyradio.WithToken(os.Getenv("FUNNY_RADIO_TOKEN")))
+//	stream, err := client.Subscribe(ctx, funnyradio.StreamOptions{
+//		Types: []string{funnyradio.TypeComplete},
+//	})
+//	defer stream.Close()
+//	for {
+//		event, err := stream.Next()
+//		if err != nil {
+//			break
+//		}
+//		fmt.Println(event.Message.Source, event.Message.Text)
+//	}
+package funnyradio
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Client calls one Funny Radio server. It is safe for concurrent use.
+type Client struct {
+	baseURL    *url.URL
+	httpClient *http.Client
+	token      string
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the HTTP client requests go through; the default is
+// http.DefaultClient. Streams stay open, so it should have no Timeout.
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithToken sets the session token sent as a bearer token, as returned by
+// POST /auth/login, for servers with accounts on (AUTH_SECRET).
+func WithToken(token string) Option {
+	return func(c *Client) { c.token = token }
+}
+
+// New returns a client for the server at baseURL, e.g.
+// "http://localhost:3000".
+func New(baseURL string, opts ...Option) (*Client, error) {
+	u, err := url.Parse(strings.TrimSuffix(baseURL, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("funnyradio: invalid base URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("funnyradio: base URL needs http(s): %q", baseURL)
+	}
+	c := &Client{baseURL: u, httpClient: http.DefaultClient}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c, nil
+}
+
+// APIError is a response outside the 2xx range.
+type APIError struct {
+	StatusCode int
+	// The response body, usually a JSON error from the server.
+	Body string
+}
+
+func (e *APIError) Error() string {
+	if e.Body == "" {
+		return fmt.Sprintf("funnyradio: %d %s", e.StatusCode,
+			http.StatusText(e.StatusCode))
+	}
+	return fmt.Sprintf("funnyradio: %d %s: %s", e.StatusCode,
+		http.StatusText(e.StatusCode), e.Body)
+}
+
+// IsNotFound reports whether err is a 404, e.g. for an unknown source.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+func (c *Client) newRequest(
+	ctx context.Context, method, path string, query url.Values, body any,
+) (*http.Request, error) {
+	u := c.baseURL.JoinPath(path)
+	u.RawQuery = query.Encode()
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("funnyradio: encoding request: %w", err)
+		}
+		reader = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// send makes a request and checks its status; the caller closes the body.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	res, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		defer res.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 4096))
+		return nil, &APIError{
+			StatusCode: res.StatusCode,
+			Body:       strings.TrimSpace(string(body)),
+		}
+	}
+	return res, nil
+}
+
+// do makes a JSON request and decodes the response into out, unless out is
+// nil.
+func (c *Client) do(
+	ctx context.Context, method, path string, query url.Values, body, out any,
+) error {
+	req, err := c.newRequest(ctx, method, path, query, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	res, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(res.Body).Decode(out); err != nil {
+		return fmt.Errorf("funnyradio: decoding %s %s: %w", method, path, err)
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package funnyradio
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSubscribe(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/stream" {
+			http.NotFound(w, r)
+			return
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer secret" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if got := r.Header.Get("Accept"); got != "text/event-stream" {
+			t.Errorf("Accept = %q", got)
+		}
+		if got := r.URL.Query().Get("type"); got != "delta,complete" {
+			t.Errorf("type = %q", got)
+		}
+		if got := r.URL.Query().Get("source"); got != "franceinfo" {
+			t.Errorf("source = %q", got)
+		}
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprint(w, ": connected\n\n")
+		fmt.Fprint(w, "data: {\"type\":\"delta\",\"responseId\":\"resp_1\",\"seq\":0,\"text\":\"Bon\"}\n\n")
+		w.(http.Flusher).Flush()
+		fmt.Fprint(w, "data: {\"type\":\"complete\",\"responseId\":\"resp_1\",\"text\":\"Bonjour\"}\n\n")
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL+"/", WithToken("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream, err := client.Subscribe(context.Background(), StreamOptions{
+		Types:  []string{TypeDelta, TypeComplete},
+		Source: "franceinfo",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+
+	delta, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if delta.Message.Type != TypeDelta || delta.Message.ResponseID != "resp_1" ||
+		delta.Message.Seq == nil || *delta.Message.Seq != 0 {
+		t.Errorf("first event = %+v", delta.Message)
+	}
+	complete, err := stream.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if complete.Message.Type != TypeComplete || complete.Message.Text != "Bonjour" {
+		t.Errorf("second event = %+v", complete.Message)
+	}
+	if _, err := stream.Next(); err != io.EOF {
+		t.Errorf("after the last event: %v, want io.EOF", err)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"_tag":"NotFound"}`, http.StatusNotFound)
+	}))
+	defer server.Close()
+
+	client, err := New(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.Config(context.Background())
+	if !IsNotFound(err) {
+		t.Fatalf("err = %v, want a 404", err)
+	}
+	if want := `funnyradio: 404 Not Found: {"_tag":"NotFound"}`; err.Error() != want {
+		t.Errorf("err = %q, want %q", err.Error(), want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	for _, baseURL := range []string{"localhost:3000", "ftp://example.com", "://"} {
+		if _, err := New(baseURL); err == nil {
+			t.Errorf("New(%q) succeeded", baseURL)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package funnyradio
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// Config is the effective configuration, defaults included, as returned by
+// GET /config (admins only when accounts are on).
+type Config struct {
+	Port  int    `json:"port"`
+	Model string `json:"model"`
+	// Instructions for the commentary task.
+	Prompt string `json:"prompt"`
+	// Language to write commentary in, if not the prompt's own.
+	Language string       `json:"language,omitempty"`
+	Window   WindowConfig `json:"window"`
+	// Processors applied in order to response text, as configured.
+	PostProcessing []json.RawMessage `json:"postProcessing"`
+	Sources        []SourceConfig    `json:"sources"`
+	Playlists      []PlaylistConfig  `json:"playlists"`
+	// Whether the OpenAI session is replaced when a response times out.
+	ReconnectOnStuck bool           `json:"reconnectOnStuck"`
+	Alerts           AlertsConfig   `json:"alerts"`
+	Webhooks         WebhooksConfig `json:"webhooks"`
+}
+
+// AlertsConfig holds the dead air alert thresholds set in the config file;
+// nil ones come from the server's environment.
+type AlertsConfig struct {
+	SilenceThresholdDbfs *float64 `json:"silenceThresholdDbfs,omitempty"`
+	DeadAirSeconds       *float64 `json:"deadAirSeconds,omitempty"`
+}
+
+// WebhooksConfig holds the alert webhooks set in the config file; empty ones
+// come from the server's environment.
+type WebhooksConfig struct {
+	DeadAir string `json:"deadAir,omitempty"`
+	Errors  string `json:"errors,omitempty"`
+}
+
+// PlaylistConfig is a playlist as configured: sources to cycle through,
+// Minutes on each.
+type PlaylistConfig struct {
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Sources []string `json:"sources"`
+	Minutes float64  `json:"minutes"`
+}
+
+// WindowConfig is how much audio goes into each response and each commit.
+type WindowConfig struct {
+	TargetSeconds float64 `json:"targetSeconds"`
+	CommitSeconds float64 `json:"commitSeconds"`
+}
+
+// SourceConfig is a source as configured.
+type SourceConfig struct {
+	ID                string            `json:"id"`
+	Name              string            `json:"name"`
+	URL               string            `json:"url"`
+	BackupURLs        []string          `json:"backupUrls,omitempty"`
+	Type              string            `json:"type,omitempty"`
+	Tasks             []string          `json:"tasks"`
+	Instructions      string            `json:"instructions,omitempty"`
+	MaxBitrate        *int              `json:"maxBitrate,omitempty"`
+	UserAgent         string            `json:"userAgent,omitempty"`
+	Headers           map[string]string `json:"headers,omitempty"`
+	NormalizeLoudness *bool             `json:"normalizeLoudness,omitempty"`
+	DelaySeconds      *float64          `json:"delaySeconds,omitempty"`
+	NoiseReduction    string            `json:"noiseReduction,omitempty"`
+	Preprocessing     *Preprocessing    `json:"preprocessing,omitempty"`
+	FFmpegArgs        []string          `json:"ffmpegArgs,omitempty"`
+	// Where the current show comes from, as configured.
+	NowPlaying json.RawMessage `json:"nowPlaying,omitempty"`
+	Budget     *SourceBudget   `json:"budget,omitempty"`
+}
+
+// Config returns the configuration currently in effect.
+func (c *Client) Config(ctx context.Context) (*Config, error) {
+	var config Config
+	if err := c.do(ctx, http.MethodGet, "/config", nil, nil, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ConfigUpdate changes the commentary prompt or language until the config
+// file is reloaded; empty fields are left as they are.
+type ConfigUpdate struct {
+	Prompt   string `json:"prompt,omitempty"`
+	Language string `json:"language,omitempty"`
+}
+
+// UpdateConfig applies the update and returns the configuration now in
+// effect (admins only when accounts are on).
+func (c *Client) UpdateConfig(ctx context.Context, update *ConfigUpdate) (*Config, error) {
+	var config Config
+	if err := c.do(ctx, http.MethodPatch, "/config", nil, update, &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// ConfigBundle is the saved configuration, alerts and webhooks included, and
+// the presets, as returned by GET /config/export. Config and Presets are kept
+// as sent, so a bundle imports back unchanged whatever fields this client
+// knows of.
+type ConfigBundle struct {
+	Version int `json:"version"`
+	// When the bundle was exported, in ms since the epoch.
+	ExportedAt int64           `json:"exportedAt"`
+	Config     json.RawMessage `json:"config"`
+	Presets    json.RawMessage `json:"presets"`
+}
+
+// ConfigImport counts what an imported bundle holds.
+type ConfigImport struct {
+	Sources   int `json:"sources"`
+	Playlists int `json:"playlists"`
+	Presets   int `json:"presets"`
+}
+
+// ExportConfig returns the saved configuration and presets as one bundle
+// (admins only when accounts are on).
+func (c *Client) ExportConfig(ctx context.Context) (*ConfigBundle, error) {
+	var bundle ConfigBundle
+	if err := c.do(ctx, http.MethodGet, "/config/export", nil, nil, &bundle); err != nil {
+		return nil, err
+	}
+	return &bundle, nil
+}
+
+// ImportConfig replaces the configuration and presets with an exported
+// bundle; the server keeps its previous config file as a backup, and puts
+// everything back if any of it can't be written.
+func (c *Client) ImportConfig(ctx context.Context, bundle *ConfigBundle) (*ConfigImport, error) {
+	var result ConfigImport
+	if err := c.do(ctx, http.MethodPost, "/config/import", nil, bundle, &result); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
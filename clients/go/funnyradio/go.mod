@@ -0,0 +1,3 @@
+module github.com/galadrimteam/effect-funny-radio/clients/go/funnyradio
+
+go 1.22
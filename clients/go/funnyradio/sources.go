@@ -0,0 +1,135 @@
+package funnyradio
+
+import (
+	"context"
+	"net/http"
+)
+
+// Source is an audio source as listed by GET /sources.
+type Source struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// Other URLs of the stream, tried in order on failures.
+	BackupURLs []string `json:"backupUrls,omitempty"`
+	// hls, icy, dash, rtsp, file or websocket; empty when guessed from the
+	// URL.
+	Type  string   `json:"type,omitempty"`
+	Tasks []string `json:"tasks"`
+	// Commentary instructions template, if the source has its own.
+	Instructions      string   `json:"instructions,omitempty"`
+	MaxBitrate        *int     `json:"maxBitrate,omitempty"`
+	NormalizeLoudness *bool    `json:"normalizeLoudness,omitempty"`
+	DelaySeconds      *float64 `json:"delaySeconds,omitempty"`
+	// near_field or far_field; empty when off.
+	NoiseReduction string         `json:"noiseReduction,omitempty"`
+	Preprocessing  *Preprocessing `json:"preprocessing,omitempty"`
+	Budget         *SourceBudget  `json:"budget,omitempty"`
+	Status         SourceStatus   `json:"status"`
+}
+
+// SourceBudget is the most a source may spend per UTC day; past it the
+// source is paused until the next day.
+type SourceBudget struct {
+	// Input and output tokens of the source's responses; nil when unlimited.
+	Tokens *int64 `json:"tokens,omitempty"`
+	// Their cost in USD; nil when unlimited.
+	USD *float64 `json:"usd,omitempty"`
+}
+
+// Preprocessing is the ffmpeg filtering a source's audio gets before it is
+// sent.
+type Preprocessing struct {
+	// Cutoff of the high-pass filter in Hz; nil when off.
+	HighpassHz *float64 `json:"highpassHz,omitempty"`
+	// Automatic gain control.
+	AGC *bool `json:"agc,omitempty"`
+}
+
+// SourceStatus is how a source's audio pipeline is doing.
+type SourceStatus struct {
+	Running bool `json:"running"`
+	// Start of the current run, in ms since the epoch.
+	StartedAt      *int64 `json:"startedAt"`
+	UptimeMs       *int64 `json:"uptimeMs"`
+	BytesProcessed int64  `json:"bytesProcessed"`
+	ChunksReceived int64  `json:"chunksReceived"`
+	// The source's URLs in the order they are tried.
+	Health []URLHealth `json:"health"`
+}
+
+// URLHealth is how streaming from one of a source's URLs has gone.
+type URLHealth struct {
+	URL string `json:"url"`
+	// Out of 100; failures lower it and it recovers over time.
+	Score    int   `json:"score"`
+	Failures int64 `json:"failures"`
+	// Last failure: unreachable, exited or stalled; nil if none.
+	LastFailure *URLFailure `json:"lastFailure"`
+	// Whether the source was last streamed from this URL.
+	Active bool `json:"active"`
+}
+
+// URLFailure is a failed stream from a URL.
+type URLFailure struct {
+	Kind string `json:"kind"`
+	// In ms since the epoch.
+	At int64 `json:"at"`
+}
+
+// Variant is the HLS rendition streamed for the current source.
+type Variant struct {
+	URL string `json:"url"`
+	// Null when ffmpeg picks the rendition.
+	Bandwidth *int64 `json:"bandwidth"`
+}
+
+// Sources is the response of GET /sources.
+type Sources struct {
+	Sources []Source `json:"sources"`
+	// Currently selected source, nil if none is.
+	Current *string  `json:"current"`
+	Paused  bool     `json:"paused"`
+	Variant *Variant `json:"variant"`
+	// Native sample rate of the current source in Hz, nil until probed.
+	SampleRate *int `json:"sampleRate"`
+}
+
+// Selection is the response of POST /sources.
+type Selection struct {
+	Current *string `json:"current"`
+	// Name of the selected source, nil if it was cleared.
+	Name *string `json:"name"`
+}
+
+// ListSources returns every source and which one is selected.
+func (c *Client) ListSources(ctx context.Context) (*Sources, error) {
+	var sources Sources
+	if err := c.do(ctx, http.MethodGet, "/sources", nil, nil, &sources); err != nil {
+		return nil, err
+	}
+	return &sources, nil
+}
+
+// SelectSource selects the source to process; it needs an admin when
+// accounts are on. IsNotFound(err) for an unknown source.
+func (c *Client) SelectSource(ctx context.Context, id string) (*Selection, error) {
+	return c.setSource(ctx, &id)
+}
+
+// ClearSource stops processing any source.
+func (c *Client) ClearSource(ctx context.Context) error {
+	_, err := c.setSource(ctx, nil)
+	return err
+}
+
+func (c *Client) setSource(ctx context.Context, id *string) (*Selection, error) {
+	var selection Selection
+	body := struct {
+		Source *string `json:"source"`
+	}{id}
+	if err := c.do(ctx, http.MethodPost, "/sources", nil, body, &selection); err != nil {
+		return nil, err
+	}
+	return &selection, nil
+}
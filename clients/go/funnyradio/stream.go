@@ -0,0 +1,197 @@
+package funnyradio
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Message types sent on the stream; see GET /schema for their fields.
+const (
+	TypeDelta           = "delta"
+	TypeComplete        = "complete"
+	TypeTranscript      = "transcript"
+	TypeError           = "error"
+	TypePaused          = "paused"
+	TypeResumed         = "resumed"
+	TypeIdle            = "idle"
+	TypeLevel           = "level"
+	TypeDeadAir         = "dead_air"
+	TypeMusicDetected   = "music_detected"
+	TypeRepeatedSegment = "repeated_segment"
+	TypeNowPlaying      = "now_playing"
+	TypeProgramChanged  = "program_changed"
+	TypeBackendChanged  = "backend_changed"
+	TypeSourceChanged   = "source_changed"
+	TypeFailover        = "failover"
+	TypeServerShutdown  = "server_shutdown"
+	TypeSessionEnded    = "session_ended"
+	TypePlaylistRotated = "playlist_rotated"
+	TypeBudgetExceeded  = "budget_exceeded"
+	TypeComparison      = "comparison"
+	TypeAnswerDelta     = "answer_delta"
+	TypeAnswer          = "answer"
+	TypeTranslation     = "translation"
+)
+
+// Message is a stream message. The fields most types share are decoded;
+// Raw holds the whole message for the rest.
+type Message struct {
+	Type       string `json:"type"`
+	ResponseID string `json:"responseId,omitempty"`
+	ItemID     string `json:"itemId,omitempty"`
+	Task       string `json:"task,omitempty"`
+	// Empty for messages about no source.
+	Source string `json:"source,omitempty"`
+	// Text of a delta, complete or transcript.
+	Text string `json:"text,omitempty"`
+	// Position of a delta or answer_delta in its response, from 0. A
+	// response's deltas are never interleaved with another's.
+	Seq *int64 `json:"seq,omitempty"`
+	// End of the window, in ms since the source started streaming.
+	AudioOffsetMs *float64 `json:"audioOffsetMs,omitempty"`
+	Program       string   `json:"program,omitempty"`
+	// On-air times of the window, in ms since the epoch.
+	WindowStart *float64 `json:"windowStart,omitempty"`
+	WindowEnd   *float64 `json:"windowEnd,omitempty"`
+	// Of an error: a code to react to and a message for people.
+	Code         string   `json:"code,omitempty"`
+	ErrorMessage string   `json:"message,omitempty"`
+	Retryable    *bool    `json:"retryable,omitempty"`
+	RetryInMs    *float64 `json:"retryInMs,omitempty"`
+	// Question an answer_delta or answer is about, as returned by POST /ask.
+	AskID string `json:"askId,omitempty"`
+	// Language code of a translation.
+	Lang string `json:"lang,omitempty"`
+
+	Raw json.RawMessage `json:"-"`
+}
+
+// Event is a message with its SSE event name: "message", or the source it
+// is about on streams following several sources.
+type Event struct {
+	Name    string
+	Message Message
+}
+
+// StreamOptions narrow a stream, like the query parameters of GET /stream.
+type StreamOptions struct {
+	// Message types to keep; all when empty.
+	Types []string
+	// Only messages about this source; messages about no source are kept.
+	Source string
+	// Several sources on one connection; events about one of them are named
+	// after it.
+	Sources []string
+	// Only responses of this task; messages about no task are kept.
+	Task string
+	// "sentence" coalesces each response's deltas into whole sentences.
+	Batch string
+	// Display name shown to other listeners.
+	Name string
+	// Also receive completed text responses translated into this language,
+	// e.g. "en", as translation messages.
+	Lang string
+}
+
+func (o StreamOptions) query() url.Values {
+	params := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+	set("type", strings.Join(o.Types, ","))
+	set("source", o.Source)
+	set("sources", strings.Join(o.Sources, ","))
+	set("task", o.Task)
+	set("batch", o.Batch)
+	set("name", o.Name)
+	set("lang", o.Lang)
+	return params
+}
+
+// Stream reads the events of an open stream until it ends or is closed.
+// It is not safe for concurrent use.
+type Stream struct {
+	body   io.ReadCloser
+	reader *bufio.Reader
+}
+
+// Subscribe opens GET /stream. The stream ends with the context, on Close,
+// or when the server stops (after a server_shutdown message).
+func (c *Client) Subscribe(ctx context.Context, opts StreamOptions) (*Stream, error) {
+	req, err := c.newRequest(ctx, http.MethodGet, "/stream", opts.query(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	res, err := c.send(req)
+	if err != nil {
+		return nil, err
+	}
+	return &Stream{body: res.Body, reader: bufio.NewReader(res.Body)}, nil
+}
+
+// Next blocks until the next event. It returns io.EOF once the server ends
+// the stream.
+func (s *Stream) Next() (Event, error) {
+	name := ""
+	var data []string
+	for {
+		line, err := s.reader.ReadString('\n')
+		if err != nil {
+			if err == io.EOF && line == "" && len(data) == 0 {
+				return Event{}, io.EOF
+			}
+			if err != io.EOF {
+				return Event{}, err
+			}
+		}
+		line = strings.TrimRight(line, "\r\n")
+		switch {
+		case line == "":
+			// A blank line dispatches the event; one without data is skipped.
+			if len(data) > 0 {
+				return decodeEvent(name, strings.Join(data, "\n"))
+			}
+			if err == io.EOF {
+				return Event{}, io.EOF
+			}
+			name = ""
+		case strings.HasPrefix(line, ":"):
+			// Comment.
+		default:
+			field, value, _ := strings.Cut(line, ":")
+			value = strings.TrimPrefix(value, " ")
+			switch field {
+			case "event":
+				name = value
+			case "data":
+				data = append(data, value)
+			}
+		}
+	}
+}
+
+// Close ends the stream.
+func (s *Stream) Close() error {
+	return s.body.Close()
+}
+
+func decodeEvent(name, data string) (Event, error) {
+	if name == "" {
+		name = "message"
+	}
+	var message Message
+	if err := json.Unmarshal([]byte(data), &message); err != nil {
+		return Event{}, fmt.Errorf("funnyradio: decoding message: %w", err)
+	}
+	message.Raw = json.RawMessage(data)
+	return Event{Name: name, Message: message}, nil
+}
@@ -0,0 +1,123 @@
+package funnyradio
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+func newTestStream(body string) *Stream {
+	r := io.NopCloser(strings.NewReader(body))
+	return &Stream{body: r, reader: bufio.NewReader(r)}
+}
+
+// readAll returns the events of the stream up to io.EOF, or the first other
+// error.
+func readAll(s *Stream) ([]Event, error) {
+	var events []Event
+	for {
+		event, err := s.Next()
+		if errors.Is(err, io.EOF) {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, event)
+	}
+}
+
+func TestStreamNext(t *testing.T) {
+	type want struct {
+		name, typ, text, raw string
+	}
+	tests := []struct {
+		name    string
+		body    string
+		want    []want
+		wantErr bool
+	}{
+		{
+			name: "one event",
+			body: "data: {\"type\":\"delta\",\"text\":\"Bonjour\"}\n\n",
+			want: []want{{"message", "delta", "Bonjour", `{"type":"delta","text":"Bonjour"}`}},
+		},
+		{
+			name: "named events",
+			body: "event: franceinfo\ndata: {\"type\":\"complete\",\"text\":\"a\"}\n\n" +
+				"data: {\"type\":\"idle\"}\n\n",
+			want: []want{
+				{"franceinfo", "complete", "a", `{"type":"complete","text":"a"}`},
+				{"message", "idle", "", `{"type":"idle"}`},
+			},
+		},
+		{
+			name: "multi-line data joined with newlines",
+			body: "data: {\"type\":\"complete\",\ndata: \"text\":\"a\"}\n\n",
+			want: []want{{"message", "complete", "a", "{\"type\":\"complete\",\n\"text\":\"a\"}"}},
+		},
+		{
+			name: "comments and keep-alives skipped",
+			body: ": connected\n\n:ping\ndata: {\"type\":\"idle\"}\n: mid-event\n\n",
+			want: []want{{"message", "idle", "", `{"type":"idle"}`}},
+		},
+		{
+			name: "retry and unknown fields ignored",
+			body: "retry: 3000\nid: 7\ndata: {\"type\":\"paused\"}\n\n",
+			want: []want{{"message", "paused", "", `{"type":"paused"}`}},
+		},
+		{
+			name: "CRLF line endings",
+			body: "event: fip\r\ndata: {\"type\":\"delta\",\"text\":\"x\"}\r\n\r\n",
+			want: []want{{"fip", "delta", "x", `{"type":"delta","text":"x"}`}},
+		},
+		{
+			name: "no space after the colon",
+			body: "data:{\"type\":\"idle\"}\n\n",
+			want: []want{{"message", "idle", "", `{"type":"idle"}`}},
+		},
+		{
+			name: "partial final event dispatched",
+			body: "data: {\"type\":\"idle\"}\n\ndata: {\"type\":\"server_shutdown\"}",
+			want: []want{
+				{"message", "idle", "", `{"type":"idle"}`},
+				{"message", "server_shutdown", "", `{"type":"server_shutdown"}`},
+			},
+		},
+		{
+			name: "event name without data dropped",
+			body: "event: fip\n\ndata: {\"type\":\"idle\"}\n\n",
+			want: []want{{"message", "idle", "", `{"type":"idle"}`}},
+		},
+		{
+			name: "empty stream",
+			body: "",
+		},
+		{
+			name:    "invalid JSON",
+			body:    "data: {\"type\":\n\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events, err := readAll(newTestStream(tt.body))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if len(events) != len(tt.want) {
+				t.Fatalf("got %d events, want %d: %+v", len(events), len(tt.want), events)
+			}
+			for i, w := range tt.want {
+				got := events[i]
+				if got.Name != w.name || got.Message.Type != w.typ ||
+					got.Message.Text != w.text || string(got.Message.Raw) != w.raw {
+					t.Errorf("event %d = {%q %q %q %q}, want %+v", i, got.Name,
+						got.Message.Type, got.Message.Text, got.Message.Raw, w)
+				}
+			}
+		})
+	}
+}
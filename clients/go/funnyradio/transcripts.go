@@ -0,0 +1,78 @@
+package funnyradio
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// TranscriptQuery narrows a transcript search. Only Text is required.
+type TranscriptQuery struct {
+	// Words to search for.
+	Text    string
+	Source  string
+	Program string
+	// Completed at or after From and before To, when set.
+	From time.Time
+	To   time.Time
+	// Maximum number of results, from 1 to 100; 0 uses the server's
+	// default of 20.
+	Limit int
+}
+
+// SpeakerSegment is a speaker turn of a transcribe response.
+type SpeakerSegment struct {
+	// Nil for text before the first label.
+	Speaker *string `json:"speaker"`
+	Text    string  `json:"text"`
+}
+
+// TranscriptMatch is a stored response matching a search.
+type TranscriptMatch struct {
+	ResponseID string  `json:"responseId"`
+	Task       string  `json:"task"`
+	Source     *string `json:"source"`
+	// Show on air when the window was captured, if known.
+	Program *string `json:"program"`
+	Text    string  `json:"text"`
+	// Matching excerpt, HTML-escaped, with hits wrapped in <mark></mark>.
+	Snippet     string    `json:"snippet"`
+	CompletedAt time.Time `json:"completedAt"`
+	// When the window's first and last audio went out on air, if known.
+	WindowStart *time.Time       `json:"windowStart"`
+	WindowEnd   *time.Time       `json:"windowEnd"`
+	Segments    []SpeakerSegment `json:"segments"`
+}
+
+// SearchTranscripts runs a full-text search over the stored responses, best
+// match first.
+func (c *Client) SearchTranscripts(
+	ctx context.Context, query TranscriptQuery,
+) ([]TranscriptMatch, error) {
+	params := url.Values{"q": {query.Text}}
+	if query.Source != "" {
+		params.Set("source", query.Source)
+	}
+	if query.Program != "" {
+		params.Set("program", query.Program)
+	}
+	if !query.From.IsZero() {
+		params.Set("from", query.From.UTC().Format(time.RFC3339))
+	}
+	if !query.To.IsZero() {
+		params.Set("to", query.To.UTC().Format(time.RFC3339))
+	}
+	if query.Limit > 0 {
+		params.Set("limit", strconv.Itoa(query.Limit))
+	}
+	var res struct {
+		Results []TranscriptMatch `json:"results"`
+	}
+	err := c.do(ctx, http.MethodGet, "/transcripts/search", params, nil, &res)
+	if err != nil {
+		return nil, err
+	}
+	return res.Results, nil
+}
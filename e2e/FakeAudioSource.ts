@@ -0,0 +1,90 @@
+import { Effect, Layer, Option, Ref, Schedule, Stream } from "effect";
+import { AppConfig, type SourceConfig } from "../src/AppConfig.js";
+import { AudioSource, type AudioSourceId } from "../src/AudioSource.js";
+import type { Rewind } from "../src/HlsVariants.js";
+import type { AudioLevelReading } from "../src/Messages.js";
+import { makeRemoteAudio, type RemoteParams } from "../src/RemoteAudio.js";
+import type { SelectionEvent } from "../src/SourceSelection.js";
+import { sourceUrls, type UrlHealth } from "../src/SourceHealth.js";
+
+// 20ms of a 440Hz tone at about -9 dBFS, loud enough not to count as silence.
+const TONE = (() => {
+  const samples = 480;
+  const buf = Buffer.alloc(samples * 2);
+  for (let i = 0; i < samples; i++) {
+    const value = Math.sin((2 * Math.PI * 440 * i) / 24000) * 0.5 * 32767;
+    buf.writeInt16LE(Math.round(value), i * 2);
+  }
+  return buf;
+})();
+
+const tone = Stream.repeatEffectWithSchedule(
+  Effect.sync(() => Buffer.from(TONE)),
+  Schedule.spaced("1 millis")
+);
+
+// AudioSource that serves the configured sources but streams a synthetic tone
+// instead of running ffmpeg, faster than real time.
+export const FakeAudioSourceLive = Layer.effect(
+  AudioSource,
+  Effect.gen(function* () {
+    const config = yield* AppConfig;
+    const sourceRef = yield* Ref.make(Option.none<AudioSourceId>());
+    const pausedRef = yield* Ref.make(false);
+    const flushRef = yield* Ref.make(0);
+    const levelsRef = yield* Ref.make<ReadonlyArray<AudioLevelReading>>([]);
+    const remote = yield* makeRemoteAudio;
+    const sources = config.get.pipe(Effect.map((c) => c.sources));
+
+    return new AudioSource({
+      sources,
+      findSource: (id: AudioSourceId) =>
+        sources.pipe(
+          Effect.map((all) =>
+            Option.fromNullable(all.find((s) => s.id === id))
+          )
+        ),
+      currentSource: Ref.get(sourceRef),
+      setSource: (id: AudioSourceId | null) =>
+        Ref.set(sourceRef, Option.fromNullable(id)),
+      selectionHistory: () =>
+        Effect.succeed<ReadonlyArray<SelectionEvent>>([]),
+      // The tone has no past to rewind into.
+      catchUp: () => Effect.succeed(Option.none<Rewind>()),
+      streamGeneration: Effect.succeed(0),
+      processingPaused: Ref.get(pausedRef),
+      setProcessingPaused: (paused: boolean) => Ref.set(pausedRef, paused),
+      flushRequests: Ref.get(flushRef),
+      requestFlush: Ref.update(flushRef, (n) => n + 1),
+      levels: Ref.get(levelsRef),
+      recordLevel: (level: AudioLevelReading) =>
+        Ref.update(levelsRef, (levels) => [...levels, level].slice(-60)),
+      // Every URL is healthy: the tone never fails.
+      sourceHealth: (source: SourceConfig) =>
+        Effect.succeed(
+          sourceUrls(source).map(
+            (url, i): UrlHealth => ({
+              url,
+              score: 100,
+              failures: 0,
+              lastFailure: null,
+              active: i === 0,
+            })
+          )
+        ),
+      hlsCacheStats: Effect.succeed(null),
+      currentVariant: Effect.succeed(Option.none()),
+      currentSampleRate: Effect.succeed(Option.some(24000)),
+      // The tone isn't broadcast, so it has no on-air time.
+      streamOrigin: Effect.succeed(Option.none<number>()),
+      connectRemote: (sourceId: AudioSourceId, params: RemoteParams) =>
+        remote.connect(sourceId, params),
+      releaseChunk: () => Effect.void,
+      getStream: () => tone,
+      decodeFile: () => tone.pipe(Stream.take(500)),
+      fileDuration: () => Effect.succeed(Option.some(10)),
+      probe: () => Effect.void,
+      streamSource: () => tone,
+    });
+  })
+);
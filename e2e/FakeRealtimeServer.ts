@@ -0,0 +1,66 @@
+import type { ServerWebSocket } from "bun";
+
+// In-process stand-in for the OpenAI Realtime API. It acknowledges session
+// updates and commits, and answers every response.create with a short canned
+// text response, echoing the request metadata like the real API does.
+export const startFakeRealtimeServer = () => {
+  let items = 0;
+  let responses = 0;
+  const stats = { appendedBytes: 0, commits: 0, responses: 0 };
+
+  const send = (ws: ServerWebSocket<unknown>, event: object) =>
+    ws.send(JSON.stringify(event));
+
+  const server = Bun.serve({
+    port: 0,
+    fetch: (req, server) =>
+      server.upgrade(req)
+        ? undefined
+        : new Response("Expected a WebSocket", { status: 400 }),
+    websocket: {
+      message: (ws, data) => {
+        const event = JSON.parse(String(data));
+        switch (event.type) {
+          case "session.update":
+            send(ws, { type: "session.updated", session: event.session });
+            break;
+          case "input_audio_buffer.append":
+            // base64: 4 characters per 3 bytes.
+            stats.appendedBytes += (event.audio.length / 4) * 3;
+            break;
+          case "input_audio_buffer.commit":
+            stats.commits++;
+            send(ws, {
+              type: "input_audio_buffer.committed",
+              item_id: `item_${++items}`,
+            });
+            break;
+          case "response.create": {
+            stats.responses++;
+            const id = `resp_${++responses}`;
+            const metadata = event.response.metadata ?? null;
+            send(ws, { type: "response.created", response: { id, metadata } });
+            for (const delta of ["Et bien sûr, ", "tout va très bien."]) {
+              send(ws, {
+                type: "response.output_text.delta",
+                response_id: id,
+                delta,
+              });
+            }
+            send(ws, {
+              type: "response.done",
+              response: { id, status: "completed" },
+            });
+            break;
+          }
+        }
+      },
+    },
+  });
+
+  return {
+    url: `ws://localhost:${server.port}`,
+    stats,
+    stop: () => server.stop(true),
+  };
+};
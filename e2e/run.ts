@@ -0,0 +1,140 @@
+// End-to-end check of the audio → OpenAI → SSE pipeline without ffmpeg or an
+// API key: a fake Realtime server and a synthetic audio source stand in for
+// the real ones, everything else is the production code.
+//
+//   bun run e2e
+import {
+  FetchHttpClient,
+  HttpApiBuilder,
+  HttpServer,
+} from "@effect/platform";
+import { BunContext, BunHttpServer, BunRuntime } from "@effect/platform-bun";
+import { Data, Effect, Layer } from "effect";
+import { mkdtempSync } from "node:fs";
+import { tmpdir } from "node:os";
+import { join } from "node:path";
+import { runAudioProcessor } from "../src/AudioProcessor.js";
+import { FunnyRadioApiLive } from "../src/HttpApi.js";
+import type { BroadcastMessage } from "../src/Messages.js";
+import { makeServicesLive } from "../src/Services.js";
+import { FakeAudioSourceLive } from "./FakeAudioSource.js";
+import { startFakeRealtimeServer } from "./FakeRealtimeServer.js";
+
+class AssertionError extends Data.TaggedError("AssertionError")<{
+  message: string;
+}> {}
+
+const assert = (condition: boolean, message: string) =>
+  condition ? Effect.void : Effect.fail(new AssertionError({ message }));
+
+const fake = startFakeRealtimeServer();
+const workDir = mkdtempSync(join(tmpdir(), "funny-radio-e2e-"));
+
+Object.assign(process.env, {
+  OPENAI_API_KEY: "test",
+  OPENAI_REALTIME_URL: fake.url,
+  CONFIG_FILE: join(workDir, "config.yaml"),
+  PRESETS_FILE: join(workDir, "presets.json"),
+  USERS_FILE: join(workDir, "users.json"),
+  FINGERPRINTS_FILE: join(workDir, "fingerprints.json"),
+  BUDGETS_FILE: join(workDir, "budgets.json"),
+  SELECTION_FILE: join(workDir, "selection.jsonl"),
+  SOURCES_FILE: join(workDir, "sources.json"),
+  PUSH_SUBSCRIPTIONS_FILE: join(workDir, "push-subscriptions.json"),
+  TRANSCRIPTS_DB: ":memory:",
+});
+
+const ServicesLive = makeServicesLive(FakeAudioSourceLive);
+
+const TestLive = Layer.mergeAll(
+  HttpApiBuilder.serve().pipe(Layer.provide(FunnyRadioApiLive)),
+  Layer.scopedDiscard(Effect.fork(runAudioProcessor)).pipe(
+    Layer.provide(FetchHttpClient.layer)
+  )
+).pipe(
+  Layer.provideMerge(BunHttpServer.layer({ port: 0 })),
+  Layer.provide(ServicesLive),
+  Layer.provide(BunContext.layer)
+);
+
+// Reads SSE messages until a response has both streamed text and completed.
+const readFirstResponse = (url: string) =>
+  Effect.tryPromise(async (signal) => {
+    const res = await fetch(url, { signal });
+    const reader = res.body!.pipeThrough(new TextDecoderStream()).getReader();
+    const messages: Array<BroadcastMessage> = [];
+    let buffer = "";
+    for (;;) {
+      const { done, value } = await reader.read();
+      if (done) return messages;
+      buffer += value;
+      const events = buffer.split("\n\n");
+      buffer = events.pop() ?? "";
+      for (const event of events) {
+        if (!event.startsWith("data: ")) continue;
+        const msg = JSON.parse(event.slice(6)) as BroadcastMessage;
+        messages.push(msg);
+        if (msg.type === "complete") return messages;
+      }
+    }
+  });
+
+const program = Effect.gen(function* () {
+  const server = yield* HttpServer.HttpServer;
+  if (server.address._tag !== "TcpAddress") return yield* Effect.die("No TCP");
+  const baseUrl = `http://localhost:${server.address.port}`;
+
+  const select = yield* Effect.tryPromise(() =>
+    fetch(`${baseUrl}/sources`, {
+      method: "POST",
+      headers: { "Content-Type": "application/json" },
+      body: JSON.stringify({ source: "franceinfo" }),
+    })
+  );
+  yield* assert(select.ok, `POST /sources returned ${select.status}`);
+
+  const messages = yield* readFirstResponse(`${baseUrl}/stream`).pipe(
+    Effect.timeout("30 seconds")
+  );
+  const deltas = messages.filter((m) => m.type === "delta");
+  const complete = messages.at(-1);
+
+  yield* assert(deltas.length > 0, "No delta received");
+  yield* assert(complete?.type === "complete", "No complete received");
+  if (complete?.type !== "complete") return;
+  yield* assert(
+    deltas.every((d) => d.responseId === complete.responseId),
+    "Deltas belong to another response"
+  );
+  yield* assert(
+    deltas.map((d) => d.text).join("") === "Et bien sûr, tout va très bien.",
+    "Unexpected response text"
+  );
+  yield* assert(
+    complete.text === "Et bien sûr, tout va très bien." &&
+      complete.wordCount === 7,
+    "Unexpected complete text"
+  );
+  yield* assert(complete.source === "franceinfo", "Wrong source tag");
+  yield* assert(
+    (complete.audioOffsetMs ?? 0) >= 15000,
+    "Response before a full window of audio"
+  );
+  yield* assert(fake.stats.commits > 0, "Audio buffer never committed");
+  yield* assert(
+    messages.some(
+      (m) => m.type === "level" && m.source === "franceinfo" && m.rmsDbfs > -20
+    ),
+    "No level reported for the tone"
+  );
+
+  yield* Effect.log(
+    `e2e passed: ${deltas.length} deltas, ${fake.stats.commits} commits, ` +
+      `${fake.stats.appendedBytes} bytes of audio appended`
+  );
+}).pipe(
+  Effect.provide(TestLive),
+  Effect.ensuring(Effect.sync(() => fake.stop()))
+);
+
+BunRuntime.runMain(program);
@@ -0,0 +1,296 @@
+import { createHmac, timingSafeEqual } from "node:crypto";
+import {
+  HttpApiSecurity,
+  HttpMiddleware,
+  HttpServerRequest,
+  HttpServerResponse,
+} from "@effect/platform";
+import {
+  Clock,
+  Config,
+  Data,
+  Effect,
+  Option,
+  Redacted,
+  Schema,
+} from "effect";
+import { BasePathConfig } from "./BasePath.js";
+import { underPrefix } from "./Cors.js";
+import { makeJsonFileStore } from "./JsonFileStore.js";
+import { TlsConfig } from "./Tls.js";
+
+export const Role = Schema.Literal("admin", "viewer").annotations({
+  description:
+    "admin changes sources, prompts and schedules; viewer only reads",
+});
+
+export type Role = typeof Role.Type;
+
+export const Username = Schema.String.pipe(
+  Schema.pattern(/^[a-z0-9_.-]{1,64}$/)
+).annotations({ description: "Login name" });
+
+const Account = Schema.Struct({
+  username: Username,
+  role: Role,
+  // Bun.password (argon2id) hash.
+  passwordHash: Schema.String,
+});
+
+type Account = typeof Account.Type;
+
+export interface User {
+  readonly username: string;
+  readonly role: Role;
+}
+
+export interface Session extends User {
+  readonly token: string;
+  // When the token stops being accepted, in ms since the epoch.
+  readonly expiresAt: number;
+}
+
+export class AccountStoreError extends Data.TaggedError("AccountStoreError")<{
+  message: string;
+}> {}
+
+// Accounts are off unless AUTH_SECRET is set: it signs the session tokens,
+// handed out as a cookie and accepted as a bearer token too, which last
+// AUTH_SESSION_HOURS (default 12). Accounts are kept in USERS_FILE (default
+// users.json); while there are none, AUTH_ADMIN_PASSWORD creates an admin
+// named AUTH_ADMIN_USER (default admin). The cookie is only sent over HTTPS
+// when TLS is configured, unless AUTH_SECURE_COOKIE says otherwise.
+export const AccountsConfig = Config.all({
+  secret: Config.option(Config.redacted("AUTH_SECRET")),
+  path: Config.string("USERS_FILE").pipe(Config.withDefault("users.json")),
+  sessionHours: Config.number("AUTH_SESSION_HOURS").pipe(
+    Config.withDefault(12)
+  ),
+  adminUser: Config.string("AUTH_ADMIN_USER").pipe(Config.withDefault("admin")),
+  adminPassword: Config.option(Config.redacted("AUTH_ADMIN_PASSWORD")),
+  secureCookie: Config.option(Config.boolean("AUTH_SECURE_COOKIE")),
+});
+
+export const SessionCookie = HttpApiSecurity.apiKey({
+  in: "cookie",
+  key: "funny_radio_session",
+});
+
+const base64url = (data: Buffer | string) =>
+  Buffer.from(data).toString("base64url");
+
+const TokenClaims = Schema.parseJson(
+  Schema.Struct({ sub: Schema.String, exp: Schema.Number })
+);
+
+// Admins and viewers, with the HS256 JWTs that prove who a request is from.
+export class Accounts extends Effect.Service<Accounts>()("Accounts", {
+  effect: Effect.gen(function* () {
+    const config = yield* AccountsConfig;
+    const tls = yield* TlsConfig;
+    const prefix = yield* BasePathConfig;
+    const enabled = Option.isSome(config.secret);
+    const secret = Option.getOrElse(config.secret, () => Redacted.make(""));
+    const path = config.path;
+
+    const store = yield* makeJsonFileStore({
+      path,
+      schema: Schema.Array(Account),
+      empty: [],
+      error: (message) => new AccountStoreError({ message }),
+      load: enabled,
+      mode: 0o600,
+    });
+    const accounts = store.get;
+    const modify = (
+      f: (all: ReadonlyArray<Account>) => ReadonlyArray<Account>
+    ) => Effect.asVoid(store.update(f));
+
+    const find = (username: string) =>
+      accounts.pipe(
+        Effect.map((all) =>
+          Option.fromNullable(all.find((a) => a.username === username))
+        )
+      );
+
+    const save = (username: string, role: Role, password: string) =>
+      Effect.gen(function* () {
+        const passwordHash = yield* Effect.promise(() =>
+          Bun.password.hash(password)
+        );
+        yield* modify((all) => [
+          ...all.filter((a) => a.username !== username),
+          { username, role, passwordHash },
+        ]);
+      });
+
+    const stored = yield* store.get;
+    if (enabled && stored.length === 0) {
+      if (Option.isSome(config.adminPassword)) {
+        yield* save(
+          config.adminUser,
+          "admin",
+          Redacted.value(config.adminPassword.value)
+        );
+        yield* Effect.log(`Created admin account ${config.adminUser}`);
+      } else {
+        yield* Effect.logWarning(
+          `No accounts in ${path}: set AUTH_ADMIN_PASSWORD to create an admin`
+        );
+      }
+    }
+
+    const signature = (data: string) =>
+      createHmac("sha256", Redacted.value(secret)).update(data).digest();
+
+    const issue = (username: string) =>
+      Effect.map(Clock.currentTimeMillis, (now) => {
+        const expiresAt = now + config.sessionHours * 60 * 60 * 1000;
+        const header = base64url(JSON.stringify({ alg: "HS256", typ: "JWT" }));
+        const claims = base64url(
+          JSON.stringify({ sub: username, exp: Math.floor(expiresAt / 1000) })
+        );
+        const signed = `${header}.${claims}`;
+        return {
+          token: `${signed}.${base64url(signature(signed))}`,
+          expiresAt,
+        };
+      });
+
+    // The account a token was issued to, as it is now, so deleting an
+    // account or changing its role takes effect on its open sessions.
+    const authenticate = (token: string) =>
+      Effect.gen(function* () {
+        const [header, claims, sig] = token.split(".");
+        if (!enabled || !header || !claims || sig === undefined) {
+          return Option.none<User>();
+        }
+        const expected = signature(`${header}.${claims}`);
+        const given = Buffer.from(sig, "base64url");
+        if (
+          given.length !== expected.length ||
+          !timingSafeEqual(given, expected)
+        ) {
+          return Option.none<User>();
+        }
+        const decoded = Schema.decodeOption(TokenClaims)(
+          Buffer.from(claims, "base64url").toString()
+        );
+        const now = yield* Clock.currentTimeMillis;
+        if (Option.isNone(decoded) || decoded.value.exp * 1000 <= now) {
+          return Option.none<User>();
+        }
+        return Option.map(
+          yield* find(decoded.value.sub),
+          ({ username, role }): User => ({ username, role })
+        );
+      });
+
+    return {
+      enabled,
+      secureCookie: Option.getOrElse(
+        config.secureCookie,
+        () => Option.isSome(tls.certFile) || tls.acmeDomains.length > 0
+      ),
+      // Under BASE_PATH, so the cookie isn't sent to the proxy's other
+      // services.
+      cookiePath: prefix === "" ? "/" : prefix,
+      list: accounts.pipe(
+        Effect.map((all) =>
+          all.map(({ username, role }): User => ({ username, role }))
+        )
+      ),
+      // Replaces any account with the same name.
+      save,
+      // Returns false if there was no such account.
+      remove: (username: string) =>
+        Effect.gen(function* () {
+          if (Option.isNone(yield* find(username))) return false;
+          yield* modify((all) => all.filter((a) => a.username !== username));
+          return true;
+        }),
+      // A session for the account, if the password matches.
+      login: (username: string, password: string) =>
+        Effect.gen(function* () {
+          const account = yield* find(username);
+          if (!enabled || Option.isNone(account)) {
+            return Option.none<Session>();
+          }
+          const valid = yield* Effect.promise(() =>
+            Bun.password.verify(password, account.value.passwordHash)
+          );
+          if (!valid) return Option.none<Session>();
+          const { token, expiresAt } = yield* issue(username);
+          return Option.some<Session>({
+            username,
+            role: account.value.role,
+            token,
+            expiresAt,
+          });
+        }),
+      authenticate,
+      // The user behind a request, from its bearer token or session cookie.
+      fromRequest: (req: HttpServerRequest.HttpServerRequest) => {
+        const bearer = req.headers.authorization?.match(/^Bearer (.+)$/i)?.[1];
+        const token = bearer ?? req.cookies[SessionCookie.key];
+        return token === undefined
+          ? Effect.succeed(Option.none<User>())
+          : authenticate(token);
+      },
+    } as const;
+  }),
+}) {}
+
+// Open to anyone: the page, the admin dashboard's files (what it reads needs
+// an admin), logging in and out, readiness probes and the API docs.
+const isPublic = (path: string) =>
+  path === "/" ||
+  path === "/sw.js" ||
+  path === "/readyz" ||
+  underPrefix(path, "/admin") ||
+  underPrefix(path, "/docs") ||
+  underPrefix(path, "/auth");
+
+// Reads that could leak secrets or slow the server down, and the WebSocket
+// pushing audio to a source, which is opened with a GET.
+const ADMIN_READS = ["/users", "/config", "/debug", "/ingest"];
+
+// Changes a viewer may make: rating responses, asking about the audio and
+// their own notifications.
+const VIEWER_WRITES = [
+  "/feedback",
+  "/ask",
+  "/push/subscribe",
+  "/push/unsubscribe",
+];
+
+// Who may make a request: viewers read, admins change sources, prompts,
+// schedules and the rest; null when it is open to anyone.
+const requiredRole = (method: string, path: string): Role | null => {
+  if (isPublic(path)) return null;
+  if (method === "GET" || method === "HEAD") {
+    return ADMIN_READS.some((prefix) => underPrefix(path, prefix))
+      ? "admin"
+      : "viewer";
+  }
+  return VIEWER_WRITES.includes(path) ? "viewer" : "admin";
+};
+
+// Answers 401 without a valid session and 403 when the role isn't enough.
+export const authorize = (accounts: Accounts) =>
+  HttpMiddleware.make((app) =>
+    Effect.gen(function* () {
+      const req = yield* HttpServerRequest.HttpServerRequest;
+      const path = new URL(req.url, "http://localhost").pathname;
+      const role = requiredRole(req.method, path);
+      if (role === null) return yield* app;
+      const user = yield* accounts.fromRequest(req);
+      if (Option.isNone(user)) {
+        return HttpServerResponse.empty({ status: 401 });
+      }
+      if (role === "admin" && user.value.role !== "admin") {
+        return HttpServerResponse.empty({ status: 403 });
+      }
+      return yield* app;
+    })
+  );
@@ -0,0 +1,305 @@
+import {
+  createHash,
+  createPrivateKey,
+  createPublicKey,
+  generateKeyPairSync,
+  type KeyObject,
+  sign,
+  X509Certificate,
+} from "node:crypto";
+import { mkdir, readFile, writeFile } from "node:fs/promises";
+import { Data, Effect } from "effect";
+
+export const LETS_ENCRYPT_DIRECTORY =
+  "https://acme-v02.api.letsencrypt.org/directory";
+
+export class AcmeError extends Data.TaggedError("AcmeError")<{
+  message: string;
+  cause?: unknown;
+}> {}
+
+export interface Certificate {
+  // PEM chain, leaf first.
+  readonly cert: string;
+  readonly key: string;
+  // When the leaf expires, in ms since the epoch.
+  readonly expiresAt: number;
+}
+
+export interface AcmeOptions {
+  readonly directoryUrl: string;
+  readonly domains: ReadonlyArray<string>;
+  readonly email: string | null;
+  // Where the account key and certificate are kept between runs.
+  readonly cacheDir: string;
+  // http-01 key authorizations by token, for the plain HTTP server to answer
+  // under /.well-known/acme-challenge/.
+  readonly challenges: Map<string, string>;
+}
+
+const POLL_INTERVAL_MS = 2000;
+const POLL_ATTEMPTS = 30;
+
+const base64url = (data: Buffer | string) =>
+  Buffer.from(data).toString("base64url");
+
+// Just enough DER for a PKCS#10 request.
+const der = (tag: number, ...content: ReadonlyArray<Buffer>) => {
+  const body = Buffer.concat(content);
+  const length: Array<number> = [];
+  for (let n = body.length; n > 0; n >>= 8) length.unshift(n & 0xff);
+  return Buffer.concat([
+    Buffer.from(
+      body.length < 0x80
+        ? [tag, body.length]
+        : [tag, 0x80 | length.length, ...length]
+    ),
+    body,
+  ]);
+};
+
+const sequence = (...content: ReadonlyArray<Buffer>) => der(0x30, ...content);
+
+const oid = (dotted: string) => {
+  const [first = 0, second = 0, ...rest] = dotted.split(".").map(Number);
+  const bytes = [first * 40 + second];
+  for (const arc of rest) {
+    const groups = [arc & 0x7f];
+    for (let n = arc >> 7; n > 0; n >>= 7) groups.unshift(0x80 | (n & 0x7f));
+    bytes.push(...groups);
+  }
+  return der(0x06, Buffer.from(bytes));
+};
+
+// Signing request for `domains`, the first as common name and all of them as
+// subject alternative names.
+const makeCsr = (domains: ReadonlyArray<string>, key: KeyObject) => {
+  const info = sequence(
+    der(0x02, Buffer.from([0])),
+    sequence(
+      der(0x31, sequence(oid("2.5.4.3"), der(0x0c, Buffer.from(domains[0]!))))
+    ),
+    createPublicKey(key).export({ format: "der", type: "spki" }),
+    der(
+      0xa0,
+      sequence(
+        oid("1.2.840.113549.1.9.14"),
+        der(
+          0x31,
+          sequence(
+            sequence(
+              oid("2.5.29.17"),
+              der(
+                0x04,
+                sequence(
+                  ...domains.map((domain) => der(0x82, Buffer.from(domain)))
+                )
+              )
+            )
+          )
+        )
+      )
+    )
+  );
+  return sequence(
+    info,
+    sequence(oid("1.2.840.10045.4.3.2")),
+    der(0x03, Buffer.from([0]), sign("sha256", info, key))
+  );
+};
+
+const newKey = () =>
+  generateKeyPairSync("ec", { namedCurve: "P-256" }).privateKey;
+
+const keyPem = (key: KeyObject) =>
+  key.export({ format: "pem", type: "pkcs8" }).toString();
+
+const readText = (path: string) => readFile(path, "utf8").catch(() => null);
+
+// The cached certificate, if there is one for every domain.
+export const cachedCertificate = (
+  cacheDir: string,
+  domains: ReadonlyArray<string>
+) =>
+  Effect.promise(async (): Promise<Certificate | null> => {
+    const [cert, key] = await Promise.all([
+      readText(`${cacheDir}/cert.pem`),
+      readText(`${cacheDir}/key.pem`),
+    ]);
+    if (cert === null || key === null) return null;
+    try {
+      const x509 = new X509Certificate(cert);
+      if (!domains.every((domain) => x509.checkHost(domain))) return null;
+      return { cert, key, expiresAt: Date.parse(x509.validTo) };
+    } catch {
+      return null;
+    }
+  });
+
+// Orders a certificate for every domain from the ACME directory (RFC 8555),
+// proving control of each with an http-01 challenge, and caches it with its
+// key. The account key is created on first use and kept in the cache.
+export const obtainCertificate = (options: AcmeOptions) =>
+  Effect.tryPromise({
+    try: async (): Promise<Certificate> => {
+      await mkdir(options.cacheDir, { recursive: true });
+      const accountPath = `${options.cacheDir}/account.pem`;
+      const accountPem = await readText(accountPath);
+      const accountKey =
+        accountPem === null ? newKey() : createPrivateKey(accountPem);
+      if (accountPem === null) {
+        await writeFile(accountPath, keyPem(accountKey), { mode: 0o600 });
+      }
+      const { crv, kty, x, y } = accountKey.export({ format: "jwk" });
+      // Members in lexicographic order, as RFC 7638 thumbprints require.
+      const jwk = { crv, kty, x, y };
+      const thumbprint = base64url(
+        createHash("sha256").update(JSON.stringify(jwk)).digest()
+      );
+
+      const directory = (await (
+        await fetch(options.directoryUrl)
+      ).json()) as { newNonce: string; newAccount: string; newOrder: string };
+      let nonce: string | null = null;
+      let kid: string | null = null;
+
+      // Signed POST; a null payload makes it a POST-as-GET. Retried once
+      // with a fresh nonce when the server rejects the old one.
+      const post = async (
+        url: string,
+        payload: object | null,
+        retry = true
+      ): Promise<Response> => {
+        nonce ??= (
+          await fetch(directory.newNonce, { method: "HEAD" })
+        ).headers.get("Replay-Nonce");
+        const header = base64url(
+          JSON.stringify({
+            alg: "ES256",
+            nonce,
+            url,
+            ...(kid === null ? { jwk } : { kid }),
+          })
+        );
+        const body =
+          payload === null ? "" : base64url(JSON.stringify(payload));
+        const signature = sign("sha256", Buffer.from(`${header}.${body}`), {
+          key: accountKey,
+          dsaEncoding: "ieee-p1363",
+        });
+        const response = await fetch(url, {
+          method: "POST",
+          headers: { "Content-Type": "application/jose+json" },
+          body: JSON.stringify({
+            protected: header,
+            payload: body,
+            signature: base64url(signature),
+          }),
+        });
+        nonce = response.headers.get("Replay-Nonce");
+        if (response.ok) return response;
+        const problem = (await response.json().catch(() => ({}))) as {
+          type?: string;
+          detail?: string;
+        };
+        if (retry && problem.type === "urn:ietf:params:acme:error:badNonce") {
+          return post(url, payload, false);
+        }
+        throw new Error(
+          `${url}: ${problem.detail ?? `HTTP ${response.status}`}`
+        );
+      };
+
+      // Re-reads `url` until its status is no longer pending or processing.
+      const poll = async <A extends { status: string }>(url: string) => {
+        for (let attempt = 0; attempt < POLL_ATTEMPTS; attempt++) {
+          const resource = (await (await post(url, null)).json()) as A;
+          if (!["pending", "processing"].includes(resource.status)) {
+            return resource;
+          }
+          await Bun.sleep(POLL_INTERVAL_MS);
+        }
+        throw new Error(`${url} still pending`);
+      };
+
+      const account = await post(directory.newAccount, {
+        termsOfServiceAgreed: true,
+        ...(options.email !== null && {
+          contact: [`mailto:${options.email}`],
+        }),
+      });
+      kid = account.headers.get("Location");
+
+      const created = await post(directory.newOrder, {
+        identifiers: options.domains.map((value) => ({ type: "dns", value })),
+      });
+      const orderUrl = created.headers.get("Location")!;
+      const order = (await created.json()) as {
+        authorizations: ReadonlyArray<string>;
+        finalize: string;
+      };
+
+      for (const authorizationUrl of order.authorizations) {
+        const authorization = (await (
+          await post(authorizationUrl, null)
+        ).json()) as {
+          status: string;
+          identifier: { value: string };
+          challenges: ReadonlyArray<{
+            type: string;
+            url: string;
+            token: string;
+          }>;
+        };
+        if (authorization.status === "valid") continue;
+        const challenge = authorization.challenges.find(
+          (c) => c.type === "http-01"
+        );
+        if (!challenge) {
+          throw new Error(
+            `No http-01 challenge for ${authorization.identifier.value}`
+          );
+        }
+        options.challenges.set(
+          challenge.token,
+          `${challenge.token}.${thumbprint}`
+        );
+        try {
+          await post(challenge.url, {});
+          const result = await poll<{ status: string }>(authorizationUrl);
+          if (result.status !== "valid") {
+            throw new Error(
+              `Validation of ${authorization.identifier.value} ${result.status}`
+            );
+          }
+        } finally {
+          options.challenges.delete(challenge.token);
+        }
+      }
+
+      const certKey = newKey();
+      await post(order.finalize, {
+        csr: base64url(makeCsr(options.domains, certKey)),
+      });
+      const finalized = await poll<{ status: string; certificate?: string }>(
+        orderUrl
+      );
+      if (finalized.status !== "valid" || !finalized.certificate) {
+        throw new Error(`Order ${finalized.status}`);
+      }
+      const cert = await (await post(finalized.certificate, null)).text();
+      const key = keyPem(certKey);
+      await writeFile(`${options.cacheDir}/key.pem`, key, { mode: 0o600 });
+      await writeFile(`${options.cacheDir}/cert.pem`, cert);
+      return {
+        cert,
+        key,
+        expiresAt: Date.parse(new X509Certificate(cert).validTo),
+      };
+    },
+    catch: (cause) =>
+      new AcmeError({
+        message: `Could not obtain a certificate for ${options.domains.join(", ")}`,
+        cause,
+      }),
+  });
@@ -0,0 +1,615 @@
+import { FileSystem, Path } from "@effect/platform";
+import {
+  Config,
+  Data,
+  Effect,
+  Option,
+  Ref,
+  Schedule,
+  Schema,
+  Stream,
+  SubscriptionRef,
+} from "effect";
+import { writeFileAtomically } from "./JsonFileStore.js";
+import { PostProcessor } from "./PostProcessing.js";
+import { systemInstruction } from "./SystemPrompt.js";
+import { TaskIdSchema } from "./Tasks.js";
+
+export const NowPlayingProvider = Schema.Union(
+  Schema.Struct({
+    type: Schema.Literal("radiofrance"),
+    station: Schema.String.pipe(Schema.pattern(/^[A-Z0-9_]+$/)).annotations({
+      description: "Radio France Open API station, e.g. FRANCEINTER",
+    }),
+  }),
+  Schema.Struct({ type: Schema.Literal("icy") }),
+  Schema.Struct({ type: Schema.Literal("none") })
+).annotations({ title: "Now Playing Provider" });
+
+export type NowPlayingProvider = typeof NowPlayingProvider.Type;
+
+export const SourceType = Schema.Literal(
+  "hls",
+  "icy",
+  "dash",
+  "file",
+  "rtsp",
+  "websocket"
+).annotations({
+  title: "Source Type",
+  description:
+    "How the stream is read: HLS playlist, ICY/Shoutcast/Icecast stream, DASH manifest, local file, RTSP or audio pushed to /ingest/:id, e.g. a browser's microphone",
+});
+
+export type SourceType = typeof SourceType.Type;
+
+export const NoiseReduction = Schema.Literal(
+  "near_field",
+  "far_field"
+).annotations({
+  title: "Noise Reduction",
+  description:
+    "Noise reduction OpenAI applies to the input audio: near_field for close microphones, far_field for distant ones",
+});
+
+export type NoiseReduction = typeof NoiseReduction.Type;
+
+// Local ffmpeg filters run on a source's audio before it is sent, for poor
+// quality streams (AM relays, community stations) that transcribe badly
+// otherwise.
+export const Preprocessing = Schema.Struct({
+  highpassHz: Schema.optional(
+    Schema.Number.pipe(Schema.between(20, 1000))
+  ).annotations({
+    description:
+      "Cuts rumble and hum below this frequency, e.g. 100 for AM relays",
+  }),
+  agc: Schema.optional(Schema.Boolean).annotations({
+    description:
+      "Automatic gain control with ffmpeg's dynaudnorm, lifting quiet passages",
+  }),
+}).annotations({ title: "Preprocessing" });
+
+export type Preprocessing = typeof Preprocessing.Type;
+
+// Most a source may spend per UTC day, in tokens, dollars or both; past
+// either its audio isn't sent until the next day.
+export const SourceBudget = Schema.Struct({
+  tokens: Schema.optional(Schema.Int.pipe(Schema.positive())).annotations({
+    description: "Input and output tokens of the source's responses per day",
+  }),
+  usd: Schema.optional(Schema.Number.pipe(Schema.positive())).annotations({
+    description:
+      "Cost of the source's responses per day, in USD at the DRY_RUN_*_PRICE prices",
+  }),
+}).annotations({ title: "Source Budget" });
+
+export type SourceBudget = typeof SourceBudget.Type;
+
+export const SourceConfig = Schema.Struct({
+  id: Schema.String.pipe(Schema.pattern(/^[a-z0-9_-]+$/)).annotations({
+    title: "Audio Source ID",
+    description: "Identifier for a radio station",
+  }),
+  name: Schema.NonEmptyString.annotations({
+    description: "Human-readable station name",
+  }),
+  url: Schema.NonEmptyString.annotations({ description: "Stream URL" }),
+  backupUrls: Schema.optional(Schema.Array(Schema.NonEmptyString)).annotations({
+    description:
+      "Other URLs of the same stream, tried in order when the main one keeps failing",
+  }),
+  type: Schema.optional(SourceType).annotations({
+    description: "How the stream is read; guessed from the URL if unset",
+  }),
+  tasks: Schema.optionalWith(Schema.NonEmptyArray(TaskIdSchema), {
+    default: () => ["commentary"] as const,
+  }).annotations({
+    description: "Tasks run in parallel for each audio window",
+  }),
+  instructions: Schema.optional(Schema.NonEmptyString).annotations({
+    description:
+      "Commentary instructions template for this source; {{prompt}}, {{name}} and {{id}} are substituted",
+  }),
+  maxBitrate: Schema.optional(Schema.Int.pipe(Schema.positive())).annotations({
+    description:
+      "Preferred HLS rendition bitrate ceiling in bits/s; the lowest rendition is used if none fits",
+  }),
+  userAgent: Schema.optional(Schema.NonEmptyString).annotations({
+    description: "User-Agent for the stream and its playlists",
+  }),
+  headers: Schema.optional(
+    Schema.Record({ key: Schema.String, value: Schema.String })
+  ).annotations({
+    description:
+      "Extra HTTP headers for the stream and its playlists, e.g. Authorization",
+  }),
+  normalizeLoudness: Schema.optional(Schema.Boolean).annotations({
+    description:
+      "Evens out the loudness of the audio sent to the model with ffmpeg's loudnorm filter, at the cost of a little latency",
+  }),
+  delaySeconds: Schema.optional(
+    Schema.Number.pipe(Schema.between(0, 600))
+  ).annotations({
+    description:
+      "How far the stream lags the live broadcast (HLS often 20-60 s); taken off the on-air times of its windows",
+  }),
+  noiseReduction: Schema.optional(NoiseReduction),
+  preprocessing: Schema.optional(Preprocessing).annotations({
+    description:
+      "ffmpeg filters run on the audio before it is sent, ahead of loudness normalization",
+  }),
+  ffmpegArgs: Schema.optional(Schema.Array(Schema.String)).annotations({
+    description:
+      "Extra ffmpeg input options, placed before -i (e.g. reconnect flags)",
+  }),
+  nowPlaying: Schema.optional(NowPlayingProvider).annotations({
+    description:
+      "Where the current show comes from; guessed from the URL if unset (Radio France API for its streams, ICY for icy sources)",
+  }),
+  budget: Schema.optional(SourceBudget).annotations({
+    description:
+      "Daily spending limit; the source is paused once it is reached, until the next UTC day",
+  }),
+}).annotations({ title: "Source Config" });
+
+export type SourceConfig = typeof SourceConfig.Type;
+
+const HTTP_URL = /^https?:\/\//i;
+const RTSP_URL = /^rtsps?:\/\//i;
+const WS_URL = /^wss?:\/\//i;
+
+// Type of a source: its own, or guessed from the URL. Plain HTTP streams are
+// taken for ICY, the protocol of most Shoutcast and Icecast stations; a
+// WebSocket URL is where the audio is pushed to.
+export const sourceType = (source: {
+  readonly type?: SourceType | undefined;
+  readonly url: string;
+}): SourceType => {
+  if (source.type) return source.type;
+  if (RTSP_URL.test(source.url)) return "rtsp";
+  if (WS_URL.test(source.url)) return "websocket";
+  if (!HTTP_URL.test(source.url)) return "file";
+  const path = URL.parse(source.url)?.pathname ?? "";
+  return path.endsWith(".m3u8")
+    ? "hls"
+    : path.endsWith(".mpd")
+      ? "dash"
+      : "icy";
+};
+
+const validUrl = (type: SourceType, url: string): true | string => {
+  switch (type) {
+    case "hls":
+    case "icy":
+    case "dash":
+      return HTTP_URL.test(url) || `A ${type} source needs an http(s) URL`;
+    case "rtsp":
+      return RTSP_URL.test(url) || "An rtsp source needs an rtsp(s) URL";
+    case "websocket":
+      return (
+        WS_URL.test(url) ||
+        "A websocket source needs a ws(s) URL, e.g. its /ingest/:id endpoint"
+      );
+    case "file":
+      return (
+        url.startsWith("/") ||
+        url.startsWith("file:") ||
+        "A file source needs an absolute path or a file: URL"
+      );
+  }
+};
+
+// Checks that a source's URLs can be read as its type, which its main URL
+// decides when it isn't set.
+export const validSourceUrl = (source: {
+  readonly type?: SourceType | undefined;
+  readonly url: string;
+  readonly backupUrls?: ReadonlyArray<string> | undefined;
+}): true | string => {
+  const type = sourceType(source);
+  for (const url of [source.url, ...(source.backupUrls ?? [])]) {
+    const valid = validUrl(type, url);
+    if (valid !== true) return valid;
+  }
+  return true;
+};
+
+const DEFAULT_SOURCES: ReadonlyArray<SourceConfig> = [
+  {
+    id: "franceinfo",
+    name: "France Info",
+    url: "https://stream.radiofrance.fr/franceinfo/franceinfo_hifi.m3u8",
+    tasks: ["commentary", "summarize"],
+  },
+  {
+    id: "franceinter",
+    name: "France Inter",
+    url: "https://stream.radiofrance.fr/franceinter/franceinter_hifi.m3u8",
+    tasks: ["commentary"],
+  },
+  {
+    id: "franceculture",
+    name: "France Culture",
+    url: "https://stream.radiofrance.fr/franceculture/franceculture_hifi.m3u8",
+    tasks: ["commentary", "quotes"],
+  },
+];
+
+export const WindowConfig = Schema.Struct({
+  targetSeconds: Schema.optionalWith(Schema.Number.pipe(Schema.between(1, 60)), {
+    default: () => 15,
+  }).annotations({ description: "Audio per response request" }),
+  commitSeconds: Schema.optionalWith(Schema.Number.pipe(Schema.between(1, 60)), {
+    default: () => 3,
+  }).annotations({ description: "Audio per intermediate buffer commit" }),
+}).pipe(
+  Schema.filter(
+    (w) =>
+      w.commitSeconds <= w.targetSeconds ||
+      "commitSeconds must not exceed targetSeconds"
+  )
+);
+
+export const PlaylistConfig = Schema.Struct({
+  id: Schema.String.pipe(Schema.pattern(/^[a-z0-9_-]+$/)).annotations({
+    description: "Playlist identifier",
+  }),
+  name: Schema.NonEmptyString.annotations({
+    description: "Label shown in the UI, e.g. Morning news tour",
+  }),
+  sources: Schema.Array(Schema.String).pipe(Schema.minItems(2)).annotations({
+    description: "Sources to cycle through, in order",
+  }),
+  minutes: Schema.optionalWith(Schema.Number.pipe(Schema.between(1, 1440)), {
+    default: () => 20,
+  }).annotations({ description: "Time on each source" }),
+}).annotations({ title: "Playlist" });
+
+export type PlaylistConfig = typeof PlaylistConfig.Type;
+
+// Thresholds of the dead air alert; unset ones come from the environment.
+export const AlertsConfig = Schema.Struct({
+  silenceThresholdDbfs: Schema.optional(
+    Schema.Number.pipe(Schema.between(-120, 0))
+  ).annotations({
+    description:
+      "Level below which audio counts as silence (SILENCE_THRESHOLD_DBFS if unset)",
+  }),
+  deadAirSeconds: Schema.optional(
+    Schema.Number.pipe(Schema.positive())
+  ).annotations({
+    description:
+      "Silence duration before dead_air is sent (DEAD_AIR_SECONDS if unset)",
+  }),
+}).annotations({ title: "Alerts" });
+
+const WebhookUrl = Schema.String.pipe(
+  Schema.pattern(/^https?:\/\//, { message: () => "Expected an http(s) URL" })
+);
+
+// Where alerts are POSTed; unset ones come from the environment.
+export const WebhooksConfig = Schema.Struct({
+  deadAir: Schema.optional(WebhookUrl).annotations({
+    description: "Receives dead_air alerts (DEAD_AIR_WEBHOOK_URL if unset)",
+  }),
+  errors: Schema.optional(WebhookUrl).annotations({
+    description: "Receives pipeline errors (ERROR_WEBHOOK_URL if unset)",
+  }),
+}).annotations({ title: "Webhooks" });
+
+export const RadioConfig = Schema.Struct({
+  port: Schema.optionalWith(Schema.Int.pipe(Schema.between(1, 65535)), {
+    default: () => 3000,
+  }).annotations({ description: "HTTP port (applied on restart)" }),
+  model: Schema.optionalWith(Schema.NonEmptyString, {
+    default: () => "gpt-realtime-mini",
+  }).annotations({ description: "Realtime model (applied on restart)" }),
+  prompt: Schema.optionalWith(Schema.NonEmptyString, {
+    default: () => systemInstruction,
+  }).annotations({ description: "Instructions for the commentary task" }),
+  language: Schema.optional(Schema.NonEmptyString).annotations({
+    description: "Language to write commentary in, if not the prompt's own",
+  }),
+  window: Schema.optionalWith(WindowConfig, {
+    default: () => ({ targetSeconds: 15, commitSeconds: 3 }),
+  }),
+  postProcessing: Schema.optionalWith(Schema.Array(PostProcessor), {
+    default: () => [],
+  }).annotations({
+    description:
+      "Processors applied in order to response text before it is broadcast and stored",
+  }),
+  sources: Schema.optionalWith(
+    Schema.Array(SourceConfig).pipe(
+      Schema.filter(
+        (sources) =>
+          new Set(sources.map((s) => s.id)).size === sources.length ||
+          "Source ids must be unique"
+      ),
+      Schema.filter((sources) => {
+        for (const source of sources) {
+          const valid = validSourceUrl(source);
+          if (valid !== true) return `${source.id}: ${valid}`;
+        }
+        return true;
+      })
+    ),
+    { default: () => DEFAULT_SOURCES }
+  ),
+  playlists: Schema.optionalWith(
+    Schema.Array(PlaylistConfig).pipe(
+      Schema.filter(
+        (playlists) =>
+          new Set(playlists.map((p) => p.id)).size === playlists.length ||
+          "Playlist ids must be unique"
+      )
+    ),
+    { default: () => [] }
+  ).annotations({
+    description:
+      "Stations to cycle through on a schedule; sources missing when a playlist rotates are skipped",
+  }),
+  reconnectOnStuck: Schema.optionalWith(Schema.Boolean, {
+    default: () => false,
+  }).annotations({
+    description:
+      "Replace the OpenAI session when a response times out, in case the session itself is stuck",
+  }),
+  alerts: Schema.optionalWith(AlertsConfig, { default: () => ({}) }),
+  webhooks: Schema.optionalWith(WebhooksConfig, { default: () => ({}) }),
+}).annotations({ title: "Radio Config" });
+
+export type RadioConfig = typeof RadioConfig.Type;
+
+// Commentary instructions for a source: its own template if it has one,
+// otherwise the global prompt, followed by the language if one is set.
+export const renderInstructions = (config: RadioConfig, sourceId: string) => {
+  const source = config.sources.find((s) => s.id === sourceId);
+  const instructions = source?.instructions
+    ? source.instructions
+        .replaceAll("{{prompt}}", config.prompt)
+        .replaceAll("{{name}}", source.name)
+        .replaceAll("{{id}}", source.id)
+    : config.prompt;
+  return config.language
+    ? `${instructions}\n\nRépondez en ${config.language}.`
+    : instructions;
+};
+
+// Sources created, replaced or removed through the API. Kept in their own
+// file and layered over the config file's list on every load.
+const SourceCatalog = Schema.Struct({
+  upserted: Schema.Array(SourceConfig),
+  removed: Schema.Array(Schema.String),
+});
+
+type SourceCatalog = typeof SourceCatalog.Type;
+
+const SourceCatalogFile = Schema.parseJson(SourceCatalog, { space: 2 });
+
+const EMPTY_CATALOG: SourceCatalog = { upserted: [], removed: [] };
+
+const applySourceCatalog = (
+  sources: ReadonlyArray<SourceConfig>,
+  catalog: SourceCatalog
+): ReadonlyArray<SourceConfig> => [
+  ...sources
+    .filter((s) => !catalog.removed.includes(s.id))
+    .map((s) => catalog.upserted.find((u) => u.id === s.id) ?? s),
+  ...catalog.upserted.filter((u) => !sources.some((s) => s.id === u.id)),
+];
+
+export class SourceCatalogError extends Data.TaggedError("SourceCatalogError")<{
+  message: string;
+}> {}
+
+export class ConfigFileError extends Data.TaggedError("ConfigFileError")<{
+  path: string;
+  message: string;
+}> {}
+
+const sighups = Stream.async<void>((emit) => {
+  const onSighup = () => void emit.single(undefined);
+  process.on("SIGHUP", onSighup);
+  return Effect.sync(() => process.off("SIGHUP", onSighup));
+});
+
+// Effective configuration, read from a YAML file (CONFIG_FILE, defaults to
+// config.yaml) and reloaded on SIGHUP or when the file changes. A missing file
+// means all defaults; an invalid one is rejected and the previous config kept.
+// Sources edited through the API are persisted separately (SOURCES_FILE,
+// defaults to sources.json) and survive both reloads and restarts.
+export class AppConfig extends Effect.Service<AppConfig>()("AppConfig", {
+  scoped: Effect.gen(function* () {
+    const fs = yield* FileSystem.FileSystem;
+    const { basename, dirname } = yield* Path.Path;
+    const path = yield* Config.string("CONFIG_FILE").pipe(
+      Config.withDefault("config.yaml")
+    );
+    const catalogPath = yield* Config.string("SOURCES_FILE").pipe(
+      Config.withDefault("sources.json")
+    );
+
+    const catalogError = (e: { message: string }) =>
+      new SourceCatalogError({ message: `${catalogPath}: ${e.message}` });
+
+    const catalog = yield* Ref.make(
+      yield* Effect.gen(function* () {
+        if (!(yield* fs.exists(catalogPath))) return EMPTY_CATALOG;
+        return yield* Schema.decode(SourceCatalogFile)(
+          yield* fs.readFileString(catalogPath)
+        );
+      }).pipe(Effect.mapError(catalogError))
+    );
+
+    const loadFile = Effect.gen(function* () {
+      const fail = (message: string) => new ConfigFileError({ path, message });
+      if (!(yield* fs.exists(path))) {
+        return yield* Schema.decodeUnknown(RadioConfig)({});
+      }
+      const text = yield* fs.readFileString(path);
+      const raw = yield* Effect.try({
+        try: () => Bun.YAML.parse(text),
+        catch: (cause) => fail(`Invalid YAML: ${String(cause)}`),
+      });
+      return yield* Schema.decodeUnknown(RadioConfig)(raw ?? {}).pipe(
+        Effect.mapError((e) => fail(e.message))
+      );
+    }).pipe(
+      Effect.catchTags({
+        SystemError: (e) => new ConfigFileError({ path, message: e.message }),
+        BadArgument: (e) => new ConfigFileError({ path, message: e.message }),
+        ParseError: (e) => new ConfigFileError({ path, message: e.message }),
+      })
+    );
+
+    const load = Effect.gen(function* () {
+      const config = yield* loadFile;
+      const overlay = yield* Ref.get(catalog);
+      return {
+        ...config,
+        sources: applySourceCatalog(config.sources, overlay),
+      };
+    });
+
+    const ref = yield* SubscriptionRef.make(yield* load);
+    yield* Effect.log(`Configuration loaded from ${path}`);
+
+    const reload = load.pipe(
+      Effect.tap((config) => SubscriptionRef.set(ref, config)),
+      Effect.tap(() => Effect.log(`Configuration reloaded from ${path}`)),
+      Effect.tapError((e) =>
+        Effect.logError(`Configuration not reloaded: ${e.message}`)
+      )
+    );
+
+    // The directory is watched rather than the file, so a config file
+    // created after startup, or replaced by an editor's rename, is picked up.
+    // A watch that can't start, as when the directory doesn't exist yet, is
+    // retried.
+    const fileChanges = fs.watch(dirname(path)).pipe(
+      Stream.filter((event) => basename(event.path) === basename(path)),
+      Stream.as(undefined),
+      Stream.tapError((e) =>
+        Effect.logWarning(
+          `Not watching ${path}, retrying in 10 seconds: ${e.message}`
+        )
+      ),
+      Stream.retry(Schedule.spaced("10 seconds"))
+    );
+
+    yield* Stream.merge(sighups, fileChanges).pipe(
+      Stream.debounce("200 millis"),
+      Stream.runForEach(() => Effect.ignore(reload)),
+      Effect.forkScoped
+    );
+
+    // Written to a temporary file first so a crash can't leave it truncated,
+    // and serialized so concurrent edits can't persist out of order.
+    const lock = yield* Effect.makeSemaphore(1);
+    const modifyCatalog = (f: (catalog: SourceCatalog) => SourceCatalog) =>
+      Effect.gen(function* () {
+        const next = f(yield* Ref.get(catalog));
+        const json = yield* Schema.encode(SourceCatalogFile)(next);
+        yield* fs.writeFileString(`${catalogPath}.tmp`, json);
+        yield* fs.rename(`${catalogPath}.tmp`, catalogPath);
+        yield* Ref.set(catalog, next);
+        yield* SubscriptionRef.update(ref, (c) => ({
+          ...c,
+          sources: applySourceCatalog(c.sources, next),
+        }));
+      }).pipe(Effect.mapError(catalogError), lock.withPermits(1));
+
+    return {
+      get: SubscriptionRef.get(ref),
+      changes: ref.changes,
+      reload,
+      // Creates or replaces a source, persisted across reloads and restarts.
+      putSource: (source: SourceConfig) =>
+        modifyCatalog((c) => ({
+          upserted: [...c.upserted.filter((u) => u.id !== source.id), source],
+          removed: c.removed.filter((id) => id !== source.id),
+        })),
+      // Removes a source, persisted across reloads and restarts.
+      removeSource: (id: string) =>
+        modifyCatalog((c) => ({
+          upserted: c.upserted.filter((u) => u.id !== id),
+          removed: [...c.removed.filter((r) => r !== id), id],
+        })),
+      // The config as saved: the file with the sources edited through the
+      // API, without runtime edits.
+      saved: load,
+      // Replaces the config file with `config`, sources included, so the
+      // sources edited through the API are folded into it and their file
+      // emptied, and reloads. The previous file is kept as `.bak`; written
+      // as JSON, which is valid YAML. Nothing is changed if it fails;
+      // otherwise it returns an effect putting the previous file and sources
+      // back, for a caller whose own changes then fail.
+      replace: (config: RadioConfig) =>
+        Effect.gen(function* () {
+          const encoded = yield* Schema.encode(RadioConfig)(config).pipe(
+            Effect.mapError(
+              (e) => new ConfigFileError({ path, message: e.message })
+            )
+          );
+          const previous = yield* Effect.gen(function* () {
+            if (!(yield* fs.exists(path))) return Option.none<string>();
+            return Option.some(yield* fs.readFileString(path));
+          }).pipe(
+            Effect.mapError(
+              (e) => new ConfigFileError({ path, message: e.message })
+            )
+          );
+          const previousCatalog = yield* Ref.get(catalog);
+
+          const restore = Effect.gen(function* () {
+            if (Option.isSome(previous)) {
+              yield* writeFileAtomically(path, previous.value);
+            } else if (yield* fs.exists(path)) {
+              yield* fs.remove(path);
+            }
+          }).pipe(
+            Effect.provideService(FileSystem.FileSystem, fs),
+            Effect.mapError(
+              (e) => new ConfigFileError({ path, message: e.message })
+            ),
+            Effect.zipRight(modifyCatalog(() => previousCatalog)),
+            Effect.zipRight(reload),
+            Effect.asVoid
+          );
+
+          yield* Effect.gen(function* () {
+            if (Option.isSome(previous)) {
+              yield* fs.copyFile(path, `${path}.bak`);
+            }
+            yield* writeFileAtomically(
+              path,
+              `${JSON.stringify(encoded, null, 2)}\n`
+            );
+          }).pipe(
+            Effect.provideService(FileSystem.FileSystem, fs),
+            Effect.mapError(
+              (e) => new ConfigFileError({ path, message: e.message })
+            ),
+            Effect.zipRight(modifyCatalog(() => EMPTY_CATALOG)),
+            Effect.zipRight(reload),
+            Effect.tapError(() =>
+              restore.pipe(
+                Effect.catchAll((e) =>
+                  Effect.logError(
+                    `Previous configuration not restored: ${e.message}`
+                  )
+                )
+              )
+            )
+          );
+          return restore;
+        }),
+      // Runtime edits apply to the effective config only; the next reload of
+      // the file replaces them.
+      update: (f: (config: RadioConfig) => RadioConfig) =>
+        SubscriptionRef.update(ref, f),
+    } as const;
+  }),
+}) {}
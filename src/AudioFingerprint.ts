@@ -0,0 +1,398 @@
+import { Effect } from "effect";
+import type { InputFormatSpec } from "./AudioFormat.js";
+import { sampleValues } from "./AudioLevel.js";
+
+// Sub-fingerprints after Haitsma and Kalker: the audio is brought down to
+// 8kHz and every 32ms a 128ms frame gives 32 bits, each the sign of how the
+// energy difference between two neighbouring bands (300Hz to 3kHz) changed
+// since the previous frame. They survive re-encoding and level changes, so a
+// jingle gives nearly the same bits each time it airs.
+const RATE = 8000;
+const FRAME = 1024;
+const HOP = 256;
+export const HOP_MS = (HOP / RATE) * 1000;
+const BANDS = 33;
+const MIN_HZ = 300;
+const MAX_HZ = 3000;
+
+// Sub-fingerprints compared to recognize audio, about 2s, and to notice it
+// is over, about half a second.
+const BLOCK = 64;
+const END_BLOCK = 16;
+// Share of differing bits under which two runs are the same audio.
+const MAX_BIT_ERROR = 0.35;
+// Frames quieter than this (about -50 dBFS) don't count, as silence matches
+// any other silence.
+const SILENT_RMS = 0.003;
+const MAX_SILENT_SHARE = 0.25;
+// Earlier positions checked per sub-fingerprint value, most recent first.
+const MAX_CANDIDATES = 8;
+
+// FFT bins where each band starts, the last one where the top band ends.
+const BAND_EDGES = Array.from({ length: BANDS + 1 }, (_, i) =>
+  Math.round((MIN_HZ * (MAX_HZ / MIN_HZ) ** (i / BANDS) * FRAME) / RATE)
+);
+
+const HANN = Float64Array.from(
+  { length: FRAME },
+  (_, i) => 0.5 - 0.5 * Math.cos((2 * Math.PI * i) / (FRAME - 1))
+);
+
+const BIT_REVERSED = Uint32Array.from({ length: FRAME }, (_, i) => {
+  let reversed = 0;
+  for (let bit = 1, j = i; bit < FRAME; bit <<= 1, j >>= 1) {
+    reversed = (reversed << 1) | (j & 1);
+  }
+  return reversed;
+});
+
+const TWIDDLE_RE = Float64Array.from({ length: FRAME / 2 }, (_, k) =>
+  Math.cos((-2 * Math.PI * k) / FRAME)
+);
+const TWIDDLE_IM = Float64Array.from({ length: FRAME / 2 }, (_, k) =>
+  Math.sin((-2 * Math.PI * k) / FRAME)
+);
+
+// In-place radix-2 FFT of FRAME points.
+const fft = (re: Float64Array, im: Float64Array) => {
+  for (let i = 0; i < FRAME; i++) {
+    const j = BIT_REVERSED[i]!;
+    if (j > i) {
+      [re[i], re[j]] = [re[j]!, re[i]!];
+      [im[i], im[j]] = [im[j]!, im[i]!];
+    }
+  }
+  for (let size = 2; size <= FRAME; size <<= 1) {
+    const half = size / 2;
+    const stride = FRAME / size;
+    for (let start = 0; start < FRAME; start += size) {
+      for (let k = 0; k < half; k++) {
+        const wr = TWIDDLE_RE[k * stride]!;
+        const wi = TWIDDLE_IM[k * stride]!;
+        const a = start + k;
+        const b = a + half;
+        const tr = re[b]! * wr - im[b]! * wi;
+        const ti = re[b]! * wi + im[b]! * wr;
+        re[b] = re[a]! - tr;
+        im[b] = im[a]! - ti;
+        re[a] = re[a]! + tr;
+        im[a] = im[a]! + ti;
+      }
+    }
+  }
+};
+
+const bitCount = (n: number) => {
+  n = n - ((n >>> 1) & 0x55555555);
+  n = (n & 0x33333333) + ((n >>> 2) & 0x33333333);
+  return Math.imul((n + (n >>> 4)) & 0x0f0f0f0f, 0x01010101) >>> 24;
+};
+
+// Share of bits that differ between `length` sub-fingerprints of each.
+const bitErrorRate = (
+  a: (i: number) => number,
+  b: (i: number) => number,
+  length: number
+) => {
+  let errors = 0;
+  for (let i = 0; i < length; i++) errors += bitCount((a(i) ^ b(i)) >>> 0);
+  return errors / (length * 32);
+};
+
+// A learned segment to recognize, as its sub-fingerprints.
+export interface LibraryEntry {
+  readonly id: string;
+  readonly subs: Uint32Array;
+}
+
+export type RepeatEvent =
+  | {
+      readonly type: "started";
+      // The entry recognized, or null for audio heard earlier in the history.
+      readonly fingerprint: string | null;
+    }
+  | {
+      readonly type: "ended";
+      readonly fingerprint: string | null;
+      // How long it matched, including the block it took to recognize.
+      readonly durationMs: number;
+      // For audio from the history that matched long enough, the
+      // sub-fingerprints to learn it by.
+      readonly learned: Uint32Array | null;
+    };
+
+export interface RepeatDetector {
+  // Adds a chunk; returns the repeats that started or ended with it.
+  readonly add: (chunk: Uint8Array) => ReadonlyArray<RepeatEvent>;
+  readonly inRepeat: () => boolean;
+  // The entry being recognized; null for a repeat not learned yet, or none.
+  readonly fingerprint: () => string | null;
+  readonly setLibrary: (entries: ReadonlyArray<LibraryEntry>) => void;
+  readonly reset: () => void;
+}
+
+export interface RepeatDetectorOptions {
+  // How far back audio is remembered to notice it airing again.
+  readonly historySeconds: number;
+  // Repeats shorter than this aren't learned: a few words said twice are.
+  readonly minSeconds: number;
+  // Longer repeats are learned in pieces of this length.
+  readonly maxSeconds: number;
+}
+
+interface Tracking {
+  // Null for a repeat of the history.
+  entry: LibraryEntry | null;
+  // Position, in the entry or the history, aligned with the latest frame.
+  at: number;
+  // Where the match starts there, and the last position that matched.
+  readonly from: number;
+  lastGood: number;
+}
+
+// Recognizes the library's entries, and audio that already aired in the
+// last `historySeconds`, e.g. ads and jingles: a block of about 2s must
+// match first, at an alignment suggested by identical sub-fingerprints.
+export const makeRepeatDetector = (
+  spec: InputFormatSpec,
+  options: RepeatDetectorOptions
+) =>
+  Effect.sync((): RepeatDetector => {
+    const decimation = Math.max(1, Math.round(spec.sampleRate / RATE));
+    const historyHops = Math.ceil((options.historySeconds * 1000) / HOP_MS);
+    const minHops = Math.ceil((options.minSeconds * 1000) / HOP_MS);
+    const maxHops = Math.ceil((options.maxSeconds * 1000) / HOP_MS);
+
+    const frame = new Float64Array(FRAME);
+    const re = new Float64Array(FRAME);
+    const im = new Float64Array(FRAME);
+    let filled = 0;
+    let decimated = 0;
+    let decimatedCount = 0;
+    let previous: Float64Array | null = null;
+
+    const history = new Uint32Array(historyHops);
+    const silent = new Uint8Array(historyHops);
+    // Frames so far; the latest is count - 1.
+    let count = 0;
+    // Non-silent frames by sub-fingerprint, oldest first.
+    let positions = new Map<number, Array<number>>();
+
+    let library: ReadonlyArray<LibraryEntry> = [];
+    let libraryPositions = new Map<
+      number,
+      Array<{ entry: LibraryEntry; at: number }>
+    >();
+    let tracking: Tracking | null = null;
+
+    const hist = (position: number) => history[position % historyHops]!;
+    const inHistory = (position: number) =>
+      position >= Math.max(0, count - historyHops) && position < count;
+
+    const subFingerprint = () => {
+      let sumSquares = 0;
+      for (let i = 0; i < FRAME; i++) {
+        re[i] = frame[i]! * HANN[i]!;
+        im[i] = 0;
+        sumSquares += frame[i]! * frame[i]!;
+      }
+      fft(re, im);
+      const energies = new Float64Array(BANDS);
+      for (let band = 0; band < BANDS; band++) {
+        let energy = 0;
+        for (let k = BAND_EDGES[band]!; k < BAND_EDGES[band + 1]!; k++) {
+          energy += re[k]! * re[k]! + im[k]! * im[k]!;
+        }
+        energies[band] = energy;
+      }
+      let sub = 0;
+      if (previous !== null) {
+        for (let band = 0; band < BANDS - 1; band++) {
+          const change =
+            energies[band]! -
+            energies[band + 1]! -
+            (previous[band]! - previous[band + 1]!);
+          if (change > 0) sub |= 1 << band;
+        }
+      }
+      const quiet =
+        previous === null || Math.sqrt(sumSquares / FRAME) < SILENT_RMS;
+      previous = energies;
+      return { sub: sub >>> 0, quiet };
+    };
+
+    const record = (sub: number, quiet: boolean) => {
+      const slot = count % historyHops;
+      if (count >= historyHops && silent[slot] === 0) {
+        const old = positions.get(history[slot]!);
+        old?.shift();
+        if (old?.length === 0) positions.delete(history[slot]!);
+      }
+      history[slot] = sub;
+      silent[slot] = quiet ? 1 : 0;
+      if (!quiet) {
+        const same = positions.get(sub);
+        if (same) same.push(count);
+        else positions.set(sub, [count]);
+      }
+      count++;
+    };
+
+    const matchesLatest = (
+      seq: (position: number) => number,
+      end: number,
+      length: number
+    ) =>
+      bitErrorRate(
+        (i) => seq(end - length + 1 + i),
+        (i) => hist(count - length + i),
+        length
+      ) <= MAX_BIT_ERROR;
+    // The whole block, and its end too, so the tail of a repeat that just
+    // ended doesn't start it again.
+    const matchesBlock = (seq: (position: number) => number, end: number) =>
+      matchesLatest(seq, end, BLOCK) && matchesLatest(seq, end, END_BLOCK);
+
+    // A match for the latest block, in the library first so a known segment
+    // is reported as such.
+    const find = (): Tracking | null => {
+      const last = count - 1;
+      const first = last - BLOCK + 1;
+      let quiet = 0;
+      for (let j = first; j <= last; j++) quiet += silent[j % historyHops]!;
+      if (quiet > BLOCK * MAX_SILENT_SHARE) return null;
+
+      const tried = new Set<string>();
+      for (let j = first; j <= last; j++) {
+        if (silent[j % historyHops] === 1) continue;
+        const candidates = libraryPositions.get(hist(j)) ?? [];
+        for (const candidate of candidates.slice(-MAX_CANDIDATES)) {
+          const at = candidate.at + (last - j);
+          const key = `${candidate.entry.id}:${at}`;
+          if (
+            at < BLOCK - 1 ||
+            at >= candidate.entry.subs.length ||
+            tried.has(key)
+          ) {
+            continue;
+          }
+          tried.add(key);
+          const subs = candidate.entry.subs;
+          if (matchesBlock((i) => subs[i]!, at)) {
+            return {
+              entry: candidate.entry,
+              at,
+              from: at - BLOCK + 1,
+              lastGood: at,
+            };
+          }
+        }
+      }
+      for (let j = first; j <= last; j++) {
+        if (silent[j % historyHops] === 1) continue;
+        // Only from before the latest block, which would match itself.
+        const earlier = positions.get(hist(j)) ?? [];
+        let checked = 0;
+        for (let c = earlier.length - 1; c >= 0; c--) {
+          const p = earlier[c]!;
+          if (p > j - BLOCK) continue;
+          if (++checked > MAX_CANDIDATES) break;
+          const at = p + (last - j);
+          const key = `:${at}`;
+          if (!inHistory(at - BLOCK + 1) || tried.has(key)) continue;
+          tried.add(key);
+          if (matchesBlock(hist, at)) {
+            return { entry: null, at, from: at - BLOCK + 1, lastGood: at };
+          }
+        }
+      }
+      return null;
+    };
+
+    const end = (t: Tracking): RepeatEvent => {
+      tracking = null;
+      const hops = t.lastGood - t.from + 1;
+      const learnable =
+        t.entry === null && hops >= minHops && inHistory(t.from);
+      return {
+        type: "ended",
+        fingerprint: t.entry?.id ?? null,
+        durationMs: hops * HOP_MS,
+        learned: learnable
+          ? Uint32Array.from({ length: hops }, (_, i) => hist(t.from + i))
+          : null,
+      };
+    };
+
+    // Follows the match one frame further.
+    const follow = (t: Tracking): RepeatEvent | null => {
+      t.at++;
+      if (t.entry !== null && t.at >= t.entry.subs.length) return end(t);
+      if (t.entry === null && t.at - t.from + 1 > maxHops) return end(t);
+      const subs = t.entry?.subs;
+      const seq = subs ? (i: number) => subs[i]! : hist;
+      if (!matchesLatest(seq, t.at, END_BLOCK)) return end(t);
+      t.lastGood = t.at;
+      return null;
+    };
+
+    const onFrame = (): RepeatEvent | null => {
+      const { sub, quiet } = subFingerprint();
+      record(sub, quiet);
+      if (tracking !== null) return follow(tracking);
+      if (count <= BLOCK) return null;
+      tracking = find();
+      return tracking === null
+        ? null
+        : { type: "started", fingerprint: tracking.entry?.id ?? null };
+    };
+
+    return {
+      add: (chunk) => {
+        const events: Array<RepeatEvent> = [];
+        for (const sample of sampleValues(spec.format, chunk)) {
+          decimated += sample;
+          if (++decimatedCount < decimation) continue;
+          frame[filled++] = decimated / decimation;
+          decimated = 0;
+          decimatedCount = 0;
+          if (filled < FRAME) continue;
+          const event = onFrame();
+          if (event !== null) events.push(event);
+          frame.copyWithin(0, HOP);
+          filled = FRAME - HOP;
+        }
+        return events;
+      },
+      inRepeat: () => tracking !== null,
+      fingerprint: () => tracking?.entry?.id ?? null,
+      setLibrary: (entries) => {
+        library = entries;
+        libraryPositions = new Map();
+        for (const entry of library) {
+          entry.subs.forEach((sub, at) => {
+            if (sub === 0) return;
+            const same = libraryPositions.get(sub);
+            if (same) same.push({ entry, at });
+            else libraryPositions.set(sub, [{ entry, at }]);
+          });
+        }
+        // A segment being followed may have been forgotten.
+        if (tracking?.entry) {
+          const id = tracking.entry.id;
+          const entry = library.find((e) => e.id === id);
+          if (entry) tracking.entry = entry;
+          else tracking = null;
+        }
+      },
+      reset: () => {
+        filled = 0;
+        decimated = 0;
+        decimatedCount = 0;
+        previous = null;
+        count = 0;
+        positions = new Map();
+        tracking = null;
+      },
+    };
+  });
@@ -0,0 +1,54 @@
+// Audio formats accepted by the Realtime API as input. G.711 (8kHz, one byte
+// per sample) is a sixth of the size of 24kHz PCM, which makes ffmpeg's
+// resampling and our base64 encoding proportionally cheaper. The API has no
+// compressed input format, so AAC/Opus frames can't be passed through as-is.
+export type InputFormat = "pcm" | "pcmu" | "pcma";
+
+// PCM rates a Realtime backend may expect: OpenAI takes 24kHz, some other
+// providers 16kHz. G.711 is always 8kHz.
+export type PcmRate = 16000 | 24000;
+
+export const DEFAULT_PCM_RATE: PcmRate = 24000;
+
+export interface InputFormatSpec {
+  readonly format: InputFormat;
+  readonly sampleRate: number;
+  // `audio.input.format` value for session.update.
+  readonly session: { readonly type: string; readonly rate?: number };
+  readonly bytesPerSecond: number;
+  // ffmpeg output options producing raw mono audio in this format.
+  readonly ffmpegArgs: ReadonlyArray<string>;
+}
+
+const g711 = (format: "pcmu" | "pcma", ffmpegFormat: string) => ({
+  format,
+  sampleRate: 8000,
+  session: { type: `audio/${format}` },
+  bytesPerSecond: 8000,
+  ffmpegArgs: ["-f", ffmpegFormat, "-ar", "8000", "-ac", "1"],
+});
+
+// Specs are per pipeline rather than global, so byte counts (windows, batches,
+// offsets) always follow the rate the audio was actually decoded at.
+export const inputFormatSpec = (
+  format: InputFormat,
+  pcmRate: PcmRate = DEFAULT_PCM_RATE
+): InputFormatSpec => {
+  switch (format) {
+    case "pcm":
+      return {
+        format,
+        sampleRate: pcmRate,
+        session: { type: "audio/pcm", rate: pcmRate },
+        bytesPerSecond: pcmRate * 2,
+        ffmpegArgs: ["-f", "s16le", "-ar", String(pcmRate), "-ac", "1"],
+      };
+    case "pcmu":
+      return g711(format, "mulaw");
+    case "pcma":
+      return g711(format, "alaw");
+  }
+};
+
+export const describeSpec = (spec: InputFormatSpec) =>
+  `${spec.format} ${spec.sampleRate / 1000}kHz`;
@@ -0,0 +1,145 @@
+import type { InputFormat } from "./AudioFormat.js";
+
+// Sum of squares and peak of a chunk's samples, normalized to [-1, 1], so
+// RMS and peak can be computed over several chunks.
+export interface LevelStats {
+  readonly sumSquares: number;
+  readonly peak: number;
+  readonly samples: number;
+}
+
+export const EMPTY_LEVEL: LevelStats = { sumSquares: 0, peak: 0, samples: 0 };
+
+export const addLevelStats = (a: LevelStats, b: LevelStats): LevelStats => ({
+  sumSquares: a.sumSquares + b.sumSquares,
+  peak: Math.max(a.peak, b.peak),
+  samples: a.samples + b.samples,
+});
+
+// RMS level in dBFS (0 = full scale); -Infinity when silent or empty.
+export const rmsDbfs = (stats: LevelStats): number =>
+  stats.samples === 0
+    ? -Infinity
+    : 10 * Math.log10(stats.sumSquares / stats.samples);
+
+export const peakDbfs = (stats: LevelStats): number =>
+  20 * Math.log10(stats.peak);
+
+const pcmLevelStats = (pcm: Uint8Array): LevelStats => {
+  const view = new DataView(pcm.buffer, pcm.byteOffset, pcm.byteLength);
+  const samples = Math.floor(pcm.byteLength / 2);
+
+  let sumSquares = 0;
+  let peak = 0;
+  for (let i = 0; i < samples; i++) {
+    const sample = view.getInt16(i * 2, true) / 32768;
+    sumSquares += sample * sample;
+    peak = Math.max(peak, Math.abs(sample));
+  }
+  return { sumSquares, peak, samples };
+};
+
+// G.711 code to 16-bit linear sample lookup tables.
+const MULAW_TABLE = Int16Array.from({ length: 256 }, (_, code) => {
+  const u = ~code & 0xff;
+  const magnitude = ((((u & 0x0f) << 3) + 0x84) << ((u >> 4) & 7)) - 0x84;
+  return u & 0x80 ? -magnitude : magnitude;
+});
+
+const ALAW_TABLE = Int16Array.from({ length: 256 }, (_, code) => {
+  const a = code ^ 0x55;
+  const exponent = (a >> 4) & 7;
+  const mantissa = (a & 0x0f) << 4;
+  const magnitude =
+    exponent === 0 ? mantissa + 8 : (mantissa + 0x108) << (exponent - 1);
+  return a & 0x80 ? magnitude : -magnitude;
+});
+
+const g711LevelStats = (bytes: Uint8Array, table: Int16Array): LevelStats => {
+  let sumSquares = 0;
+  let peak = 0;
+  for (const code of bytes) {
+    const sample = table[code]! / 32768;
+    sumSquares += sample * sample;
+    peak = Math.max(peak, Math.abs(sample));
+  }
+  return { sumSquares, peak, samples: bytes.length };
+};
+
+export const levelStats = (
+  format: InputFormat,
+  chunk: Uint8Array
+): LevelStats => {
+  switch (format) {
+    case "pcm":
+      return pcmLevelStats(chunk);
+    case "pcmu":
+      return g711LevelStats(chunk, MULAW_TABLE);
+    case "pcma":
+      return g711LevelStats(chunk, ALAW_TABLE);
+  }
+};
+
+// RMS level of a mono PCM s16le chunk, in dBFS.
+export const pcmLevelDbfs = (pcm: Uint8Array): number =>
+  rmsDbfs(pcmLevelStats(pcm));
+
+export const levelDbfs = (format: InputFormat, chunk: Uint8Array): number =>
+  rmsDbfs(levelStats(format, chunk));
+
+const sampleReader = (format: InputFormat, chunk: Uint8Array) => {
+  switch (format) {
+    case "pcm": {
+      const view = new DataView(
+        chunk.buffer,
+        chunk.byteOffset,
+        chunk.byteLength
+      );
+      return {
+        count: Math.floor(chunk.byteLength / 2),
+        at: (i: number) => view.getInt16(i * 2, true),
+      };
+    }
+    case "pcmu":
+      return {
+        count: chunk.length,
+        at: (i: number) => MULAW_TABLE[chunk[i]!]!,
+      };
+    case "pcma":
+      return {
+        count: chunk.length,
+        at: (i: number) => ALAW_TABLE[chunk[i]!]!,
+      };
+  }
+};
+
+// Share of consecutive samples that change sign, from 0 to 1. High for
+// noisy sounds (fricatives), low for tones.
+export const zeroCrossingRate = (
+  format: InputFormat,
+  chunk: Uint8Array
+): number => {
+  const samples = sampleReader(format, chunk);
+  if (samples.count < 2) return 0;
+  let crossings = 0;
+  let previous = samples.at(0);
+  for (let i = 1; i < samples.count; i++) {
+    const sample = samples.at(i);
+    if ((previous < 0 && sample >= 0) || (previous >= 0 && sample < 0)) {
+      crossings++;
+    }
+    previous = sample;
+  }
+  return crossings / (samples.count - 1);
+};
+
+// A chunk's samples, normalized to [-1, 1].
+export const sampleValues = (
+  format: InputFormat,
+  chunk: Uint8Array
+): Float32Array => {
+  const samples = sampleReader(format, chunk);
+  const values = new Float32Array(samples.count);
+  for (let i = 0; i < samples.count; i++) values[i] = samples.at(i) / 32768;
+  return values;
+};
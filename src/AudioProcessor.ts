@@ -1,15 +1,142 @@
-import { Data, Effect, Either, Option, Ref, Schedule, Stream } from "effect";
 import {
-  AudioSource,
-  BYTES_PER_SECOND,
-  type AudioSourceId,
-} from "./AudioSource.js";
+  HttpClient,
+  HttpClientRequest,
+  HttpClientResponse,
+} from "@effect/platform";
+import {
+  Cause,
+  Clock,
+  Config,
+  Data,
+  Effect,
+  Either,
+  Option,
+  Predicate,
+  Ref,
+  Schedule,
+  Stream,
+  SubscriptionRef,
+} from "effect";
+import {
+  AppConfig,
+  renderInstructions,
+  sourceType,
+  type RadioConfig,
+} from "./AppConfig.js";
+import {
+  addLevelStats,
+  EMPTY_LEVEL,
+  levelStats,
+  peakDbfs,
+  rmsDbfs,
+  zeroCrossingRate,
+  type LevelStats,
+} from "./AudioLevel.js";
+import { makeRepeatDetector } from "./AudioFingerprint.js";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { Budgets } from "./Budgets.js";
+import {
+  type ChunkCorruption,
+  ChunkCrcConfig,
+  chunkCrc,
+  makeChunkAligner,
+} from "./ChunkIntegrity.js";
+import { Fingerprints } from "./Fingerprints.js";
+import { IdleMonitor } from "./IdleMonitor.js";
+import { makeMusicDetector } from "./MusicDetection.js";
 import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { pipelineError } from "./PipelineErrors.js";
+import { PipelineEvent, PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { makeRingBuffer } from "./RingBuffer.js";
+import { SourceStats } from "./SourceStats.js";
+import { type Program, StationMetadata } from "./StationMetadata.js";
+import { SttFallback } from "./SttFallback.js";
+
+// Short pauses are kept so speech isn't clipped; only sustained silence is
+// withheld from OpenAI.
+const SKIP_SILENCE_SECONDS = 1;
+
+const DeadAirConfig = Config.all({
+  thresholdDbfs: Config.number("SILENCE_THRESHOLD_DBFS").pipe(
+    Config.withDefault(-50)
+  ),
+  deadAirSeconds: Config.number("DEAD_AIR_SECONDS").pipe(
+    Config.withDefault(10)
+  ),
+  webhookUrl: Config.option(Config.string("DEAD_AIR_WEBHOOK_URL")),
+});
+
+// Music segments are only withheld once they last MUSIC_SKIP_SECONDS, so
+// jingles and short beds are still sent.
+const MusicConfig = Config.all({
+  enabled: Config.boolean("SKIP_MUSIC").pipe(Config.withDefault(false)),
+  windowSeconds: Config.integer("MUSIC_SKIP_SECONDS").pipe(
+    Config.withDefault(20)
+  ),
+});
+
+// Segments that aired before in the last REPEAT_HISTORY_MINUTES, e.g. ads
+// and jingles, are learned by their fingerprint; with SKIP_REPEATS they are
+// withheld from OpenAI when they air again.
+const RepeatConfig = Config.all({
+  skip: Config.boolean("SKIP_REPEATS").pipe(Config.withDefault(false)),
+  historyMinutes: Config.number("REPEAT_HISTORY_MINUTES").pipe(
+    Config.withDefault(60)
+  ),
+});
 
-const TARGET_BYTES = 15 * BYTES_PER_SECOND;
-const COMMIT_BYTES = 3 * BYTES_PER_SECOND;
+// Shorter repeats are phrases said twice rather than ads; longer ones are
+// learned in pieces.
+const MIN_REPEAT_SECONDS = 3;
+const MAX_REPEAT_SECONDS = 90;
+
+// Audio read ahead of processing: ffmpeg keeps reading the live stream while
+// processing stalls, and past AUDIO_QUEUE_SECONDS the oldest chunks are
+// dropped rather than falling behind the broadcast.
+const AudioQueueConfig = Config.integer("AUDIO_QUEUE_SECONDS").pipe(
+  Config.withDefault(10)
+);
+
+// Windows are cut where the station's program guide changes shows, so none
+// straddles two programs.
+const ProgramSegmentationConfig = Config.boolean("PROGRAM_SEGMENTATION").pipe(
+  Config.withDefault(true)
+);
+
+// Instructions naming the show on air, if known.
+const withProgram = (instructions: string, program: Option.Option<Program>) =>
+  Option.match(program, {
+    onNone: () => instructions,
+    onSome: ({ show }) => `${instructions}\n\nÉmission en cours : ${show}.`,
+  });
+
+// Chunks hold up to 20ms of audio.
+const CHUNK_MS = 20;
+
+// The last chunk processed, so a run restarted on the same source can tell
+// how much of its stream was missed in between.
+interface LastChunk {
+  readonly source: AudioSourceId;
+  readonly at: number;
+}
+
+// Silence measures -Infinity dBFS, which JSON can't carry.
+const reportedDbfs = (dbfs: number) =>
+  Math.max(-120, Math.round(dbfs * 10) / 10);
 
 class SourceClearedError extends Data.TaggedError("SourceClearedError") {}
+class ConfigChangedError extends Data.TaggedError("ConfigChangedError") {}
+class StreamRestartedError extends Data.TaggedError("StreamRestartedError") {}
+class IdleError extends Data.TaggedError("IdleError") {}
+
+// The parts of the config a processing run depends on; a change restarts it.
+const processingKey = (config: RadioConfig, sourceId: AudioSourceId) =>
+  JSON.stringify([
+    config.window,
+    config.sources.find((s) => s.id === sourceId),
+  ]);
 
 const assertSource = (sourceId: AudioSourceId) =>
   AudioSource.currentSource.pipe(
@@ -19,45 +146,711 @@ const assertSource = (sourceId: AudioSourceId) =>
     )
   );
 
-const processAudio = (sourceId: AudioSourceId) =>
+const notifyWebhook = (url: string, payload: object) =>
+  Effect.gen(function* () {
+    const client = yield* HttpClient.HttpClient;
+    yield* HttpClientRequest.post(url).pipe(
+      HttpClientRequest.bodyUnsafeJson(payload),
+      (request) => client.execute(request),
+      Effect.flatMap(HttpClientResponse.filterStatusOk),
+      Effect.timeout("5 seconds")
+    );
+  }).pipe(
+    Effect.catchAllCause((cause) =>
+      Effect.logWarning("Dead air webhook failed", cause)
+    )
+  );
+
+const processAudio = (
+  sourceId: AudioSourceId,
+  lastChunk: Ref.Ref<Option.Option<LastChunk>>
+) =>
   Effect.gen(function* () {
     yield* Effect.log(`Source selected: ${sourceId}, starting processing...`);
 
     const openai = yield* OpenAIRealtime;
+    const broadcaster = yield* Broadcaster;
+    const sourceStats = yield* SourceStats;
+    const events = yield* PipelineEvents;
+    const fallback = yield* SttFallback;
+    const stationMetadata = yield* StationMetadata;
+    const idle = yield* IdleMonitor;
+    const budgets = yield* Budgets;
+    const fingerprints = yield* Fingerprints;
+    const appConfig = yield* AppConfig;
+    const config = yield* appConfig.get;
+    const source = config.sources.find((s) => s.id === sourceId);
+    if (!source) return yield* new SourceClearedError();
+    yield* sourceStats.track(sourceId);
+    yield* events.publish(PipelineEvent.SourceSelected({ source: sourceId }));
+
+    const tasks = source.tasks;
+    const spec = yield* openai.inputSpec;
+    const bytesPerSecond = spec.bytesPerSecond;
+    const targetBytes = Math.round(config.window.targetSeconds * bytesPerSecond);
+    const commitBytes = Math.round(config.window.commitSeconds * bytesPerSecond);
+    const configKey = processingKey(config, sourceId);
+    const generation = yield* AudioSource.streamGeneration;
+    const assertGeneration = AudioSource.streamGeneration.pipe(
+      Effect.filterOrFail(
+        (current) => current === generation,
+        () => new StreamRestartedError()
+      )
+    );
+    const assertConfig = appConfig.get.pipe(
+      Effect.filterOrFail(
+        (current) =>
+          current === config || processingKey(current, sourceId) === configKey,
+        () => new ConfigChangedError()
+      )
+    );
+
+    // The show the window being accumulated belongs to, from the program
+    // guide, and the scheduled end of the last one left behind.
+    const segmentation = yield* ProgramSegmentationConfig;
+    const program = yield* SubscriptionRef.make(
+      segmentation
+        ? yield* stationMetadata.currentProgram(sourceId)
+        : Option.none<Program>()
+    );
+    const endedAt = yield* Ref.make<number | null>(null);
+
+    // Keep the session on this source's commentary instructions, following
+    // prompt edits and show changes for as long as the source is processed.
+    yield* Stream.zipLatest(appConfig.changes, program.changes).pipe(
+      Stream.map(([current, show]) =>
+        withProgram(renderInstructions(current, sourceId), show)
+      ),
+      Stream.changes,
+      Stream.runForEach(openai.setInstructions),
+      Effect.forkScoped
+    );
+    // And on its noise reduction, which a source edit restarts processing to
+    // change.
+    yield* openai.setNoiseReduction(source.noiseReduction ?? null);
+
+    // Between a show's end and the guide listing the next one, the station's
+    // metadata still names the one that ended.
+    const currentProgram = Effect.gen(function* () {
+      const show = yield* SubscriptionRef.get(program);
+      if (Option.isSome(show)) return show.value.show;
+      if ((yield* Ref.get(endedAt)) !== null) return null;
+      return Option.getOrNull(yield* stationMetadata.currentShow(sourceId));
+    });
+    // Every byte received from the source, skipped or not, so offsets match
+    // the position a listener of the same stream has reached.
+    const streamBytes = yield* Ref.make(0);
+    const streamOffsetMs = Ref.get(streamBytes).pipe(
+      Effect.map((n) => Math.round((n / bytesPerSecond) * 1000))
+    );
     const accumulated = yield* Ref.make(0);
+    // Offset at which the window being accumulated started.
+    const windowStartMs = yield* Ref.make(Option.none<number>());
+
+    // On-air times of the window from `startMs` to the current offset, known
+    // once the source has started streaming, and the lag they compensate.
+    const delayMs = (source.delaySeconds ?? 0) * 1000;
+    const windowTimes = (startMs: number) =>
+      Effect.gen(function* () {
+        const endMs = yield* streamOffsetMs;
+        return Option.match(yield* AudioSource.streamOrigin, {
+          onNone: () => ({ windowStart: null, windowEnd: null, delayMs }),
+          onSome: (origin) => ({
+            windowStart: origin + startMs,
+            windowEnd: origin + endMs,
+            delayMs,
+          }),
+        });
+      });
+    // Chunks that reached the processor since the window began, and those
+    // lost on the way: dropped from the queue, or missed while the stream
+    // was restarted.
+    const windowChunks = yield* Ref.make({ received: 0, dropped: 0 });
+    const windowLoss = Effect.gen(function* () {
+      const { received, dropped } = yield* Ref.getAndSet(windowChunks, {
+        received: 0,
+        dropped: 0,
+      });
+      if (dropped === 0) return { lossRatio: 0 };
+      yield* Effect.logWarning(
+        `Window from ${sourceId} is missing ${dropped} of ${received + dropped} audio chunks`
+      );
+      return {
+        lossRatio: Math.round((dropped / (received + dropped)) * 1000) / 1000,
+      };
+    });
+    const lastSeq = yield* Ref.make(-1);
+    // Missed since the previous run on this source, counted with the first
+    // chunk of this one.
+    const previousChunk = yield* Ref.get(lastChunk);
+    const missedSince = (now: number) =>
+      Option.match(previousChunk, {
+        onNone: () => 0,
+        onSome: (last) =>
+          last.source === sourceId
+            ? Math.max(0, Math.floor((now - last.at) / CHUNK_MS) - 1)
+            : 0,
+      });
+    const countChunk = (seq: number) =>
+      Effect.gen(function* () {
+        const now = yield* Clock.currentTimeMillis;
+        yield* Ref.set(lastChunk, Option.some({ source: sourceId, at: now }));
+        const previous = yield* Ref.getAndSet(lastSeq, seq);
+        const dropped =
+          previous === -1 ? seq + missedSince(now) : seq - previous - 1;
+        yield* Ref.update(windowChunks, (w) => ({
+          received: w.received + 1,
+          dropped: w.dropped + dropped,
+        }));
+        return dropped;
+      });
+    const flushesSeen = yield* Ref.make(yield* AudioSource.flushRequests);
+    const wasPaused = yield* Ref.make(false);
     const sinceCommit = yield* Ref.make(0);
 
-    const audioStream = yield* AudioSource.getStream();
+    // The audio of the window being gathered is kept locally so it can be
+    // replayed when OpenAI reports an error about this source's commits or
+    // window responses, instead of losing a whole window of content.
+    const recent = yield* makeRingBuffer(targetBytes);
+    // Windows for the STT fallback while OpenAI's circuit is open.
+    const fallbackAudio = yield* makeRingBuffer(targetBytes);
+    const seenFailures = yield* Ref.make(
+      yield* openai.windowFailures(sourceId)
+    );
+    const retried = yield* Ref.make(false);
+
+    // Defaults of the config's alerts and webhooks, read on every chunk so
+    // edits apply without restarting processing.
+    const deadAir = yield* DeadAirConfig;
+    const silentBytes = yield* Ref.make(0);
+    const deadAirReported = yield* Ref.make(false);
+
+    const musicConfig = yield* MusicConfig;
+    const music = yield* makeMusicDetector(
+      bytesPerSecond,
+      musicConfig.windowSeconds
+    );
+
+    const repeatConfig = yield* RepeatConfig;
+    const repeats = yield* makeRepeatDetector(spec, {
+      historySeconds: repeatConfig.historyMinutes * 60,
+      minSeconds: MIN_REPEAT_SECONDS,
+      maxSeconds: MAX_REPEAT_SECONDS,
+    });
+    // The library version the detector was last given.
+    const libraryVersion = yield* Ref.make(-1);
+
+    // Accumulates levels over each second of stream, paused or not, so
+    // clients can see the station is live before any response arrives.
+    const meter = yield* Ref.make({ stats: EMPTY_LEVEL, bytes: 0 });
+    const meterLevel = (chunk: Buffer, stats: LevelStats) =>
+      Effect.gen(function* () {
+        const second = yield* Ref.modify(meter, (m) => {
+          const next = {
+            stats: addLevelStats(m.stats, stats),
+            bytes: m.bytes + chunk.length,
+          };
+          return next.bytes >= bytesPerSecond
+            ? [Option.some(next.stats), { stats: EMPTY_LEVEL, bytes: 0 }]
+            : [Option.none(), next];
+        });
+        if (Option.isNone(second)) return;
+        const level = {
+          source: sourceId,
+          rmsDbfs: reportedDbfs(rmsDbfs(second.value)),
+          peakDbfs: reportedDbfs(peakDbfs(second.value)),
+          at: yield* Clock.currentTimeMillis,
+        };
+        yield* AudioSource.recordLevel(level);
+        yield* broadcaster.publish({ type: "level", ...level });
+      });
+
+    // Tracks continuous silence and returns true when the chunk should be
+    // withheld from OpenAI.
+    const checkSilence = (chunk: Buffer, stats: LevelStats) =>
+      Effect.gen(function* () {
+        const { alerts, webhooks } = yield* appConfig.get;
+        const thresholdDbfs =
+          alerts.silenceThresholdDbfs ?? deadAir.thresholdDbfs;
+        const deadAirBytes =
+          (alerts.deadAirSeconds ?? deadAir.deadAirSeconds) * bytesPerSecond;
+        const webhookUrl = Option.orElse(
+          Option.fromNullable(webhooks.deadAir),
+          () => deadAir.webhookUrl
+        );
+        const silent = rmsDbfs(stats) < thresholdDbfs;
+        const silence = yield* Ref.updateAndGet(silentBytes, (n) =>
+          silent ? n + chunk.length : 0
+        );
+
+        if (!silent) {
+          if (yield* Ref.getAndSet(deadAirReported, false)) {
+            yield* Effect.log(`Audio resumed on ${sourceId}`);
+          }
+          return false;
+        }
+
+        if (
+          silence >= deadAirBytes &&
+          !(yield* Ref.getAndSet(deadAirReported, true))
+        ) {
+          const silentForMs = Math.round((silence / bytesPerSecond) * 1000);
+          yield* Effect.logWarning(
+            `Dead air on ${sourceId} for ${(silentForMs / 1000).toFixed(1)}s`
+          );
+          yield* broadcaster.publish({
+            type: "dead_air",
+            source: sourceId,
+            silentForMs,
+          });
+          if (Option.isSome(webhookUrl)) {
+            yield* notifyWebhook(webhookUrl.value, {
+              event: "dead_air",
+              source: sourceId,
+              silentForMs,
+            }).pipe(Effect.forkDaemon);
+          }
+        }
+        return silence >= SKIP_SILENCE_SECONDS * bytesPerSecond;
+      });
+
+    // Classifies the audio as music or speech and returns true while a long
+    // music segment is playing, so it isn't paid for.
+    const checkMusic = (chunk: Buffer, stats: LevelStats) =>
+      Effect.gen(function* () {
+        if (!musicConfig.enabled) return false;
+        const change = music.add(
+          {
+            rms: 10 ** (rmsDbfs(stats) / 20),
+            zcr: zeroCrossingRate(spec.format, chunk),
+          },
+          chunk.length
+        );
+        if (change === "started") {
+          yield* Effect.log(`Music on ${sourceId}, skipping until speech`);
+          yield* broadcaster.publish({
+            type: "music_detected",
+            source: sourceId,
+            musicForMs: musicConfig.windowSeconds * 1000,
+          });
+        } else if (change === "ended") {
+          yield* Effect.log(`Speech resumed on ${sourceId}`);
+        }
+        return music.inMusic();
+      });
+
+    // Recognizes segments that aired before, learning those heard twice,
+    // and returns true while one that isn't kept is playing with
+    // SKIP_REPEATS.
+    const checkRepeat = (chunk: Buffer) =>
+      Effect.gen(function* () {
+        const library = yield* fingerprints.library;
+        const seen = yield* Ref.getAndSet(libraryVersion, library.version);
+        if (seen !== library.version) repeats.setLibrary(library.entries);
+        const skips = (id: string | null) =>
+          repeatConfig.skip && (id === null || !library.kept.has(id));
+        for (const event of repeats.add(chunk)) {
+          if (event.type !== "ended") continue;
+          const { durationMs, learned } = event;
+          const known =
+            event.fingerprint !== null
+              ? yield* fingerprints.recognized(event.fingerprint)
+              : learned !== null
+                ? Option.some(
+                    yield* fingerprints.learn(sourceId, learned, durationMs)
+                  )
+                : Option.none();
+          if (Option.isNone(known)) continue;
+          const offset = yield* streamOffsetMs;
+          const { windowStart, windowEnd } = yield* windowTimes(
+            offset - durationMs
+          );
+          const fingerprint = known.value;
+          yield* Effect.log(
+            `${event.fingerprint === null ? "Learned" : "Recognized"} ${fingerprint.id} on ${sourceId} (${(durationMs / 1000).toFixed(1)}s)`
+          );
+          yield* broadcaster.publish({
+            type: "repeated_segment",
+            source: sourceId,
+            fingerprint: fingerprint.id,
+            label: fingerprint.label,
+            skipped: skips(event.fingerprint),
+            startedAt: windowStart,
+            endedAt: windowEnd,
+            durationMs,
+          });
+        }
+        return repeats.inRepeat() && skips(repeats.fingerprint());
+      }).pipe(
+        Effect.catchTag("FingerprintStoreError", (e) =>
+          Effect.logError("Failed to store fingerprint", e.message).pipe(
+            Effect.as(false)
+          )
+        )
+      );
+
+    const replayWindow = Effect.gen(function* () {
+      const failures = yield* openai.windowFailures(sourceId);
+      if (failures === (yield* Ref.getAndSet(seenFailures, failures))) return;
+      if (yield* Ref.getAndSet(retried, true)) return;
+      if (recent.size() < commitBytes) return;
+
+      yield* Effect.logWarning(
+        `Replaying ${(recent.size() / bytesPerSecond).toFixed(1)}s of audio after OpenAI error`
+      );
+      yield* openai.clearBuffer();
+      yield* Effect.forEach(recent.read(), openai.appendAudio);
+      const offset = yield* streamOffsetMs;
+      yield* openai.requestResponse({
+        tasks,
+        source: sourceId,
+        audioOffsetMs: offset,
+        program: yield* currentProgram,
+        ...(yield* windowTimes(
+          offset - Math.round((recent.size() / bytesPerSecond) * 1000)
+        )),
+        ...(yield* windowLoss),
+      });
+      yield* Ref.set(accumulated, 0);
+      yield* Ref.set(windowStartMs, Option.none());
+      yield* Ref.set(sinceCommit, 0);
+    });
+
+    const requestWindow = (acc: number) =>
+      Effect.gen(function* () {
+        yield* Effect.log(
+          `Requesting response (${(acc / bytesPerSecond).toFixed(1)}s of audio)`
+        );
+        const offset = yield* streamOffsetMs;
+        const startMs = yield* Ref.getAndSet(windowStartMs, Option.none());
+        yield* openai.requestResponse({
+          tasks,
+          source: sourceId,
+          audioOffsetMs: offset,
+          program: yield* currentProgram,
+          ...(yield* windowTimes(Option.getOrElse(startMs, () => offset))),
+          ...(yield* windowLoss),
+        });
+        yield* Ref.set(accumulated, 0);
+        yield* Ref.set(sinceCommit, 0);
+        yield* Ref.set(retried, false);
+        // The next replay is of the next window only; this one is answered.
+        recent.clear();
+      });
+
+    // At a change of show, the audio gathered so far is responded to on its
+    // own, and the next windows start from a fresh context: the commentary
+    // of the previous show is forgotten and the instructions name the new
+    // one. A scheduled end is followed as the audio reaches it, a lookup
+    // catching up notwithstanding; without one, the guide changing shows
+    // is the change.
+    const checkProgram = Effect.gen(function* () {
+      const ended = yield* Ref.get(endedAt);
+      // The show that just ended is still listed until the lookup catches up.
+      const listed = Option.filter(
+        yield* stationMetadata.currentProgram(sourceId),
+        (p) => ended === null || p.endsAt !== ended
+      );
+      const current = yield* SubscriptionRef.get(program);
+      if (Option.isNone(current)) {
+        if (Option.isSome(listed)) yield* SubscriptionRef.set(program, listed);
+        return;
+      }
+      const { show, endsAt } = current.value;
+      const offset = yield* streamOffsetMs;
+      const onAir = Option.map(
+        yield* AudioSource.streamOrigin,
+        (origin) => origin + offset
+      );
+      if (endsAt !== null) {
+        if (!Option.exists(onAir, (at) => at >= endsAt)) return;
+      } else if (!Option.exists(listed, (p) => p.show !== show)) {
+        return;
+      }
+      const next = Option.filter(
+        listed,
+        (p) => p.show !== show || p.endsAt !== endsAt
+      );
+      const acc = yield* Ref.get(accumulated);
+      if (acc > 0) yield* requestWindow(acc);
+      yield* Ref.set(endedAt, endsAt);
+      yield* SubscriptionRef.set(program, next);
+      yield* openai.endProgram(sourceId, show);
+      const started = Option.map(next, (p) => p.show);
+      yield* Effect.log(
+        `${show} ended on ${sourceId}` +
+          Option.match(started, {
+            onNone: () => "",
+            onSome: (s) => `, now ${s}`,
+          })
+      );
+      yield* broadcaster.publish({
+        type: "program_changed",
+        source: sourceId,
+        previous: show,
+        program: Option.getOrNull(started),
+        at: Option.getOrNull(onAir),
+      });
+      if (Option.isNone(next)) {
+        yield* stationMetadata.refresh(sourceId).pipe(Effect.forkScoped);
+      }
+    });
+
+    const feedFallback = (chunk: Uint8Array) =>
+      Effect.gen(function* () {
+        fallbackAudio.write(chunk);
+        if (fallbackAudio.size() < targetBytes) return;
+        const audio = Buffer.concat(fallbackAudio.read());
+        fallbackAudio.clear();
+        const offset = yield* streamOffsetMs;
+        yield* fallback
+          .transcribeWindow({
+            source: sourceId,
+            spec,
+            audio,
+            audioOffsetMs: offset,
+            program: yield* currentProgram,
+            ...(yield* windowTimes(
+              offset - Math.round((audio.length / bytesPerSecond) * 1000)
+            )),
+            ...(yield* windowLoss),
+          })
+          .pipe(Effect.forkScoped);
+      });
+
+    const reportCorruption = (kind: ChunkCorruption) =>
+      Effect.gen(function* () {
+        yield* events.publish(
+          PipelineEvent.ChunkCorrupted({ source: sourceId, kind })
+        );
+        // Reads ending mid-sample are common and harmless once realigned.
+        yield* kind === "odd_length"
+          ? Effect.logDebug(`Realigned odd-length chunk on ${sourceId}`)
+          : Effect.logWarning(`Corrupted chunk on ${sourceId}: ${kind}`);
+      });
+
+    // 16-bit PCM is kept in step with its samples before anything reads it.
+    const align = spec.format === "pcm" ? makeChunkAligner() : null;
+    const checkCrc = yield* ChunkCrcConfig;
+    // Numbered and placed as read, before the queue, so chunks dropped from
+    // it show as gaps and don't shift the offsets of the ones after.
+    const queueSeconds = yield* AudioQueueConfig;
+    const queueCapacity = Math.max(1, (queueSeconds * 1000) / CHUNK_MS);
+    const lastRead = yield* Ref.make(0);
+    const audioStream = (yield* AudioSource.getStream(spec)).pipe(
+      Stream.mapEffect((chunk) =>
+        Effect.gen(function* () {
+          if (!align) return chunk;
+          const aligned = align(chunk);
+          if (aligned.chunk !== chunk) yield* AudioSource.releaseChunk(chunk);
+          if (aligned.corruption) yield* reportCorruption(aligned.corruption);
+          return aligned.chunk;
+        })
+      ),
+      Stream.filter((chunk) => chunk.length > 0),
+      Stream.mapAccum({ seq: 0, end: 0 }, (read, chunk) => {
+        const next = { seq: read.seq + 1, end: read.end + chunk.length };
+        const crc = checkCrc ? chunkCrc(chunk) : null;
+        return [next, { chunk, crc, seq: read.seq, end: next.end }];
+      }),
+      Stream.tap(({ seq }) => Ref.set(lastRead, seq)),
+      Stream.buffer({ capacity: queueCapacity, strategy: "sliding" }),
+      // Dropped, and counted as lost by the next one's numbering. Its buffer
+      // isn't returned to the pool, as something else may hold it.
+      Stream.filterEffect(({ chunk, crc }) =>
+        crc === null || chunkCrc(chunk) === crc
+          ? Effect.succeed(true)
+          : reportCorruption("checksum").pipe(Effect.as(false))
+      )
+    );
     yield* audioStream.pipe(
-      Stream.runForEach((chunk) =>
+      Stream.runForEach(({ chunk, seq, end }) =>
         Effect.gen(function* () {
           yield* assertSource(sourceId);
-          yield* openai.appendAudio(chunk.toString("base64"));
+          yield* assertConfig;
+          yield* assertGeneration;
+          yield* Ref.set(streamBytes, end);
+          yield* events.publish(
+            PipelineEvent.ChunkProduced({
+              source: sourceId,
+              bytes: chunk.length,
+              dropped: yield* countChunk(seq),
+              queued: Math.min(queueCapacity, (yield* Ref.get(lastRead)) - seq),
+              queueCapacity,
+            })
+          );
+          const stats = levelStats(spec.format, chunk);
+          yield* meterLevel(chunk, stats);
+          if (segmentation) yield* checkProgram;
+          // Paused by the user, idle without listeners or over the source's
+          // daily budget: keep reading the source but send nothing, and drop
+          // the partial window so it isn't mixed with later audio. Idle can
+          // stop the stream instead.
+          const idling = yield* idle.isIdle;
+          if (idling && idle.stopsStream) return yield* new IdleError();
+          if (
+            idling ||
+            (yield* AudioSource.processingPaused) ||
+            (yield* budgets.exceeded(sourceId))
+          ) {
+            if (!(yield* Ref.getAndSet(wasPaused, true))) {
+              yield* Effect.log(`Processing paused on ${sourceId}`);
+              yield* openai.clearBuffer();
+              recent.clear();
+              fallbackAudio.clear();
+              yield* Ref.set(silentBytes, 0);
+              music.reset();
+              repeats.reset();
+              yield* Ref.set(accumulated, 0);
+              yield* Ref.set(windowStartMs, Option.none());
+              yield* Ref.set(sinceCommit, 0);
+              yield* Ref.set(windowChunks, { received: 0, dropped: 0 });
+            }
+            return;
+          }
+          if (yield* Ref.getAndSet(wasPaused, false)) {
+            yield* Effect.log(`Processing resumed on ${sourceId}`);
+          }
+          // While the circuit is open, audio goes to the STT fallbacks if
+          // any, or is dropped; nothing stale is replayed once it closes.
+          if (yield* openai.paused) {
+            recent.clear();
+            yield* Ref.set(
+              seenFailures,
+              yield* openai.windowFailures(sourceId)
+            );
+            yield* Ref.set(accumulated, 0);
+            yield* Ref.set(windowStartMs, Option.none());
+            yield* Ref.set(sinceCommit, 0);
+            if (fallback.enabled) yield* feedFallback(chunk);
+            return;
+          }
+          fallbackAudio.clear();
+          yield* fallback.useOpenAI;
+          yield* replayWindow;
+          // Heard before silence or music can withhold the chunk, so the
+          // fingerprints stay aligned with the stream.
+          const repeated = yield* checkRepeat(chunk);
+          if (yield* checkSilence(chunk, stats)) return;
+          if (yield* checkMusic(chunk, stats)) return;
+          if (repeated) return;
+          if (Option.isNone(yield* Ref.get(windowStartMs))) {
+            const chunkMs = Math.round((chunk.length / bytesPerSecond) * 1000);
+            yield* Ref.set(
+              windowStartMs,
+              Option.some((yield* streamOffsetMs) - chunkMs)
+            );
+          }
+          yield* openai.appendAudio(chunk);
+          recent.write(chunk);
 
           const acc = yield* Ref.updateAndGet(accumulated, (n) => n + chunk.length);
           const since = yield* Ref.updateAndGet(sinceCommit, (n) => n + chunk.length);
 
-          if (since >= COMMIT_BYTES && acc < TARGET_BYTES) {
-            yield* openai.commitBuffer();
+          if (since >= commitBytes && acc < targetBytes) {
+            yield* openai.commitBuffer({
+              source: sourceId,
+              audioOffsetMs: yield* streamOffsetMs,
+            });
             yield* Ref.set(sinceCommit, 0);
           }
 
-          if (acc >= TARGET_BYTES) {
-            yield* Effect.log(
-              `Requesting response (${(acc / BYTES_PER_SECOND).toFixed(1)}s of audio)`
-            );
-            yield* openai.commitBuffer();
-            yield* openai.requestResponse();
-            yield* Ref.set(accumulated, 0);
-            yield* Ref.set(sinceCommit, 0);
-          }
-        })
+          // Closes the window early when asked, e.g. at the end of a
+          // listening session.
+          const flushes = yield* AudioSource.flushRequests;
+          const flush =
+            (yield* Ref.getAndSet(flushesSeen, flushes)) !== flushes;
+
+          if (acc >= targetBytes || flush) yield* requestWindow(acc);
+        }).pipe(Effect.ensuring(AudioSource.releaseChunk(chunk)))
       )
     );
+
+    // Changes of source or settings end the run with an error, so a stream
+    // that ends on its own means ffmpeg exited: the station dropped the
+    // connection, or never answered if no audio came through. The processor
+    // starts it again a second later. A source waiting for pushed audio
+    // ends its stream when deselected, and one whose sender disconnected
+    // waits for the next.
+    yield* assertSource(sourceId);
+    if (sourceType(source) === "websocket") {
+      yield* Effect.log(`Audio stopped being pushed to ${source.name}`);
+      return;
+    }
+    const received = yield* Ref.get(streamBytes);
+    const error =
+      received === 0
+        ? pipelineError(
+            "source_unreachable",
+            `No audio could be read from ${source.name}`,
+            { source: sourceId, retryInMs: 1000 }
+          )
+        : pipelineError(
+            "ffmpeg_exit",
+            `ffmpeg stopped reading ${source.name} after ${(received / bytesPerSecond).toFixed(0)}s`,
+            { source: sourceId, retryInMs: 1000 }
+          );
+    yield* Effect.logWarning(error.message);
+    yield* broadcaster.publish({ type: "error", ...error });
+    yield* events.publish(PipelineEvent.Error(error));
   }).pipe(
-    Effect.catchTag("SourceClearedError", () =>
-      Effect.log("Source cleared, stopping audio processing")
-    )
+    Effect.scoped,
+    Effect.catchTags({
+      SourceClearedError: () =>
+        Effect.log("Source changed, stopping audio processing").pipe(
+          Effect.zipRight(Ref.set(lastChunk, Option.none())),
+          Effect.zipRight(
+            OpenAIRealtime.pipe(Effect.flatMap((o) => o.cancelResponses()))
+          )
+        ),
+      ConfigChangedError: () =>
+        Effect.log("Configuration changed, restarting audio processing"),
+      IdleError: () =>
+        Effect.log(
+          "Idle, stopping the audio stream until a listener is back"
+        ).pipe(Effect.zipRight(Ref.set(lastChunk, Option.none()))),
+      // Audio buffered from the live edge must not be mixed with the replay.
+      StreamRestartedError: () =>
+        Effect.log("Catching up, restarting audio processing").pipe(
+          Effect.zipRight(Ref.set(lastChunk, Option.none())),
+          Effect.zipRight(
+            OpenAIRealtime.pipe(Effect.flatMap((o) => o.clearBuffer()))
+          )
+        ),
+      // Processing starts over a second later, connecting again.
+      OpenAIConnectionError: (e) =>
+        Effect.gen(function* () {
+          const error = pipelineError("openai_error", e.message, {
+            source: sourceId,
+            retryInMs: 1000,
+          });
+          yield* Effect.logWarning(error.message, e.cause);
+          const broadcaster = yield* Broadcaster;
+          const events = yield* PipelineEvents;
+          yield* broadcaster.publish({ type: "error", ...error });
+          yield* events.publish(PipelineEvent.Error(error));
+        }),
+    }),
+    // Interruption, e.g. on shutdown, isn't a failure. Failing to start
+    // ffmpeg is the only expected one.
+    Effect.tapErrorCause((cause) => {
+      if (Cause.isInterruptedOnly(cause)) return Effect.void;
+      const squashed = Cause.squash(cause);
+      const error = pipelineError(
+        Predicate.isTagged(squashed, "SystemError") ||
+          Predicate.isTagged(squashed, "BadArgument")
+          ? "ffmpeg_exit"
+          : "internal",
+        squashed instanceof Error ? squashed.message : String(squashed),
+        { source: sourceId }
+      );
+      return Effect.gen(function* () {
+        const broadcaster = yield* Broadcaster;
+        const events = yield* PipelineEvents;
+        yield* broadcaster.publish({ type: "error", ...error });
+        yield* events.publish(PipelineEvent.Error(error));
+      });
+    })
   );
 
 const waitForSource = AudioSource.currentSource.pipe(
@@ -65,14 +858,18 @@ const waitForSource = AudioSource.currentSource.pipe(
   Effect.retry(Schedule.spaced("1 second"))
 );
 
+// The ffmpeg reader runs inside the processor, so a crash of either restarts
+// both, with the supervisor's backoff.
 export const runAudioProcessor = Effect.gen(function* () {
   yield* Effect.log("Audio processor initialized, waiting for source selection...");
+  const supervisor = yield* PipelineSupervisor;
+  const idle = yield* IdleMonitor;
+  const lastChunk = yield* Ref.make(Option.none<LastChunk>());
 
-  yield* waitForSource.pipe(
-    Effect.flatMap(processAudio),
-    Effect.catchAllCause((cause) =>
-      Effect.logError("Audio processing failed, restarting...", cause)
-    ),
-    Effect.repeat(Schedule.spaced("1 second"))
+  yield* (idle.stopsStream ? idle.awaitActive : Effect.void).pipe(
+    Effect.zipRight(waitForSource),
+    Effect.flatMap((sourceId) => processAudio(sourceId, lastChunk)),
+    Effect.repeat(Schedule.spaced("1 second")),
+    (processor) => supervisor.supervise("processor", processor)
   );
 });
@@ -1,46 +1,201 @@
 import {
   Command,
   CommandExecutor,
+  HttpClient,
+  HttpClientResponse,
   Error as PlatformError,
 } from "@effect/platform";
-import { Effect, Option, Ref, Sink, Stream } from "effect";
-
-export const AUDIO_SOURCES = {
-  franceinfo: {
-    name: "France Info",
-    url: "https://stream.radiofrance.fr/franceinfo/franceinfo_hifi.m3u8",
-  },
-  franceinter: {
-    name: "France Inter",
-    url: "https://stream.radiofrance.fr/franceinter/franceinter_hifi.m3u8",
-  },
-  franceculture: {
-    name: "France Culture",
-    url: "https://stream.radiofrance.fr/franceculture/franceculture_hifi.m3u8",
-  },
-} as const;
-
-export type AudioSourceId = keyof typeof AUDIO_SOURCES;
-
-export const BYTES_PER_SECOND = 24000 * 2;
-const BATCH_THRESHOLD = Math.floor(BYTES_PER_SECOND / 50);
-
-const batchByBytes = <E, R>(stream: Stream.Stream<Uint8Array, E, R>) =>
-  stream.pipe(
-    Stream.transduce(
-      Sink.foldWeighted({
-        initial: [] as Uint8Array[],
-        maxCost: BATCH_THRESHOLD,
-        cost: (chunk) => chunk.length,
-        body: (acc, chunk) => [...acc, chunk],
-      })
-    ),
-    Stream.map((chunks) => Buffer.concat(chunks))
-  );
+import {
+  Clock,
+  Config,
+  Data,
+  Effect,
+  Option,
+  Ref,
+  Schedule,
+  Sink,
+  Stream,
+} from "effect";
+import {
+  AppConfig,
+  sourceType,
+  type SourceConfig,
+  type SourceType,
+} from "./AppConfig.js";
+import { inputFormatSpec, type InputFormatSpec } from "./AudioFormat.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { makeBufferPool, type BufferPool } from "./BufferPool.js";
+import {
+  audioFixture,
+  DevReplayConfig,
+  isRecording,
+  isReplaying,
+  recordAudio,
+  replayAudio,
+  resetFixture,
+} from "./DevReplay.js";
+import { HlsCacheConfig, startHlsCache } from "./HlsCache.js";
+import {
+  resolveRewind,
+  resolveVariant,
+  type HlsVariant,
+  type Rewind,
+} from "./HlsVariants.js";
+import type { AudioLevelReading } from "./Messages.js";
+import {
+  makeSourceHealth,
+  SourceHealthConfig,
+  type StreamFailure,
+} from "./SourceHealth.js";
+import {
+  makeSelectionLog,
+  SelectionFileConfig,
+  type SelectionReason,
+} from "./SourceSelection.js";
+import {
+  makeRemoteAudio,
+  remoteInputArgs,
+  remoteSampleRate,
+  type RemoteParams,
+} from "./RemoteAudio.js";
+
+export type AudioSourceId = string;
+
+// Binaries to run, for installs outside PATH or custom builds.
+export const FfmpegConfig = Config.all({
+  ffmpeg: Config.string("FFMPEG_PATH").pipe(Config.withDefault("ffmpeg")),
+  ffprobe: Config.string("FFPROBE_PATH").pipe(Config.withDefault("ffprobe")),
+});
+
+export type FfmpegConfig = Config.Config.Success<typeof FfmpegConfig>;
+
+export class SourceProbeError extends Data.TaggedError("SourceProbeError")<{
+  message: string;
+}> {}
+
+class StreamStalledError extends Data.TaggedError("StreamStalledError") {}
+
+// HTTP headers of a source's requests, as for ffmpeg and the playlist client.
+const sourceHeaders = (source: SourceConfig): Record<string, string> => ({
+  ...source.headers,
+  ...(source.userAgent && { "User-Agent": source.userAgent }),
+});
+
+const HTTP_TYPES: ReadonlyArray<SourceType> = ["hls", "icy", "dash"];
 
-const ffmpegStream = (url: string) =>
+// ffmpeg/ffprobe options sending a source's headers, for sources read over
+// HTTP.
+const headerArgs = (source: SourceConfig) => {
+  const headers = Object.entries(sourceHeaders(source));
+  return headers.length === 0 || !HTTP_TYPES.includes(sourceType(source))
+    ? []
+    : ["-headers", headers.map(([k, v]) => `${k}: ${v}\r\n`).join("")];
+};
+
+// ffmpeg input options for each type of source. ICY servers drop idle
+// listeners and restart streams, so their connection is reopened; their
+// metadata is read by StationMetadata, not ffmpeg. DASH manifests don't
+// always end in .mpd, so the demuxer is forced. Files are read in real time,
+// like a broadcast, and RTSP goes over TCP, which gets through NAT and
+// firewalls where UDP doesn't. Pushed audio takes its connection's options.
+const typeArgs: Record<SourceType, ReadonlyArray<string>> = {
+  hls: [],
+  icy: [
+    "-icy",
+    "0",
+    "-reconnect",
+    "1",
+    "-reconnect_streamed",
+    "1",
+    "-reconnect_delay_max",
+    "5",
+  ],
+  dash: ["-f", "dash"],
+  file: ["-re"],
+  rtsp: ["-rtsp_transport", "tcp"],
+  websocket: [],
+};
+
+// Options for ffprobe, which has no -re or reconnection.
+const probeArgs = (source: SourceConfig) => [
+  ...headerArgs(source),
+  ...(sourceType(source) === "rtsp" ? typeArgs.rtsp : []),
+];
+
+// Batches hold 20ms of audio; pooled buffers are sized for the largest format.
+const batchBytes = (spec: InputFormatSpec) =>
+  Math.floor(spec.bytesPerSecond / 50);
+const BATCH_THRESHOLD = batchBytes(inputFormatSpec("pcm"));
+// Seconds of level readings kept for GET /levels.
+const LEVEL_HISTORY = 60;
+
+const concatInto = (pool: BufferPool, chunks: Uint8Array[]) => {
+  const length = chunks.reduce((n, chunk) => n + chunk.length, 0);
+  const out = pool.acquire(length);
+  let offset = 0;
+  for (const chunk of chunks) {
+    out.set(chunk, offset);
+    offset += chunk.length;
+  }
+  return out;
+};
+
+export const batchByBytes =
+  (pool: BufferPool, maxBytes: number) =>
+  <E, R>(stream: Stream.Stream<Uint8Array, E, R>) =>
+    stream.pipe(
+      Stream.transduce(
+        Sink.foldWeighted({
+          initial: [] as Uint8Array[],
+          maxCost: maxBytes,
+          cost: (chunk) => chunk.length,
+          body: (acc, chunk) => [...acc, chunk],
+        })
+      ),
+      Stream.map((chunks) => concatInto(pool, chunks))
+    );
+
+// EBU R128 loudness normalization, so quiet stations and loud ads reach the
+// model at about the same level. The filter looks ahead a few hundred
+// milliseconds, which is the latency it adds.
+const LOUDNORM_FILTER = "loudnorm=I=-16:TP=-1.5:LRA=11";
+
+// Automatic gain control over 150ms frames, smoothed across 15 of them; the
+// filter holds about a second of audio back.
+const AGC_FILTER = "dynaudnorm=f=150:g=15";
+
+// A source's preprocessing, then loudness normalization, which then works on
+// the filtered signal.
+const sourceFilters = (source: SourceConfig) => [
+  ...(source.preprocessing?.highpassHz !== undefined
+    ? [`highpass=f=${source.preprocessing.highpassHz}`]
+    : []),
+  ...(source.preprocessing?.agc ? [AGC_FILTER] : []),
+  ...(source.normalizeLoudness ? [LOUDNORM_FILTER] : []),
+];
+
+// How a source's audio is filtered, for the log line starting its stream.
+const filtersNote = (source: SourceConfig) =>
+  [
+    source.preprocessing?.highpassHz !== undefined &&
+      `, high-passed at ${source.preprocessing.highpassHz} Hz`,
+    source.preprocessing?.agc && ", gain controlled",
+    source.normalizeLoudness && ", loudness normalized",
+  ]
+    .filter((note) => typeof note === "string")
+    .join("");
+
+const ffmpegStream = (
+  bin: FfmpegConfig,
+  url: string,
+  spec: InputFormatSpec,
+  pool: BufferPool,
+  inputArgs: ReadonlyArray<string> = [],
+  filters: ReadonlyArray<string> = [],
+  stdin: Stream.Stream<Uint8Array> | null = null
+) =>
   Command.make(
-    "ffmpeg",
+    bin.ffmpeg,
     "-fflags",
     "+nobuffer",
     "-flags",
@@ -49,42 +204,591 @@ const ffmpegStream = (url: string) =>
     "32",
     "-analyzeduration",
     "0",
+    ...inputArgs,
     "-i",
     url,
-    "-f",
-    "s16le",
-    "-ar",
-    "24000",
-    "-ac",
-    "1",
+    ...(filters.length > 0 ? ["-af", filters.join(",")] : []),
+    ...spec.ffmpegArgs,
     "-flush_packets",
     "1",
     "-"
-  ).pipe(Command.stream, batchByBytes);
+  ).pipe(
+    (command) => (stdin ? Command.stdin(command, stdin) : command),
+    Command.stream,
+    batchByBytes(pool, batchBytes(spec))
+  );
+
+// Duration of a media file in seconds, if ffprobe can tell.
+const probeDuration = (bin: FfmpegConfig, path: string) =>
+  Command.make(
+    bin.ffprobe,
+    "-v",
+    "error",
+    "-show_entries",
+    "format=duration",
+    "-of",
+    "csv=p=0",
+    path
+  ).pipe(
+    Command.string,
+    Effect.map((out) => Number.parseFloat(out)),
+    Effect.map((seconds) =>
+      Number.isFinite(seconds) ? Option.some(seconds) : Option.none()
+    ),
+    Effect.orElseSucceed(() => Option.none<number>())
+  );
+
+// Sample rate of the first audio stream, if ffprobe can tell.
+const probeSampleRate = (
+  bin: FfmpegConfig,
+  url: string,
+  inputArgs: ReadonlyArray<string>
+) =>
+  Command.make(
+    bin.ffprobe,
+    "-v",
+    "error",
+    ...inputArgs,
+    "-select_streams",
+    "a:0",
+    "-show_entries",
+    "stream=sample_rate",
+    "-of",
+    "csv=p=0",
+    url
+  ).pipe(
+    Command.string,
+    Effect.map((out) => Number.parseInt(out, 10)),
+    Effect.map((rate) => (rate > 0 ? Option.some(rate) : Option.none())),
+    Effect.timeout("15 seconds"),
+    Effect.orElseSucceed(() => Option.none<number>())
+  );
+
+// Whether ffprobe can open a source, e.g. a file that exists or an RTSP
+// server that answers.
+const probeReadable = (
+  bin: FfmpegConfig,
+  url: string,
+  inputArgs: ReadonlyArray<string>
+) =>
+  Command.make(
+    bin.ffprobe,
+    "-v",
+    "error",
+    ...inputArgs,
+    "-show_entries",
+    "format=format_name",
+    "-of",
+    "csv=p=0",
+    url
+  ).pipe(
+    Command.exitCode,
+    Effect.flatMap((code) =>
+      code === 0
+        ? Effect.void
+        : Effect.fail(`ffprobe exited with code ${code}`)
+    )
+  );
 
 export class AudioSource extends Effect.Service<AudioSource>()("AudioSource", {
   accessors: true,
-  effect: Effect.gen(function* () {
+  scoped: Effect.gen(function* () {
     const executor = yield* CommandExecutor.CommandExecutor;
+    const httpClient = yield* HttpClient.HttpClient;
+    const config = yield* AppConfig;
     const sourceRef = yield* Ref.make(Option.none<AudioSourceId>());
+    const pausedRef = yield* Ref.make(false);
+    const variantRef = yield* Ref.make(Option.none<HlsVariant>());
+    // Native sample rate of the selected source, probed once its stream starts.
+    const sourceRateRef = yield* Ref.make(Option.none<number>());
+    // When the first byte of the stream last started went on air.
+    const originRef = yield* Ref.make(Option.none<number>());
+    const levelsRef = yield* Ref.make<ReadonlyArray<AudioLevelReading>>([]);
+    // Catch-up requested for the next start of a source's stream, and a
+    // counter bumped on each request so the running stream gets restarted.
+    const rewindRef = yield* Ref.make(
+      Option.none<{ source: AudioSourceId; rewind: Rewind }>()
+    );
+    const generationRef = yield* Ref.make(0);
+    // Bumped to make the processor close its current window early.
+    const flushRef = yield* Ref.make(0);
+    const catchUpSpeed = yield* Config.number("CATCHUP_SPEED").pipe(
+      Config.withDefault(4)
+    );
+    const bin = yield* FfmpegConfig;
+    const pool = yield* makeBufferPool(BATCH_THRESHOLD);
+    const devReplay = yield* DevReplayConfig;
+    const scope = yield* Effect.scope;
+    // Fixtures recorded so far in this run; each is reset once.
+    const recordedFixtures = new Set<string>();
+    const remote = yield* makeRemoteAudio;
+    const selectionLog = yield* makeSelectionLog(yield* SelectionFileConfig);
+    // Serialized so the log records changes in the order they were made.
+    const selectLock = yield* Effect.makeSemaphore(1);
+    const hlsCacheMb = yield* HlsCacheConfig;
+    const hlsCache =
+      hlsCacheMb > 0 ? yield* startHlsCache(hlsCacheMb * 1024 * 1024) : null;
+    const broadcaster = yield* Broadcaster;
+    const healthConfig = yield* SourceHealthConfig;
+    const health = yield* makeSourceHealth(healthConfig.threshold);
+
+    const sources = config.get.pipe(Effect.map((c) => c.sources));
+    const findSource = (id: AudioSourceId) =>
+      sources.pipe(
+        Effect.map((all) => Option.fromNullable(all.find((s) => s.id === id)))
+      );
+
+    // Counts how a stream read from `url` ends against that URL's health:
+    // on its own, or once it has produced nothing for STREAM_STALL_SECONDS.
+    // Interruptions are the reader's doing, and files end anyway.
+    const watchHealth = <A>(
+      source: SourceConfig,
+      url: string,
+      stream: Stream.Stream<A, PlatformError.PlatformError>
+    ) => {
+      if (sourceType(source) === "file") return stream;
+      const report = (kind: StreamFailure) =>
+        health.report(source, url, kind).pipe(
+          Effect.flatMap((score) =>
+            Effect.logWarning(
+              `${source.name} stream ${kind} on ${url}, health ${score}`
+            )
+          )
+        );
+      let received = false;
+      return stream.pipe(
+        Stream.tap(() =>
+          Effect.sync(() => {
+            received = true;
+          })
+        ),
+        Stream.concat(
+          Stream.execute(
+            Effect.suspend(() => report(received ? "exited" : "unreachable"))
+          )
+        ),
+        Stream.timeoutFail(
+          () => new StreamStalledError(),
+          `${healthConfig.stallSeconds} seconds`
+        ),
+        Stream.catchTag("StreamStalledError", () =>
+          Stream.execute(report("stalled"))
+        )
+      );
+    };
+
+    // Started from the source's healthiest URL; a change of URL is
+    // broadcast.
+    const startStream = (
+      configured: SourceConfig,
+      spec: InputFormatSpec,
+      rewind?: Rewind
+    ) =>
+      Effect.gen(function* () {
+        const picked = yield* health.pick(configured);
+        if (picked.replaced !== null) {
+          yield* Effect.logWarning(
+            `${configured.name} failing over from ${picked.replaced} to ${picked.url}`
+          );
+          yield* broadcaster.publish({
+            type: "failover",
+            source: configured.id,
+            from: picked.replaced,
+            to: picked.url,
+            score: picked.score,
+          });
+        }
+        // Backups are read as the type the main URL gives.
+        const source = {
+          ...configured,
+          type: sourceType(configured),
+          url: picked.url,
+        };
+        const type = sourceType(source);
+        // Only HLS playlists have renditions to choose from.
+        const variant: HlsVariant =
+          type === "hls"
+            ? yield* resolveVariant(
+                source.url,
+                source.maxBitrate,
+                sourceHeaders(source)
+              ).pipe(Effect.provideService(HttpClient.HttpClient, httpClient))
+            : { url: source.url, bandwidth: null };
+        // What ffmpeg reads, through the segment cache if it is on.
+        const input =
+          type === "hls" && hlsCache ? hlsCache.url(variant.url) : variant.url;
+        yield* Effect.log(
+          `Starting audio stream from ${source.name}` +
+            (variant.bandwidth
+              ? ` (${Math.round(variant.bandwidth / 1000)} kb/s rendition)`
+              : "") +
+            (rewind ? `, ${Math.round(rewind.seconds)}s behind live` : "") +
+            filtersNote(source)
+        );
+        // Past segments are read faster than real time, so the backlog is
+        // worked through while still pacing responses.
+        const catchUpArgs = rewind
+          ? [
+              "-live_start_index",
+              String(rewind.startIndex),
+              "-readrate",
+              String(catchUpSpeed),
+            ]
+          : [];
+        const stream = ffmpegStream(
+          bin,
+          input,
+          spec,
+          pool,
+          [
+            ...headerArgs(source),
+            ...typeArgs[type],
+            ...(source.ffmpegArgs ?? []),
+            ...catchUpArgs,
+          ],
+          sourceFilters(source)
+        ).pipe(
+          Stream.provideService(CommandExecutor.CommandExecutor, executor),
+          (stream) => watchHealth(source, source.url, stream)
+        );
+        return { variant, input, stream };
+      });
+
+    // Audio pushed to a websocket source, decoded by ffmpeg from its stdin
+    // until the connection ends. Waits for one, as long as `wanted` holds;
+    // none once it no longer does.
+    const startRemoteStream = (
+      source: SourceConfig,
+      spec: InputFormatSpec,
+      wanted: Effect.Effect<boolean>
+    ) =>
+      Effect.gen(function* () {
+        const current = yield* remote.current(source.id);
+        if (Option.isNone(current)) {
+          yield* Effect.log(`Waiting for audio to be pushed to ${source.name}`);
+        }
+        const connection = yield* remote.current(source.id).pipe(
+          Effect.flatMap((c) =>
+            Option.isSome(c)
+              ? Effect.succeed(c)
+              : Effect.flatMap(wanted, (w) =>
+                  w ? Effect.fail("waiting" as const) : Effect.succeed(c)
+                )
+          ),
+          Effect.retry(Schedule.spaced("1 second")),
+          Effect.orDie
+        );
+        if (Option.isNone(connection)) return Option.none();
+        const { params, frames } = connection.value;
+        yield* Effect.log(
+          `Receiving ${params.format} audio for ${source.name}` +
+            filtersNote(source)
+        );
+        const stream = ffmpegStream(
+          bin,
+          "pipe:0",
+          spec,
+          pool,
+          [...remoteInputArgs(params), ...(source.ffmpegArgs ?? [])],
+          sourceFilters(source),
+          frames
+        ).pipe(
+          Stream.provideService(CommandExecutor.CommandExecutor, executor)
+        );
+        return Option.some({ params, stream });
+      });
+
+    // Each change is logged with who made it and why.
+    const setSource = (
+      id: AudioSourceId | null,
+      reason: SelectionReason,
+      by: string | null = null
+    ) =>
+      Effect.gen(function* () {
+        const previous = yield* Ref.getAndSet(
+          sourceRef,
+          Option.fromNullable(id)
+        );
+        if (Option.getOrNull(previous) === id) return;
+        yield* Ref.set(variantRef, Option.none());
+        yield* Ref.set(sourceRateRef, Option.none());
+        yield* Ref.set(levelsRef, []);
+        yield* Ref.set(rewindRef, Option.none());
+        yield* selectionLog.append({
+          at: yield* Clock.currentTimeMillis,
+          source: id,
+          by,
+          reason,
+        });
+      }).pipe(selectLock.withPermits(1));
+
+    // Clear the selection if a config reload removed the selected source.
+    yield* config.changes.pipe(
+      Stream.runForEach((c) =>
+        Ref.get(sourceRef).pipe(
+          Effect.flatMap((current) =>
+            Option.isSome(current) &&
+            !c.sources.some((s) => s.id === current.value)
+              ? Effect.log(
+                  `Source ${current.value} removed from config, clearing it`
+                ).pipe(Effect.zipRight(setSource(null, "removed")))
+              : Effect.void
+          )
+        )
+      ),
+      Effect.forkScoped
+    );
+
+    // The source selected when the server last stopped is selected again.
+    if (Option.isSome(selectionLog.last)) {
+      const id = selectionLog.last.value;
+      if (Option.isSome(yield* findSource(id))) {
+        yield* setSource(id, "restored");
+        yield* Effect.log(`Audio source restored: ${id}`);
+      } else {
+        yield* Effect.logWarning(
+          `Previously selected source ${id} no longer exists, not restored`
+        );
+      }
+    }
 
     return {
+      sources,
+      findSource,
       currentSource: Ref.get(sourceRef),
-      setSource: (id: AudioSourceId | null) =>
-        Ref.set(sourceRef, Option.fromNullable(id)),
-      getStream: (): Stream.Stream<Buffer, PlatformError.PlatformError> =>
+      setSource,
+      // Changes of the selected source, most recent first.
+      selectionHistory: selectionLog.history,
+      // Selects a source and restarts its stream `seconds` in the past, as far
+      // as its HLS playlist window allows. None if the source isn't HLS.
+      catchUp: (
+        source: SourceConfig,
+        seconds: number,
+        by: string | null = null
+      ) =>
+        Effect.gen(function* () {
+          if (sourceType(source) !== "hls") return Option.none<Rewind>();
+          const headers = sourceHeaders(source);
+          // From the URL the stream restarts from, most likely.
+          const variant = yield* resolveVariant(
+            yield* health.current(source),
+            source.maxBitrate,
+            headers
+          );
+          const rewind = yield* resolveRewind(variant.url, seconds, headers);
+          if (Option.isNone(rewind)) return rewind;
+          yield* setSource(source.id, "catch-up", by);
+          yield* Ref.set(
+            rewindRef,
+            Option.some({ source: source.id, rewind: rewind.value })
+          );
+          yield* Ref.update(generationRef, (n) => n + 1);
+          return rewind;
+        }).pipe(Effect.provideService(HttpClient.HttpClient, httpClient)),
+      // Changes whenever the selected source's stream must be restarted.
+      streamGeneration: Ref.get(generationRef),
+      // While paused the stream keeps running but no audio is sent to OpenAI.
+      processingPaused: Ref.get(pausedRef),
+      setProcessingPaused: (paused: boolean) => Ref.set(pausedRef, paused),
+      // Changes whenever the audio gathered so far should be responded to
+      // without waiting for a full window.
+      flushRequests: Ref.get(flushRef),
+      requestFlush: Ref.update(flushRef, (n) => n + 1),
+      // Per-second levels of the selected source, oldest first.
+      levels: Ref.get(levelsRef),
+      recordLevel: (level: AudioLevelReading) =>
+        Ref.update(levelsRef, (levels) =>
+          [...levels, level].slice(-LEVEL_HISTORY)
+        ),
+      // Scores of the source's URLs, in the order they are tried.
+      sourceHealth: health.health,
+      // Usage of the HLS segment cache; null when it is off.
+      hlsCacheStats: hlsCache ? hlsCache.stats : Effect.succeed(null),
+      // Rendition of the stream last started, if any.
+      currentVariant: Ref.get(variantRef),
+      // Sample rate the selected source is broadcast at, once probed.
+      currentSampleRate: Ref.get(sourceRateRef),
+      // On-air time of the first byte of the stream last started, in ms since
+      // the epoch, the source's delaySeconds compensated; a position in the
+      // stream is on air this much later.
+      streamOrigin: Ref.get(originRef),
+      // Registers a connection pushing audio to a websocket source for the
+      // scope's lifetime, replacing any other.
+      connectRemote: (sourceId: AudioSourceId, params: RemoteParams) =>
+        remote.connect(sourceId, params),
+      // Chunks emitted by getStream are pooled; hand them back once written.
+      releaseChunk: (chunk: Buffer) => Effect.sync(() => pool.release(chunk)),
+      // Raw mono audio in the given format.
+      getStream: (
+        spec: InputFormatSpec = inputFormatSpec("pcm")
+      ): Stream.Stream<Buffer, PlatformError.PlatformError> =>
         Stream.unwrap(
           Effect.gen(function* () {
             const sourceId = Option.getOrNull(yield* Ref.get(sourceRef));
             if (!sourceId) return Stream.empty;
-            yield* Effect.log(
-              `Starting audio stream from ${AUDIO_SOURCES[sourceId].name}`
+            const source = Option.getOrNull(yield* findSource(sourceId));
+            if (!source) return Stream.empty;
+            const fixture = audioFixture(devReplay.dir, spec);
+            if (isReplaying(devReplay)) {
+              yield* Effect.log(`Replaying recorded audio from ${fixture}`);
+              yield* Ref.set(
+                originRef,
+                Option.some(yield* Clock.currentTimeMillis)
+              );
+              return replayAudio(
+                fixture,
+                batchBytes(spec),
+                spec.bytesPerSecond,
+                pool.acquire
+              );
+            }
+            if (sourceType(source) === "websocket") {
+              const started = yield* startRemoteStream(
+                source,
+                spec,
+                Ref.get(sourceRef).pipe(Effect.map(Option.contains(sourceId)))
+              );
+              if (Option.isNone(started)) return Stream.empty;
+              const { params, stream } = started.value;
+              yield* Ref.set(
+                variantRef,
+                Option.some({ url: source.url, bandwidth: null })
+              );
+              yield* Ref.set(
+                sourceRateRef,
+                Option.some(remoteSampleRate(params))
+              );
+              yield* Ref.set(
+                originRef,
+                Option.some(
+                  (yield* Clock.currentTimeMillis) -
+                    (source.delaySeconds ?? 0) * 1000
+                )
+              );
+              return stream;
+            }
+            const rewind = yield* Ref.modify(rewindRef, (pending) =>
+              Option.isSome(pending) && pending.value.source === sourceId
+                ? [pending.value.rewind, Option.none()]
+                : [undefined, pending]
+            );
+            const { variant, input, stream } = yield* startStream(
+              source,
+              spec,
+              rewind
             );
-            return ffmpegStream(AUDIO_SOURCES[sourceId].url).pipe(
-              Stream.provideService(CommandExecutor.CommandExecutor, executor)
+            yield* Ref.set(variantRef, Option.some(variant));
+            // Taken as broadcast on arrival, less the stream's known lag
+            // and how far back a catch-up starts.
+            const behindMs =
+              ((source.delaySeconds ?? 0) + (rewind?.seconds ?? 0)) * 1000;
+            yield* Ref.set(
+              originRef,
+              Option.some((yield* Clock.currentTimeMillis) - behindMs)
+            );
+            // Probed alongside the stream rather than before it, so a slow
+            // probe doesn't delay the audio.
+            yield* probeSampleRate(bin, input, probeArgs(source)).pipe(
+              Effect.provideService(CommandExecutor.CommandExecutor, executor),
+              Effect.flatMap(
+                Option.match({
+                  onNone: () => Effect.void,
+                  onSome: (rate) =>
+                    Effect.gen(function* () {
+                      const current = yield* Ref.get(sourceRef);
+                      if (!Option.contains(current, sourceId)) return;
+                      yield* Ref.set(sourceRateRef, Option.some(rate));
+                      yield* Effect.log(
+                        `${source.name} is broadcast at ${rate} Hz, ` +
+                          (rate < spec.sampleRate
+                            ? `upsampled to ${spec.sampleRate} Hz`
+                            : `decoded at ${spec.sampleRate} Hz`)
+                      );
+                    }),
+                })
+              ),
+              Effect.forkIn(scope)
+            );
+            if (!isRecording(devReplay)) return stream;
+            if (!recordedFixtures.has(fixture)) {
+              recordedFixtures.add(fixture);
+              resetFixture(fixture);
+            }
+            yield* Effect.log(`Recording audio to ${fixture}`);
+            return stream.pipe(
+              Stream.tap((chunk) =>
+                Effect.sync(() => recordAudio(fixture, chunk))
+              )
             );
           })
         ),
+      // Decodes a media file through the same ffmpeg path as live sources.
+      // Chunks are pooled like getStream's.
+      decodeFile: (
+        path: string,
+        spec: InputFormatSpec
+      ): Stream.Stream<Buffer, PlatformError.PlatformError> =>
+        ffmpegStream(bin, path, spec, pool).pipe(
+          Stream.provideService(CommandExecutor.CommandExecutor, executor)
+        ),
+      fileDuration: (path: string) =>
+        probeDuration(bin, path).pipe(
+          Effect.provideService(CommandExecutor.CommandExecutor, executor)
+        ),
+      // Checks that a source can be reached without streaming it: HTTP
+      // sources must answer their URL (only the headers are read, as ICY
+      // servers often reject HEAD), others must open in ffprobe. Audio
+      // pushed to a websocket source has nothing to reach beforehand.
+      probe: (source: SourceConfig) =>
+        (sourceType(source) === "websocket"
+          ? Effect.void
+          : HTTP_TYPES.includes(sourceType(source))
+            ? httpClient
+                .get(source.url, { headers: sourceHeaders(source) })
+                .pipe(
+                  Effect.flatMap(HttpClientResponse.filterStatusOk),
+                  Effect.scoped,
+                  Effect.asVoid
+                )
+            : probeReadable(bin, source.url, probeArgs(source)).pipe(
+                Effect.provideService(CommandExecutor.CommandExecutor, executor)
+              )
+        ).pipe(
+          Effect.timeout("15 seconds"),
+          Effect.mapError(
+            (e) =>
+              new SourceProbeError({
+                message: e instanceof Error ? e.message : String(e),
+              })
+          )
+        ),
+      // Stream of a given source, independent of the selection. Chunks are
+      // pooled like getStream's.
+      streamSource: (
+        id: AudioSourceId,
+        spec: InputFormatSpec
+      ): Stream.Stream<Buffer, PlatformError.PlatformError> =>
+        Stream.unwrap(
+          findSource(id).pipe(
+            Effect.flatMap(
+              Option.match({
+                onNone: () => Effect.succeed(Stream.empty),
+                onSome: (source) =>
+                  sourceType(source) === "websocket"
+                    ? Effect.map(
+                        startRemoteStream(source, spec, Effect.succeed(true)),
+                        Option.match({
+                          onNone: () => Stream.empty,
+                          onSome: (s) => s.stream,
+                        })
+                      )
+                    : startStream(source, spec).pipe(
+                        Effect.map((s) => s.stream)
+                      ),
+              })
+            )
+          )
+        ),
     };
   }),
 }) {}
@@ -0,0 +1,43 @@
+import {
+  HttpMiddleware,
+  HttpServerRequest,
+  HttpServerResponse,
+} from "@effect/platform";
+import { Config, Effect } from "effect";
+
+// BASE_PATH serves everything under a prefix, e.g. /radio on a reverse proxy
+// shared with other services, which passes the path on unchanged. Empty (the
+// default) serves from the root.
+export const BasePathConfig = Config.string("BASE_PATH").pipe(
+  Config.withDefault(""),
+  Config.map((path) => path.replace(/\/+$/, "")),
+  Config.validate({
+    message: "Expected BASE_PATH to start with a slash, e.g. /radio",
+    validation: (path) => path === "" || path.startsWith("/"),
+  })
+);
+
+// Takes the prefix off before routing, so the routes, roles and CORS paths
+// stay as they are. The prefix alone redirects to the page with a trailing
+// slash, which its relative links need; anything outside it is a 404.
+export const basePath = (prefix: string) =>
+  HttpMiddleware.make((app) =>
+    Effect.flatMap(HttpServerRequest.HttpServerRequest, (req) => {
+      const url = new URL(req.url, "http://localhost");
+      if (url.pathname === prefix) {
+        return Effect.succeed(
+          HttpServerResponse.redirect(`${prefix}/${url.search}`)
+        );
+      }
+      if (!url.pathname.startsWith(`${prefix}/`)) {
+        return Effect.succeed(HttpServerResponse.empty({ status: 404 }));
+      }
+      return Effect.provideService(
+        app,
+        HttpServerRequest.HttpServerRequest,
+        req.modify({
+          url: `${url.pathname.slice(prefix.length)}${url.search}`,
+        })
+      );
+    })
+  );
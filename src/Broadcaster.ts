@@ -0,0 +1,283 @@
+import { RedisClient } from "bun";
+import {
+  Clock,
+  Config,
+  Effect,
+  Either,
+  Option,
+  PubSub,
+  Queue,
+  Redacted,
+} from "effect";
+import {
+  type BroadcastMessage,
+  decodeBroadcastJsonEither,
+  encodeBroadcastJson,
+} from "./Messages.js";
+
+export type SubscriberKind = "sse" | "ndjson" | "grpc";
+
+// A connected stream client as other listeners see it.
+export interface Listener {
+  readonly id: string;
+  readonly name: string | null;
+  readonly kind: SubscriberKind;
+  readonly connectedAt: number;
+}
+
+export interface SubscriberStats {
+  readonly id: number;
+  readonly kind: SubscriberKind;
+  readonly address: string | null;
+  readonly connectedAt: number;
+  readonly delivered: number;
+  readonly dropped: number;
+  readonly queued: number;
+}
+
+interface ClientSubscriber {
+  readonly id: number;
+  // Unique across replicas, unlike `id`, since presence goes through Redis.
+  readonly listenerId: string;
+  readonly name: string | null;
+  readonly kind: SubscriberKind;
+  readonly address: string | null;
+  readonly connectedAt: number;
+  readonly queue: Queue.Queue<BroadcastMessage>;
+  delivered: number;
+  dropped: number;
+}
+
+type Priority = "low" | "normal" | "high";
+
+// Deltas and levels are superseded by what follows them; a response's
+// completion must get through for clients to finish it, and errors and status
+// changes even more so.
+const priority = (msg: BroadcastMessage): Priority => {
+  switch (msg.type) {
+    case "delta":
+    case "answer_delta":
+    case "level":
+      return "low";
+    case "complete":
+    case "translation":
+    case "answer":
+    case "comparison":
+    case "transcript":
+      return "normal";
+    default:
+      return "high";
+  }
+};
+
+// Relays messages through a Redis channel: everything published on it, by
+// this instance or another, is delivered locally.
+const redisRelay = (
+  url: Redacted.Redacted<string>,
+  channel: string,
+  deliver: (msg: BroadcastMessage) => void
+) =>
+  Effect.gen(function* () {
+    const publisher = yield* Effect.acquireRelease(
+      Effect.tryPromise(async () => {
+        const client = new RedisClient(Redacted.value(url));
+        await client.connect();
+        return client;
+      }),
+      (client) => Effect.sync(() => client.close())
+    );
+    // A subscribed connection can't run other commands, hence a second one.
+    const subscriber = yield* Effect.acquireRelease(
+      Effect.tryPromise(() => publisher.duplicate()),
+      (client) => Effect.sync(() => client.close())
+    );
+    yield* Effect.tryPromise(() =>
+      subscriber.subscribe(channel, (message) =>
+        Either.match(decodeBroadcastJsonEither(message), {
+          onLeft: (error) =>
+            Effect.runFork(
+              Effect.logWarning("Ignoring malformed broadcast from Redis").pipe(
+                Effect.annotateLogs({ channel, error: error.message })
+              )
+            ),
+          onRight: deliver,
+        })
+      )
+    );
+    yield* Effect.log(`Broadcasting through Redis channel ${channel}`);
+
+    return (msg: BroadcastMessage) =>
+      Effect.tryPromise(() =>
+        publisher.publish(channel, encodeBroadcastJson(msg))
+      ).pipe(
+        Effect.asVoid,
+        Effect.catchAll((e) =>
+          Effect.logError("Failed to publish broadcast to Redis", e)
+        )
+      );
+  });
+
+// Fans broadcast messages out to stream clients. With REDIS_URL set they go
+// through Redis, so clients connected to any replica receive what the
+// instance running the audio pipeline publishes.
+//
+// Stream clients get a bounded queue each (SUBSCRIBER_BUFFER messages); what
+// doesn't fit is dropped and counted. Deltas and levels stop being queued once
+// a client's buffer is three quarters full and responses once it is nearly
+// full, keeping the rest for errors and status changes. A client dropping more
+// than SUBSCRIBER_MAX_DROP_RATE of its messages is disconnected, so it
+// reconnects fresh instead of silently missing deltas.
+export class Broadcaster extends Effect.Service<Broadcaster>()("Broadcaster", {
+  scoped: Effect.gen(function* () {
+    const redisUrl = yield* Config.option(Config.redacted("REDIS_URL"));
+    const channel = yield* Config.string("REDIS_CHANNEL").pipe(
+      Config.withDefault("funny-radio:broadcast")
+    );
+    const bufferSize = yield* Config.integer("SUBSCRIBER_BUFFER").pipe(
+      Config.withDefault(1024)
+    );
+    const maxDropRate = yield* Config.number("SUBSCRIBER_MAX_DROP_RATE").pipe(
+      Config.withDefault(0.05)
+    );
+    // In-process consumers (e.g. the transcript store) never drop messages.
+    const local = yield* Effect.acquireRelease(
+      PubSub.unbounded<BroadcastMessage>(),
+      PubSub.shutdown
+    );
+
+    // Queued messages beyond which a message of each priority is dropped.
+    const admitBelow: Record<Priority, number> = {
+      low: Math.max(1, Math.floor(bufferSize * 0.75)),
+      normal: Math.max(1, bufferSize - Math.ceil(bufferSize / 16)),
+      high: bufferSize,
+    };
+
+    const clients = new Map<number, ClientSubscriber>();
+    let nextId = 1;
+    let evicted = 0;
+
+    const evict = (client: ClientSubscriber) => {
+      clients.delete(client.id);
+      evicted++;
+      const total = client.delivered + client.dropped;
+      Effect.runFork(
+        Queue.shutdown(client.queue).pipe(
+          Effect.zipRight(
+            Effect.logWarning(
+              `Disconnecting slow ${client.kind} subscriber ${client.id}: ` +
+                `${client.dropped} of ${total} messages dropped`
+            )
+          )
+        )
+      );
+    };
+
+    // Synchronous so messages relayed from Redis keep their order.
+    const deliver = (msg: BroadcastMessage) => {
+      PubSub.unsafeOffer(local, msg);
+      const limit = admitBelow[priority(msg)];
+      for (const client of clients.values()) {
+        const queued = Option.getOrElse(client.queue.unsafeSize(), () => 0);
+        if (queued < limit && client.queue.unsafeOffer(msg)) {
+          client.delivered++;
+        } else {
+          client.dropped++;
+        }
+        const total = client.delivered + client.dropped;
+        // Judged over at least a buffer's worth of messages.
+        if (total >= bufferSize && client.dropped / total > maxDropRate) {
+          evict(client);
+        }
+      }
+    };
+
+    const publish = yield* Option.match(redisUrl, {
+      onNone: () =>
+        Effect.succeed((msg: BroadcastMessage) =>
+          Effect.sync(() => deliver(msg))
+        ),
+      onSome: (url) => redisRelay(url, channel, deliver),
+    });
+
+    yield* Effect.addFinalizer(() =>
+      Effect.forEach(clients.values(), (client) => Queue.shutdown(client.queue))
+    );
+
+    return {
+      publish,
+      subscribe: PubSub.subscribe(local),
+      // Queue of a stream client, unsubscribed when the scope closes. It is
+      // shut down if the client falls too far behind. Its arrival and
+      // departure are announced to every client, itself included, as
+      // listener_joined and listener_left.
+      subscribeClient: (
+        kind: SubscriberKind,
+        address: string | null,
+        name: string | null
+      ) =>
+        Effect.acquireRelease(
+          Effect.gen(function* () {
+            const client: ClientSubscriber = {
+              id: nextId++,
+              listenerId: `lst_${crypto.randomUUID().slice(0, 8)}`,
+              name,
+              kind,
+              address,
+              connectedAt: yield* Clock.currentTimeMillis,
+              queue: yield* Queue.bounded<BroadcastMessage>(bufferSize),
+              delivered: 0,
+              dropped: 0,
+            };
+            clients.set(client.id, client);
+            yield* publish({
+              type: "listener_joined",
+              listenerId: client.listenerId,
+              name,
+              kind,
+            });
+            return client;
+          }),
+          (client) =>
+            Effect.sync(() => clients.delete(client.id)).pipe(
+              Effect.zipRight(Queue.shutdown(client.queue)),
+              Effect.zipRight(
+                publish({
+                  type: "listener_left",
+                  listenerId: client.listenerId,
+                  name: client.name,
+                })
+              )
+            )
+        ).pipe(
+          Effect.map((client): Queue.Dequeue<BroadcastMessage> => client.queue)
+        ),
+      subscriberStats: Effect.sync(() => ({
+        subscribers: Array.from(
+          clients.values(),
+          ({ queue, listenerId, name, ...client }): SubscriberStats => ({
+            ...client,
+            queued: Option.getOrElse(queue.unsafeSize(), () => 0),
+          })
+        ),
+        evicted,
+      })),
+      // Clients connected to this instance, oldest first.
+      listeners: Effect.sync(() =>
+        Array.from(
+          clients.values(),
+          (client): Listener => ({
+            id: client.listenerId,
+            name: client.name,
+            kind: client.kind,
+            connectedAt: client.connectedAt,
+          })
+        )
+      ),
+      // Tells this instance's clients it is going away; their streams end
+      // after this message. Not relayed to other replicas.
+      closeClients: Effect.sync(() => deliver({ type: "server_shutdown" })),
+      // True when messages may come from other instances.
+      distributed: Option.isSome(redisUrl),
+    } as const;
+  }),
+}) {}
@@ -0,0 +1,194 @@
+import { Clock, Config, Data, Effect, Schema } from "effect";
+import { AppConfig, type SourceBudget } from "./AppConfig.js";
+import type { AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { DryRunConfig } from "./DryRun.js";
+import { makeJsonFileStore } from "./JsonFileStore.js";
+import { DAY_MS } from "./MetricsSnapshots.js";
+import { PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+
+// What a source's responses used on one UTC day.
+const Spend = Schema.Struct({
+  day: Schema.Number,
+  tokens: Schema.Number,
+  costUsd: Schema.Number,
+  // Whether it was over budget after its last response, so budget_exceeded
+  // is sent once, and again only if the budget is raised and used up again.
+  over: Schema.Boolean,
+});
+
+type Spend = typeof Spend.Type;
+
+// Spend by source.
+const Spends = Schema.Record({ key: Schema.String, value: Spend });
+
+type Spends = typeof Spends.Type;
+
+export class BudgetStoreError extends Data.TaggedError("BudgetStoreError")<{
+  message: string;
+}> {}
+
+export interface BudgetUsage {
+  readonly source: AudioSourceId;
+  readonly tokens: number;
+  readonly costUsd: number;
+  readonly budget: SourceBudget | null;
+  readonly exceeded: boolean;
+  // Start of the next UTC day, when the spend starts over.
+  readonly resetsAt: number;
+}
+
+const startOfDay = (at: number) => Math.floor(at / DAY_MS) * DAY_MS;
+
+const over = (spend: Spend, budget: SourceBudget | undefined) =>
+  budget !== undefined &&
+  ((budget.tokens !== undefined && spend.tokens >= budget.tokens) ||
+    (budget.usd !== undefined && spend.costUsd >= budget.usd));
+
+// Daily spending limits of the sources, so a station left on doesn't run up
+// the bill: the tokens OpenAI reports for each response over a source's audio,
+// window or question, are added up per UTC day and priced at the
+// DRY_RUN_*_PRICE prices. Once a source with a `budget` reaches it, a
+// budget_exceeded message is sent and its audio processor sends nothing until
+// the day is over, or the budget is raised; the sources it paused are
+// announced with a resumed message when the next day starts. Spend is kept in
+// a JSON file (BUDGETS_FILE, defaults to budgets.json) so a restart doesn't
+// reset it.
+export class Budgets extends Effect.Service<Budgets>()("Budgets", {
+  scoped: Effect.gen(function* () {
+    const appConfig = yield* AppConfig;
+    const broadcaster = yield* Broadcaster;
+    const events = yield* PipelineEvents;
+    const supervisor = yield* PipelineSupervisor;
+    const prices = yield* DryRunConfig;
+    const path = yield* Config.string("BUDGETS_FILE").pipe(
+      Config.withDefault("budgets.json")
+    );
+
+    const store = yield* makeJsonFileStore({
+      path,
+      schema: Spends,
+      empty: {},
+      error: (message) => new BudgetStoreError({ message }),
+    });
+
+    const budgetOf = (source: AudioSourceId) =>
+      appConfig.get.pipe(
+        Effect.map(
+          (config) => config.sources.find((s) => s.id === source)?.budget
+        )
+      );
+
+    // The source's spend today, none before its first response.
+    const spendIn = (all: Spends, source: AudioSourceId, today: number) => {
+      const spend = all[source];
+      return spend !== undefined && spend.day === today
+        ? spend
+        : { day: today, tokens: 0, costUsd: 0, over: false };
+    };
+
+    yield* events.on(
+      "ResponseUsage",
+      ({ source, audioTokens, textTokens, outputTokens }) =>
+        Effect.gen(function* () {
+          const today = startOfDay(yield* Clock.currentTimeMillis);
+          // Usage events are handled one at a time, and the rollover only
+          // drops past days, so this is still current when written.
+          const before = spendIn(yield* store.get, source, today);
+          const spend: Spend = {
+            ...before,
+            tokens: before.tokens + audioTokens + textTokens + outputTokens,
+            costUsd:
+              before.costUsd +
+              (audioTokens * prices.audioInputPrice +
+                textTokens * prices.textInputPrice +
+                outputTokens * prices.outputPrice) /
+                1_000_000,
+          };
+          const budget = yield* budgetOf(source);
+          const isOver = over(spend, budget);
+          yield* store.update((all) => ({
+            ...all,
+            [source]: { ...spend, over: isOver },
+          }));
+          if (!isOver || before.over) return;
+          yield* Effect.logWarning(
+            `Source ${source} exceeded its daily budget ` +
+              `(${spend.tokens} tokens, $${spend.costUsd.toFixed(2)}), ` +
+              `paused until the next UTC day`
+          );
+          yield* broadcaster.publish({
+            type: "budget_exceeded",
+            source,
+            tokens: spend.tokens,
+            costUsd: spend.costUsd,
+            budget: {
+              tokens: budget?.tokens ?? null,
+              usd: budget?.usd ?? null,
+            },
+            resumesAt: today + DAY_MS,
+          });
+        })
+    );
+
+    // Drops the spend of past days, announcing the sources it had paused.
+    const rollOver = Effect.gen(function* () {
+      const today = startOfDay(yield* Clock.currentTimeMillis);
+      const past = Object.entries(yield* store.get).filter(
+        ([, spend]) => spend.day < today
+      );
+      if (past.length === 0) return;
+      yield* store.update((all) =>
+        Object.fromEntries(
+          Object.entries(all).filter(([, spend]) => spend.day >= today)
+        )
+      );
+      for (const [source, spend] of past) {
+        if (!spend.over) continue;
+        yield* Effect.log(`Source ${source} resumed with a new daily budget`);
+        yield* broadcaster.publish({ type: "resumed", from: "budget", source });
+      }
+    });
+
+    // Also run at startup, for a day that ended while the server was down.
+    yield* rollOver.pipe(
+      Effect.zipRight(
+        Clock.currentTimeMillis.pipe(
+          Effect.flatMap((now) => Effect.sleep(startOfDay(now) + DAY_MS - now))
+        )
+      ),
+      Effect.forever,
+      (loop) => supervisor.supervise("budget-rollover", loop),
+      Effect.forkScoped
+    );
+
+    const usage = (source: AudioSourceId) =>
+      Effect.gen(function* () {
+        const today = startOfDay(yield* Clock.currentTimeMillis);
+        const spend = spendIn(yield* store.get, source, today);
+        const budget = yield* budgetOf(source);
+        return {
+          source,
+          tokens: spend.tokens,
+          costUsd: spend.costUsd,
+          budget: budget ?? null,
+          exceeded: over(spend, budget),
+          resetsAt: today + DAY_MS,
+        } satisfies BudgetUsage;
+      });
+
+    return {
+      // Today's spend of every source, in config order.
+      all: appConfig.get.pipe(
+        Effect.flatMap((config) =>
+          Effect.forEach(config.sources, (s) => usage(s.id))
+        )
+      ),
+      // Whether the source's budget for today is used up, under the budget
+      // configured now.
+      exceeded: (source: AudioSourceId) =>
+        usage(source).pipe(Effect.map((u) => u.exceeded)),
+    } as const;
+  }),
+}) {}
@@ -0,0 +1,26 @@
+import { Effect } from "effect";
+
+export interface BufferPool {
+  readonly acquire: (length: number) => Buffer;
+  readonly release: (buf: Buffer) => void;
+}
+
+// Recycles fixed-size backing stores so the audio hot path doesn't allocate a
+// fresh buffer per chunk. Requests larger than `size` fall back to a plain
+// allocation and are silently dropped on release.
+export const makeBufferPool = (size: number, maxRetained = 64) =>
+  Effect.sync((): BufferPool => {
+    const free: ArrayBuffer[] = [];
+
+    return {
+      acquire: (length) => {
+        if (length > size) return Buffer.allocUnsafe(length);
+        const backing = free.pop() ?? new ArrayBuffer(size);
+        return Buffer.from(backing, 0, length);
+      },
+      release: (buf) => {
+        if (buf.byteOffset !== 0 || buf.buffer.byteLength !== size) return;
+        if (free.length < maxRetained) free.push(buf.buffer as ArrayBuffer);
+      },
+    };
+  });
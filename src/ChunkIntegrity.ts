@@ -0,0 +1,70 @@
+import { Config } from "effect";
+
+// Ways a chunk of PCM can be found broken before processing:
+// - odd_length: its length isn't a whole number of samples, as when a read
+//   from ffmpeg ends mid-sample; the extra bytes are carried to the next one.
+// - slipped: its samples are read a byte off, the low and high bytes of each
+//   swapped for its neighbour's, which turns speech into loud noise; a byte
+//   is dropped to get back in step.
+// - checksum: it changed between being read and being processed, as when
+//   its buffer was reused too early; it is dropped.
+export type ChunkCorruption = "odd_length" | "slipped" | "checksum";
+
+// Checksums each chunk as read and checks it again when processed. Off by
+// default: it costs a CRC32 twice per chunk and only catches bugs.
+export const ChunkCrcConfig = Config.boolean("AUDIO_CHUNK_CRC").pipe(
+  Config.withDefault(false)
+);
+
+export const chunkCrc = (chunk: Uint8Array) => Bun.hash.crc32(chunk);
+
+// Mean absolute difference between consecutive 16-bit little-endian samples
+// starting at byte `offset`. A few thousand at most for speech and music,
+// near 20000 for samples read a byte off.
+const roughness = (chunk: Uint8Array, offset: number) => {
+  const samples = Math.floor((chunk.length - offset) / 2);
+  if (samples < 2) return 0;
+  const view = new DataView(chunk.buffer, chunk.byteOffset, chunk.byteLength);
+  let previous = view.getInt16(offset, true);
+  let total = 0;
+  for (let i = 1; i < samples; i++) {
+    const sample = view.getInt16(offset + i * 2, true);
+    total += Math.abs(sample - previous);
+    previous = sample;
+  }
+  return total / (samples - 1);
+};
+
+// Above this the chunk is noise or slipped; read a byte further it tells.
+const SLIP_ROUGHNESS = 8000;
+
+const slipped = (chunk: Uint8Array) => {
+  const aligned = roughness(chunk, 0);
+  return aligned > SLIP_ROUGHNESS && roughness(chunk, 1) * 4 < aligned;
+};
+
+// Keeps a stream of 16-bit PCM chunks in step with its samples. Returns the
+// chunk as is when it is sound, or else a copy realigned, possibly empty,
+// with what was wrong with it.
+export const makeChunkAligner = () => {
+  let carry: Uint8Array | null = null;
+
+  return (
+    chunk: Buffer
+  ): { chunk: Buffer; corruption: ChunkCorruption | null } => {
+    let data: Uint8Array = carry ? Buffer.concat([carry, chunk]) : chunk;
+    carry = null;
+    let corruption: ChunkCorruption | null = null;
+    if (slipped(data)) {
+      data = data.subarray(1);
+      corruption = "slipped";
+    }
+    if (data.length % 2 !== 0) {
+      carry = Buffer.from(data.subarray(data.length - 1));
+      data = data.subarray(0, data.length - 1);
+      corruption ??= "odd_length";
+    }
+    if (data === chunk) return { chunk, corruption };
+    return { chunk: Buffer.from(data), corruption };
+  };
+};
@@ -0,0 +1,94 @@
+import {
+  Config,
+  Effect,
+  FiberHandle,
+  Ref,
+  Schedule,
+  Stream,
+} from "effect";
+import { AppConfig } from "./AppConfig.js";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { makeRingBuffer } from "./RingBuffer.js";
+
+const COMPARISON_INSTRUCTIONS = `Vous recevez des extraits audio diffuses au meme moment par plusieurs radios, chacun precede du nom de la station. Comparez la facon dont elles couvrent l'actualite : sujets retenus ou ignores, cadrage, ton, informations presentes chez l'une et absentes chez l'autre. Repondez en quelques phrases, avec une pointe d'ironie.`;
+
+// Streams several sources side by side, independently of the selected one,
+// and periodically asks the model to compare their latest window of audio.
+export class Comparison extends Effect.Service<Comparison>()("Comparison", {
+  scoped: Effect.gen(function* () {
+    const openai = yield* OpenAIRealtime;
+    const audioSource = yield* AudioSource;
+    const appConfig = yield* AppConfig;
+    const intervalSeconds = yield* Config.number(
+      "COMPARISON_INTERVAL_SECONDS"
+    ).pipe(Config.withDefault(60));
+
+    const current = yield* Ref.make<ReadonlyArray<AudioSourceId> | null>(null);
+    const fiber = yield* FiberHandle.make();
+
+    const run = (ids: ReadonlyArray<AudioSourceId>) =>
+      Effect.gen(function* () {
+        const config = yield* appConfig.get;
+        const spec = yield* openai.inputSpec;
+        const windowBytes = Math.round(
+          config.window.targetSeconds * spec.bytesPerSecond
+        );
+
+        const feeds = yield* Effect.forEach(ids, (id) =>
+          Effect.gen(function* () {
+            const source = config.sources.find((s) => s.id === id);
+            const recent = yield* makeRingBuffer(windowBytes);
+            yield* audioSource.streamSource(id, spec).pipe(
+              Stream.runForEach((chunk) =>
+                Effect.sync(() => recent.write(chunk)).pipe(
+                  Effect.ensuring(audioSource.releaseChunk(chunk))
+                )
+              ),
+              Effect.catchAllCause((cause) =>
+                Effect.logWarning(`Comparison stream ${id} failed`, cause)
+              ),
+              Effect.repeat(Schedule.spaced("5 seconds")),
+              Effect.forkScoped
+            );
+            return { id, name: source?.name ?? id, recent };
+          })
+        );
+
+        const compare = Effect.gen(function* () {
+          // Only compare once every source has a full window.
+          if (feeds.some((feed) => feed.recent.size() < windowBytes)) return;
+          yield* Effect.log(`Comparing ${ids.join(", ")}`);
+          yield* openai.compareSources(
+            COMPARISON_INSTRUCTIONS,
+            feeds.map((feed) => ({
+              source: feed.id,
+              name: feed.name,
+              audio: Buffer.concat(feed.recent.read()),
+            }))
+          );
+        });
+
+        yield* compare.pipe(
+          Effect.delay(`${intervalSeconds} seconds`),
+          Effect.forever
+        );
+      }).pipe(Effect.scoped);
+
+    return {
+      current: Ref.get(current),
+      // Replaces any comparison already running.
+      start: (ids: ReadonlyArray<AudioSourceId>) =>
+        FiberHandle.run(fiber, run(ids)).pipe(
+          Effect.zipRight(Ref.set(current, ids)),
+          Effect.zipRight(Effect.log(`Comparison started: ${ids.join(", ")}`))
+        ),
+      stop: FiberHandle.clear(fiber).pipe(
+        Effect.zipRight(Ref.getAndSet(current, null)),
+        Effect.flatMap((previous) =>
+          previous ? Effect.log("Comparison stopped") : Effect.void
+        )
+      ),
+    } as const;
+  }),
+}) {}
@@ -0,0 +1,49 @@
+import { HttpMiddleware, HttpServerRequest } from "@effect/platform";
+import { Config, Effect } from "effect";
+
+// Cross-origin access, for dashboards and web apps on other domains.
+// CORS_ORIGINS lists the origins allowed, or "*" for any; none leaves CORS
+// off. It applies under the CORS_PATHS prefixes, by default the streams and
+// the sources. CORS_CREDENTIALS lets browsers send cookies and
+// Authorization, which they refuse to do for "*".
+export const CorsConfig = Config.all({
+  origins: Config.array(Config.string(), "CORS_ORIGINS").pipe(
+    Config.withDefault([])
+  ),
+  paths: Config.array(Config.string(), "CORS_PATHS").pipe(
+    Config.withDefault(["/stream", "/sources"])
+  ),
+  credentials: Config.boolean("CORS_CREDENTIALS").pipe(
+    Config.withDefault(false)
+  ),
+});
+
+export type CorsConfig = Config.Config.Success<typeof CorsConfig>;
+
+// A prefix covers itself, what is under it and its variants: /stream covers
+// /stream.ndjson, /sources covers /sources/franceinfo/catchup.
+export const underPrefix = (path: string, prefix: string) =>
+  path === prefix ||
+  path.startsWith(`${prefix}/`) ||
+  path.startsWith(`${prefix}.`);
+
+// Answers preflight requests and adds the CORS headers to responses under the
+// configured paths; other requests pass through untouched.
+export const cors = (config: CorsConfig) => {
+  const withCors = HttpMiddleware.cors({
+    allowedOrigins: config.origins.includes("*") ? [] : config.origins,
+    allowedMethods: ["GET", "POST", "PUT", "PATCH", "DELETE"],
+    allowedHeaders: ["Content-Type", "Authorization", "Last-Event-ID"],
+    credentials: config.credentials,
+    maxAge: 600,
+  });
+  return HttpMiddleware.make((app) => {
+    const corsApp = withCors(app);
+    return Effect.flatMap(HttpServerRequest.HttpServerRequest, (req) => {
+      const path = new URL(req.url, "http://localhost").pathname;
+      return config.paths.some((prefix) => underPrefix(path, prefix))
+        ? corsApp
+        : app;
+    });
+  });
+};
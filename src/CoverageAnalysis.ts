@@ -0,0 +1,223 @@
+import { Clock, Config, Effect, Option, Schema } from "effect";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { stripCodeFence } from "./Messages.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { RESPONSE_TASKS, type TaskId } from "./Tasks.js";
+import type { CoverageDiff, StationCoverage } from "./TranscriptBackend.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+
+const FRAMING_INSTRUCTIONS = `Voici ce que plusieurs stations de radio ont diffuse pendant la meme heure, station par station, suivi des sujets qu'elles ont toutes deux ou plus abordes. Pour chacun de ces sujets communs, decrivez en une ou deux phrases, en francais, ce qui differe dans la maniere dont les stations le traitent : angle, ton, place accordee, faits retenus ou omis. Repondez uniquement par un objet JSON, sans texte autour ni bloc de code, de la forme {"framing": [{"topic": "sujet", "difference": "..."}]}. Laissez de cote les sujets traites de la meme maniere. N'inventez rien qui ne figure pas dans le texte.`;
+
+export const HOUR_MS = 60 * 60 * 1000;
+
+// Each hour is analyzed this long after it ends, leaving its last responses
+// time to be tagged.
+const ANALYSIS_DELAY_MS = 5 * 60 * 1000;
+
+// Per station; what aired last is kept if it ran long.
+const MAX_STATION_INPUT = 12_000;
+
+const TEXT_TASKS = (Object.keys(RESPONSE_TASKS) as Array<TaskId>).filter(
+  (task) => RESPONSE_TASKS[task].format === "text"
+);
+
+const Framing = Schema.Struct({
+  framing: Schema.Array(
+    Schema.Struct({ topic: Schema.String, difference: Schema.String })
+  ),
+});
+
+const decodeFraming = Schema.decodeUnknownOption(Schema.parseJson(Framing));
+
+// Only the shared topics are kept.
+const parseFraming = (text: string, shared: ReadonlyArray<string>) =>
+  decodeFraming(stripCodeFence(text)).pipe(
+    Option.map(({ framing }) =>
+      framing
+        .map((f) => ({
+          topic: f.topic.trim().toLowerCase(),
+          difference: f.difference.trim(),
+        }))
+        .filter((f) => shared.includes(f.topic) && f.difference !== "")
+    )
+  );
+
+// Compares what the stations covered during the same hour, for media-bias
+// analysis: topics only one station covered, from the topic tagging, and how
+// they framed the topics they share, through a one-off text response on the
+// OpenAI session given their summaries of the hour. Each hour is analyzed
+// shortly after it ends and stored; one not analyzed yet is when asked for.
+// The hourly job is disabled with COVERAGE_ANALYSIS=false.
+export class CoverageAnalysis extends Effect.Service<CoverageAnalysis>()(
+  "CoverageAnalysis",
+  {
+    scoped: Effect.gen(function* () {
+      const enabled = yield* Config.boolean("COVERAGE_ANALYSIS").pipe(
+        Config.withDefault(true)
+      );
+      const audioSource = yield* AudioSource;
+      const openai = yield* OpenAIRealtime;
+      const store = yield* TranscriptStore;
+      const supervisor = yield* PipelineSupervisor;
+
+      // What the source said that hour: its summaries, or its other text
+      // responses if it had none.
+      const hourText = (source: AudioSourceId, hour: number) =>
+        Effect.gen(function* () {
+          const range = { source, from: hour, to: hour + HOUR_MS };
+          const summaries = yield* store.between({
+            ...range,
+            tasks: ["summarize"],
+          });
+          const transcripts =
+            summaries.length > 0
+              ? summaries
+              : yield* store.between({ ...range, tasks: TEXT_TASKS });
+          return transcripts
+            .map((t) => t.text)
+            .join("\n\n")
+            .slice(-MAX_STATION_INPUT);
+        });
+
+      const framing = (
+        stations: ReadonlyArray<{ name: string; text: string }>,
+        shared: ReadonlyArray<string>
+      ) =>
+        openai
+          .respondToText(
+            FRAMING_INSTRUCTIONS,
+            [
+              ...stations.map((s) => `## ${s.name}\n\n${s.text}`),
+              `## Sujets communs\n\n${shared.join(", ")}`,
+            ].join("\n\n")
+          )
+          .pipe(
+            Effect.map((answer) => parseFraming(answer, shared)),
+            Effect.catchAll((e) =>
+              Effect.logWarning("Coverage framing failed", e).pipe(
+                Effect.as(Option.none())
+              )
+            )
+          );
+
+      // None when fewer than two stations have tagged responses that hour. A
+      // diff without framing is analyzed again next time it is asked for.
+      const analyze = (hour: number) =>
+        Effect.gen(function* () {
+          const stations: Array<{
+            source: AudioSourceId;
+            name: string;
+            responses: number;
+            topics: ReadonlyArray<{ topic: string; count: number }>;
+          }> = [];
+          for (const source of yield* audioSource.sources) {
+            const [bucket] = yield* store.topicTimeline({
+              source: source.id,
+              from: hour,
+              to: hour + HOUR_MS,
+              bucketMs: HOUR_MS,
+            });
+            if (bucket === undefined) continue;
+            const { positive, neutral, negative } = bucket.sentiment;
+            stations.push({
+              source: source.id,
+              name: source.name,
+              responses: positive + neutral + negative,
+              topics: bucket.topics,
+            });
+          }
+          if (stations.length < 2) return Option.none();
+
+          const totals = new Map<string, { stations: number; count: number }>();
+          for (const station of stations) {
+            for (const { topic, count } of station.topics) {
+              const total = totals.get(topic) ?? { stations: 0, count: 0 };
+              totals.set(topic, {
+                stations: total.stations + 1,
+                count: total.count + count,
+              });
+            }
+          }
+          const shared = Array.from(totals.entries())
+            .filter(([, total]) => total.stations >= 2)
+            .sort(([, a], [, b]) => b.count - a.count)
+            .map(([topic]) => topic);
+          const coverage = stations.map(
+            (s): StationCoverage => ({
+              source: s.source,
+              responses: s.responses,
+              topics: s.topics,
+              exclusive: s.topics
+                .filter(({ topic }) => totals.get(topic)?.stations === 1)
+                .map(({ topic }) => topic),
+            })
+          );
+
+          const differences =
+            shared.length === 0
+              ? Option.some([])
+              : yield* framing(
+                  yield* Effect.forEach(stations, (s) =>
+                    hourText(s.source, hour).pipe(
+                      Effect.map((text) => ({ name: s.name, text }))
+                    )
+                  ),
+                  shared
+                );
+          const diff: CoverageDiff = {
+            hour,
+            stations: coverage,
+            shared,
+            framing: Option.getOrNull(differences),
+            createdAt: yield* Clock.currentTimeMillis,
+          };
+          if (diff.framing !== null) yield* store.saveCoverage(diff);
+          return Option.some(diff);
+        });
+
+      // Waits for the next hour to end, then analyzes it.
+      const nextHour = Effect.gen(function* () {
+        const now = yield* Clock.currentTimeMillis;
+        const hour = Math.floor((now - ANALYSIS_DELAY_MS) / HOUR_MS) * HOUR_MS;
+        yield* Effect.sleep(hour + HOUR_MS + ANALYSIS_DELAY_MS - now);
+        const diff = yield* analyze(hour);
+        yield* Option.match(diff, {
+          onNone: () =>
+            Effect.logDebug(
+              `No coverage diff for ${new Date(hour).toISOString()}: fewer than two stations tagged`
+            ),
+          onSome: (d) =>
+            Effect.log(
+              `Coverage diff for ${new Date(hour).toISOString()}: ${d.stations.length} stations, ${d.shared.length} shared topics`
+            ),
+        });
+      }).pipe(
+        Effect.catchTag("TranscriptStoreError", (e) =>
+          Effect.logError("Coverage analysis failed", e.cause)
+        )
+      );
+
+      if (enabled) {
+        yield* nextHour.pipe(
+          Effect.forever,
+          (loop) => supervisor.supervise("coverage-analysis", loop),
+          Effect.forkScoped
+        );
+      } else {
+        yield* Effect.log("Coverage analysis disabled");
+      }
+
+      return {
+        // The diff of the hour starting at `hour`, which should be over;
+        // analyzed now if it wasn't stored.
+        coverage: (hour: number) =>
+          Effect.flatMap(store.coverage(hour), (stored) =>
+            stored === null
+              ? analyze(hour)
+              : Effect.succeed(Option.some(stored))
+          ),
+      } as const;
+    }),
+  }
+) {}
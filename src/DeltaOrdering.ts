@@ -0,0 +1,95 @@
+import { Clock, Effect, Stream } from "effect";
+import type { BroadcastMessage } from "./Messages.js";
+
+// A response whose deltas have gone quiet this long without its end (one
+// that timed out, or a failed answer) stops holding up the others.
+const HOLD_MS = 30_000;
+
+type Part = Extract<BroadcastMessage, { type: "delta" | "answer_delta" }>;
+
+const isPart = (msg: BroadcastMessage): msg is Part =>
+  msg.type === "delta" || msg.type === "answer_delta";
+
+// The message a response's parts end with.
+const endOf = (msg: BroadcastMessage) =>
+  msg.type === "complete" || msg.type === "answer" ? msg.responseId : null;
+
+interface State {
+  // Response whose deltas are going out, and when its last one did.
+  readonly current: { readonly id: string; readonly at: number } | null;
+  // Messages of the other responses, held in arrival order, each ending
+  // with the response's end once it has come.
+  readonly held: ReadonlyMap<string, ReadonlyArray<BroadcastMessage>>;
+}
+
+const EMPTY: State = { current: null, held: new Map() };
+
+// Sends the held responses in turn, up to the first one not over yet, which
+// takes the turn.
+const release = (
+  held: ReadonlyMap<string, ReadonlyArray<BroadcastMessage>>,
+  now: number
+): readonly [State, ReadonlyArray<BroadcastMessage>] => {
+  const out: Array<BroadcastMessage> = [];
+  const rest = new Map(held);
+  for (const [id, messages] of held) {
+    rest.delete(id);
+    out.push(...messages);
+    if (endOf(messages[messages.length - 1]!) === null) {
+      return [{ current: { id, at: now }, held: rest }, out];
+    }
+  }
+  return [EMPTY, out];
+};
+
+const step = (
+  state: State,
+  msg: BroadcastMessage,
+  now: number
+): readonly [State, ReadonlyArray<BroadcastMessage>] => {
+  if (state.current && now - state.current.at > HOLD_MS) {
+    const [next, released] = release(state.held, now);
+    const [after, out] = step(next, msg, now);
+    return [after, [...released, ...out]];
+  }
+  const id = isPart(msg) ? msg.responseId : endOf(msg);
+  if (id === null) return [state, [msg]];
+  if (state.current?.id === id) {
+    if (isPart(msg)) return [{ ...state, current: { id, at: now } }, [msg]];
+    const [next, released] = release(state.held, now);
+    return [next, [msg, ...released]];
+  }
+  const held = state.held.get(id);
+  const hold = (messages: ReadonlyArray<BroadcastMessage>) =>
+    [{ ...state, held: new Map(state.held).set(id, messages) }, []] as const;
+  if (held) return hold([...held, msg]);
+  // An end without parts held, or the first parts while no response has the
+  // turn.
+  if (!isPart(msg)) return [state, [msg]];
+  if (state.current === null) {
+    return [{ ...state, current: { id, at: now } }, [msg]];
+  }
+  return hold([msg]);
+};
+
+// Keeps the deltas (and answer_deltas) of concurrent responses from being
+// interleaved on a client's stream: once a response's deltas start, those of
+// the others are held until it ends with its complete (or answer), then sent
+// in the order they came, each response's end after its deltas. Together
+// with each delta's seq, a client can put a response together from what it
+// receives in a row, whenever it connected. Other messages pass straight
+// through. Only the messages `keep` accepts are sent; the ends of the others
+// are still seen, so a client filtering them out isn't held up.
+export const serializeResponses =
+  (keep: (msg: BroadcastMessage) => boolean) =>
+  <E, R>(messages: Stream.Stream<BroadcastMessage, E, R>) =>
+    messages.pipe(
+      Stream.filter((msg) => keep(msg) || endOf(msg) !== null),
+      Stream.mapAccumEffect(EMPTY, (state, msg) =>
+        Clock.currentTimeMillis.pipe(
+          Effect.map((now) => step(state, msg, now))
+        )
+      ),
+      Stream.flattenIterables,
+      Stream.filter(keep)
+    );
@@ -0,0 +1,201 @@
+import type { ServerWebSocket } from "bun";
+import {
+  appendFileSync,
+  existsSync,
+  mkdirSync,
+  readFileSync,
+  writeFileSync,
+} from "node:fs";
+import { dirname, join } from "node:path";
+import { Config, Effect, Option, Schedule, Stream } from "effect";
+import type { InputFormatSpec } from "./AudioFormat.js";
+
+// Development fixtures: with DEV_REPLAY=record, a live run saves the decoded
+// source audio and every OpenAI server event to DEV_REPLAY_DIR (defaults to
+// fixtures/); with DEV_REPLAY=replay, that audio is streamed again and a local
+// stand-in for the Realtime API answers with the recorded responses, so no
+// ffmpeg, network or API key is needed. Files are written synchronously, which
+// is fine for a development run but not meant for production.
+export const DevReplayConfig = Config.all({
+  mode: Config.option(Config.literal("record", "replay")("DEV_REPLAY")),
+  dir: Config.string("DEV_REPLAY_DIR").pipe(Config.withDefault("fixtures")),
+});
+
+export type DevReplayConfig = Config.Config.Success<typeof DevReplayConfig>;
+
+export const audioFixture = (dir: string, spec: InputFormatSpec) =>
+  join(dir, `audio-${spec.sampleRate}.${spec.format}`);
+
+const eventsFixture = (dir: string) => join(dir, "events.jsonl");
+
+// Starts a new recording, replacing the previous one.
+export const resetFixture = (path: string) => {
+  mkdirSync(dirname(path), { recursive: true });
+  writeFileSync(path, "");
+};
+
+export const recordAudio = (path: string, chunk: Uint8Array) =>
+  appendFileSync(path, chunk);
+
+export const makeEventRecorder = (dir: string) => {
+  const path = eventsFixture(dir);
+  resetFixture(path);
+  const start = Date.now();
+  return (event: unknown) =>
+    appendFileSync(
+      path,
+      `${JSON.stringify({ at: Date.now() - start, event })}\n`
+    );
+};
+
+// Recorded audio in `chunkBytes` pieces at real-time pace, looped. Each piece
+// is copied into a buffer from `acquire` so it can be released like a live
+// chunk.
+export const replayAudio = (
+  path: string,
+  chunkBytes: number,
+  bytesPerSecond: number,
+  acquire: (length: number) => Buffer
+) =>
+  Stream.suspend(() => {
+    if (!existsSync(path)) {
+      return Stream.dieMessage(`No recorded audio at ${path}`);
+    }
+    const audio = readFileSync(path);
+    const pieces = Math.ceil(audio.length / chunkBytes);
+    return Stream.range(0, pieces - 1).pipe(
+      Stream.map((i) => {
+        const piece = audio.subarray(i * chunkBytes, (i + 1) * chunkBytes);
+        const out = acquire(piece.length);
+        piece.copy(out);
+        return out;
+      }),
+      Stream.schedule(
+        Schedule.spaced(Math.round((chunkBytes / bytesPerSecond) * 1000))
+      ),
+      Stream.forever
+    );
+  });
+
+interface RecordedEvent {
+  readonly at: number;
+  readonly event: {
+    readonly type: string;
+    readonly response_id?: string;
+    readonly response?: {
+      readonly id: string;
+      readonly metadata?: Record<string, string> | null;
+    };
+  };
+}
+
+interface RecordedResponse {
+  readonly kind: string;
+  readonly events: ReadonlyArray<RecordedEvent>;
+}
+
+// Window responses are told apart by task; clip and comparison responses
+// only by their kind.
+const responseKind = (metadata: Record<string, string> | null | undefined) =>
+  metadata?.task ??
+  (metadata?.comparison ? "comparison" : metadata?.clip ? "clip" : "other");
+
+const loadResponses = (dir: string) => {
+  const path = eventsFixture(dir);
+  if (!existsSync(path)) throw new Error(`No recorded events at ${path}`);
+  const byId = new Map<string, Array<RecordedEvent>>();
+  const responses: Array<RecordedResponse> = [];
+  for (const line of readFileSync(path, "utf8").split("\n")) {
+    if (!line) continue;
+    const recorded = JSON.parse(line) as RecordedEvent;
+    const { event } = recorded;
+    const id = event.response_id ?? event.response?.id;
+    if (!id) continue;
+    if (event.type === "response.created") {
+      const events = [recorded];
+      byId.set(id, events);
+      responses.push({ kind: responseKind(event.response?.metadata), events });
+    } else {
+      byId.get(id)?.push(recorded);
+    }
+  }
+  return responses.filter((r) =>
+    r.events.some((e) => e.event.type === "response.done")
+  );
+};
+
+const send = (ws: ServerWebSocket<unknown>, event: object) =>
+  ws.send(JSON.stringify(event));
+
+// Local Realtime API stand-in answering each response.create with the next
+// recorded response of the same kind (cycling through them), under a fresh id
+// and the request's own metadata, with the recorded timing.
+export const startReplayServer = (dir: string) =>
+  Effect.acquireRelease(
+    Effect.sync(() => {
+      const responses = loadResponses(dir);
+      if (responses.length === 0) {
+        throw new Error(`No complete responses recorded in ${dir}`);
+      }
+      const cursors = new Map<string, number>();
+      let items = 0;
+      let created = 0;
+
+      const nextResponse = (kind: string) => {
+        const candidates = responses.filter((r) => r.kind === kind);
+        const pool = candidates.length > 0 ? candidates : responses;
+        const cursor = cursors.get(kind) ?? 0;
+        cursors.set(kind, cursor + 1);
+        return pool[cursor % pool.length]!;
+      };
+
+      const server = Bun.serve({
+        port: 0,
+        fetch: (req, server) =>
+          server.upgrade(req)
+            ? undefined
+            : new Response("Expected a WebSocket", { status: 400 }),
+        websocket: {
+          message: (ws, data) => {
+            const event = JSON.parse(String(data));
+            switch (event.type) {
+              case "session.update":
+                send(ws, { type: "session.updated", session: event.session });
+                break;
+              case "input_audio_buffer.commit":
+                send(ws, {
+                  type: "input_audio_buffer.committed",
+                  item_id: `replay_item_${++items}`,
+                });
+                break;
+              case "response.create": {
+                const metadata = event.response?.metadata ?? null;
+                const recorded = nextResponse(responseKind(metadata));
+                const id = `replay_resp_${++created}`;
+                const start = recorded.events[0]!.at;
+                for (const { at, event: original } of recorded.events) {
+                  const replayed = {
+                    ...original,
+                    ...(original.response_id && { response_id: id }),
+                    ...(original.response && {
+                      response: { ...original.response, id, metadata },
+                    }),
+                  };
+                  setTimeout(() => send(ws, replayed), at - start);
+                }
+                break;
+              }
+            }
+          },
+        },
+      });
+      return server;
+    }),
+    (server) => Effect.sync(() => server.stop(true))
+  ).pipe(Effect.map((server) => `ws://localhost:${server.port}`));
+
+export const isReplaying = (config: DevReplayConfig) =>
+  Option.contains(config.mode, "replay");
+
+export const isRecording = (config: DevReplayConfig) =>
+  Option.contains(config.mode, "record");
@@ -0,0 +1,260 @@
+import type { ServerWebSocket } from "bun";
+import { Config, Effect } from "effect";
+
+// With OPENAI_DRY_RUN=true nothing is sent to OpenAI: a local stand-in for
+// the Realtime API takes the session's messages, logs what each response
+// would have been sent and cost, and answers it with that estimate, so the
+// whole pipeline runs and a new source can be costed before it is paid for.
+// Audio counts one token per 100 ms, as OpenAI bills user audio, and text
+// about four characters per token; each response is assumed to write
+// DRY_RUN_OUTPUT_TOKENS. Prices are in USD per million tokens, gpt-realtime's
+// by default.
+export const DryRunConfig = Config.all({
+  enabled: Config.boolean("OPENAI_DRY_RUN").pipe(Config.withDefault(false)),
+  audioInputPrice: Config.number("DRY_RUN_AUDIO_INPUT_PRICE").pipe(
+    Config.withDefault(32)
+  ),
+  textInputPrice: Config.number("DRY_RUN_TEXT_INPUT_PRICE").pipe(
+    Config.withDefault(4)
+  ),
+  outputPrice: Config.number("DRY_RUN_OUTPUT_PRICE").pipe(
+    Config.withDefault(16)
+  ),
+  outputTokens: Config.integer("DRY_RUN_OUTPUT_TOKENS").pipe(
+    Config.withDefault(150)
+  ),
+});
+
+export type DryRunConfig = Config.Config.Success<typeof DryRunConfig>;
+
+export interface DryRunEstimate {
+  readonly responses: number;
+  // Audio appended to the input buffer, whether responses used it or not.
+  readonly audioSeconds: number;
+  // Input of the responses: audio they referenced, and instructions, text
+  // and remembered commentary.
+  readonly audioTokens: number;
+  readonly textTokens: number;
+  readonly outputTokens: number;
+  readonly costUsd: number;
+  // The cost so far spread over the time since the first audio.
+  readonly costPerHourUsd: number | null;
+  // Time of the first audio, null before any.
+  readonly since: number | null;
+}
+
+const AUDIO_TOKENS_PER_SECOND = 10;
+
+const textTokens = (text: string | undefined) =>
+  Math.ceil((text?.length ?? 0) / 4);
+
+// Appended audio is base64, three bytes per four characters.
+const base64Bytes = (audio: string) => Math.floor((audio.length * 3) / 4);
+
+interface InputPart {
+  readonly type?: string;
+  readonly id?: string;
+  readonly text?: string;
+  readonly audio?: string;
+  readonly content?: ReadonlyArray<InputPart>;
+}
+
+const send = (ws: ServerWebSocket<unknown>, event: object) =>
+  ws.send(JSON.stringify(event));
+
+// `bytesPerSecond` is that of the input format the session asks for; the
+// stand-in accepts any.
+export const startDryRunServer = (
+  config: DryRunConfig,
+  bytesPerSecond: number
+) =>
+  Effect.acquireRelease(
+    Effect.sync(() => {
+      // Committed items, as audio bytes or text tokens.
+      const items = new Map<string, { bytes: number; tokens: number }>();
+      let instructions = "";
+      let transcribes = false;
+      let pendingBytes = 0;
+      let itemCount = 0;
+      let responseCount = 0;
+      const totals = {
+        audioBytes: 0,
+        audioTokens: 0,
+        textTokens: 0,
+        outputTokens: 0,
+        costUsd: 0,
+        since: null as number | null,
+      };
+
+      const audioTokens = (bytes: number) =>
+        Math.ceil((bytes / bytesPerSecond) * AUDIO_TOKENS_PER_SECOND);
+
+      // Input tokens of a response, as [audio, text].
+      const inputTokens = (
+        parts: ReadonlyArray<InputPart>
+      ): [number, number] =>
+        parts.reduce<[number, number]>(
+          ([audio, text], part) => {
+            if (part.type === "item_reference") {
+              const item = part.id ? items.get(part.id) : undefined;
+              return [
+                audio + audioTokens(item?.bytes ?? 0),
+                text + (item?.tokens ?? 0),
+              ];
+            }
+            if (part.type === "input_audio" && part.audio) {
+              return [audio + audioTokens(base64Bytes(part.audio)), text];
+            }
+            if (part.content) {
+              const [a, t] = inputTokens(part.content);
+              return [audio + a, text + t];
+            }
+            return [audio, text + textTokens(part.text)];
+          },
+          [0, 0]
+        );
+
+      const estimate = (): DryRunEstimate => {
+        const hours =
+          totals.since === null ? 0 : (Date.now() - totals.since) / 3_600_000;
+        return {
+          responses: responseCount,
+          audioSeconds:
+            Math.round((totals.audioBytes / bytesPerSecond) * 10) / 10,
+          audioTokens: totals.audioTokens,
+          textTokens: totals.textTokens,
+          outputTokens: totals.outputTokens,
+          costUsd: totals.costUsd,
+          costPerHourUsd: hours > 0 ? totals.costUsd / hours : null,
+          since: totals.since,
+        };
+      };
+
+      const respond = (
+        ws: ServerWebSocket<unknown>,
+        response: {
+          instructions?: string;
+          metadata?: Record<string, string> | null;
+          input?: ReadonlyArray<InputPart>;
+        }
+      ) => {
+        const [audio, text] = inputTokens(response.input ?? []);
+        const textIn = text + textTokens(response.instructions ?? instructions);
+        const cost =
+          (audio * config.audioInputPrice +
+            textIn * config.textInputPrice +
+            config.outputTokens * config.outputPrice) /
+          1_000_000;
+        responseCount++;
+        totals.audioTokens += audio;
+        totals.textTokens += textIn;
+        totals.outputTokens += config.outputTokens;
+        totals.costUsd += cost;
+        const task = response.metadata?.task ?? "one-off";
+        const source = response.metadata?.source;
+        const summary =
+          `~$${cost.toFixed(4)} (${audio} audio + ${textIn} text tokens in, ` +
+          `~${config.outputTokens} out)`;
+        const total = estimate();
+        Effect.runFork(
+          Effect.log(
+            `Dry run: "${task}" response${source ? ` for ${source}` : ""} ` +
+              `would cost ${summary}; $${total.costUsd.toFixed(4)} so far` +
+              (total.costPerHourUsd === null
+                ? ""
+                : `, ~$${total.costPerHourUsd.toFixed(2)}/hour`)
+          )
+        );
+        const id = `dry_resp_${responseCount}`;
+        const answer = `[dry run] ${summary}`;
+        send(ws, {
+          type: "response.created",
+          response: { id, metadata: response.metadata ?? null },
+        });
+        send(ws, {
+          type: "response.output_text.delta",
+          response_id: id,
+          delta: answer,
+        });
+        send(ws, {
+          type: "response.done",
+          response: {
+            id,
+            status: "completed",
+            metadata: response.metadata ?? null,
+            output: [{ content: [{ text: answer }] }],
+            usage: {
+              output_tokens: config.outputTokens,
+              input_token_details: { audio_tokens: audio, text_tokens: textIn },
+            },
+          },
+        });
+      };
+
+      const server = Bun.serve({
+        port: 0,
+        fetch: (req, server) =>
+          server.upgrade(req)
+            ? undefined
+            : new Response("Expected a WebSocket", { status: 400 }),
+        websocket: {
+          message: (ws, data) => {
+            const event = JSON.parse(String(data));
+            switch (event.type) {
+              case "session.update":
+                instructions = event.session?.instructions ?? instructions;
+                transcribes =
+                  event.session?.audio?.input?.transcription != null ||
+                  transcribes;
+                send(ws, { type: "session.updated", session: event.session });
+                break;
+              case "input_audio_buffer.append": {
+                const bytes = base64Bytes(event.audio);
+                totals.since ??= Date.now();
+                totals.audioBytes += bytes;
+                pendingBytes += bytes;
+                break;
+              }
+              case "input_audio_buffer.clear":
+                pendingBytes = 0;
+                break;
+              case "input_audio_buffer.commit": {
+                const id = `dry_item_${++itemCount}`;
+                items.set(id, { bytes: pendingBytes, tokens: 0 });
+                pendingBytes = 0;
+                send(ws, { type: "input_audio_buffer.committed", item_id: id });
+                // Two-stage commentary waits for the transcript.
+                if (transcribes) {
+                  send(ws, {
+                    type: "conversation.item.input_audio_transcription.completed",
+                    item_id: id,
+                    transcript: "[dry run]",
+                  });
+                }
+                break;
+              }
+              case "conversation.item.create":
+                if (event.item?.id) {
+                  const [, tokens] = inputTokens(event.item.content ?? []);
+                  items.set(event.item.id, { bytes: 0, tokens });
+                }
+                break;
+              case "conversation.item.delete":
+                items.delete(event.item_id);
+                break;
+              case "response.create":
+                respond(ws, event.response ?? {});
+                break;
+            }
+          },
+        },
+      });
+      return { server, estimate };
+    }),
+    ({ server }) => Effect.sync(() => server.stop(true))
+  ).pipe(
+    Effect.map(({ server, estimate }) => ({
+      url: `ws://localhost:${server.port}`,
+      estimate,
+    }))
+  );
@@ -0,0 +1,150 @@
+import { Option } from "effect";
+import { parseDigest, type Digest } from "./Messages.js";
+import { RESPONSE_TASKS, type TaskId } from "./Tasks.js";
+import type { Transcript } from "./TranscriptBackend.js";
+
+// Tasks whose completed responses make up the feed.
+export const FEED_TASKS: ReadonlyArray<TaskId> = ["summarize", "digest"];
+
+const escapeXml = (text: string) =>
+  text
+    .replaceAll("&", "&amp;")
+    .replaceAll("<", "&lt;")
+    .replaceAll(">", "&gt;")
+    .replaceAll('"', "&quot;");
+
+// Inline markup of escaped text. Only http(s) links are kept as links.
+const renderInline = (text: string) =>
+  text
+    .replace(/`([^`\n]+)`/g, "<code>$1</code>")
+    .replace(/\[([^\]\n]*)\]\((https?:\/\/[^)\s]+)\)/g, '<a href="$2">$1</a>')
+    .replace(/(\*\*|__)(?=\S)([^\n]*?\S)\1/g, "<strong>$2</strong>")
+    .replace(
+      /(?<![\p{L}\p{N}*_])([*_])(?=\S)([^\n*_]*?\S)\1(?![\p{L}\p{N}*_])/gu,
+      "<em>$2</em>"
+    );
+
+interface Block {
+  readonly tag: "p" | "ul" | "ol" | "pre" | `h${number}`;
+  readonly lines: Array<string>;
+}
+
+// Renders the Markdown models answer with (paragraphs, headings, lists, code,
+// emphasis and links) as HTML. Everything else is kept as escaped text.
+export const renderMarkdown = (markdown: string) => {
+  const blocks: Array<Block> = [];
+  const start = (tag: Block["tag"]) => {
+    const block: Block = { tag, lines: [] };
+    blocks.push(block);
+    return block;
+  };
+  let open: Block | null = null;
+  for (const line of escapeXml(markdown).split("\n")) {
+    if (/^\s*```/.test(line)) {
+      open = open?.tag === "pre" ? null : start("pre");
+      continue;
+    }
+    if (open?.tag === "pre") {
+      open.lines.push(line);
+      continue;
+    }
+    const heading = /^\s*(#{1,6})\s+(.*)$/.exec(line);
+    const bullet = /^\s*[-*+•]\s+(.*)$/.exec(line);
+    const numbered = /^\s*\d+[.)]\s+(.*)$/.exec(line);
+    if (line.trim() === "") {
+      open = null;
+    } else if (heading) {
+      // Entries have their own title, so headings start at h3.
+      start(`h${Math.min(heading[1]!.length + 2, 6)}`).lines.push(heading[2]!);
+      open = null;
+    } else if (bullet || numbered) {
+      const tag = bullet ? "ul" : "ol";
+      if (open?.tag !== tag) open = start(tag);
+      open.lines.push((bullet ?? numbered)![1]!);
+    } else {
+      if (open?.tag !== "p") open = start("p");
+      open.lines.push(line.trim());
+    }
+  }
+  return blocks
+    .map(({ tag, lines }) => {
+      switch (tag) {
+        case "pre":
+          return `<pre><code>${lines.join("\n")}</code></pre>`;
+        case "ul":
+        case "ol":
+          return `<${tag}>${lines
+            .map((item) => `<li>${renderInline(item)}</li>`)
+            .join("")}</${tag}>`;
+        default:
+          return `<${tag}>${lines.map(renderInline).join("<br>")}</${tag}>`;
+      }
+    })
+    .join("\n");
+};
+
+const renderDigest = (digest: Digest) =>
+  `<ul>${digest.bullets
+    .map((bullet) => `<li>${escapeXml(bullet)}</li>`)
+    .join("")}</ul>` +
+  (digest.entities.length > 0
+    ? `\n<p>${escapeXml(digest.entities.join(", "))}</p>`
+    : "");
+
+const isoDate = (ms: number) => new Date(ms).toISOString();
+
+// One entry per completed summary. Digests are titled with their headline,
+// plain summaries (and digests that didn't parse) with the show and station
+// they were heard on.
+const renderEntry = (
+  transcript: Transcript,
+  sourceName: (id: string) => string | null
+) => {
+  const source =
+    transcript.source === null
+      ? null
+      : { id: transcript.source, name: sourceName(transcript.source) };
+  const digest =
+    transcript.task === "digest" ? parseDigest(transcript.text) : Option.none();
+  const title = Option.match(digest, {
+    onNone: () =>
+      [transcript.program, source?.name ?? null]
+        .filter((s) => s !== null)
+        .join(" · ") || RESPONSE_TASKS[transcript.task].name,
+    onSome: (d) => d.headline,
+  });
+  const html = Option.match(digest, {
+    onNone: () => renderMarkdown(transcript.text),
+    onSome: renderDigest,
+  });
+  return `  <entry>
+    <id>urn:funny-radio:response:${escapeXml(transcript.responseId)}</id>
+    <title>${escapeXml(title)}</title>
+    <updated>${isoDate(transcript.completedAt)}</updated>${
+      source === null
+        ? ""
+        : `\n    <category term="${escapeXml(source.id)}" label="${escapeXml(source.name ?? source.id)}"/>`
+    }
+    <content type="html">${escapeXml(html)}</content>
+  </entry>`;
+};
+
+// Atom feed of the transcripts, most recent first. `updated` is used when
+// there are none.
+export const renderFeed = (params: {
+  title: string;
+  source: string | null;
+  transcripts: ReadonlyArray<Transcript>;
+  sourceName: (id: string) => string | null;
+  updated: number;
+}) => `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+  <id>urn:funny-radio:feed${
+    params.source === null ? "" : `:${escapeXml(params.source)}`
+  }</id>
+  <title>${escapeXml(params.title)}</title>
+  <updated>${isoDate(params.transcripts[0]?.completedAt ?? params.updated)}</updated>
+  <author><name>Funny Radio</name></author>
+${params.transcripts.map((t) => renderEntry(t, params.sourceName)).join("\n")}
+</feed>
+`;
@@ -0,0 +1,251 @@
+import { FileSystem } from "@effect/platform";
+import {
+  Clock,
+  Config,
+  Effect,
+  HashMap,
+  Option,
+  Pool,
+  Queue,
+  Ref,
+  Schedule,
+  Schema,
+  Stream,
+} from "effect";
+import { AppConfig } from "./AppConfig.js";
+import { AudioSource } from "./AudioSource.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { applyPostProcessing } from "./PostProcessing.js";
+import { RESPONSE_TASKS } from "./Tasks.js";
+
+export const FileJob = Schema.Struct({
+  id: Schema.String,
+  name: Schema.String.annotations({ description: "Uploaded file name" }),
+  status: Schema.Literal("queued", "running", "done", "failed"),
+  durationSeconds: Schema.NullOr(Schema.Number).annotations({
+    description: "Length of the recording, or null if ffprobe can't tell",
+  }),
+  processedSeconds: Schema.Number.annotations({
+    description: "Audio transcribed so far",
+  }),
+  progress: Schema.NullOr(Schema.Number).annotations({
+    description: "Fraction of the recording transcribed, from 0 to 1",
+  }),
+  transcript: Schema.String.annotations({
+    description: "Transcript so far, complete once the job is done",
+  }),
+  error: Schema.NullOr(Schema.String),
+  createdAt: Schema.Number.annotations({
+    description: "Upload time, in ms since the epoch",
+  }),
+}).annotations({ title: "File Job" });
+
+export type FileJob = typeof FileJob.Type;
+
+// Finished jobs beyond this many are forgotten, oldest first.
+const MAX_JOBS = 100;
+
+// Words compared when looking for the overlap between two pieces.
+const MAX_OVERLAP_WORDS = 40;
+
+const normalizeWord = (word: string) =>
+  word.replace(/[^\p{L}\p{N}]/gu, "").toLowerCase();
+
+// Appends `next` to `previous`, minus the words at its start that repeat the
+// end of `previous`: the audio both pieces share is transcribed twice.
+const joinOverlapping = (previous: string, next: string) => {
+  const before = previous.split(/\s+/).map(normalizeWord);
+  const after = next.split(/\s+/);
+  const words = after.map(normalizeWord);
+  const limit = Math.min(MAX_OVERLAP_WORDS, before.length, words.length);
+  for (let n = limit; n > 0; n--) {
+    const tail = before.slice(before.length - n);
+    if (tail.every((word, i) => word === words[i] && word !== "")) {
+      return [previous, after.slice(n).join(" ")]
+        .filter((t) => t.length > 0)
+        .join("\n");
+    }
+  }
+  return [previous, next].filter((t) => t.length > 0).join("\n");
+};
+
+// Transcribes uploaded recordings in the background, one at a time: the file
+// is decoded with ffmpeg like a live source and cut into FILE_CHUNK_SECONDS
+// pieces, each sent to OpenAI as a one-off transcribe response. Up to
+// FILE_SHARDS pieces are transcribed at once, each over a connection of its
+// own, so a recording takes a fraction of its length; pieces start
+// FILE_SHARD_OVERLAP_SECONDS before the previous one ends so no word is cut
+// in half, and the repeated words are dropped when their text is joined.
+export class FileJobs extends Effect.Service<FileJobs>()("FileJobs", {
+  scoped: Effect.gen(function* () {
+    const fs = yield* FileSystem.FileSystem;
+    const openai = yield* OpenAIRealtime;
+    const audioSource = yield* AudioSource;
+    const appConfig = yield* AppConfig;
+    const supervisor = yield* PipelineSupervisor;
+    const chunkSeconds = yield* Config.number("FILE_CHUNK_SECONDS").pipe(
+      Config.withDefault(60)
+    );
+    const shards = yield* Config.integer("FILE_SHARDS").pipe(
+      Config.withDefault(4)
+    );
+    const overlapSeconds = yield* Config.number(
+      "FILE_SHARD_OVERLAP_SECONDS"
+    ).pipe(Config.withDefault(2));
+
+    const jobs = yield* Ref.make(HashMap.empty<string, FileJob>());
+    const queue = yield* Queue.unbounded<{ id: string; dir: string }>();
+
+    const update = (id: string, f: (job: FileJob) => FileJob) =>
+      Ref.update(jobs, HashMap.modify(id, f));
+
+    // Decoded chunks hold at most 20ms of audio.
+    const chunksPerPiece = Math.max(1, Math.round(chunkSeconds * 50));
+
+    const transcribe = (
+      respondToClip: typeof openai.respondToClip,
+      piece: Buffer
+    ) =>
+      Effect.gen(function* () {
+        const text = yield* respondToClip(
+          RESPONSE_TASKS.transcribe.instructions,
+          piece
+        ).pipe(
+          Effect.retry(
+            Schedule.spaced("5 seconds").pipe(
+              Schedule.intersect(Schedule.recurs(5))
+            )
+          )
+        );
+        const { postProcessing } = yield* appConfig.get;
+        return applyPostProcessing(postProcessing, text.trim());
+      });
+
+    const run = ({ id, dir }: { id: string; dir: string }) =>
+      Effect.gen(function* () {
+        const path = `${dir}/upload`;
+        const spec = yield* openai.inputSpec;
+        const bytesPerSecond = spec.bytesPerSecond;
+        // Whole samples, so a piece never starts mid-sample.
+        const bytesPerSample = bytesPerSecond / spec.sampleRate;
+        const overlapBytes =
+          Math.floor((overlapSeconds * bytesPerSecond) / bytesPerSample) *
+          bytesPerSample;
+        const duration = yield* audioSource.fileDuration(path);
+        yield* update(id, (job) => ({
+          ...job,
+          status: "running",
+          durationSeconds: Option.getOrNull(duration),
+        }));
+        yield* Effect.log(`File job ${id} started`);
+
+        const connections = yield* Pool.make({
+          acquire: openai.openClipConnection,
+          size: shards,
+        });
+        yield* audioSource.decodeFile(path, spec).pipe(
+          Stream.mapEffect((chunk) =>
+            Effect.sync(() => Buffer.from(chunk)).pipe(
+              Effect.ensuring(audioSource.releaseChunk(chunk))
+            )
+          ),
+          Stream.grouped(chunksPerPiece),
+          // Each piece starts with the end of the one before.
+          Stream.mapAccum(Buffer.alloc(0), (tail, chunks) => {
+            const audio = Buffer.concat([...chunks]);
+            const piece = Buffer.concat([tail, audio]);
+            const next = piece.subarray(
+              Math.max(0, piece.length - overlapBytes)
+            );
+            return [next, { piece, seconds: audio.length / bytesPerSecond }];
+          }),
+          // In order, whichever piece finishes first.
+          Stream.mapEffect(
+            ({ piece, seconds }) =>
+              Pool.get(connections).pipe(
+                Effect.flatMap((respondToClip) =>
+                  transcribe(respondToClip, piece)
+                ),
+                Effect.scoped,
+                Effect.map((text) => ({ text, seconds }))
+              ),
+            { concurrency: shards }
+          ),
+          Stream.runForEach(({ text, seconds }) =>
+            update(id, (job) => {
+              const processedSeconds = job.processedSeconds + seconds;
+              return {
+                ...job,
+                processedSeconds,
+                progress: job.durationSeconds
+                  ? Math.min(1, processedSeconds / job.durationSeconds)
+                  : null,
+                transcript: joinOverlapping(job.transcript, text),
+              };
+            })
+          )
+        );
+
+        yield* update(id, (job) => ({ ...job, status: "done", progress: 1 }));
+        yield* Effect.log(`File job ${id} done`);
+      }).pipe(
+        Effect.scoped,
+        Effect.catchAll((e) =>
+          Effect.logError(`File job ${id} failed`, e).pipe(
+            Effect.zipRight(
+              update(id, (job) => ({
+                ...job,
+                status: "failed",
+                error: e.message,
+              }))
+            )
+          )
+        ),
+        Effect.ensuring(
+          fs.remove(dir, { recursive: true }).pipe(Effect.ignore)
+        )
+      );
+
+    yield* Stream.fromQueue(queue).pipe(
+      Stream.runForEach(run),
+      (loop) => supervisor.supervise("file-jobs", loop),
+      Effect.forkScoped
+    );
+
+    return {
+      get: (id: string) => Ref.get(jobs).pipe(Effect.map(HashMap.get(id))),
+      // Copies the upload out of the request's temporary storage and queues
+      // it; the copy is deleted once the job ends.
+      submit: (upload: { name: string; path: string }) =>
+        Effect.gen(function* () {
+          const dir = yield* fs.makeTempDirectory({ prefix: "funny-radio-" });
+          yield* fs.copyFile(upload.path, `${dir}/upload`);
+          const job: FileJob = {
+            id: crypto.randomUUID(),
+            name: upload.name,
+            status: "queued",
+            durationSeconds: null,
+            processedSeconds: 0,
+            progress: 0,
+            transcript: "",
+            error: null,
+            createdAt: yield* Clock.currentTimeMillis,
+          };
+          yield* Ref.update(jobs, (all) => {
+            const finished = Array.from(HashMap.values(all))
+              .filter((j) => j.status === "done" || j.status === "failed")
+              .sort((a, b) => a.createdAt - b.createdAt);
+            const excess = HashMap.size(all) + 1 - MAX_JOBS;
+            const pruned = finished
+              .slice(0, Math.max(0, excess))
+              .reduce((acc, j) => HashMap.remove(acc, j.id), all);
+            return HashMap.set(pruned, job.id, job);
+          });
+          yield* Queue.offer(queue, { id: job.id, dir });
+          yield* Effect.log(`File job ${job.id} queued: ${upload.name}`);
+          return job;
+        }),
+    } as const;
+  }),
+}) {}
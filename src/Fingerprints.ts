@@ -0,0 +1,203 @@
+import { Clock, Config, Data, Effect, Option, Ref, Schema } from "effect";
+import type { LibraryEntry } from "./AudioFingerprint.js";
+import { makeJsonFileStore } from "./JsonFileStore.js";
+
+export const FingerprintLabel = Schema.Literal("ad", "jingle").annotations({
+  description: "What the segment is, as marked by hand",
+});
+
+export type FingerprintLabel = typeof FingerprintLabel.Type;
+
+export const Fingerprint = Schema.Struct({
+  id: Schema.String,
+  source: Schema.String.annotations({
+    description: "Source it was first heard on",
+  }),
+  durationMs: Schema.Number,
+  occurrences: Schema.Number.annotations({
+    description: "Times it aired, counting the one it was learned from",
+  }),
+  firstSeenAt: Schema.Number,
+  lastSeenAt: Schema.Number,
+  label: Schema.NullOr(FingerprintLabel),
+  skip: Schema.Boolean.annotations({
+    description:
+      "Whether it is withheld from OpenAI when recognized; false keeps it",
+  }),
+}).annotations({ title: "Fingerprint" });
+
+export type Fingerprint = typeof Fingerprint.Type;
+
+// Sub-fingerprints as base64 of their little-endian uint32 bytes.
+const StoredFingerprint = Schema.Struct({
+  ...Fingerprint.fields,
+  subs: Schema.String,
+});
+
+type StoredFingerprint = typeof StoredFingerprint.Type;
+
+export class FingerprintStoreError extends Data.TaggedError(
+  "FingerprintStoreError"
+)<{ message: string }> {}
+
+// Past this many, learning forgets the one not heard for longest among
+// those without a label.
+const MAX_FINGERPRINTS = 500;
+
+const toSubs = (base64: string) =>
+  new Uint32Array(new Uint8Array(Buffer.from(base64, "base64")).buffer);
+
+const fromSubs = (subs: Uint32Array) =>
+  Buffer.from(subs.buffer, subs.byteOffset, subs.byteLength).toString(
+    "base64"
+  );
+
+const publicFields = ({ subs: _, ...fingerprint }: StoredFingerprint) =>
+  fingerprint;
+
+// What the repeat detectors recognize, renewed on every change that matters
+// to them so they only rebuild their index then.
+export interface FingerprintLibrary {
+  readonly version: number;
+  readonly entries: ReadonlyArray<LibraryEntry>;
+  // Recognized but still sent to OpenAI.
+  readonly kept: ReadonlySet<string>;
+}
+
+const makeLibrary = (
+  version: number,
+  all: ReadonlyArray<StoredFingerprint>
+): FingerprintLibrary => ({
+  version,
+  entries: all.map((f) => ({ id: f.id, subs: toSubs(f.subs) })),
+  kept: new Set(all.filter((f) => !f.skip).map((f) => f.id)),
+});
+
+// Repeated segments learned from the audio, e.g. ads and jingles, kept in a
+// JSON file (FINGERPRINTS_FILE, defaults to fingerprints.json) so they are
+// recognized from the first airing after a restart.
+export class Fingerprints extends Effect.Service<Fingerprints>()(
+  "Fingerprints",
+  {
+    effect: Effect.gen(function* () {
+      const path = yield* Config.string("FINGERPRINTS_FILE").pipe(
+        Config.withDefault("fingerprints.json")
+      );
+
+      const store = yield* makeJsonFileStore({
+        path,
+        schema: Schema.Array(StoredFingerprint),
+        empty: [],
+        error: (message) => new FingerprintStoreError({ message }),
+      });
+      const fingerprints = store.get;
+      const library = yield* Ref.make(makeLibrary(0, yield* fingerprints));
+
+      // Changes to what is recognized, or kept, renew the library, in the
+      // order they were made.
+      const lock = yield* Effect.makeSemaphore(1);
+      const modify = (
+        f: (
+          all: ReadonlyArray<StoredFingerprint>
+        ) => ReadonlyArray<StoredFingerprint>,
+        renewsLibrary: boolean
+      ) =>
+        store.update(f).pipe(
+          Effect.tap((all) =>
+            renewsLibrary
+              ? Ref.update(library, (l) => makeLibrary(l.version + 1, all))
+              : Effect.void
+          ),
+          lock.withPermits(1)
+        );
+
+      const get = (id: string) =>
+        fingerprints.pipe(
+          Effect.map((all) => Option.fromNullable(all.find((f) => f.id === id)))
+        );
+
+      const update = (
+        id: string,
+        f: (fingerprint: StoredFingerprint) => StoredFingerprint,
+        renewsLibrary: boolean
+      ) =>
+        Effect.gen(function* () {
+          if (Option.isNone(yield* get(id))) return Option.none<Fingerprint>();
+          const all = yield* modify(
+            (all) => all.map((fp) => (fp.id === id ? f(fp) : fp)),
+            renewsLibrary
+          );
+          return Option.map(
+            Option.fromNullable(all.find((fp) => fp.id === id)),
+            publicFields
+          );
+        });
+
+      return {
+        list: fingerprints.pipe(Effect.map((all) => all.map(publicFields))),
+        library: Ref.get(library),
+        get: (id: string) => Effect.map(get(id), Option.map(publicFields)),
+        // A repeat heard twice so far: this airing and the one before it.
+        learn: (source: string, subs: Uint32Array, durationMs: number) =>
+          Effect.gen(function* () {
+            const now = yield* Clock.currentTimeMillis;
+            const learned: StoredFingerprint = {
+              id: `fp_${crypto.randomUUID().slice(0, 8)}`,
+              source,
+              durationMs,
+              occurrences: 2,
+              firstSeenAt: now,
+              lastSeenAt: now,
+              label: null,
+              skip: true,
+              subs: fromSubs(subs),
+            };
+            yield* modify((all) => {
+              const next = [...all, learned];
+              if (next.length <= MAX_FINGERPRINTS) return next;
+              const forgotten = next
+                .filter((f) => f.label === null)
+                .sort((a, b) => a.lastSeenAt - b.lastSeenAt)[0];
+              return next.filter((f) => f !== forgotten);
+            }, true);
+            return publicFields(learned);
+          }),
+        // Counts another airing.
+        recognized: (id: string) =>
+          Effect.gen(function* () {
+            const now = yield* Clock.currentTimeMillis;
+            return yield* update(
+              id,
+              (f) => ({
+                ...f,
+                occurrences: f.occurrences + 1,
+                lastSeenAt: now,
+              }),
+              false
+            );
+          }),
+        // Returns none if there was no such fingerprint.
+        mark: (
+          id: string,
+          changes: { label?: FingerprintLabel | null; skip?: boolean }
+        ) =>
+          update(
+            id,
+            (f) => ({
+              ...f,
+              label: changes.label === undefined ? f.label : changes.label,
+              skip: changes.skip ?? f.skip,
+            }),
+            changes.skip !== undefined
+          ),
+        // Returns false if there was no such fingerprint.
+        remove: (id: string) =>
+          Effect.gen(function* () {
+            if (Option.isNone(yield* get(id))) return false;
+            yield* modify((all) => all.filter((f) => f.id !== id), true);
+            return true;
+          }),
+      } as const;
+    }),
+  }
+) {}
@@ -0,0 +1,360 @@
+import {
+  createServer,
+  type IncomingHttpHeaders,
+  type ServerHttp2Session,
+  type ServerHttp2Stream,
+} from "node:http2";
+import {
+  Config,
+  Data,
+  Effect,
+  Fiber,
+  FiberSet,
+  Layer,
+  Option,
+  Stream,
+} from "effect";
+import { Accounts, type Role } from "./Accounts.js";
+import { AudioSource } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { serializeResponses } from "./DeltaOrdering.js";
+import { encodeBroadcastJson, type BroadcastMessage } from "./Messages.js";
+import {
+  decodeMessage,
+  encodeMessage,
+  getNumber,
+  getString,
+  ProtobufDecodeError,
+  type DecodedMessage,
+} from "./Protobuf.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+
+// See proto/funny_radio.proto for the service definition.
+const SERVICE = "/funnyradio.v1.FunnyRadio";
+
+const GrpcStatus = {
+  OK: 0,
+  INVALID_ARGUMENT: 3,
+  NOT_FOUND: 5,
+  PERMISSION_DENIED: 7,
+  UNIMPLEMENTED: 12,
+  INTERNAL: 13,
+  UNAUTHENTICATED: 16,
+} as const;
+
+class GrpcError extends Data.TaggedError("GrpcError")<{
+  code: number;
+  message: string;
+}> {}
+
+type Services = Accounts | AudioSource | Broadcaster | TranscriptStore;
+
+// `user` is the caller's account, null while accounts are off.
+type Method = (
+  request: DecodedMessage,
+  stream: ServerHttp2Stream,
+  user: string | null
+) => Effect.Effect<void, GrpcError, Services>;
+
+const frame = (msg: Uint8Array) => {
+  const out = Buffer.allocUnsafe(5 + msg.length);
+  out[0] = 0;
+  out.writeUInt32BE(msg.length, 1);
+  out.set(msg, 5);
+  return out;
+};
+
+const respond = (stream: ServerHttp2Stream) =>
+  stream.respond(
+    { ":status": 200, "content-type": "application/grpc" },
+    { waitForTrailers: true }
+  );
+
+// Ends the call with the given status, as a trailers-only response if no
+// headers were sent yet.
+const finish = (stream: ServerHttp2Stream, code: number, message = "") => {
+  if (stream.closed || stream.destroyed) return;
+  const trailers = {
+    "grpc-status": String(code),
+    ...(message ? { "grpc-message": encodeURIComponent(message) } : {}),
+  };
+  if (!stream.headersSent) {
+    stream.respond(
+      { ":status": 200, "content-type": "application/grpc", ...trailers },
+      { endStream: true }
+    );
+    return;
+  }
+  stream.once("wantTrailers", () => stream.sendTrailers(trailers));
+  stream.end();
+};
+
+const readRequest = (stream: ServerHttp2Stream) =>
+  Effect.async<Uint8Array, GrpcError>((resume) => {
+    const chunks: Buffer[] = [];
+    stream.on("data", (chunk: Buffer) => chunks.push(chunk));
+    stream.on("end", () => {
+      const body = Buffer.concat(chunks);
+      if (body.length < 5) {
+        return resume(
+          Effect.fail(
+            new GrpcError({
+              code: GrpcStatus.INVALID_ARGUMENT,
+              message: "Missing request message",
+            })
+          )
+        );
+      }
+      if (body[0] !== 0) {
+        return resume(
+          Effect.fail(
+            new GrpcError({
+              code: GrpcStatus.UNIMPLEMENTED,
+              message: "Compressed messages are not supported",
+            })
+          )
+        );
+      }
+      // Unary calls carry exactly one message, of the length its frame says.
+      if (body.readUInt32BE(1) !== body.length - 5) {
+        return resume(
+          Effect.fail(
+            new GrpcError({
+              code: GrpcStatus.INVALID_ARGUMENT,
+              message: "Request frame length doesn't match its message",
+            })
+          )
+        );
+      }
+      resume(Effect.succeed(body.subarray(5)));
+    });
+  });
+
+const unary =
+  (
+    handler: (
+      request: DecodedMessage,
+      user: string | null
+    ) => Effect.Effect<Uint8Array, GrpcError, Services>
+  ): Method =>
+  (request, stream, user) =>
+    handler(request, user).pipe(
+      Effect.flatMap((response) =>
+        Effect.sync(() => {
+          respond(stream);
+          stream.write(frame(response));
+          finish(stream, GrpcStatus.OK);
+        })
+      )
+    );
+
+const encodeBroadcast = (msg: BroadcastMessage) =>
+  encodeMessage([
+    [1, msg.type],
+    [2, "responseId" in msg ? msg.responseId : null],
+    [3, "task" in msg ? msg.task : null],
+    [4, "text" in msg ? msg.text : null],
+    [5, "message" in msg ? msg.message : null],
+    [6, "retryInMs" in msg ? msg.retryInMs : null],
+    [7, "audioOffsetMs" in msg ? msg.audioOffsetMs : null],
+    [8, "source" in msg ? msg.source : null],
+    [9, "code" in msg ? msg.code : null],
+    [10, "seq" in msg ? msg.seq : null],
+    [15, encodeBroadcastJson(msg)],
+  ]);
+
+const selectSource = unary((request, user) =>
+  Effect.gen(function* () {
+    const id = getString(request, 1) || null;
+    const source = id
+      ? Option.getOrNull(yield* AudioSource.findSource(id))
+      : null;
+    if (id && !source) {
+      return yield* new GrpcError({
+        code: GrpcStatus.NOT_FOUND,
+        message: `Unknown source "${id}"`,
+      });
+    }
+    yield* AudioSource.setSource(id, "request", user);
+    const name = source?.name ?? null;
+    yield* Effect.log(
+      name ? `Audio source changed to: ${name}` : "Audio source cleared"
+    );
+    return encodeMessage([
+      [1, id],
+      [2, name],
+    ]);
+  })
+);
+
+const streamMessages: Method = (_request, stream) =>
+  Effect.gen(function* () {
+    const broadcaster = yield* Broadcaster;
+    const subscription = yield* broadcaster.subscribeClient(
+      "grpc",
+      stream.session?.socket.remoteAddress ?? null,
+      null
+    );
+    yield* Effect.sync(() => respond(stream));
+    yield* Stream.fromQueue(subscription).pipe(
+      // Translations are for the stream clients that asked for them.
+      serializeResponses((msg) => msg.type !== "translation"),
+      Stream.takeUntil((msg) => msg.type === "server_shutdown"),
+      Stream.runForEach((msg) =>
+        Effect.sync(() => stream.write(frame(encodeBroadcast(msg))))
+      )
+    );
+  }).pipe(
+    Effect.scoped,
+    Effect.ensuring(Effect.sync(() => finish(stream, GrpcStatus.OK)))
+  );
+
+const getTranscripts = unary((request) =>
+  Effect.gen(function* () {
+    const limit = Math.min(getNumber(request, 1) || 50, 500);
+    const store = yield* TranscriptStore;
+    const transcripts = yield* store.recent(limit).pipe(
+      Effect.mapError(
+        () =>
+          new GrpcError({
+            code: GrpcStatus.INTERNAL,
+            message: "Failed to read transcripts",
+          })
+      )
+    );
+    return encodeMessage(
+      transcripts.map(
+        (t) =>
+          [
+            1,
+            encodeMessage([
+              [1, t.responseId],
+              [2, t.task],
+              [3, t.source],
+              [4, t.text],
+              [5, t.completedAt],
+              ...t.segments.map(
+                (segment) =>
+                  [
+                    6,
+                    encodeMessage([
+                      [1, segment.speaker],
+                      [2, segment.text],
+                    ]),
+                  ] as const
+              ),
+              [7, t.program],
+              [8, t.windowStart],
+              [9, t.windowEnd],
+            ]),
+          ] as const
+      )
+    );
+  })
+);
+
+const METHODS: Record<string, Method> = {
+  [`${SERVICE}/SelectSource`]: selectSource,
+  [`${SERVICE}/StreamMessages`]: streamMessages,
+  [`${SERVICE}/GetTranscripts`]: getTranscripts,
+};
+
+// With accounts on, calls carry a session token in their authorization
+// metadata, as for the HTTP API; selecting a source takes an admin. Returns
+// the caller's username, null while accounts are off.
+const authorizeCall = (path: string, headers: IncomingHttpHeaders) =>
+  Effect.gen(function* () {
+    const accounts = yield* Accounts;
+    if (!accounts.enabled) return null;
+    const role: Role = path === `${SERVICE}/SelectSource` ? "admin" : "viewer";
+    const token = headers.authorization?.match(/^Bearer (.+)$/i)?.[1];
+    const user =
+      token === undefined ? Option.none() : yield* accounts.authenticate(token);
+    if (Option.isNone(user)) {
+      return yield* new GrpcError({
+        code: GrpcStatus.UNAUTHENTICATED,
+        message: "Missing or invalid session token",
+      });
+    }
+    if (role === "admin" && user.value.role !== "admin") {
+      return yield* new GrpcError({
+        code: GrpcStatus.PERMISSION_DENIED,
+        message: "Admins only",
+      });
+    }
+    return user.value.username;
+  });
+
+const handleCall = (stream: ServerHttp2Stream, headers: IncomingHttpHeaders) =>
+  Effect.gen(function* () {
+    const path = headers[":path"] ?? "";
+    const method = METHODS[path];
+    if (!method) {
+      return yield* new GrpcError({
+        code: GrpcStatus.UNIMPLEMENTED,
+        message: `Unknown method ${path}`,
+      });
+    }
+    const user = yield* authorizeCall(path, headers);
+    const body = yield* readRequest(stream);
+    const request = yield* Effect.try({
+      try: () => decodeMessage(body),
+      catch: (e) =>
+        new GrpcError({
+          code: GrpcStatus.INVALID_ARGUMENT,
+          message:
+            e instanceof ProtobufDecodeError
+              ? `Malformed request message: ${e.message}`
+              : "Malformed request message",
+        }),
+    });
+    yield* method(request, stream, user);
+  }).pipe(
+    Effect.catchTag("GrpcError", (e) =>
+      Effect.sync(() => finish(stream, e.code, e.message))
+    ),
+    Effect.catchAllDefect((defect) =>
+      Effect.logError("gRPC call failed", defect).pipe(
+        Effect.zipRight(
+          Effect.sync(() => finish(stream, GrpcStatus.INTERNAL, "Internal error"))
+        )
+      )
+    )
+  );
+
+// Plaintext (h2c) gRPC server running next to the HTTP API on its own port.
+export const GrpcServerLive = Layer.scopedDiscard(
+  Effect.gen(function* () {
+    const port = yield* Config.port("GRPC_PORT").pipe(
+      Config.withDefault(50051)
+    );
+    const sessions = new Set<ServerHttp2Session>();
+
+    const server = yield* Effect.acquireRelease(
+      Effect.async<ReturnType<typeof createServer>>((resume) => {
+        const server = createServer();
+        server.listen(port, () => resume(Effect.succeed(server)));
+      }),
+      (server) =>
+        Effect.async<void>((resume) => {
+          sessions.forEach((session) => session.destroy());
+          server.close(() => resume(Effect.void));
+        })
+    );
+
+    // Released before the server so open streams end cleanly.
+    const fibers = yield* FiberSet.make();
+    const run = yield* FiberSet.runtime(fibers)<Services>();
+
+    server.on("session", (session) => {
+      sessions.add(session);
+      session.on("close", () => sessions.delete(session));
+    });
+    server.on("stream", (stream, headers) => {
+      const fiber = run(handleCall(stream, headers));
+      stream.on("close", () => Effect.runFork(Fiber.interrupt(fiber)));
+    });
+
+    yield* Effect.log(`gRPC server listening on port ${port}`);
+  })
+);
@@ -0,0 +1,232 @@
+import { Config, Effect } from "effect";
+
+// HLS_SEGMENT_CACHE_MB turns on a local caching proxy for HLS sources, keeping
+// up to that many megabytes of segments; 0 (the default) reads them directly.
+export const HlsCacheConfig = Config.number("HLS_SEGMENT_CACHE_MB").pipe(
+  Config.withDefault(0),
+  Config.validate({
+    message: "Expected HLS_SEGMENT_CACHE_MB to be 0 or more",
+    validation: (mb) => mb >= 0,
+  })
+);
+
+// Live playlists change with every new segment, but readers polling the same
+// one within this long share a fetch.
+const PLAYLIST_TTL_MS = 1000;
+
+// Request headers left out of upstream requests: they are about the
+// connection to the proxy, or would get a body back that can't be served as
+// it is.
+const LOCAL_HEADERS = new Set([
+  "host",
+  "connection",
+  "keep-alive",
+  "accept-encoding",
+  "range",
+]);
+
+interface Fetched {
+  readonly status: number;
+  readonly contentType: string;
+  readonly body: Uint8Array;
+  readonly playlist: boolean;
+  readonly at: number;
+}
+
+export interface HlsCacheStats {
+  readonly entries: number;
+  readonly bytes: number;
+  readonly maxBytes: number;
+  // Requests answered from the cache or by a fetch already under way, and
+  // those that went upstream.
+  readonly hits: number;
+  readonly misses: number;
+  readonly fetchedBytes: number;
+  readonly servedBytes: number;
+}
+
+// The upstream URL, base64url-encoded, then its file name: ffmpeg checks a
+// segment's extension before reading it.
+const proxyPath = (url: string) => {
+  const name = new URL(url).pathname.split("/").pop() || "index";
+  return `/${Buffer.from(url).toString("base64url")}/${name}`;
+};
+
+const isPlaylist = (contentType: string, body: Uint8Array) =>
+  /mpegurl/i.test(contentType) ||
+  new TextDecoder().decode(body.subarray(0, 7)) === "#EXTM3U";
+
+// Points a playlist's variants, segments, keys and init sections back at the
+// proxy, resolved against the playlist's own URL.
+export const rewritePlaylist = (
+  body: string,
+  playlistUrl: string,
+  proxy: (url: string) => string
+) => {
+  const rewrite = (uri: string) => {
+    const url = new URL(uri, playlistUrl);
+    return url.protocol === "http:" || url.protocol === "https:"
+      ? proxy(url.toString())
+      : uri;
+  };
+  return body
+    .split("\n")
+    .map((raw) => {
+      const line = raw.trim();
+      if (line === "") return raw;
+      if (line.startsWith("#")) {
+        return raw.replace(
+          /URI="([^"]*)"/g,
+          (_, uri: string) => `URI="${rewrite(uri)}"`
+        );
+      }
+      return rewrite(line);
+    })
+    .join("\n");
+};
+
+// Local proxy for HLS sources, so the pipelines reading the same station
+// (processing, comparisons, catch-up) fetch each segment from it once rather
+// than once each. ffmpeg reads the proxied playlist, whose URIs lead back
+// here; the headers it sends are passed upstream. Segments are kept, least
+// recently used first out, up to `maxBytes`; concurrent requests for the same
+// URL share one fetch. Byte-range requests go straight through.
+export const startHlsCache = (maxBytes: number) =>
+  Effect.acquireRelease(
+    Effect.sync(() => {
+      // In least recently used order.
+      const cached = new Map<string, Fetched>();
+      const pending = new Map<string, Promise<Fetched>>();
+      const totals = {
+        bytes: 0,
+        hits: 0,
+        misses: 0,
+        fetchedBytes: 0,
+        servedBytes: 0,
+      };
+      let origin = "";
+      const proxy = (url: string) => `${origin}${proxyPath(url)}`;
+
+      const remember = (url: string, fetched: Fetched) => {
+        if (fetched.body.length > maxBytes) return;
+        cached.set(url, fetched);
+        totals.bytes += fetched.body.length;
+        for (const [oldest, entry] of cached) {
+          if (totals.bytes <= maxBytes) break;
+          cached.delete(oldest);
+          totals.bytes -= entry.body.length;
+        }
+      };
+
+      const fetchUpstream = async (
+        url: string,
+        headers: Headers
+      ): Promise<Fetched> => {
+        const res = await fetch(url, { headers });
+        const contentType = res.headers.get("content-type") ?? "";
+        const body = new Uint8Array(await res.arrayBuffer());
+        totals.fetchedBytes += body.length;
+        const playlist = res.ok && isPlaylist(contentType, body);
+        return {
+          status: res.status,
+          contentType,
+          body: playlist
+            ? new TextEncoder().encode(
+                rewritePlaylist(new TextDecoder().decode(body), url, proxy)
+              )
+            : body,
+          playlist,
+          at: Date.now(),
+        };
+      };
+
+      const load = (url: string, headers: Headers) => {
+        const hit = cached.get(url);
+        if (hit && (!hit.playlist || Date.now() - hit.at < PLAYLIST_TTL_MS)) {
+          totals.hits++;
+          cached.delete(url);
+          cached.set(url, hit);
+          return Promise.resolve(hit);
+        }
+        const inFlight = pending.get(url);
+        if (inFlight) {
+          totals.hits++;
+          return inFlight;
+        }
+        totals.misses++;
+        if (hit) {
+          cached.delete(url);
+          totals.bytes -= hit.body.length;
+        }
+        const request = fetchUpstream(url, headers)
+          .then((fetched) => {
+            if (fetched.status === 200) remember(url, fetched);
+            return fetched;
+          })
+          .finally(() => pending.delete(url));
+        pending.set(url, request);
+        return request;
+      };
+
+      const server = Bun.serve({
+        hostname: "127.0.0.1",
+        port: 0,
+        fetch: async (req) => {
+          const encoded = new URL(req.url).pathname.split("/")[1] ?? "";
+          const url = Buffer.from(encoded, "base64url").toString();
+          if (!URL.canParse(url)) {
+            return new Response("Unknown upstream URL", { status: 400 });
+          }
+          const headers = new Headers();
+          for (const [name, value] of req.headers) {
+            if (!LOCAL_HEADERS.has(name)) headers.set(name, value);
+          }
+          try {
+            const range = req.headers.get("range");
+            if (range !== null) {
+              headers.set("range", range);
+              const res = await fetch(url, { headers });
+              const passed = new Headers();
+              for (const name of ["content-type", "content-range"]) {
+                const value = res.headers.get(name);
+                if (value !== null) passed.set(name, value);
+              }
+              return new Response(res.body, {
+                status: res.status,
+                headers: passed,
+              });
+            }
+            const fetched = await load(url, headers);
+            totals.servedBytes += fetched.body.length;
+            return new Response(fetched.body, {
+              status: fetched.status,
+              headers: { "content-type": fetched.contentType },
+            });
+          } catch (e) {
+            return new Response(String(e), { status: 502 });
+          }
+        },
+      });
+      origin = `http://127.0.0.1:${server.port}`;
+
+      return {
+        server,
+        // Where ffmpeg should read an HLS playlist from.
+        url: proxy,
+        stats: Effect.sync(
+          (): HlsCacheStats => ({
+            entries: cached.size,
+            maxBytes,
+            ...totals,
+          })
+        ),
+      };
+    }),
+    ({ server }) => Effect.sync(() => server.stop(true))
+  ).pipe(
+    Effect.tap(({ server }) =>
+      Effect.log(
+        `Caching up to ${Math.round(maxBytes / 1024 / 1024)} MB of HLS segments through port ${server.port}`
+      )
+    )
+  );
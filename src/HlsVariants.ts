@@ -0,0 +1,130 @@
+import { HttpClient, HttpClientResponse } from "@effect/platform";
+import { Effect, Option } from "effect";
+
+export interface HlsVariant {
+  readonly url: string;
+  // Peak bitrate in bits/s, as advertised by the master playlist.
+  readonly bandwidth: number | null;
+}
+
+// Variants listed by an HLS master playlist, in playlist order. A media
+// playlist (or anything else) has none.
+export const parseMasterPlaylist = (
+  playlistUrl: string,
+  body: string
+): ReadonlyArray<HlsVariant> => {
+  const variants: Array<HlsVariant> = [];
+  let pending: { bandwidth: number | null } | null = null;
+  for (const raw of body.split("\n")) {
+    const line = raw.trim();
+    if (line.startsWith("#EXT-X-STREAM-INF:")) {
+      const bandwidth = /(?:^|[:,])BANDWIDTH=(\d+)/.exec(line)?.[1];
+      pending = { bandwidth: bandwidth ? Number(bandwidth) : null };
+    } else if (pending && line && !line.startsWith("#")) {
+      variants.push({
+        url: new URL(line, playlistUrl).toString(),
+        bandwidth: pending.bandwidth,
+      });
+      pending = null;
+    }
+  }
+  return variants;
+};
+
+// Highest-bitrate variant within `maxBitrate`, or the lowest one if none fits.
+export const pickVariant = (
+  variants: ReadonlyArray<HlsVariant>,
+  maxBitrate: number
+): HlsVariant | undefined => {
+  const byBandwidth = [...variants].sort(
+    (a, b) => (a.bandwidth ?? Infinity) - (b.bandwidth ?? Infinity)
+  );
+  const fitting = byBandwidth.filter(
+    (v) => v.bandwidth !== null && v.bandwidth <= maxBitrate
+  );
+  return fitting.at(-1) ?? byBandwidth[0];
+};
+
+const fetchPlaylist = (url: string, headers: Record<string, string>) =>
+  Effect.gen(function* () {
+    const client = yield* HttpClient.HttpClient;
+    return yield* client.get(url, { headers }).pipe(
+      Effect.flatMap(HttpClientResponse.filterStatusOk),
+      Effect.flatMap((res) => res.text),
+      Effect.scoped,
+      Effect.timeout("10 seconds")
+    );
+  });
+
+// Resolves the rendition to stream for a source. Without a bitrate limit, or
+// when the playlist can't be read, the source URL is used as-is and ffmpeg
+// picks the rendition.
+export const resolveVariant = (
+  url: string,
+  maxBitrate: number | undefined,
+  headers: Record<string, string> = {}
+) =>
+  Effect.gen(function* () {
+    const asIs: HlsVariant = { url, bandwidth: null };
+    if (maxBitrate === undefined) return asIs;
+    const body = yield* fetchPlaylist(url, headers);
+    return pickVariant(parseMasterPlaylist(url, body), maxBitrate) ?? asIs;
+  }).pipe(
+    Effect.catchAll((e) =>
+      Effect.logWarning(`Could not read HLS playlist ${url}`, e).pipe(
+        Effect.as<HlsVariant>({ url, bandwidth: null })
+      )
+    )
+  );
+
+// Segment durations in seconds of an HLS media playlist, in playlist order.
+export const parseSegmentDurations = (body: string): ReadonlyArray<number> =>
+  body
+    .split("\n")
+    .map((line) => /^#EXTINF:([\d.]+)/.exec(line.trim())?.[1])
+    .filter((duration): duration is string => duration !== undefined)
+    .map(Number);
+
+export interface Rewind {
+  // Negative ffmpeg -live_start_index: segments back from the live edge.
+  readonly startIndex: number;
+  // How far back that is; less than asked when the playlist window is shorter.
+  readonly seconds: number;
+}
+
+export const pickRewind = (
+  durations: ReadonlyArray<number>,
+  seconds: number
+): Rewind | undefined => {
+  let count = 0;
+  let covered = 0;
+  for (const duration of [...durations].reverse()) {
+    if (covered >= seconds) break;
+    covered += duration;
+    count++;
+  }
+  return count === 0 ? undefined : { startIndex: -count, seconds: covered };
+};
+
+// Where to start a stream to play it from `seconds` ago, if it is HLS. For a
+// master playlist the first variant's segments are measured; renditions share
+// segment boundaries.
+export const resolveRewind = (
+  url: string,
+  seconds: number,
+  headers: Record<string, string> = {}
+) =>
+  Effect.gen(function* () {
+    const body = yield* fetchPlaylist(url, headers);
+    const variant = parseMasterPlaylist(url, body)[0];
+    const media = variant ? yield* fetchPlaylist(variant.url, headers) : body;
+    return Option.fromNullable(
+      pickRewind(parseSegmentDurations(media), seconds)
+    );
+  }).pipe(
+    Effect.catchAll((e) =>
+      Effect.logWarning(`Could not read HLS playlist ${url}`, e).pipe(
+        Effect.as(Option.none<Rewind>())
+      )
+    )
+  );
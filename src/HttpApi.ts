@@ -5,28 +5,104 @@ import {
   HttpApiError,
   HttpApiGroup,
   HttpApiSchema,
+  HttpServerRequest,
   HttpServerResponse,
+  Multipart,
   OpenApi,
   Path,
+  Socket,
 } from "@effect/platform";
 import { fileURLToPath } from "node:url";
-import { Effect, Layer, Option, Schema, Stream } from "effect";
 import {
-  AudioSource,
-  AUDIO_SOURCES,
-  type AudioSourceId,
-} from "./AudioSource.js";
-import type { BroadcastMessage } from "./Messages.js";
-import { OpenAIRealtime } from "./OpenAIRealtime.js";
+  Chunk,
+  Clock,
+  DateTime,
+  Deferred,
+  Duration,
+  Effect,
+  JSONSchema,
+  Layer,
+  Option,
+  Redacted,
+  Schema,
+  Stream,
+} from "effect";
+import { Accounts, Role, SessionCookie, Username } from "./Accounts.js";
+import {
+  AppConfig,
+  NoiseReduction,
+  PlaylistConfig,
+  Preprocessing,
+  RadioConfig,
+  SourceBudget,
+  SourceConfig,
+  SourceType,
+  sourceType,
+  validSourceUrl,
+} from "./AppConfig.js";
+import { AudioSource } from "./AudioSource.js";
+import { Broadcaster, type SubscriberKind } from "./Broadcaster.js";
+import { Budgets } from "./Budgets.js";
+import { Comparison } from "./Comparison.js";
+import { CoverageAnalysis, HOUR_MS } from "./CoverageAnalysis.js";
+import { serializeResponses } from "./DeltaOrdering.js";
+import { FEED_TASKS, renderFeed } from "./Feed.js";
+import { FileJob, FileJobs } from "./FileJobs.js";
+import {
+  type Fingerprint,
+  FingerprintLabel,
+  Fingerprints,
+} from "./Fingerprints.js";
+import { IdleMonitor } from "./IdleMonitor.js";
+import { ListenSessions } from "./ListenSessions.js";
+import { LiveMetrics } from "./LiveMetrics.js";
+import { MetricsSnapshots } from "./MetricsSnapshots.js";
+import {
+  AudioLevelReading,
+  BROADCAST_VERSION,
+  BroadcastMessage,
+  encodeBroadcastJson,
+} from "./Messages.js";
+import {
+  type Experiment,
+  type Nudge,
+  OpenAIRealtime,
+  SPEECH_SAMPLE_RATE,
+} from "./OpenAIRealtime.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { Playlists } from "./Playlists.js";
+import { Preset, Presets } from "./Presets.js";
+import {
+  cpuProfile,
+  heapSnapshot,
+  memoryStats,
+  ProfilingConfig,
+} from "./Profiling.js";
+import { PushNotifications, PushSubscription } from "./PushNotifications.js";
+import {
+  REMOTE_OVERFLOW_CLOSE_CODE,
+  RemoteFormat,
+  type RemoteEnd,
+} from "./RemoteAudio.js";
+import { SemanticSearch } from "./SemanticSearch.js";
+import { batchSentences } from "./SentenceBatching.js";
+import { SelectionEvent } from "./SourceSelection.js";
+import { SourceStats } from "./SourceStats.js";
+import { NowPlaying, StationMetadata } from "./StationMetadata.js";
+import {
+  compressStream,
+  negotiateEncoding,
+  StreamCompressionConfig,
+} from "./StreamCompression.js";
+import { TaskIdSchema } from "./Tasks.js";
+import type { RepeatedSegment, Transcript } from "./TranscriptBackend.js";
+import { broadcastKey, TranscriptStore } from "./TranscriptStore.js";
+import { LanguageCode, Translations } from "./Translations.js";
 
 // Schema for audio source selection
-const AudioSourceIdSchema = Schema.Literal(
-  "franceinfo",
-  "franceinter",
-  "franceculture"
-).annotations({
+const AudioSourceIdSchema = Schema.String.annotations({
   title: "Audio Source ID",
-  description: "Identifier for a French radio station",
+  description: "Identifier for a radio station, as listed by GET /sources",
 });
 
 const AudioSourceInfo = Schema.Struct({
@@ -35,18 +111,140 @@ const AudioSourceInfo = Schema.Struct({
     description: "Human-readable station name",
   }),
   url: Schema.String.annotations({ description: "Stream URL" }),
+  backupUrls: Schema.optional(Schema.Array(Schema.String)).annotations({
+    description: "Other URLs of the stream, tried in order on failures",
+  }),
+  type: Schema.optional(SourceType),
+  tasks: Schema.Array(TaskIdSchema).annotations({
+    description: "Tasks run in parallel for each audio window",
+  }),
+  instructions: Schema.optional(Schema.String).annotations({
+    description:
+      "Commentary instructions template; {{prompt}}, {{name}} and {{id}} are substituted",
+  }),
+  maxBitrate: Schema.optional(Schema.Number).annotations({
+    description: "Preferred HLS rendition bitrate ceiling in bits/s",
+  }),
+  normalizeLoudness: Schema.optional(Schema.Boolean).annotations({
+    description: "Whether the audio's loudness is normalized before sending",
+  }),
+  delaySeconds: Schema.optional(Schema.Number).annotations({
+    description: "How far the stream lags the live broadcast, in seconds",
+  }),
+  noiseReduction: Schema.optional(NoiseReduction),
+  preprocessing: Schema.optional(Preprocessing),
+  budget: Schema.optional(SourceBudget),
 }).annotations({
   title: "Audio Source Info",
   description: "Information about an available audio source",
 });
 
+const SourceStatusSchema = Schema.Struct({
+  running: Schema.Boolean.annotations({
+    description: "Whether the source's audio pipeline is running",
+  }),
+  startedAt: Schema.NullOr(Schema.Number).annotations({
+    description: "Start of the current run, in ms since the epoch",
+  }),
+  uptimeMs: Schema.NullOr(Schema.Number),
+  bytesProcessed: Schema.Number.annotations({
+    description: "Audio received from the source since the server started",
+  }),
+  chunksReceived: Schema.Number.annotations({
+    description: "Audio chunks processed since the server started",
+  }),
+  chunksDropped: Schema.Number.annotations({
+    description:
+      "Audio chunks lost before processing: dropped when it fell behind, or missed while the stream restarted",
+  }),
+  lossRatio: Schema.Number.annotations({
+    description: "Share of the source's audio chunks lost, from 0 to 1",
+  }),
+  chunksCorrupted: Schema.Struct({
+    oddLength: Schema.Number.annotations({
+      description:
+        "Chunks ending mid-sample, realigned by carrying the extra bytes over",
+    }),
+    slipped: Schema.Number.annotations({
+      description:
+        "Chunks whose samples were read a byte off, realigned by dropping one",
+    }),
+    checksum: Schema.Number.annotations({
+      description:
+        "Chunks changed between reading and processing, dropped (with AUDIO_CHUNK_CRC)",
+    }),
+  }).annotations({
+    description: "Audio chunks found corrupted since the server started",
+  }),
+  lastResponseAt: Schema.NullOr(Schema.Number).annotations({
+    description: "Last completed response, in ms since the epoch",
+  }),
+  lastError: Schema.NullOr(
+    Schema.Struct({ message: Schema.String, at: Schema.Number })
+  ),
+  probe: Schema.NullOr(
+    Schema.Struct({
+      up: Schema.Boolean,
+      at: Schema.Number,
+      error: Schema.NullOr(Schema.String),
+    })
+  ).annotations({
+    description:
+      "Last background check that the source can be reached, or null if not checked yet",
+  }),
+  health: Schema.Array(
+    Schema.Struct({
+      url: Schema.String,
+      score: Schema.Number.annotations({
+        description:
+          "Out of 100, lowered by failures and recovering over time; under FAILOVER_THRESHOLD the next URL is used",
+      }),
+      failures: Schema.Number.annotations({
+        description: "Failed streams from this URL since the server started",
+      }),
+      lastFailure: Schema.NullOr(
+        Schema.Struct({
+          kind: Schema.Literal("unreachable", "exited", "stalled"),
+          at: Schema.Number,
+        })
+      ),
+      active: Schema.Boolean.annotations({
+        description: "Whether the source was last streamed from this URL",
+      }),
+    })
+  ).annotations({
+    description: "Health of the source's URLs, in the order they are tried",
+  }),
+}).annotations({ title: "Source Status" });
+
+const AudioSourceListing = Schema.Struct({
+  ...AudioSourceInfo.fields,
+  status: SourceStatusSchema,
+}).annotations({ title: "Audio Source Listing" });
+
 const AudioSourcesResponse = Schema.Struct({
-  sources: Schema.Array(AudioSourceInfo).annotations({
+  sources: Schema.Array(AudioSourceListing).annotations({
     description: "List of all available audio sources",
   }),
   current: Schema.NullOr(AudioSourceIdSchema).annotations({
     description: "Currently selected source, or null if none selected",
   }),
+  paused: Schema.Boolean.annotations({
+    description: "Whether audio processing is paused",
+  }),
+  variant: Schema.NullOr(
+    Schema.Struct({
+      url: Schema.String,
+      bandwidth: Schema.NullOr(Schema.Number),
+    })
+  ).annotations({
+    description:
+      "HLS rendition being streamed for the current source; bandwidth is null when ffmpeg picks it",
+  }),
+  sampleRate: Schema.NullOr(Schema.Number).annotations({
+    description:
+      "Native sample rate of the current source in Hz, null until probed",
+  }),
 }).annotations({ title: "Audio Sources Response" });
 
 const SetSourceRequest = Schema.Struct({
@@ -63,147 +261,3847 @@ const SetSourceResponse = Schema.Struct({
   }),
 }).annotations({ title: "Set Source Response" });
 
-// Define the API
-export class FunnyRadioApi extends HttpApi.make("funnyRadioApi")
-  .add(
-    HttpApiGroup.make("ui").add(
-      HttpApiEndpoint.get("getIndex", "/").addSuccess(
-        Schema.String.pipe(
-          HttpApiSchema.withEncoding({ kind: "Text", contentType: "text/html" })
-        )
-      )
-    )
-  )
-  .add(
-    HttpApiGroup.make("sources")
-      .annotate(OpenApi.Title, "Audio Sources")
-      .annotate(
-        OpenApi.Description,
-        "Manage audio sources for the sarcastic news transformer"
-      )
-      .add(
-        HttpApiEndpoint.get("getSources", "/sources")
-          .annotate(OpenApi.Summary, "List available audio sources")
-          .addSuccess(AudioSourcesResponse)
-          .addError(HttpApiError.InternalServerError)
-      )
-      .add(
-        HttpApiEndpoint.post("setSource", "/sources")
-          .annotate(OpenApi.Summary, "Set the audio source")
-          .addSuccess(SetSourceResponse)
-          .setPayload(SetSourceRequest)
-          .addError(HttpApiError.InternalServerError)
-      )
-  )
-  .add(
-    HttpApiGroup.make("stream")
-      .annotate(OpenApi.Title, "Message Stream")
-      .annotate(
-        OpenApi.Description,
-        "Server-Sent Events stream of transformed audio messages"
-      )
-      .add(
-        HttpApiEndpoint.get("getStream", "/stream")
-          .annotate(OpenApi.Summary, "Subscribe to sarcastic messages")
-          .addSuccess(
-            Schema.String.pipe(
-              HttpApiSchema.withEncoding({
-                kind: "Text",
-                contentType: "text/event-stream",
-              })
-            )
-          )
-          .addError(HttpApiError.ServiceUnavailable)
-          .addError(HttpApiError.InternalServerError)
-      )
-  )
-  .annotate(OpenApi.Title, "Funny Radio API")
-  .annotate(
-    OpenApi.Description,
-    "Transform French radio news into sarcastic, optimistic summaries using AI"
-  )
-  .annotate(OpenApi.Version, "1.0.0") {}
+const SelectionHistoryParams = Schema.Struct({
+  limit: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 500))
+  ).annotations({ description: "Maximum number of changes (default 50)" }),
+});
 
-const formatSSE = (msg: BroadcastMessage): string =>
-  `data: ${JSON.stringify(msg)}\n\n`;
+const SelectionHistoryResponse = Schema.Struct({
+  events: Schema.Array(SelectionEvent).annotations({
+    description: "Most recent first",
+  }),
+}).annotations({ title: "Selection History Response" });
 
-// UI group - serves HTML page
-const uiGroupLive = HttpApiBuilder.group(FunnyRadioApi, "ui", (handlers) =>
-  handlers.handleRaw("getIndex", () =>
-    Effect.gen(function* () {
-      const path = yield* Path.Path;
-      const currentDir = path.dirname(fileURLToPath(import.meta.url));
-      const htmlPath = path.join(currentDir, "index.html");
-      return yield* HttpServerResponse.file(htmlPath);
-    }).pipe(Effect.orDie)
-  )
+// Omitted fields are left unchanged.
+const UpdateSourceRequest = Schema.Struct({
+  instructions: Schema.optional(
+    Schema.NullOr(Schema.NonEmptyString)
+  ).annotations({
+    description:
+      "Commentary instructions template for this source, or null to use the global prompt",
+  }),
+  maxBitrate: Schema.optional(
+    Schema.NullOr(Schema.Int.pipe(Schema.positive()))
+  ).annotations({
+    description:
+      "Preferred HLS rendition bitrate ceiling in bits/s, or null to let ffmpeg choose",
+  }),
+  normalizeLoudness: Schema.optional(Schema.Boolean).annotations({
+    description:
+      "Normalize the audio's loudness before sending it to the model",
+  }),
+  delaySeconds: Schema.optional(
+    Schema.NullOr(Schema.Number.pipe(Schema.between(0, 600)))
+  ).annotations({
+    description:
+      "How far the stream lags the live broadcast, in seconds, or null for none",
+  }),
+  noiseReduction: Schema.optional(Schema.NullOr(NoiseReduction)).annotations({
+    description:
+      "Noise reduction OpenAI applies to the input audio, or null for none",
+  }),
+  preprocessing: Schema.optional(Schema.NullOr(Preprocessing)).annotations({
+    description:
+      "ffmpeg filters run on the audio before it is sent, replacing the current ones, or null for none",
+  }),
+}).annotations({ title: "Update Source Request" });
+
+// A full source definition; the id comes from the path.
+const { id: _, ...sourceFields } = SourceConfig.fields;
+const PutSourceRequest = Schema.Struct(sourceFields)
+  .pipe(Schema.filter(validSourceUrl))
+  .annotations({ title: "Put Source Request" });
+
+const NowPlayingResponse = Schema.Struct({
+  source: AudioSourceIdSchema,
+  nowPlaying: Schema.NullOr(NowPlaying).annotations({
+    description:
+      "Current show, or null if the station publishes no metadata (or the lookup failed)",
+  }),
+}).annotations({ title: "Now Playing Response" });
+
+const CatchUpRequest = Schema.Struct({
+  minutes: Schema.Number.pipe(Schema.between(1, 60)).annotations({
+    description: "How far behind live to start processing",
+  }),
+}).annotations({ title: "Catch Up Request" });
+
+const CatchUpResponse = Schema.Struct({
+  current: AudioSourceIdSchema,
+  name: Schema.String,
+  rewindSeconds: Schema.Number.annotations({
+    description:
+      "How far behind live processing restarts; less than asked when the playlist keeps less audio",
+  }),
+}).annotations({ title: "Catch Up Response" });
+
+const PushKeyResponse = Schema.Struct({
+  publicKey: Schema.String.annotations({
+    description: "VAPID public key, to pass as applicationServerKey",
+  }),
+}).annotations({ title: "Push Key Response" });
+
+const PushUnsubscribeRequest = Schema.Struct({
+  endpoint: Schema.String,
+}).annotations({ title: "Push Unsubscribe Request" });
+
+const PresetsResponse = Schema.Struct({
+  presets: Schema.Array(Preset),
+}).annotations({ title: "Presets Response" });
+
+const IngestParams = Schema.Struct({
+  format: Schema.optional(RemoteFormat).annotations({
+    description: "How the audio is encoded (default opus)",
+  }),
+  sampleRate: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(8000, 48000))
+  ).annotations({ description: "Sample rate of pcm audio (default 48000)" }),
+}).annotations({ title: "Ingest Params" });
+
+const StreamParams = Schema.Struct({
+  type: Schema.optional(Schema.String).annotations({
+    description:
+      "Comma-separated message types to keep, e.g. delta,complete (default: all)",
+  }),
+  source: Schema.optional(AudioSourceIdSchema).annotations({
+    description:
+      "Only messages about this source; messages about no source are kept",
+  }),
+  sources: Schema.optional(Schema.String).annotations({
+    description:
+      "Comma-separated sources to multiplex on one connection, e.g. franceinfo,franceinter; over SSE, messages about one of them are sent as events named after it",
+  }),
+  task: Schema.optional(TaskIdSchema).annotations({
+    description: "Only responses of this task; messages about no task are kept",
+  }),
+  batch: Schema.optional(Schema.Literal("none", "sentence")).annotations({
+    description:
+      "sentence coalesces each response's deltas into whole sentences (default none)",
+  }),
+  name: Schema.optional(Schema.Trim.pipe(Schema.maxLength(40))).annotations({
+    description: "Display name shown to other listeners (default: anonymous)",
+  }),
+  lang: Schema.optional(LanguageCode).annotations({
+    description:
+      "Also receive completed text responses translated into this language, e.g. en, as translation messages",
+  }),
+}).annotations({ title: "Stream Params" });
+
+const ReplayParams = Schema.Struct({
+  ...StreamParams.fields,
+  since: Schema.DateTimeUtc.annotations({
+    description: "Replay the responses logged since then, e.g. an hour ago",
+  }),
+  speed: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.between(1, 3600))
+  ).annotations({
+    description:
+      "How many times faster than they happened the logged messages are replayed (default 360, an hour in 10s); gaps are capped at a second",
+  }),
+}).annotations({ title: "Replay Params" });
+
+const ListenersResponse = Schema.Struct({
+  listeners: Schema.Array(
+    Schema.Struct({
+      id: Schema.String.annotations({
+        description: "Listener ID, as in listener_joined and listener_left",
+      }),
+      name: Schema.NullOr(Schema.String).annotations({
+        description: "Display name, or null for an anonymous listener",
+      }),
+      kind: Schema.Literal("sse", "ndjson", "grpc"),
+      connectedAt: Schema.Number.annotations({
+        description: "Connection time, in ms since the epoch",
+      }),
+    })
+  ).annotations({ description: "Connected stream clients, oldest first" }),
+}).annotations({ title: "Listeners Response" });
+
+const SubscriberStatsResponse = Schema.Struct({
+  subscribers: Schema.Array(
+    Schema.Struct({
+      id: Schema.Number,
+      kind: Schema.Literal("sse", "ndjson", "grpc"),
+      address: Schema.NullOr(Schema.String),
+      connectedAt: Schema.Number.annotations({
+        description: "Connection time, in ms since the epoch",
+      }),
+      delivered: Schema.Number.annotations({
+        description: "Messages queued for the client",
+      }),
+      dropped: Schema.Number.annotations({
+        description: "Messages dropped because the client's buffer was full",
+      }),
+      queued: Schema.Number.annotations({
+        description: "Messages waiting to be sent",
+      }),
+    })
+  ),
+  evicted: Schema.Number.annotations({
+    description: "Clients disconnected for dropping too many messages",
+  }),
+}).annotations({ title: "Subscriber Stats" });
+
+const MessageCatalog = Schema.Struct({
+  version: Schema.Number.annotations({
+    description: "Version carried by every stream message",
+  }),
+  schema: Schema.Unknown.annotations({
+    description: "JSON Schema of the stream messages, one variant per type",
+  }),
+}).annotations({ title: "Message Catalog" });
+
+const ProcessingState = Schema.Struct({
+  paused: Schema.Boolean.annotations({
+    description: "Whether audio processing is paused",
+  }),
+}).annotations({ title: "Processing State" });
+
+const LevelsResponse = Schema.Struct({
+  source: Schema.NullOr(AudioSourceIdSchema).annotations({
+    description: "Currently selected source, or null if none selected",
+  }),
+  levels: Schema.Array(AudioLevelReading).annotations({
+    description:
+      "Per-second levels of the selected source over the last minute, oldest first",
+  }),
+}).annotations({ title: "Levels Response" });
+
+const StartSessionRequest = Schema.Struct({
+  source: Schema.optional(AudioSourceIdSchema).annotations({
+    description: "Source to listen to (default: the selected one)",
+  }),
+  minutes: Schema.Number.pipe(Schema.between(1, 720)).annotations({
+    description: "How long to listen before stopping on its own",
+  }),
+}).annotations({ title: "Start Session Request" });
+
+const RunningSessionSchema = Schema.Struct({
+  id: Schema.String,
+  source: AudioSourceIdSchema,
+  startedAt: Schema.Number.annotations({
+    description: "Start time, in ms since the epoch",
+  }),
+  endsAt: Schema.Number.annotations({
+    description: "Time the session stops on its own, in ms since the epoch",
+  }),
+}).annotations({ title: "Running Session" });
+
+const ListenSessionSchema = Schema.Struct({
+  id: Schema.String,
+  source: AudioSourceIdSchema,
+  startedAt: Schema.Number,
+  endedAt: Schema.Number,
+  reason: Schema.Literal("expired", "stopped"),
+  responses: Schema.Number.annotations({
+    description: "Text responses completed during the session",
+  }),
+  summary: Schema.NullOr(Schema.String).annotations({
+    description: "Summary of the session, or null if nothing was said",
+  }),
+}).annotations({ title: "Listen Session" });
+
+const SessionsResponse = Schema.Struct({
+  current: Schema.NullOr(RunningSessionSchema),
+  history: Schema.Array(ListenSessionSchema).annotations({
+    description: "Last 20 finished sessions, most recent first",
+  }),
+}).annotations({ title: "Sessions Response" });
+
+const RunningPlaylistSchema = Schema.Struct({
+  playlist: Schema.String,
+  source: AudioSourceIdSchema,
+  index: Schema.Number.annotations({
+    description: "Position of the source in the playlist, from 0",
+  }),
+  startedAt: Schema.Number.annotations({
+    description: "When the source was selected, in ms since the epoch",
+  }),
+  nextAt: Schema.Number.annotations({
+    description: "When the playlist rotates again, in ms since the epoch",
+  }),
+}).annotations({ title: "Running Playlist" });
+
+const PlaylistsResponse = Schema.Struct({
+  playlists: Schema.Array(PlaylistConfig).annotations({
+    description: "As configured",
+  }),
+  current: Schema.NullOr(RunningPlaylistSchema),
+}).annotations({ title: "Playlists Response" });
+
+const FileUpload = HttpApiSchema.Multipart(
+  Schema.Struct({
+    file: Multipart.SingleFileSchema.annotations({
+      description: "MP3 or WAV recording",
+    }),
+  })
 );
 
-// Sources group
-const sourcesGroupLive = HttpApiBuilder.group(
-  FunnyRadioApi,
-  "sources",
-  (handlers) =>
-    handlers
-      .handle("getSources", () =>
-        Effect.gen(function* () {
-          const maybeCurrent = yield* AudioSource.currentSource;
-          const sources = Object.entries(AUDIO_SOURCES).map(([id, info]) => ({
-            id: id as AudioSourceId,
-            name: info.name,
-            url: info.url,
-          }));
-          return { sources, current: Option.getOrNull(maybeCurrent) };
-        })
-      )
-      .handle("setSource", ({ payload }) =>
-        Effect.gen(function* () {
-          yield* AudioSource.setSource(payload.source);
-          const name = payload.source
-            ? AUDIO_SOURCES[payload.source].name
-            : null;
-          yield* Effect.log(
-            name ? `Audio source changed to: ${name}` : "Audio source cleared"
-          );
-          return { success: true, current: payload.source, name };
+const ComparisonState = Schema.Struct({
+  sources: Schema.NullOr(Schema.Array(AudioSourceIdSchema)).annotations({
+    description: "Sources being compared, or null if comparison is off",
+  }),
+}).annotations({ title: "Comparison State" });
+
+const SetComparisonRequest = Schema.Struct({
+  sources: Schema.NullOr(
+    Schema.Tuple(AudioSourceIdSchema, AudioSourceIdSchema)
+  ).annotations({
+    description: "Two distinct sources to compare, or null to stop",
+  }),
+}).annotations({ title: "Set Comparison Request" });
+
+const ExperimentVariant = Schema.Struct({
+  id: Schema.String.pipe(Schema.pattern(/^[\w-]{1,32}$/)).annotations({
+    description: "Variant ID echoed on its responses",
+  }),
+  instructions: Schema.NullOr(Schema.String).annotations({
+    description:
+      "Commentary instructions, where {{prompt}} stands for the current ones; null keeps them unchanged",
+  }),
+}).annotations({ title: "Experiment Variant" });
+
+const StartExperimentRequest = Schema.Struct({
+  id: Schema.optional(
+    Schema.String.pipe(Schema.pattern(/^[\w-]{1,64}$/))
+  ).annotations({ description: "Experiment ID (default: generated)" }),
+  windows: Schema.Number.pipe(
+    Schema.int(),
+    Schema.between(1, 50)
+  ).annotations({ description: "Windows to run both variants over" }),
+  variants: Schema.Tuple(ExperimentVariant, ExperimentVariant),
+}).annotations({ title: "Start Experiment Request" });
+
+const RespondRequest = Schema.Struct({
+  instructions: Schema.NonEmptyTrimmedString.pipe(
+    Schema.maxLength(4000)
+  ).annotations({
+    description:
+      "Instructions for this response only, e.g. list the politicians mentioned",
+  }),
+  task: Schema.optional(TaskIdSchema).annotations({
+    description:
+      "Task the response is labelled with on the stream (default commentary)",
+  }),
+}).annotations({ title: "Respond Request" });
+
+const RespondResponse = Schema.Struct({
+  responseId: Schema.String.annotations({
+    description: "ID of the response, on its delta and complete messages",
+  }),
+}).annotations({ title: "Respond Response" });
+
+const AskRequest = Schema.Struct({
+  question: Schema.NonEmptyTrimmedString.pipe(
+    Schema.maxLength(500)
+  ).annotations({
+    description:
+      "Question about what was just said, e.g. what was the name of the guest just now?",
+  }),
+}).annotations({ title: "Ask Request" });
+
+const AskResponse = Schema.Struct({
+  askId: Schema.String.annotations({
+    description: "ID of the question, on its answer_delta and answer messages",
+  }),
+  responseId: Schema.String,
+}).annotations({ title: "Ask Response" });
+
+const NudgeRequest = Schema.Struct({
+  text: Schema.NonEmptyTrimmedString.pipe(
+    Schema.maxLength(500)
+  ).annotations({
+    description:
+      "What the commentary should do next, e.g. focus on the sports segment coming up",
+  }),
+  minutes: Schema.optional(
+    Schema.Number.pipe(Schema.int(), Schema.between(1, 120))
+  ).annotations({ description: "How long the nudge lasts (default 10)" }),
+}).annotations({ title: "Nudge Request" });
+
+const NudgeState = Schema.Struct({
+  nudge: Schema.NullOr(
+    Schema.Struct({
+      text: Schema.String,
+      expiresAt: Schema.DateTimeUtc,
+    })
+  ).annotations({ description: "Nudge in effect, or null if none" }),
+}).annotations({ title: "Nudge State" });
+
+const ExperimentState = Schema.Struct({
+  experiment: Schema.NullOr(
+    Schema.Struct({
+      id: Schema.String,
+      variants: Schema.Array(ExperimentVariant),
+      remaining: Schema.Number.annotations({
+        description: "Windows left before the experiment ends",
+      }),
+    })
+  ).annotations({ description: "Running experiment, or null if none" }),
+}).annotations({ title: "Experiment State" });
+
+const TranscriptSearchParams = Schema.Struct({
+  q: Schema.String.annotations({ description: "Words to search for" }),
+  source: Schema.optional(AudioSourceIdSchema).annotations({
+    description: "Only match transcripts from this source",
+  }),
+  program: Schema.optional(Schema.String).annotations({
+    description: "Only match transcripts captured during this show",
+  }),
+  from: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only match transcripts completed at or after this time",
+  }),
+  to: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only match transcripts completed before this time",
+  }),
+  limit: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 100))
+  ).annotations({ description: "Maximum number of results (default 20)" }),
+});
+
+const FeedParams = Schema.Struct({
+  source: Schema.optional(AudioSourceIdSchema).annotations({
+    description: "Only include summaries of this source",
+  }),
+  limit: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 100))
+  ).annotations({ description: "Maximum number of entries (default 50)" }),
+});
+
+const SpeakerSegment = Schema.Struct({
+  speaker: Schema.NullOr(Schema.String).annotations({
+    description: "Speaker label, or null for text before the first label",
+  }),
+  text: Schema.String,
+}).annotations({ title: "Speaker Segment" });
+
+const TranscriptMatch = Schema.Struct({
+  responseId: Schema.String,
+  task: TaskIdSchema,
+  source: Schema.NullOr(AudioSourceIdSchema),
+  program: Schema.NullOr(Schema.String).annotations({
+    description: "Show on air when the window was captured, if known",
+  }),
+  text: Schema.String,
+  snippet: Schema.String.annotations({
+    description:
+      "Matching excerpt, HTML-escaped, with hits wrapped in <mark></mark>",
+  }),
+  completedAt: Schema.DateTimeUtc,
+  windowStart: Schema.NullOr(Schema.DateTimeUtc).annotations({
+    description: "When the window's first audio went out on air, if known",
+  }),
+  windowEnd: Schema.NullOr(Schema.DateTimeUtc).annotations({
+    description: "When the window's last audio went out on air, if known",
+  }),
+  segments: Schema.Array(SpeakerSegment).annotations({
+    description: "Speaker turns of a transcribe response; empty for other tasks",
+  }),
+}).annotations({ title: "Transcript Match" });
+
+const TranscriptSearchResponse = Schema.Struct({
+  results: Schema.Array(TranscriptMatch).annotations({
+    description: "Matching transcripts, best match first",
+  }),
+}).annotations({ title: "Transcript Search Response" });
+
+const ArchivePath = Schema.Struct({
+  source: AudioSourceIdSchema,
+  date: Schema.String.pipe(Schema.pattern(/^\d{4}-\d{2}-\d{2}$/)).annotations({
+    description: "Day to browse, as YYYY-MM-DD in the requested time zone",
+  }),
+});
+
+const ArchiveParams = Schema.Struct({
+  tz: Schema.optional(Schema.String).annotations({
+    description: "IANA time zone the day and hours are in (default UTC)",
+  }),
+  task: Schema.optional(TaskIdSchema).annotations({
+    description: "Only include responses of this task",
+  }),
+  page: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.positive())
+  ).annotations({ description: "Page to return, from 1 (default 1)" }),
+  pageSize: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 200))
+  ).annotations({ description: "Responses per page (default 50)" }),
+});
+
+const ArchiveSegment = TranscriptMatch.omit("snippet").annotations({
+  title: "Archive Segment",
+});
+
+const ArchiveHour = Schema.Struct({
+  hour: Schema.Number.annotations({
+    description: "Hour of the day, 0-23, in the requested time zone",
+  }),
+  start: Schema.DateTimeUtc,
+  count: Schema.Number.annotations({
+    description: "Responses completed during the hour, across all pages",
+  }),
+  programs: Schema.Array(Schema.String).annotations({
+    description: "Shows on air during the hour, in order",
+  }),
+  segments: Schema.Array(ArchiveSegment).annotations({
+    description: "Responses of the hour on this page, oldest first",
+  }),
+}).annotations({ title: "Archive Hour" });
+
+const ArchiveResponse = Schema.Struct({
+  source: AudioSourceIdSchema,
+  date: Schema.String,
+  timeZone: Schema.String,
+  total: Schema.Number.annotations({
+    description: "Responses completed during the day",
+  }),
+  page: Schema.Number,
+  pages: Schema.Number,
+  pageSize: Schema.Number,
+  hours: Schema.Array(ArchiveHour).annotations({
+    description:
+      "Hours with responses, in order; those off this page have no segments",
+  }),
+}).annotations({ title: "Archive Response" });
+
+const SemanticMatch = Schema.Struct({
+  ...TranscriptMatch.fields,
+  snippet: Schema.String.annotations({
+    description: "Chunk of the transcript closest in meaning to the query",
+  }),
+  score: Schema.Number.annotations({
+    description: "Cosine similarity of the chunk to the query, from -1 to 1",
+  }),
+}).annotations({ title: "Semantic Match" });
+
+const SemanticSearchResponse = Schema.Struct({
+  results: Schema.Array(SemanticMatch).annotations({
+    description: "Closest transcripts, best match first",
+  }),
+}).annotations({ title: "Semantic Search Response" });
+
+const PipelineStatus = Schema.Struct({
+  components: Schema.Array(
+    Schema.Struct({
+      name: Schema.String,
+      running: Schema.Boolean,
+      restarts: Schema.Number.annotations({
+        description: "Times the component was restarted after failing",
+      }),
+      lastCrash: Schema.NullOr(
+        Schema.Struct({
+          at: Schema.Number.annotations({
+            description: "Time of the crash, in ms since the epoch",
+          }),
+          message: Schema.String,
+          defect: Schema.Boolean.annotations({
+            description: "True for an unexpected exception, not a failure",
+          }),
         })
-      )
+      ),
+    })
+  ).annotations({ description: "Supervised pipeline components, by name" }),
+}).annotations({ title: "Pipeline Status" });
+
+const PipelineNodeId = Schema.Literal(
+  "source",
+  "processor",
+  "openai",
+  "broadcaster",
+  "clients"
 );
 
-// Stream group
-const streamGroupLive = HttpApiBuilder.group(
-  FunnyRadioApi,
-  "stream",
-  (handlers) =>
-    handlers.handleRaw("getStream", () =>
-      Effect.gen(function* () {
-        const maybeCurrent = yield* AudioSource.currentSource;
+const PipelineGraph = Schema.Struct({
+  nodes: Schema.Array(
+    Schema.Struct({
+      id: PipelineNodeId,
+      label: Schema.String,
+      state: Schema.Literal("running", "paused", "stopped").annotations({
+        description: "Paused when it runs but passes nothing on",
+      }),
+      detail: Schema.NullOr(Schema.String).annotations({
+        description: "Why it is paused or stopped, or what it is doing",
+      }),
+      restarts: Schema.Number.annotations({
+        description: "Restarts of its supervised components",
+      }),
+    })
+  ).annotations({ description: "Stages audio goes through, in order" }),
+  edges: Schema.Array(
+    Schema.Struct({ from: PipelineNodeId, to: PipelineNodeId })
+  ),
+}).annotations({ title: "Pipeline Graph" });
 
-        if (Option.isNone(maybeCurrent)) {
-          return yield* new HttpApiError.ServiceUnavailable();
-        }
+const QueueDepths = Schema.Struct({
+  audio: Schema.NullOr(
+    Schema.Struct({
+      source: AudioSourceIdSchema,
+      queued: Schema.Number.annotations({
+        description: "Chunks of 20ms read and waiting to be processed",
+      }),
+      capacity: Schema.Number.annotations({
+        description: "Chunks kept before the oldest are dropped",
+      }),
+      at: Schema.Number.annotations({
+        description: "When the last chunk was processed, in ms since the epoch",
+      }),
+    })
+  ).annotations({ description: "Null before any audio was processed" }),
+  openai: Schema.Struct({
+    running: Schema.Number.annotations({ description: "Responses running" }),
+    waiting: Schema.Number.annotations({
+      description: "Commits waiting for their response or transcript",
+    }),
+  }),
+  clients: Schema.Struct({
+    connected: Schema.Number,
+    queued: Schema.Number.annotations({
+      description: "Messages waiting to be sent, all clients",
+    }),
+    maxQueued: Schema.Number.annotations({
+      description: "Messages waiting for the slowest client",
+    }),
+    dropped: Schema.Number.annotations({
+      description: "Messages dropped for clients still connected",
+    }),
+  }),
+}).annotations({ title: "Queue Depths" });
 
-        const openai = yield* OpenAIRealtime;
-        const subscription = yield* openai.subscribe;
+const LiveKpisSchema = Schema.Struct({
+  windowMs: Schema.Number.annotations({
+    description: "Period the figures cover, up to now",
+  }),
+  responses: Schema.Number,
+  meanDurationMs: Schema.NullOr(Schema.Number),
+  meanLagMs: Schema.NullOr(Schema.Number).annotations({
+    description: "Time from the end of the audio to the complete message",
+  }),
+  bytesPerSecond: Schema.Number.annotations({
+    description: "Audio read from the source",
+  }),
+  chunksReceived: Schema.Number,
+  chunksDropped: Schema.Number,
+  chunksCorrupted: Schema.Number,
+  errors: Schema.Number,
+}).annotations({ title: "Live KPIs" });
 
-        const stream = Stream.fromQueue(subscription).pipe(
-          Stream.map((msg) => new TextEncoder().encode(formatSSE(msg)))
-        );
+const Readiness = Schema.Struct({
+  ready: Schema.Boolean.annotations({
+    description:
+      "False while OPENAI_WARMUP is set and the OpenAI session isn't open",
+  }),
+  openai: Schema.Struct({
+    warmup: Schema.Boolean,
+    state: Schema.Literal("not_connected", "connecting", "open").annotations({
+      description: "Without warmup, the session opens with the first audio",
+    }),
+    sessionAgeMs: Schema.NullOr(Schema.Number),
+    standby: Schema.Boolean.annotations({
+      description: "Whether a session is open for the next rotation",
+    }),
+  }),
+}).annotations({ title: "Readiness" });
 
-        return yield* HttpServerResponse.stream(stream, {
-          headers: {
-            "Content-Type": "text/event-stream",
+const JournalSummarySchema = Schema.Struct({
+  audioBytes: Schema.Number.annotations({
+    description: "Audio sent since the last commit OpenAI acknowledged",
+  }),
+  audioMs: Schema.Number,
+  commits: Schema.Number.annotations({
+    description: "Commits sent but not acknowledged",
+  }),
+  responses: Schema.Number.annotations({
+    description:
+      "Responses requested since the last acknowledged commit, finished or not",
+  }),
+  since: Schema.NullOr(Schema.Number).annotations({
+    description: "Time of the oldest journaled message, in ms since the epoch",
+  }),
+}).annotations({ title: "Journal Summary" });
+
+const JournalStatus = Schema.Struct({
+  path: Schema.String,
+  recovered: Schema.NullOr(JournalSummarySchema).annotations({
+    description: "What the previous run left unacknowledged, if anything",
+  }),
+  current: JournalSummarySchema,
+  entries: Schema.Array(
+    Schema.Struct({
+      at: Schema.Number,
+      type: Schema.Literal(
+        "input_audio_buffer.append",
+        "input_audio_buffer.commit",
+        "response.create"
+      ),
+      bytes: Schema.NullOr(Schema.Number).annotations({
+        description: "Audio bytes of an append",
+      }),
+      source: Schema.NullOr(Schema.String),
+      task: Schema.NullOr(Schema.String).annotations({
+        description: "Task of a response request",
+      }),
+    })
+  ).annotations({ description: "Journaled messages, oldest first" }),
+}).annotations({ title: "Journal Status" });
+
+const HlsCacheStatsSchema = Schema.Struct({
+  entries: Schema.Number.annotations({
+    description: "Segments and playlists kept",
+  }),
+  bytes: Schema.Number,
+  maxBytes: Schema.Number.annotations({
+    description: "HLS_SEGMENT_CACHE_MB in bytes",
+  }),
+  hits: Schema.Number.annotations({
+    description:
+      "Requests answered from the cache or by a fetch already under way",
+  }),
+  misses: Schema.Number.annotations({
+    description: "Requests that went upstream",
+  }),
+  fetchedBytes: Schema.Number.annotations({
+    description: "Downloaded from upstream",
+  }),
+  servedBytes: Schema.Number.annotations({
+    description: "Served to ffmpeg, byte-range requests aside",
+  }),
+}).annotations({ title: "HLS Cache Stats" });
+
+const DryRunEstimateSchema = Schema.Struct({
+  responses: Schema.Number,
+  audioSeconds: Schema.Number.annotations({
+    description: "Audio sent to the stand-in so far",
+  }),
+  audioTokens: Schema.Number.annotations({
+    description: "Audio input tokens of the responses",
+  }),
+  textTokens: Schema.Number.annotations({
+    description:
+      "Text input tokens of the responses (instructions, transcripts, remembered commentary)",
+  }),
+  outputTokens: Schema.Number.annotations({
+    description: "Assumed output tokens, DRY_RUN_OUTPUT_TOKENS per response",
+  }),
+  costUsd: Schema.Number.annotations({
+    description: "Estimated cost so far, in USD",
+  }),
+  costPerHourUsd: Schema.NullOr(Schema.Number).annotations({
+    description: "Cost so far spread over the time since the first audio",
+  }),
+  since: Schema.NullOr(Schema.Number).annotations({
+    description: "Time of the first audio in ms since the epoch, null before",
+  }),
+}).annotations({ title: "Dry Run Estimate" });
+
+const MemoryStats = Schema.Struct({
+  rss: Schema.Number.annotations({ description: "Resident set size, bytes" }),
+  heapUsed: Schema.Number,
+  heapTotal: Schema.Number,
+  external: Schema.Number,
+  arrayBuffers: Schema.Number.annotations({
+    description: "Bytes held by ArrayBuffers, audio buffers included",
+  }),
+  objectCount: Schema.Number,
+  objectTypes: Schema.Array(
+    Schema.Struct({ type: Schema.String, count: Schema.Number })
+  ).annotations({ description: "Most common object types, most first" }),
+}).annotations({ title: "Memory Stats" });
+
+const ProfileParams = Schema.Struct({
+  seconds: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 60))
+  ).annotations({ description: "How long to sample (default 10)" }),
+});
+
+const TopicTimelineParams = Schema.Struct({
+  source: Schema.optional(AudioSourceIdSchema).annotations({
+    description: "Only count responses from this source",
+  }),
+  from: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only count responses completed at or after this time",
+  }),
+  to: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only count responses completed before this time",
+  }),
+  bucket: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 1440))
+  ).annotations({ description: "Bucket size in minutes (default 60)" }),
+});
+
+const TopicBucket = Schema.Struct({
+  start: Schema.DateTimeUtc,
+  topics: Schema.Array(
+    Schema.Struct({ topic: Schema.String, count: Schema.Number })
+  ).annotations({
+    description: "Topics tagged in the bucket, most frequent first",
+  }),
+  sentiment: Schema.Struct({
+    positive: Schema.Number,
+    neutral: Schema.Number,
+    negative: Schema.Number,
+  }).annotations({ description: "Tagged responses per sentiment" }),
+}).annotations({ title: "Topic Bucket" });
+
+const TopicTimelineResponse = Schema.Struct({
+  buckets: Schema.Array(TopicBucket).annotations({
+    description: "Oldest first; buckets without tagged responses are omitted",
+  }),
+}).annotations({ title: "Topic Timeline Response" });
+
+const CoverageParams = Schema.Struct({
+  hour: Schema.DateTimeUtc.annotations({
+    description:
+      "Any time in the hour to compare; the hour must be over, e.g. 2025-01-15T08:00:00Z",
+  }),
+});
+
+const StationCoverageSchema = Schema.Struct({
+  source: AudioSourceIdSchema,
+  responses: Schema.Number.annotations({
+    description: "Tagged text responses of the hour",
+  }),
+  topics: Schema.Array(
+    Schema.Struct({ topic: Schema.String, count: Schema.Number })
+  ).annotations({ description: "Most frequent first" }),
+  exclusive: Schema.Array(Schema.String).annotations({
+    description: "Topics no other station covered that hour",
+  }),
+}).annotations({ title: "Station Coverage" });
+
+const CoverageDiffSchema = Schema.Struct({
+  hour: Schema.Number.annotations({
+    description: "Start of the hour, in ms since the epoch",
+  }),
+  stations: Schema.Array(StationCoverageSchema).annotations({
+    description: "Stations with tagged responses that hour",
+  }),
+  shared: Schema.Array(Schema.String).annotations({
+    description: "Topics covered by at least two stations, most frequent first",
+  }),
+  framing: Schema.NullOr(
+    Schema.Array(
+      Schema.Struct({ topic: Schema.String, difference: Schema.String })
+    )
+  ).annotations({
+    description:
+      "How the stations framed the shared topics differently; null if it could not be written, in which case it is tried again on the next request",
+  }),
+  createdAt: Schema.Number,
+}).annotations({ title: "Coverage Diff" });
+
+const DailyReportParams = Schema.Struct({
+  days: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 90))
+  ).annotations({ description: "Days to report, today included (default 7)" }),
+});
+
+const LatencyPercentilesSchema = Schema.NullOr(
+  Schema.Struct({ p50: Schema.Number, p90: Schema.Number, p99: Schema.Number })
+).annotations({
+  description:
+    "Upper bounds, in ms, of the latency buckets the percentiles fall in (60000 for a minute or more); null without responses",
+});
+
+const DailyReportSchema = Schema.Struct({
+  day: Schema.Number.annotations({
+    description: "Start of the UTC day, in ms since the epoch",
+  }),
+  coverage: Schema.Number.annotations({
+    description:
+      "Share of the day, so far for today, covered by snapshots: the server was up",
+  }),
+  uptime: Schema.Number.annotations({
+    description: "Share of the day audio was being processed",
+  }),
+  responses: Schema.Number,
+  duration: LatencyPercentilesSchema.annotations({
+    description: "Time from each response's creation to its end",
+  }),
+  lag: LatencyPercentilesSchema.annotations({
+    description:
+      "Time from the end of each response's window on air to the response's end, for windows with known on-air times",
+  }),
+  bytesProcessed: Schema.Number,
+  chunksReceived: Schema.Number,
+  chunksDropped: Schema.Number,
+  chunksCorrupted: Schema.Number.annotations({
+    description: "Audio chunks realigned or dropped as corrupted",
+  }),
+  errors: Schema.Number,
+  restarts: Schema.Number.annotations({
+    description: "Restarts of supervised pipeline components",
+  }),
+}).annotations({ title: "Daily Report" });
+
+const DailyReportResponse = Schema.Struct({
+  days: Schema.Array(DailyReportSchema).annotations({
+    description: "Most recent first",
+  }),
+}).annotations({ title: "Daily Report Response" });
+
+// Everything needed to set up the server the same way elsewhere, alerts and
+// webhooks included; settings from the environment (secrets, and the alert
+// and webhook defaults) aren't part of it.
+const ConfigBundle = Schema.Struct({
+  version: Schema.Literal(1),
+  exportedAt: Schema.Number.annotations({
+    description: "When the bundle was exported, in ms since the epoch",
+  }),
+  config: RadioConfig.annotations({
+    description:
+      "The config file with the sources edited through the API folded in, without runtime edits such as applied presets",
+  }),
+  presets: Schema.Array(Preset).pipe(
+    Schema.filter(
+      (presets) =>
+        new Set(presets.map((p) => p.id)).size === presets.length ||
+        "Preset ids must be unique"
+    )
+  ),
+}).annotations({ title: "Config Bundle" });
+
+const ConfigImportResponse = Schema.Struct({
+  sources: Schema.Number,
+  playlists: Schema.Number,
+  presets: Schema.Number,
+}).annotations({ title: "Config Import Response" });
+
+const UpdateConfigRequest = Schema.Struct({
+  prompt: Schema.optional(Schema.NonEmptyString).annotations({
+    description: "Instructions for the commentary task",
+  }),
+  language: Schema.optional(Schema.NullOr(Schema.NonEmptyString)).annotations(
+    {
+      description:
+        "Language to write commentary in, or null for the prompt's own",
+    }
+  ),
+}).annotations({ title: "Update Config Request" });
+
+const BudgetUsageSchema = Schema.Struct({
+  source: AudioSourceIdSchema,
+  tokens: Schema.Number.annotations({
+    description: "Tokens used by the source's responses today (UTC)",
+  }),
+  costUsd: Schema.Number.annotations({
+    description: "Their cost, at the DRY_RUN_*_PRICE prices",
+  }),
+  budget: Schema.NullOr(SourceBudget),
+  exceeded: Schema.Boolean.annotations({
+    description: "Whether the budget is used up and the source paused",
+  }),
+  resetsAt: Schema.Number.annotations({
+    description: "Start of the next UTC day, in ms since the epoch",
+  }),
+}).annotations({ title: "Budget Usage" });
+
+const BudgetsResponse = Schema.Struct({
+  sources: Schema.Array(BudgetUsageSchema),
+}).annotations({ title: "Budgets Response" });
+
+const FeedbackRequest = Schema.Struct({
+  responseId: Schema.String.annotations({
+    description: "Stored response being rated",
+  }),
+  rating: Schema.Number.pipe(Schema.int(), Schema.between(1, 5)).annotations({
+    description: "From 1 (useless) to 5 (spot on)",
+  }),
+  comment: Schema.optional(
+    Schema.String.pipe(Schema.maxLength(1000))
+  ).annotations({ description: "What worked or didn't" }),
+}).annotations({ title: "Feedback Request" });
+
+const FeedbackSchema = Schema.Struct({
+  responseId: Schema.String,
+  rating: Schema.Number,
+  comment: Schema.NullOr(Schema.String),
+  createdAt: Schema.DateTimeUtc,
+}).annotations({ title: "Feedback" });
+
+const FeedbackStatsParams = Schema.Struct({
+  from: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only count ratings given at or after this time",
+  }),
+  to: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only count ratings given before this time",
+  }),
+});
+
+const FeedbackStatsResponse = Schema.Struct({
+  stats: Schema.Array(
+    Schema.Struct({
+      source: Schema.NullOr(AudioSourceIdSchema),
+      task: TaskIdSchema,
+      count: Schema.Number,
+      averageRating: Schema.Number,
+      low: Schema.Number.annotations({ description: "Rated 1 or 2" }),
+      high: Schema.Number.annotations({ description: "Rated 4 or 5" }),
+      comments: Schema.Number.annotations({
+        description: "Ratings that came with a comment",
+      }),
+    })
+  ).annotations({ description: "By source and task, most rated first" }),
+}).annotations({ title: "Feedback Stats Response" });
+
+const FingerprintSchema = Schema.Struct({
+  id: Schema.String,
+  source: AudioSourceIdSchema.annotations({
+    description: "Source it was first heard on",
+  }),
+  durationMs: Schema.Number,
+  occurrences: Schema.Number.annotations({
+    description: "Times it aired, counting the one it was learned from",
+  }),
+  firstSeenAt: Schema.DateTimeUtc,
+  lastSeenAt: Schema.DateTimeUtc,
+  label: Schema.NullOr(FingerprintLabel),
+  skip: Schema.Boolean.annotations({
+    description: "Whether it is withheld from OpenAI with SKIP_REPEATS",
+  }),
+}).annotations({ title: "Fingerprint" });
+
+const FingerprintsResponse = Schema.Struct({
+  fingerprints: Schema.Array(FingerprintSchema),
+}).annotations({ title: "Fingerprints Response" });
+
+const MarkFingerprintRequest = Schema.Struct({
+  label: Schema.optional(Schema.NullOr(FingerprintLabel)).annotations({
+    description: "What it is; null to clear, omitted to keep",
+  }),
+  skip: Schema.optional(Schema.Boolean).annotations({
+    description: "Whether to withhold it from OpenAI; omitted to keep",
+  }),
+}).annotations({ title: "Mark Fingerprint Request" });
+
+const RepeatedSegmentsParams = Schema.Struct({
+  source: Schema.optional(AudioSourceIdSchema).annotations({
+    description: "Only list segments aired on this source",
+  }),
+  fingerprint: Schema.optional(Schema.String).annotations({
+    description: "Only list airings of this fingerprint",
+  }),
+  from: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only list segments recorded at or after this time",
+  }),
+  to: Schema.optional(Schema.DateTimeUtc).annotations({
+    description: "Only list segments recorded before this time",
+  }),
+  limit: Schema.optional(
+    Schema.NumberFromString.pipe(Schema.int(), Schema.between(1, 500))
+  ).annotations({ description: "Maximum number of results (default 100)" }),
+});
+
+const RepeatedSegmentSchema = Schema.Struct({
+  fingerprint: Schema.String,
+  label: Schema.NullOr(FingerprintLabel).annotations({
+    description: "The fingerprint's label as it is now",
+  }),
+  source: AudioSourceIdSchema,
+  startedAt: Schema.NullOr(Schema.DateTimeUtc).annotations({
+    description: "When it went out on air; null if unknown",
+  }),
+  endedAt: Schema.NullOr(Schema.DateTimeUtc),
+  durationMs: Schema.Number,
+  skipped: Schema.Boolean.annotations({
+    description: "Whether it was withheld from OpenAI",
+  }),
+  recordedAt: Schema.DateTimeUtc,
+}).annotations({ title: "Repeated Segment" });
+
+const RepeatedSegmentsResponse = Schema.Struct({
+  segments: Schema.Array(RepeatedSegmentSchema).annotations({
+    description: "Most recent first",
+  }),
+}).annotations({ title: "Repeated Segments Response" });
+
+const LoginRequest = Schema.Struct({
+  username: Schema.String,
+  password: Schema.Redacted(Schema.String),
+}).annotations({ title: "Login Request" });
+
+const UserSchema = Schema.Struct({
+  username: Username,
+  role: Role,
+}).annotations({ title: "User" });
+
+const SessionResponse = Schema.Struct({
+  username: Schema.String,
+  role: Role,
+  token: Schema.String.annotations({
+    description:
+      "Also set as the session cookie; send as Authorization: Bearer from other clients",
+  }),
+  expiresAt: Schema.Number.annotations({
+    description: "When the session ends, in ms since the epoch",
+  }),
+}).annotations({ title: "Session Response" });
+
+const AuthStatusResponse = Schema.Struct({
+  enabled: Schema.Boolean.annotations({
+    description: "False when accounts are off and anyone may do anything",
+  }),
+  username: Schema.NullOr(Schema.String),
+  role: Schema.NullOr(Role).annotations({
+    description: "Null when not logged in",
+  }),
+}).annotations({ title: "Auth Status Response" });
+
+const UsersResponse = Schema.Struct({
+  users: Schema.Array(UserSchema),
+}).annotations({ title: "Users Response" });
+
+const SaveUserRequest = Schema.Struct({
+  role: Role,
+  password: Schema.Redacted(Schema.String.pipe(Schema.minLength(8))),
+}).annotations({ title: "Save User Request" });
+
+// Files of the admin dashboard besides its page; only these are served.
+const AdminAsset = Schema.Literal("app.js", "admin.css");
+
+// Define the API
+export class FunnyRadioApi extends HttpApi.make("funnyRadioApi")
+  .add(
+    HttpApiGroup.make("ui")
+      .add(
+        HttpApiEndpoint.get("getIndex", "/").addSuccess(
+          Schema.String.pipe(
+            HttpApiSchema.withEncoding({ kind: "Text", contentType: "text/html" })
+          )
+        )
+      )
+      .add(
+        HttpApiEndpoint.get("getServiceWorker", "/sw.js").addSuccess(
+          Schema.String.pipe(
+            HttpApiSchema.withEncoding({
+              kind: "Text",
+              contentType: "text/javascript",
+            })
+          )
+        )
+      )
+      .add(
+        HttpApiEndpoint.get("getAdmin", "/admin").addSuccess(
+          Schema.String.pipe(
+            HttpApiSchema.withEncoding({ kind: "Text", contentType: "text/html" })
+          )
+        )
+      )
+      .add(
+        HttpApiEndpoint.get("getAdminAsset", "/admin/:file")
+          .setPath(Schema.Struct({ file: AdminAsset }))
+          .addSuccess(Schema.String)
+      )
+  )
+  .add(
+    HttpApiGroup.make("auth")
+      .annotate(OpenApi.Title, "Authentication")
+      .annotate(
+        OpenApi.Description,
+        "Sessions for viewers, who read streams and transcripts, and admins, who also change the station; only with AUTH_SECRET set"
+      )
+      .add(
+        HttpApiEndpoint.post("login", "/auth/login")
+          .annotate(OpenApi.Summary, "Log in and get a session")
+          .setPayload(LoginRequest)
+          .addSuccess(SessionResponse)
+          .addError(HttpApiError.Unauthorized)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.post("logout", "/auth/logout")
+          .annotate(OpenApi.Summary, "Clear the session cookie")
+          .addSuccess(Schema.Void)
+      )
+      .add(
+        HttpApiEndpoint.get("getMe", "/auth/me")
+          .annotate(OpenApi.Summary, "Who the request is from")
+          .addSuccess(AuthStatusResponse)
+      )
+  )
+  .add(
+    HttpApiGroup.make("users")
+      .annotate(OpenApi.Title, "Users")
+      .annotate(OpenApi.Description, "Accounts, managed by admins")
+      .add(
+        HttpApiEndpoint.get("getUsers", "/users")
+          .annotate(OpenApi.Summary, "List accounts")
+          .addSuccess(UsersResponse)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.put("putUser", "/users/:username")
+          .annotate(
+            OpenApi.Summary,
+            "Create an account or replace its role and password"
+          )
+          .setPath(Schema.Struct({ username: Username }))
+          .setPayload(SaveUserRequest)
+          .addSuccess(UserSchema)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.del("deleteUser", "/users/:username")
+          .annotate(OpenApi.Summary, "Delete an account")
+          .setPath(Schema.Struct({ username: Schema.String }))
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("sources")
+      .annotate(OpenApi.Title, "Audio Sources")
+      .annotate(
+        OpenApi.Description,
+        "Manage audio sources for the sarcastic news transformer"
+      )
+      .add(
+        HttpApiEndpoint.get("getSources", "/sources")
+          .annotate(OpenApi.Summary, "List available audio sources")
+          .addSuccess(AudioSourcesResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.post("setSource", "/sources")
+          .annotate(OpenApi.Summary, "Set the audio source")
+          .addSuccess(SetSourceResponse)
+          .setPayload(SetSourceRequest)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getSelectionHistory", "/sources/history")
+          .annotate(
+            OpenApi.Summary,
+            "Changes of the selected source: who, when and why"
+          )
+          .setUrlParams(SelectionHistoryParams)
+          .addSuccess(SelectionHistoryResponse)
+      )
+      .add(
+        HttpApiEndpoint.patch("updateSource", "/sources/:id")
+          .annotate(
+            OpenApi.Summary,
+            "Update a source's instructions or bitrate (until the next config reload)"
+          )
+          .setPath(Schema.Struct({ id: AudioSourceIdSchema }))
+          .setPayload(UpdateSourceRequest)
+          .addSuccess(AudioSourceInfo)
+          .addError(HttpApiError.NotFound)
+      )
+      .add(
+        HttpApiEndpoint.put("putSource", "/sources/:id")
+          .annotate(OpenApi.Summary, "Create or replace a source (persisted)")
+          .setPath(Schema.Struct({ id: SourceConfig.fields.id }))
+          .setPayload(PutSourceRequest)
+          .addSuccess(AudioSourceInfo)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getNowPlaying", "/sources/:id/nowplaying")
+          .annotate(OpenApi.Summary, "Show currently on air on a source")
+          .setPath(Schema.Struct({ id: AudioSourceIdSchema }))
+          .addSuccess(NowPlayingResponse)
+          .addError(HttpApiError.NotFound)
+      )
+      .add(
+        HttpApiEndpoint.post("catchUp", "/sources/:id/catchup")
+          .annotate(
+            OpenApi.Summary,
+            "Select an HLS source and reprocess its last minutes"
+          )
+          .setPath(Schema.Struct({ id: AudioSourceIdSchema }))
+          .setPayload(CatchUpRequest)
+          .addSuccess(CatchUpResponse)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.BadRequest)
+      )
+      .add(
+        HttpApiEndpoint.get("ingestAudio", "/ingest/:id")
+          .annotate(
+            OpenApi.Summary,
+            "WebSocket pushing audio to a websocket source, as binary frames"
+          )
+          .setPath(Schema.Struct({ id: AudioSourceIdSchema }))
+          .setUrlParams(IngestParams)
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.BadRequest)
+      )
+      .add(
+        HttpApiEndpoint.del("deleteSource", "/sources/:id")
+          .annotate(OpenApi.Summary, "Remove a source (persisted)")
+          .setPath(Schema.Struct({ id: AudioSourceIdSchema }))
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("processing")
+      .annotate(OpenApi.Title, "Processing")
+      .annotate(
+        OpenApi.Description,
+        "Stop and restart sending audio to OpenAI; the source stream and SSE clients stay connected"
+      )
+      .add(
+        HttpApiEndpoint.post("pauseProcessing", "/processing/pause")
+          .annotate(OpenApi.Summary, "Pause audio processing")
+          .addSuccess(ProcessingState)
+      )
+      .add(
+        HttpApiEndpoint.post("resumeProcessing", "/processing/resume")
+          .annotate(OpenApi.Summary, "Resume audio processing")
+          .addSuccess(ProcessingState)
+      )
+  )
+  .add(
+    HttpApiGroup.make("sessions")
+      .annotate(OpenApi.Title, "Listening Sessions")
+      .annotate(
+        OpenApi.Description,
+        "Listen for a set time, then stop, clear the source and store a summary"
+      )
+      .add(
+        HttpApiEndpoint.get("getSessions", "/sessions")
+          .annotate(OpenApi.Summary, "Running session and past ones")
+          .addSuccess(SessionsResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.post("startSession", "/sessions")
+          .annotate(OpenApi.Summary, "Start a time-boxed listening session")
+          .setPayload(StartSessionRequest)
+          .addSuccess(RunningSessionSchema)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.Conflict)
+      )
+      .add(
+        HttpApiEndpoint.del("stopSession", "/sessions/current")
+          .annotate(OpenApi.Summary, "End the running session now")
+          .addSuccess(RunningSessionSchema)
+          .addError(HttpApiError.NotFound)
+      )
+  )
+  .add(
+    HttpApiGroup.make("playlists")
+      .annotate(OpenApi.Title, "Playlists")
+      .annotate(
+        OpenApi.Description,
+        "Cycle through the stations of a playlist from the config file, a set time on each"
+      )
+      .add(
+        HttpApiEndpoint.get("getPlaylists", "/playlists")
+          .annotate(OpenApi.Summary, "Configured playlists and the one running")
+          .addSuccess(PlaylistsResponse)
+      )
+      .add(
+        HttpApiEndpoint.post("startPlaylist", "/playlists/:id/start")
+          .annotate(
+            OpenApi.Summary,
+            "Select the playlist's first station and rotate from there"
+          )
+          .setPath(Schema.Struct({ id: Schema.String }))
+          .addSuccess(RunningPlaylistSchema)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.Conflict)
+      )
+      .add(
+        HttpApiEndpoint.del("stopPlaylist", "/playlists/current")
+          .annotate(OpenApi.Summary, "Stop rotating, keeping the current station")
+          .addSuccess(RunningPlaylistSchema)
+          .addError(HttpApiError.NotFound)
+      )
+  )
+  .add(
+    HttpApiGroup.make("files")
+      .annotate(OpenApi.Title, "File Transcription")
+      .annotate(
+        OpenApi.Description,
+        "Transcribe recorded files in the background through the live pipeline"
+      )
+      .add(
+        HttpApiEndpoint.post("uploadFile", "/files")
+          .annotate(OpenApi.Summary, "Upload a recording to transcribe")
+          .setPayload(FileUpload)
+          .addSuccess(FileJob, { status: 202 })
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getJob", "/jobs/:id")
+          .annotate(OpenApi.Summary, "Get a transcription job's progress")
+          .setPath(Schema.Struct({ id: Schema.String }))
+          .addSuccess(FileJob)
+          .addError(HttpApiError.NotFound)
+      )
+  )
+  .add(
+    HttpApiGroup.make("levels")
+      .annotate(OpenApi.Title, "Audio Levels")
+      .annotate(
+        OpenApi.Description,
+        "Loudness of the selected station, to check it is producing audio"
+      )
+      .add(
+        HttpApiEndpoint.get("getLevels", "/levels")
+          .annotate(OpenApi.Summary, "Get recent audio levels")
+          .addSuccess(LevelsResponse)
+      )
+  )
+  .add(
+    HttpApiGroup.make("comparison")
+      .annotate(OpenApi.Title, "Comparison")
+      .annotate(
+        OpenApi.Description,
+        "Stream two sources side by side and periodically compare their coverage"
+      )
+      .add(
+        HttpApiEndpoint.get("getComparison", "/comparison")
+          .annotate(OpenApi.Summary, "Get the sources being compared")
+          .addSuccess(ComparisonState)
+      )
+      .add(
+        HttpApiEndpoint.post("setComparison", "/comparison")
+          .annotate(OpenApi.Summary, "Start or stop comparing two sources")
+          .setPayload(SetComparisonRequest)
+          .addSuccess(ComparisonState)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.NotFound)
+      )
+  )
+  .add(
+    HttpApiGroup.make("experiment")
+      .annotate(OpenApi.Title, "Experiment")
+      .annotate(
+        OpenApi.Description,
+        "A/B test commentary instructions: both variants answer the same windows, tagged with their variant ID"
+      )
+      .add(
+        HttpApiEndpoint.get("getExperiment", "/experiment")
+          .annotate(OpenApi.Summary, "Get the running experiment")
+          .addSuccess(ExperimentState)
+      )
+      .add(
+        HttpApiEndpoint.post("startExperiment", "/experiment")
+          .annotate(
+            OpenApi.Summary,
+            "Run two commentary variants over the next windows"
+          )
+          .setPayload(StartExperimentRequest)
+          .addSuccess(ExperimentState)
+          .addError(HttpApiError.BadRequest)
+      )
+      .add(
+        HttpApiEndpoint.del("stopExperiment", "/experiment")
+          .annotate(OpenApi.Summary, "Stop the running experiment")
+          .addSuccess(ExperimentState)
+      )
+  )
+  .add(
+    HttpApiGroup.make("respond")
+      .annotate(OpenApi.Title, "One-off Responses")
+      .annotate(
+        OpenApi.Description,
+        "Ask something of the audio already sent, with instructions of your own"
+      )
+      .add(
+        HttpApiEndpoint.post("respond", "/respond")
+          .annotate(
+            OpenApi.Summary,
+            "Run a response over the last window with other instructions"
+          )
+          .setPayload(RespondRequest)
+          .addSuccess(RespondResponse)
+          .addError(HttpApiError.Conflict)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.post("ask", "/ask")
+          .annotate(
+            OpenApi.Summary,
+            "Ask about the last couple of minutes, answered on the stream"
+          )
+          .setPayload(AskRequest)
+          .addSuccess(AskResponse)
+          .addError(HttpApiError.Conflict)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+  )
+  .add(
+    HttpApiGroup.make("nudge")
+      .annotate(OpenApi.Title, "Nudges")
+      .annotate(
+        OpenApi.Description,
+        "Steer the commentary of the next windows without restarting the session"
+      )
+      .add(
+        HttpApiEndpoint.get("getNudge", "/nudge")
+          .annotate(OpenApi.Summary, "Get the nudge in effect")
+          .addSuccess(NudgeState)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.post("nudge", "/nudge")
+          .annotate(
+            OpenApi.Summary,
+            "Give the commentary an instruction for the next minutes"
+          )
+          .setPayload(NudgeRequest)
+          .addSuccess(NudgeState)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.del("clearNudge", "/nudge")
+          .annotate(OpenApi.Summary, "Drop the nudge in effect")
+          .addSuccess(NudgeState)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+  )
+  .add(
+    HttpApiGroup.make("presets")
+      .annotate(OpenApi.Title, "Presets")
+      .annotate(
+        OpenApi.Description,
+        "Named combinations of source, prompt, window and language, kept across restarts"
+      )
+      .add(
+        HttpApiEndpoint.get("getPresets", "/presets")
+          .annotate(OpenApi.Summary, "List presets")
+          .addSuccess(PresetsResponse)
+      )
+      .add(
+        HttpApiEndpoint.post("savePreset", "/presets")
+          .annotate(OpenApi.Summary, "Create or replace a preset")
+          .setPayload(Preset)
+          .addSuccess(Preset)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.del("deletePreset", "/presets/:id")
+          .annotate(OpenApi.Summary, "Delete a preset")
+          .setPath(Schema.Struct({ id: Schema.String }))
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.post("applyPreset", "/presets/:id/apply")
+          .annotate(
+            OpenApi.Summary,
+            "Apply a preset (until the next config reload)"
+          )
+          .setPath(Schema.Struct({ id: Schema.String }))
+          .addSuccess(Preset)
+          .addError(HttpApiError.NotFound)
+      )
+  )
+  .add(
+    HttpApiGroup.make("push")
+      .annotate(OpenApi.Title, "Push Notifications")
+      .annotate(
+        OpenApi.Description,
+        "Web Push notifications for alerts and digests, delivered with the page closed"
+      )
+      .add(
+        HttpApiEndpoint.get("getPushKey", "/push/key")
+          .annotate(OpenApi.Summary, "Get the VAPID public key")
+          .addSuccess(PushKeyResponse)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.post("subscribePush", "/push/subscribe")
+          .annotate(OpenApi.Summary, "Subscribe a browser to notifications")
+          .setPayload(PushSubscription)
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.post("unsubscribePush", "/push/unsubscribe")
+          .annotate(OpenApi.Summary, "Unsubscribe a browser")
+          .setPayload(PushUnsubscribeRequest)
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("stream")
+      .annotate(OpenApi.Title, "Message Stream")
+      .annotate(
+        OpenApi.Description,
+        "Server-Sent Events stream of transformed audio messages"
+      )
+      .add(
+        HttpApiEndpoint.get("getStream", "/stream")
+          .annotate(OpenApi.Summary, "Subscribe to sarcastic messages")
+          .setUrlParams(StreamParams)
+          .addSuccess(
+            Schema.String.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Text",
+                contentType: "text/event-stream",
+              })
+            )
+          )
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("replayStream", "/stream/replay")
+          .annotate(
+            OpenApi.Summary,
+            "Logged responses since a time, sped up, then live messages"
+          )
+          .setUrlParams(ReplayParams)
+          .addSuccess(
+            Schema.String.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Text",
+                contentType: "text/event-stream",
+              })
+            )
+          )
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getStreamNdjson", "/stream.ndjson")
+          .annotate(
+            OpenApi.Summary,
+            "Messages as newline-delimited JSON, for log pipelines"
+          )
+          .setUrlParams(StreamParams)
+          .addSuccess(
+            Schema.String.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Text",
+                contentType: "application/x-ndjson",
+              })
+            )
+          )
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getListeners", "/listeners")
+          .annotate(OpenApi.Summary, "Who is connected to the stream")
+          .addSuccess(ListenersResponse)
+      )
+      .add(
+        HttpApiEndpoint.get("getSubscriberStats", "/stats/subscribers")
+          .annotate(
+            OpenApi.Summary,
+            "Delivered and dropped message counts of connected clients"
+          )
+          .addSuccess(SubscriberStatsResponse)
+      )
+      .add(
+        HttpApiEndpoint.get("getSchema", "/schema")
+          .annotate(OpenApi.Summary, "Describe the stream message types")
+          .addSuccess(MessageCatalog)
+      )
+  )
+  .add(
+    HttpApiGroup.make("speech")
+      .annotate(OpenApi.Title, "Spoken Commentary")
+      .annotate(
+        OpenApi.Description,
+        "Audio responses, available when OPENAI_OUTPUT_MODALITY=audio"
+      )
+      .add(
+        HttpApiEndpoint.get("getSpeech", "/speech")
+          .annotate(OpenApi.Summary, "Stream spoken commentary as WAV")
+          .setUrlParams(
+            Schema.Struct({
+              task: Schema.optional(TaskIdSchema).annotations({
+                description: "Task whose audio to stream (default commentary)",
+              }),
+            })
+          )
+          .addSuccess(
+            Schema.Uint8ArrayFromSelf.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Uint8Array",
+                contentType: "audio/wav",
+              })
+            )
+          )
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+  )
+  .add(
+    HttpApiGroup.make("transcripts")
+      .annotate(OpenApi.Title, "Transcripts")
+      .annotate(
+        OpenApi.Description,
+        "Search the responses stored from past audio windows"
+      )
+      .add(
+        HttpApiEndpoint.get("searchTranscripts", "/transcripts/search")
+          .annotate(OpenApi.Summary, "Full-text search over transcripts")
+          .setUrlParams(TranscriptSearchParams)
+          .addSuccess(TranscriptSearchResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("semanticSearch", "/transcripts/semantic-search")
+          .annotate(OpenApi.Summary, "Search transcripts by meaning")
+          .setUrlParams(TranscriptSearchParams)
+          .addSuccess(SemanticSearchResponse)
+          .addError(HttpApiError.ServiceUnavailable)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getTopics", "/topics")
+          .annotate(OpenApi.Summary, "Topic and sentiment timeline")
+          .setUrlParams(TopicTimelineParams)
+          .addSuccess(TopicTimelineResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getArchive", "/archive/:source/:date")
+          .annotate(OpenApi.Summary, "A source's responses of a day, by hour")
+          .setPath(ArchivePath)
+          .setUrlParams(ArchiveParams)
+          .addSuccess(ArchiveResponse)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getFeed", "/feed.xml")
+          .annotate(OpenApi.Summary, "Atom feed of completed summaries")
+          .setUrlParams(FeedParams)
+          .addSuccess(
+            Schema.String.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Text",
+                contentType: "application/atom+xml",
+              })
+            )
+          )
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("analysis")
+      .annotate(OpenApi.Title, "Analysis")
+      .annotate(
+        OpenApi.Description,
+        "Compare the stations' coverage of the same hour, built on the topic tagging"
+      )
+      .add(
+        HttpApiEndpoint.get("getCoverage", "/analysis/coverage")
+          .annotate(
+            OpenApi.Summary,
+            "Topics only one station covered and framing differences"
+          )
+          .setUrlParams(CoverageParams)
+          .addSuccess(CoverageDiffSchema)
+          .addError(HttpApiError.BadRequest)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("feedback")
+      .annotate(OpenApi.Title, "Feedback")
+      .annotate(
+        OpenApi.Description,
+        "Rate stored responses, to tell which stations and prompts produce useful commentary"
+      )
+      .add(
+        HttpApiEndpoint.post("addFeedback", "/feedback")
+          .annotate(OpenApi.Summary, "Rate a stored response")
+          .setPayload(FeedbackRequest)
+          .addSuccess(FeedbackSchema)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.get("getFeedbackStats", "/feedback/stats")
+          .annotate(OpenApi.Summary, "Ratings by source and task")
+          .setUrlParams(FeedbackStatsParams)
+          .addSuccess(FeedbackStatsResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("fingerprints")
+      .annotate(OpenApi.Title, "Fingerprints")
+      .annotate(
+        OpenApi.Description,
+        "Segments learned from the audio because they aired more than once, e.g. ads and jingles, and their airings"
+      )
+      .add(
+        HttpApiEndpoint.get("getFingerprints", "/fingerprints")
+          .annotate(OpenApi.Summary, "List learned fingerprints")
+          .addSuccess(FingerprintsResponse)
+      )
+      .add(
+        HttpApiEndpoint.get("getRepeatedSegments", "/fingerprints/segments")
+          .annotate(OpenApi.Summary, "Airings of learned segments")
+          .setUrlParams(RepeatedSegmentsParams)
+          .addSuccess(RepeatedSegmentsResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.patch("markFingerprint", "/fingerprints/:id")
+          .annotate(
+            OpenApi.Summary,
+            "Mark a fingerprint as an ad or a jingle, or choose to keep it"
+          )
+          .setPath(Schema.Struct({ id: Schema.String }))
+          .setPayload(MarkFingerprintRequest)
+          .addSuccess(FingerprintSchema)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.del("deleteFingerprint", "/fingerprints/:id")
+          .annotate(OpenApi.Summary, "Forget a fingerprint")
+          .setPath(Schema.Struct({ id: Schema.String }))
+          .addSuccess(Schema.Void)
+          .addError(HttpApiError.NotFound)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("health")
+      .annotate(OpenApi.Title, "Health")
+      .annotate(
+        OpenApi.Description,
+        "Readiness for load balancers and orchestrators; needs no session"
+      )
+      .add(
+        HttpApiEndpoint.get("getReady", "/readyz")
+          .annotate(OpenApi.Summary, "Whether the OpenAI session is warm")
+          .addSuccess(Readiness)
+          .addError(Readiness, { status: 503 })
+      )
+  )
+  .add(
+    HttpApiGroup.make("debug")
+      .annotate(OpenApi.Title, "Debug")
+      .annotate(
+        OpenApi.Description,
+        "Health of the pipeline's supervised components, its stages, queues and last minute, the OpenAI journal, dry-run estimates, the HLS segment cache and runtime profiling"
+      )
+      .add(
+        HttpApiEndpoint.get("getPipeline", "/debug/pipeline")
+          .annotate(OpenApi.Summary, "Restart counts and last crashes")
+          .addSuccess(PipelineStatus)
+      )
+      .add(
+        HttpApiEndpoint.get("getGraph", "/debug/graph")
+          .annotate(OpenApi.Summary, "Pipeline stages and their state")
+          .addSuccess(PipelineGraph)
+      )
+      .add(
+        HttpApiEndpoint.get("getQueues", "/debug/queues")
+          .annotate(
+            OpenApi.Summary,
+            "Audio, responses and messages waiting at each stage"
+          )
+          .addSuccess(QueueDepths)
+      )
+      .add(
+        HttpApiEndpoint.get("getKpis", "/debug/kpis")
+          .annotate(OpenApi.Summary, "Responses, audio and errors, last minute")
+          .addSuccess(LiveKpisSchema)
+      )
+      .add(
+        HttpApiEndpoint.get("getJournal", "/debug/journal")
+          .annotate(
+            OpenApi.Summary,
+            "OpenAI messages not yet safe, with OPENAI_JOURNAL"
+          )
+          .addSuccess(JournalStatus)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.get("getDryRun", "/debug/dry-run")
+          .annotate(
+            OpenApi.Summary,
+            "Estimated OpenAI cost so far, with OPENAI_DRY_RUN"
+          )
+          .addSuccess(DryRunEstimateSchema)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.get("getHlsCache", "/debug/hls-cache")
+          .annotate(
+            OpenApi.Summary,
+            "HLS segments fetched and served, with HLS_SEGMENT_CACHE_MB"
+          )
+          .addSuccess(HlsCacheStatsSchema)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.get("getMemory", "/debug/memory")
+          .annotate(
+            OpenApi.Summary,
+            "Process memory and heap object counts, with DEBUG_PROFILING"
+          )
+          .addSuccess(MemoryStats)
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.get("getHeapSnapshot", "/debug/heap-snapshot")
+          .annotate(
+            OpenApi.Summary,
+            "Heap snapshot for Chrome DevTools, with DEBUG_PROFILING"
+          )
+          .addSuccess(
+            Schema.String.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Text",
+                contentType: "application/json",
+              })
+            )
+          )
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+      .add(
+        HttpApiEndpoint.get("getProfile", "/debug/profile")
+          .annotate(
+            OpenApi.Summary,
+            "Sample the CPU for a while and list the hottest functions, with DEBUG_PROFILING"
+          )
+          .setUrlParams(ProfileParams)
+          .addSuccess(
+            Schema.String.pipe(
+              HttpApiSchema.withEncoding({
+                kind: "Text",
+                contentType: "text/plain",
+              })
+            )
+          )
+          .addError(HttpApiError.ServiceUnavailable)
+      )
+  )
+  .add(
+    HttpApiGroup.make("reports")
+      .annotate(OpenApi.Title, "Reports")
+      .annotate(
+        OpenApi.Description,
+        "Pipeline reliability over days, from the metrics snapshots kept in the transcript store"
+      )
+      .add(
+        HttpApiEndpoint.get("getDailyReport", "/reports/daily")
+          .annotate(
+            OpenApi.Summary,
+            "Uptime, latency percentiles, audio, errors and restarts per day"
+          )
+          .setUrlParams(DailyReportParams)
+          .addSuccess(DailyReportResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .add(
+    HttpApiGroup.make("budgets")
+      .annotate(OpenApi.Title, "Budgets")
+      .annotate(
+        OpenApi.Description,
+        "Daily spending limits of the sources; set one with a source's budget"
+      )
+      .add(
+        HttpApiEndpoint.get("getBudgets", "/budgets")
+          .annotate(OpenApi.Summary, "Today's spend of every source")
+          .addSuccess(BudgetsResponse)
+      )
+  )
+  .add(
+    HttpApiGroup.make("config")
+      .annotate(OpenApi.Title, "Configuration")
+      .annotate(
+        OpenApi.Description,
+        "Effective configuration, reloaded from the config file on change or SIGHUP"
+      )
+      .add(
+        HttpApiEndpoint.get("getConfig", "/config")
+          .annotate(OpenApi.Summary, "Get the effective configuration")
+          .addSuccess(RadioConfig)
+      )
+      .add(
+        HttpApiEndpoint.patch("updateConfig", "/config")
+          .annotate(
+            OpenApi.Summary,
+            "Change the prompt or language until the next config reload"
+          )
+          .setPayload(UpdateConfigRequest)
+          .addSuccess(RadioConfig)
+      )
+      .add(
+        HttpApiEndpoint.get("exportConfig", "/config/export")
+          .annotate(
+            OpenApi.Summary,
+            "Export the saved configuration and presets as one bundle"
+          )
+          .addSuccess(ConfigBundle)
+          .addError(HttpApiError.InternalServerError)
+      )
+      .add(
+        HttpApiEndpoint.post("importConfig", "/config/import")
+          .annotate(
+            OpenApi.Summary,
+            "Replace the configuration and presets with an exported bundle"
+          )
+          .setPayload(ConfigBundle)
+          .addSuccess(ConfigImportResponse)
+          .addError(HttpApiError.InternalServerError)
+      )
+  )
+  .annotate(OpenApi.Title, "Funny Radio API")
+  .annotate(
+    OpenApi.Description,
+    "Transform French radio news into sarcastic, optimistic summaries using AI"
+  )
+  .annotate(OpenApi.Version, "1.0.0") {}
+
+const messageSource = (msg: BroadcastMessage) =>
+  "source" in msg && typeof msg.source === "string" ? msg.source : null;
+
+const formatSSE = (msg: BroadcastMessage): string =>
+  `data: ${encodeBroadcastJson(msg)}\n\n`;
+
+// Multiplexed streams name each event after the source it is about, so a
+// dashboard can listen per station; other messages stay plain "message"
+// events.
+const formatTaggedSSE = (msg: BroadcastMessage): string => {
+  const source = messageSource(msg);
+  return source === null
+    ? formatSSE(msg)
+    : `event: ${source}\n${formatSSE(msg)}`;
+};
+
+const formatNdjson = (msg: BroadcastMessage): string =>
+  `${encodeBroadcastJson(msg)}\n`;
+
+const splitList = (list: string | undefined) =>
+  list
+    ?.split(",")
+    .map((item) => item.trim())
+    .filter((item) => item.length > 0) ?? [];
+
+const matchesFilter =
+  (params: typeof StreamParams.Type) => (msg: BroadcastMessage) => {
+    const types = splitList(params.type);
+    const sources = [
+      ...(params.source ? [params.source] : []),
+      ...splitList(params.sources),
+    ];
+    const source = messageSource(msg);
+    return (
+      (types.length === 0 || types.includes(msg.type)) &&
+      (sources.length === 0 || source === null || sources.includes(source)) &&
+      (!params.task || !("task" in msg) || msg.task === params.task) &&
+      (msg.type !== "translation" || msg.lang === params.lang)
+    );
+  };
+
+// Live messages for one client, in the given framing. Ends after the
+// server_shutdown message, which is sent whatever the filter.
+// Logged messages replayed at most, and the longest pause between two.
+const REPLAY_LIMIT = 5000;
+const MAX_REPLAY_GAP_MS = 1000;
+
+// Messages logged since `since`, spaced as they happened but `speed` times
+// faster, then `live`. The live subscription is taken first, so nothing
+// published during the replay is missed; what was both replayed and queued
+// meanwhile is sent once.
+const afterReplay = (
+  live: Stream.Stream<BroadcastMessage>,
+  since: number,
+  speed: number
+) =>
+  Effect.gen(function* () {
+    const store = yield* TranscriptStore;
+    const logged = yield* store.broadcastsSince(since, REPLAY_LIMIT);
+    const replayed = new Set(logged.map((entry) => entry.key));
+    const past = Stream.fromIterable(logged).pipe(
+      Stream.zipWithPrevious,
+      Stream.mapEffect(([previous, entry]) =>
+        Effect.sleep(
+          Option.match(previous, {
+            onNone: () => 0,
+            onSome: (p) =>
+              Math.min((entry.at - p.at) / speed, MAX_REPLAY_GAP_MS),
+          })
+        ).pipe(Effect.as(entry.message))
+      )
+    );
+    return Stream.concat(
+      past,
+      live.pipe(
+        Stream.filter((msg) => {
+          const key = broadcastKey(msg);
+          return key === null || !replayed.has(key);
+        })
+      )
+    );
+  });
+
+const streamMessages = (
+  request: HttpServerRequest.HttpServerRequest,
+  params: typeof StreamParams.Type,
+  kind: SubscriberKind,
+  format: (msg: BroadcastMessage) => string,
+  contentType: string,
+  replay?: { since: number; speed: number }
+) =>
+  Effect.gen(function* () {
+    const broadcaster = yield* Broadcaster;
+    const maybeCurrent = yield* AudioSource.currentSource;
+
+    // With a shared broadcaster, another instance may be the one
+    // processing audio.
+    if (!broadcaster.distributed && Option.isNone(maybeCurrent)) {
+      return yield* new HttpApiError.ServiceUnavailable();
+    }
+
+    const subscription = yield* broadcaster.subscribeClient(
+      kind,
+      Option.getOrNull(request.remoteAddress),
+      params.name || null
+    );
+    if (params.lang) yield* (yield* Translations).want(params.lang);
+    const matches = matchesFilter(params);
+    const live = Stream.fromQueue(subscription);
+
+    const stream = (
+      replay === undefined
+        ? live
+        : yield* afterReplay(live, replay.since, replay.speed)
+    ).pipe(
+      Stream.takeUntil((msg) => msg.type === "server_shutdown"),
+      serializeResponses(
+        (msg) => msg.type === "server_shutdown" || matches(msg)
+      ),
+      (messages) =>
+        params.batch === "sentence" ? batchSentences(messages) : messages,
+      Stream.map((msg) => new TextEncoder().encode(format(msg)))
+    );
+
+    const encoding = (yield* StreamCompressionConfig)
+      ? negotiateEncoding(request.headers["accept-encoding"])
+      : Option.none();
+
+    return yield* HttpServerResponse.stream(
+      Option.match(encoding, {
+        onNone: () => stream,
+        onSome: (e) => compressStream(e)(stream),
+      }),
+      {
+        headers: {
+          "Content-Type": contentType,
+          "Cache-Control": "no-cache",
+          "X-Accel-Buffering": "no",
+          Vary: "Accept-Encoding",
+          ...Option.match(encoding, {
+            onNone: () => ({}),
+            onSome: (e) => ({ "Content-Encoding": e }),
+          }),
+        },
+      }
+    );
+  });
+
+// UI group - serves HTML page
+const serveFile = (name: string) =>
+  Effect.gen(function* () {
+    const path = yield* Path.Path;
+    const currentDir = path.dirname(fileURLToPath(import.meta.url));
+    return yield* HttpServerResponse.file(path.join(currentDir, name));
+  }).pipe(Effect.orDie);
+
+const uiGroupLive = HttpApiBuilder.group(FunnyRadioApi, "ui", (handlers) =>
+  handlers
+    .handleRaw("getIndex", () => serveFile("index.html"))
+    // Served from the root so it can receive pushes for the whole page.
+    .handleRaw("getServiceWorker", () => serveFile("sw.js"))
+    // The page is open to anyone; what it reads needs an admin session.
+    .handleRaw("getAdmin", () => serveFile("admin/index.html"))
+    .handleRaw("getAdminAsset", ({ path }) => serveFile(`admin/${path.file}`))
+);
+
+// Auth group
+const sessionCookie = (
+  accounts: Accounts,
+  token: string,
+  expiresAt: number
+) =>
+  HttpApiBuilder.securitySetCookie(SessionCookie, token, {
+    secure: accounts.secureCookie,
+    sameSite: "lax",
+    path: accounts.cookiePath,
+    expires: new Date(expiresAt),
+  });
+
+const authGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "auth",
+  (handlers) =>
+    handlers
+      .handle("login", ({ payload }) =>
+        Effect.gen(function* () {
+          const accounts = yield* Accounts;
+          if (!accounts.enabled) {
+            return yield* new HttpApiError.ServiceUnavailable();
+          }
+          const session = yield* accounts.login(
+            payload.username,
+            Redacted.value(payload.password)
+          );
+          if (Option.isNone(session)) {
+            yield* Effect.logWarning(`Failed login as ${payload.username}`);
+            return yield* new HttpApiError.Unauthorized();
+          }
+          yield* sessionCookie(
+            accounts,
+            session.value.token,
+            session.value.expiresAt
+          );
+          return session.value;
+        })
+      )
+      // Tokens are stateless, so one copied elsewhere stays valid until it
+      // expires or its account is deleted.
+      .handle("logout", () =>
+        Accounts.pipe(
+          Effect.flatMap((accounts) => sessionCookie(accounts, "", 0))
+        )
+      )
+      .handle("getMe", () =>
+        Effect.gen(function* () {
+          const accounts = yield* Accounts;
+          if (!accounts.enabled) {
+            return { enabled: false, username: null, role: "admin" as const };
+          }
+          const request = yield* HttpServerRequest.HttpServerRequest;
+          const user = Option.getOrNull(yield* accounts.fromRequest(request));
+          return {
+            enabled: true,
+            username: user?.username ?? null,
+            role: user?.role ?? null,
+          };
+        })
+      )
+);
+
+// Users group
+const accountStoreFailed = (e: { message: string }) =>
+  Effect.logError(`Failed to save accounts: ${e.message}`).pipe(
+    Effect.zipRight(new HttpApiError.InternalServerError())
+  );
+
+const accountsEnabled = Accounts.pipe(
+  Effect.filterOrFail(
+    (accounts) => accounts.enabled,
+    () => new HttpApiError.ServiceUnavailable()
+  )
+);
+
+// Whether changing `username` to `role` (null to delete it) would leave
+// nobody able to manage the station.
+const removesLastAdmin = (
+  accounts: Accounts,
+  username: string,
+  role: Role | null
+) =>
+  Effect.map(
+    accounts.list,
+    (users) =>
+      role !== "admin" &&
+      users.some((u) => u.username === username && u.role === "admin") &&
+      users.filter((u) => u.role === "admin").length === 1
+  );
+
+const usersGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "users",
+  (handlers) =>
+    handlers
+      .handle("getUsers", () =>
+        accountsEnabled.pipe(
+          Effect.flatMap((accounts) => accounts.list),
+          Effect.map((users) => ({ users }))
+        )
+      )
+      .handle("putUser", ({ path, payload }) =>
+        Effect.gen(function* () {
+          const accounts = yield* accountsEnabled;
+          if (yield* removesLastAdmin(accounts, path.username, payload.role)) {
+            return yield* new HttpApiError.BadRequest();
+          }
+          yield* accounts
+            .save(path.username, payload.role, Redacted.value(payload.password))
+            .pipe(Effect.catchTag("AccountStoreError", accountStoreFailed));
+          yield* Effect.log(`Saved account ${path.username} (${payload.role})`);
+          return { username: path.username, role: payload.role };
+        })
+      )
+      .handle("deleteUser", ({ path }) =>
+        Effect.gen(function* () {
+          const accounts = yield* accountsEnabled;
+          if (yield* removesLastAdmin(accounts, path.username, null)) {
+            return yield* new HttpApiError.BadRequest();
+          }
+          const removed = yield* accounts
+            .remove(path.username)
+            .pipe(Effect.catchTag("AccountStoreError", accountStoreFailed));
+          if (!removed) return yield* new HttpApiError.NotFound();
+          yield* Effect.log(`Deleted account ${path.username}`);
+        })
+      )
+);
+
+// Sources group
+const catalogFailed = (e: { message: string }) =>
+  Effect.logError(`Failed to save sources: ${e.message}`).pipe(
+    Effect.zipRight(new HttpApiError.InternalServerError())
+  );
+
+// Account making the request, recorded with the selection changes it makes;
+// null while accounts are off.
+const requestUser = Effect.gen(function* () {
+  const accounts = yield* Accounts;
+  const request = yield* HttpServerRequest.HttpServerRequest;
+  const user = yield* accounts.fromRequest(request);
+  return Option.getOrNull(Option.map(user, (u) => u.username));
+});
+
+// Tells clients to refresh their source list.
+const notifySourceChanged = (id: string, removed: boolean) =>
+  Broadcaster.pipe(
+    Effect.flatMap((broadcaster) =>
+      broadcaster.publish({ type: "source_changed", source: id, removed })
+    )
+  );
+
+const sourcesGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "sources",
+  (handlers) =>
+    handlers
+      .handle("getSources", () =>
+        Effect.gen(function* () {
+          const maybeCurrent = yield* AudioSource.currentSource;
+          const sources = yield* AudioSource.sources;
+          const paused = yield* AudioSource.processingPaused;
+          const variant = yield* AudioSource.currentVariant;
+          const sampleRate = yield* AudioSource.currentSampleRate;
+          const stats = yield* SourceStats;
+          const now = yield* Clock.currentTimeMillis;
+          return {
+            sources: yield* Effect.forEach(sources, (source) =>
+              Effect.zip(
+                stats.get(source.id),
+                AudioSource.sourceHealth(source)
+              ).pipe(
+                Effect.map(([status, health]) => ({
+                  ...source,
+                  type: sourceType(source),
+                  status: {
+                    ...status,
+                    health,
+                    uptimeMs:
+                      status.startedAt === null
+                        ? null
+                        : now - status.startedAt,
+                    lossRatio:
+                      status.chunksDropped === 0
+                        ? 0
+                        : status.chunksDropped /
+                          (status.chunksReceived + status.chunksDropped),
+                  },
+                }))
+              )
+            ),
+            current: Option.getOrNull(maybeCurrent),
+            paused,
+            variant: Option.getOrNull(variant),
+            sampleRate: Option.getOrNull(sampleRate),
+          };
+        })
+      )
+      .handle("setSource", ({ payload }) =>
+        Effect.gen(function* () {
+          const source = payload.source
+            ? Option.getOrNull(yield* AudioSource.findSource(payload.source))
+            : null;
+          if (payload.source && !source) {
+            return yield* new HttpApiError.NotFound();
+          }
+          yield* AudioSource.setSource(
+            payload.source,
+            "request",
+            yield* requestUser
+          );
+          const name = source?.name ?? null;
+          yield* Effect.log(
+            name ? `Audio source changed to: ${name}` : "Audio source cleared"
+          );
+          return { success: true, current: payload.source, name };
+        })
+      )
+      .handle("getSelectionHistory", ({ urlParams }) =>
+        AudioSource.selectionHistory(urlParams.limit ?? 50).pipe(
+          Effect.map((events) => ({ events }))
+        )
+      )
+      .handle("updateSource", ({ path, payload }) =>
+        Effect.gen(function* () {
+          if (Option.isNone(yield* AudioSource.findSource(path.id))) {
+            return yield* new HttpApiError.NotFound();
+          }
+          const config = yield* AppConfig;
+          yield* config.update((c) => ({
+            ...c,
+            sources: c.sources.map((s) =>
+              s.id === path.id
+                ? {
+                    ...s,
+                    ...(payload.instructions !== undefined && {
+                      instructions: payload.instructions ?? undefined,
+                    }),
+                    ...(payload.maxBitrate !== undefined && {
+                      maxBitrate: payload.maxBitrate ?? undefined,
+                    }),
+                    ...(payload.normalizeLoudness !== undefined && {
+                      normalizeLoudness: payload.normalizeLoudness,
+                    }),
+                    ...(payload.delaySeconds !== undefined && {
+                      delaySeconds: payload.delaySeconds ?? undefined,
+                    }),
+                    ...(payload.noiseReduction !== undefined && {
+                      noiseReduction: payload.noiseReduction ?? undefined,
+                    }),
+                    ...(payload.preprocessing !== undefined && {
+                      preprocessing: payload.preprocessing ?? undefined,
+                    }),
+                  }
+                : s
+            ),
+          }));
+          yield* Effect.log(`Source ${path.id} updated`);
+          const updated = yield* AudioSource.findSource(path.id);
+          if (Option.isNone(updated)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          return updated.value;
+        })
+      )
+      // Replacing the selected source restarts its processing with the new
+      // settings.
+      .handle("putSource", ({ path, payload }) =>
+        Effect.gen(function* () {
+          const config = yield* AppConfig;
+          const source = { ...payload, id: path.id };
+          yield* config
+            .putSource(source)
+            .pipe(Effect.catchTag("SourceCatalogError", catalogFailed));
+          yield* Effect.log(`Source ${path.id} saved`);
+          yield* notifySourceChanged(path.id, false);
+          return source;
+        })
+      )
+      .handle("getNowPlaying", ({ path }) =>
+        Effect.gen(function* () {
+          const source = yield* AudioSource.findSource(path.id);
+          if (Option.isNone(source)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          const metadata = yield* StationMetadata;
+          const nowPlaying = yield* metadata.nowPlaying(source.value);
+          return {
+            source: path.id,
+            nowPlaying: Option.getOrNull(nowPlaying),
+          };
+        })
+      )
+      .handle("catchUp", ({ path, payload }) =>
+        Effect.gen(function* () {
+          const source = yield* AudioSource.findSource(path.id);
+          if (Option.isNone(source)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          // Only HLS playlists keep past audio to go back to.
+          const rewind = yield* AudioSource.catchUp(
+            source.value,
+            payload.minutes * 60,
+            yield* requestUser
+          );
+          if (Option.isNone(rewind)) {
+            return yield* new HttpApiError.BadRequest();
+          }
+          yield* Effect.log(
+            `Catching up on ${source.value.name} from ${Math.round(rewind.value.seconds)}s ago`
+          );
+          return {
+            current: path.id,
+            name: source.value.name,
+            rewindSeconds: rewind.value.seconds,
+          };
+        })
+      )
+      // Frames are decoded as they come while the source is selected; the
+      // socket stays open until the browser closes it or another connection
+      // for the same source takes over. A container stream nobody reads for
+      // too long is closed with REMOTE_OVERFLOW_CLOSE_CODE.
+      .handleRaw("ingestAudio", ({ path, urlParams, request }) =>
+        Effect.gen(function* () {
+          const source = yield* AudioSource.findSource(path.id);
+          if (Option.isNone(source)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          if (sourceType(source.value) !== "websocket") {
+            return yield* new HttpApiError.BadRequest();
+          }
+          const socket = yield* request.upgrade.pipe(
+            Effect.mapError(() => new HttpApiError.BadRequest())
+          );
+          const connection = yield* AudioSource.connectRemote(path.id, {
+            format: urlParams.format ?? "opus",
+            sampleRate: urlParams.sampleRate ?? 48000,
+          });
+          yield* Effect.log(`Audio connected to ${source.value.name}`);
+          const ended = yield* socket.run(connection.push).pipe(
+            Effect.as(Option.none<RemoteEnd>()),
+            Effect.raceFirst(
+              Deferred.await(connection.ended).pipe(Effect.map(Option.some))
+            ),
+            Effect.catchAll((e) =>
+              Effect.logWarning(
+                `Audio connection to ${source.value.name} failed`,
+                e
+              ).pipe(Effect.as(Option.none<RemoteEnd>()))
+            )
+          );
+          if (Option.contains(ended, "overflow")) {
+            const write = yield* socket.writer;
+            yield* Effect.ignore(
+              write(new Socket.CloseEvent(REMOTE_OVERFLOW_CLOSE_CODE))
+            );
+          }
+          yield* Effect.log(`Audio disconnected from ${source.value.name}`);
+          return HttpServerResponse.empty();
+        }).pipe(Effect.scoped)
+      )
+      .handle("deleteSource", ({ path }) =>
+        Effect.gen(function* () {
+          if (Option.isNone(yield* AudioSource.findSource(path.id))) {
+            return yield* new HttpApiError.NotFound();
+          }
+          // Clearing the selection first stops processing and cancels the
+          // responses still running for it.
+          const current = yield* AudioSource.currentSource;
+          if (Option.contains(current, path.id)) {
+            yield* AudioSource.setSource(null, "removed", yield* requestUser);
+            yield* Effect.log(`Audio source cleared: ${path.id} was removed`);
+          }
+          const config = yield* AppConfig;
+          yield* config
+            .removeSource(path.id)
+            .pipe(Effect.catchTag("SourceCatalogError", catalogFailed));
+          yield* Effect.log(`Source ${path.id} removed`);
+          yield* notifySourceChanged(path.id, true);
+        })
+      )
+);
+
+// Processing group
+const setProcessingPaused = (paused: boolean) =>
+  AudioSource.setProcessingPaused(paused).pipe(
+    Effect.zipRight(
+      Effect.log(paused ? "Processing paused" : "Processing resumed")
+    ),
+    Effect.as({ paused })
+  );
+
+const processingGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "processing",
+  (handlers) =>
+    handlers
+      .handle("pauseProcessing", () => setProcessingPaused(true))
+      .handle("resumeProcessing", () => setProcessingPaused(false))
+);
+
+// Sessions group
+const sessionsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "sessions",
+  (handlers) =>
+    handlers
+      .handle("getSessions", () =>
+        Effect.gen(function* () {
+          const sessions = yield* ListenSessions;
+          return {
+            current: Option.getOrNull(yield* sessions.current),
+            history: yield* sessions.history(20),
+          };
+        }).pipe(
+          Effect.tapError((e) =>
+            Effect.logError("Failed to read sessions", e.cause)
+          ),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        )
+      )
+      .handle("startSession", ({ payload }) =>
+        Effect.gen(function* () {
+          const current = yield* AudioSource.currentSource;
+          const id = payload.source ?? Option.getOrNull(current);
+          if (id === null) return yield* new HttpApiError.BadRequest();
+          if (Option.isNone(yield* AudioSource.findSource(id))) {
+            return yield* new HttpApiError.NotFound();
+          }
+          const sessions = yield* ListenSessions;
+          const by = yield* requestUser;
+          return yield* sessions
+            .start(id, Duration.minutes(payload.minutes), by)
+            .pipe(
+              Effect.catchTag(
+                "SessionRunningError",
+                () => new HttpApiError.Conflict()
+              )
+            );
+        })
+      )
+      .handle("stopSession", () =>
+        ListenSessions.pipe(
+          Effect.flatMap((sessions) => sessions.stop),
+          Effect.flatMap(
+            Option.match({
+              onNone: () => new HttpApiError.NotFound(),
+              onSome: Effect.succeed,
+            })
+          )
+        )
+      )
+);
+
+// Playlists group
+const playlistsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "playlists",
+  (handlers) =>
+    handlers
+      .handle("getPlaylists", () =>
+        Effect.gen(function* () {
+          const { playlists } = yield* AppConfig.pipe(
+            Effect.flatMap((c) => c.get)
+          );
+          const current = yield* Playlists.pipe(
+            Effect.flatMap((p) => p.current)
+          );
+          return { playlists, current: Option.getOrNull(current) };
+        })
+      )
+      .handle("startPlaylist", ({ path }) =>
+        Effect.gen(function* () {
+          const playlists = yield* Playlists;
+          const playlist = yield* playlists.find(path.id);
+          if (Option.isNone(playlist)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          return yield* playlists
+            .start(playlist.value, yield* requestUser)
+            .pipe(
+              Effect.catchTag(
+                "NoPlayableSourceError",
+                () => new HttpApiError.Conflict()
+              )
+            );
+        })
+      )
+      .handle("stopPlaylist", () =>
+        Playlists.pipe(
+          Effect.flatMap((playlists) => playlists.stop),
+          Effect.flatMap(
+            Option.match({
+              onNone: () => new HttpApiError.NotFound(),
+              onSome: Effect.succeed,
+            })
+          )
+        )
+      )
+);
+
+// Files group
+const AUDIO_FILE = /\.(mp3|wav)$/i;
+
+const filesGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "files",
+  (handlers) =>
+    handlers
+      .handle("uploadFile", ({ payload }) =>
+        Effect.gen(function* () {
+          const { file } = payload;
+          if (
+            !AUDIO_FILE.test(file.name) &&
+            !/^audio\/(mpeg|mp3|wav|x-wav|wave)$/.test(file.contentType)
+          ) {
+            return yield* new HttpApiError.BadRequest();
+          }
+          const jobs = yield* FileJobs;
+          return yield* jobs.submit(file).pipe(
+            Effect.catchAll((e) =>
+              Effect.logError("Failed to queue upload", e).pipe(
+                Effect.zipRight(new HttpApiError.InternalServerError())
+              )
+            )
+          );
+        })
+      )
+      .handle("getJob", ({ path }) =>
+        Effect.gen(function* () {
+          const jobs = yield* FileJobs;
+          const job = yield* jobs.get(path.id);
+          if (Option.isNone(job)) return yield* new HttpApiError.NotFound();
+          return job.value;
+        })
+      )
+);
+
+// Levels group
+const levelsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "levels",
+  (handlers) =>
+    handlers.handle("getLevels", () =>
+      Effect.gen(function* () {
+        const source = Option.getOrNull(yield* AudioSource.currentSource);
+        const levels = yield* AudioSource.levels;
+        return {
+          source,
+          levels: levels.filter((level) => level.source === source),
+        };
+      })
+    )
+);
+
+// Comparison group
+const comparisonGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "comparison",
+  (handlers) =>
+    handlers
+      .handle("getComparison", () =>
+        Comparison.pipe(
+          Effect.flatMap((comparison) => comparison.current),
+          Effect.map((sources) => ({ sources }))
+        )
+      )
+      .handle("setComparison", ({ payload }) =>
+        Effect.gen(function* () {
+          const comparison = yield* Comparison;
+          if (payload.sources === null) {
+            yield* comparison.stop;
+            return { sources: null };
+          }
+          const [a, b] = payload.sources;
+          if (a === b) return yield* new HttpApiError.BadRequest();
+          for (const id of payload.sources) {
+            if (Option.isNone(yield* AudioSource.findSource(id))) {
+              return yield* new HttpApiError.NotFound();
+            }
+          }
+          yield* comparison.start(payload.sources);
+          return { sources: payload.sources };
+        })
+      )
+);
+
+// Experiment group
+const experimentState = Option.match({
+  onNone: () => ({ experiment: null }),
+  onSome: (experiment: Experiment) => ({ experiment }),
+});
+
+const experimentGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "experiment",
+  (handlers) =>
+    handlers
+      .handle("getExperiment", () =>
+        OpenAIRealtime.pipe(
+          Effect.flatMap((openai) => openai.getExperiment),
+          Effect.map(experimentState)
+        )
+      )
+      .handle("startExperiment", ({ payload }) =>
+        Effect.gen(function* () {
+          const [a, b] = payload.variants;
+          if (a.id === b.id) return yield* new HttpApiError.BadRequest();
+          const openai = yield* OpenAIRealtime;
+          const id = payload.id ?? `exp_${crypto.randomUUID().slice(0, 8)}`;
+          yield* openai.startExperiment(id, payload.variants, payload.windows);
+          return experimentState(yield* openai.getExperiment);
+        })
+      )
+      .handle("stopExperiment", () =>
+        OpenAIRealtime.pipe(
+          Effect.flatMap((openai) => openai.stopExperiment),
+          Effect.map(experimentState)
+        )
+      )
+);
+
+// Respond group
+const openaiUnreachable = (e: { message: string }) =>
+  Effect.logWarning(`OpenAI unreachable: ${e.message}`).pipe(
+    Effect.zipRight(new HttpApiError.ServiceUnavailable())
+  );
+
+const respondGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "respond",
+  (handlers) =>
+    handlers
+      .handle("respond", ({ payload }) =>
+        Effect.gen(function* () {
+          const openai = yield* OpenAIRealtime;
+          const task = payload.task ?? "commentary";
+          const responseId = yield* openai.respondWith(
+            task,
+            payload.instructions
+          );
+          yield* Effect.log(`One-off ${task} response ${responseId} requested`);
+          return { responseId };
+        }).pipe(
+          Effect.catchTags({
+            NoBufferedAudioError: () => new HttpApiError.Conflict(),
+            CustomResponseError: (e) =>
+              Effect.logWarning(`One-off response failed: ${e.message}`).pipe(
+                Effect.zipRight(new HttpApiError.ServiceUnavailable())
+              ),
+            OpenAIConnectionError: openaiUnreachable,
+          })
+        )
+      )
+      .handle("ask", ({ payload }) =>
+        Effect.gen(function* () {
+          const openai = yield* OpenAIRealtime;
+          const asked = yield* openai.ask(payload.question);
+          yield* Effect.log(`Question ${asked.askId}: ${payload.question}`);
+          return asked;
+        }).pipe(
+          Effect.catchTags({
+            NoBufferedAudioError: () => new HttpApiError.Conflict(),
+            CustomResponseError: (e) =>
+              Effect.logWarning(`Question failed: ${e.message}`).pipe(
+                Effect.zipRight(new HttpApiError.ServiceUnavailable())
+              ),
+            OpenAIConnectionError: openaiUnreachable,
+          })
+        )
+      )
+);
+
+// Nudge group
+const nudgeState = Option.match({
+  onNone: () => ({ nudge: null }),
+  onSome: (nudge: Nudge) => ({
+    nudge: {
+      text: nudge.text,
+      expiresAt: DateTime.unsafeMake(nudge.expiresAt),
+    },
+  }),
+});
+
+const nudgeGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "nudge",
+  (handlers) =>
+    handlers
+      .handle("getNudge", () =>
+        OpenAIRealtime.pipe(
+          Effect.flatMap((openai) => openai.getNudge),
+          Effect.map(nudgeState),
+          Effect.catchTag("OpenAIConnectionError", openaiUnreachable)
+        )
+      )
+      .handle("nudge", ({ payload }) =>
+        OpenAIRealtime.pipe(
+          Effect.flatMap((openai) =>
+            openai.nudge(payload.text, (payload.minutes ?? 10) * 60_000)
+          ),
+          Effect.map((nudge) => nudgeState(Option.some(nudge))),
+          Effect.catchTag("OpenAIConnectionError", openaiUnreachable)
+        )
+      )
+      .handle("clearNudge", () =>
+        OpenAIRealtime.pipe(
+          Effect.flatMap((openai) => openai.clearNudge),
+          Effect.as(nudgeState(Option.none())),
+          Effect.catchTag("OpenAIConnectionError", openaiUnreachable)
+        )
+      )
+);
+
+// Presets group
+const presetStoreFailed = (e: { message: string }) =>
+  Effect.logError(`Failed to save presets: ${e.message}`).pipe(
+    Effect.zipRight(new HttpApiError.InternalServerError())
+  );
+
+const presetsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "presets",
+  (handlers) =>
+    handlers
+      .handle("getPresets", () =>
+        Presets.pipe(
+          Effect.flatMap((presets) => presets.list),
+          Effect.map((presets) => ({ presets }))
+        )
+      )
+      .handle("savePreset", ({ payload }) =>
+        Effect.gen(function* () {
+          if (
+            payload.source &&
+            Option.isNone(yield* AudioSource.findSource(payload.source))
+          ) {
+            return yield* new HttpApiError.BadRequest();
+          }
+          const presets = yield* Presets;
+          yield* presets
+            .save(payload)
+            .pipe(Effect.catchTag("PresetStoreError", presetStoreFailed));
+          return payload;
+        })
+      )
+      .handle("deletePreset", ({ path }) =>
+        Effect.gen(function* () {
+          const presets = yield* Presets;
+          const removed = yield* presets
+            .remove(path.id)
+            .pipe(Effect.catchTag("PresetStoreError", presetStoreFailed));
+          if (!removed) return yield* new HttpApiError.NotFound();
+        })
+      )
+      .handle("applyPreset", ({ path }) =>
+        Effect.gen(function* () {
+          const presets = yield* Presets;
+          const preset = yield* presets.get(path.id);
+          if (Option.isNone(preset)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          yield* presets.apply(preset.value, yield* requestUser);
+          return preset.value;
+        })
+      )
+);
+
+// Push group
+const pushStoreFailed = (e: { message: string }) =>
+  Effect.logError(`Failed to save push subscriptions: ${e.message}`).pipe(
+    Effect.zipRight(new HttpApiError.InternalServerError())
+  );
+
+const pushDisabled = () => new HttpApiError.ServiceUnavailable();
+
+const pushGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "push",
+  (handlers) =>
+    handlers
+      .handle("getPushKey", () =>
+        PushNotifications.pipe(
+          Effect.flatMap((push) => push.publicKey),
+          Effect.map((publicKey) => ({ publicKey })),
+          Effect.catchTag("PushDisabledError", pushDisabled)
+        )
+      )
+      .handle("subscribePush", ({ payload }) =>
+        PushNotifications.pipe(
+          Effect.flatMap((push) => push.subscribe(payload)),
+          Effect.tap(() => Effect.log("Push subscription added")),
+          Effect.catchTags({
+            PushDisabledError: pushDisabled,
+            PushStoreError: pushStoreFailed,
+          })
+        )
+      )
+      .handle("unsubscribePush", ({ payload }) =>
+        PushNotifications.pipe(
+          Effect.flatMap((push) => push.unsubscribe(payload.endpoint)),
+          Effect.catchTags({
+            PushDisabledError: pushDisabled,
+            PushStoreError: pushStoreFailed,
+          })
+        )
+      )
+);
+
+// Stream group
+const streamGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "stream",
+  (handlers) =>
+    handlers
+      .handleRaw("getStream", ({ request, urlParams }) =>
+        streamMessages(
+          request,
+          urlParams,
+          "sse",
+          urlParams.sources ? formatTaggedSSE : formatSSE,
+          "text/event-stream"
+        )
+      )
+      .handleRaw("replayStream", ({ request, urlParams }) =>
+        streamMessages(
+          request,
+          urlParams,
+          "sse",
+          urlParams.sources ? formatTaggedSSE : formatSSE,
+          "text/event-stream",
+          { since: urlParams.since.epochMillis, speed: urlParams.speed ?? 360 }
+        ).pipe(
+          Effect.catchTag("TranscriptStoreError", (e) =>
+            Effect.logError("Broadcast replay failed", e.cause).pipe(
+              Effect.zipRight(new HttpApiError.InternalServerError())
+            )
+          )
+        )
+      )
+      .handleRaw("getStreamNdjson", ({ request, urlParams }) =>
+        streamMessages(
+          request,
+          urlParams,
+          "ndjson",
+          formatNdjson,
+          "application/x-ndjson"
+        )
+      )
+      .handle("getListeners", () =>
+        Broadcaster.pipe(
+          Effect.flatMap((b) => b.listeners),
+          Effect.map((listeners) => ({ listeners }))
+        )
+      )
+      .handle("getSubscriberStats", () =>
+        Broadcaster.pipe(Effect.flatMap((b) => b.subscriberStats))
+      )
+      .handle("getSchema", () =>
+        Effect.succeed({
+          version: BROADCAST_VERSION,
+          schema: JSONSchema.make(BroadcastMessage),
+        })
+      )
+);
+
+// Header for an open-ended mono s16le WAV stream of speech; the unknown sizes
+// are set to the maximum so players keep reading.
+const wavStreamHeader = () => {
+  const header = Buffer.alloc(44);
+  header.write("RIFF", 0, "latin1");
+  header.writeUInt32LE(0xffffffff, 4);
+  header.write("WAVEfmt ", 8, "latin1");
+  header.writeUInt32LE(16, 16);
+  header.writeUInt16LE(1, 20);
+  header.writeUInt16LE(1, 22);
+  header.writeUInt32LE(SPEECH_SAMPLE_RATE, 24);
+  header.writeUInt32LE(SPEECH_SAMPLE_RATE * 2, 28);
+  header.writeUInt16LE(2, 32);
+  header.writeUInt16LE(16, 34);
+  header.write("data", 36, "latin1");
+  header.writeUInt32LE(0xffffffff, 40);
+  return header;
+};
+
+// Speech group
+const speechGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "speech",
+  (handlers) =>
+    handlers.handleRaw("getSpeech", ({ urlParams }) =>
+      Effect.gen(function* () {
+        const openai = yield* OpenAIRealtime;
+        if (openai.outputModality !== "audio") {
+          return yield* new HttpApiError.ServiceUnavailable();
+        }
+
+        const task = urlParams.task ?? "commentary";
+        const subscription = yield* openai.subscribeSpeech;
+        const stream = Stream.fromQueue(subscription).pipe(
+          Stream.filter((chunk) => chunk.task === task),
+          Stream.map((chunk) => chunk.pcm),
+          Stream.prepend(Chunk.of(wavStreamHeader()))
+        );
+
+        return yield* HttpServerResponse.stream(stream, {
+          headers: {
+            "Content-Type": "audio/wav",
             "Cache-Control": "no-cache",
             "X-Accel-Buffering": "no",
-            Connection: "keep-alive",
           },
         });
       })
     )
 );
 
+// Transcripts group
+interface ArchiveHourTally {
+  readonly start: DateTime.Zoned;
+  count: number;
+  readonly programs: Array<string>;
+  readonly segments: Array<Transcript>;
+}
+
+const transcriptTimes = (t: Transcript) => ({
+  completedAt: DateTime.unsafeMake(t.completedAt),
+  windowStart:
+    t.windowStart === null ? null : DateTime.unsafeMake(t.windowStart),
+  windowEnd: t.windowEnd === null ? null : DateTime.unsafeMake(t.windowEnd),
+});
+
+const transcriptsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "transcripts",
+  (handlers) =>
+    handlers
+      .handle("searchTranscripts", ({ urlParams }) =>
+        Effect.gen(function* () {
+          const store = yield* TranscriptStore;
+          const results = yield* store.search({
+            query: urlParams.q,
+            source: urlParams.source,
+            program: urlParams.program,
+            from: urlParams.from?.epochMillis,
+            to: urlParams.to?.epochMillis,
+            limit: urlParams.limit ?? 20,
+          });
+          return {
+            results: results.map((r) => ({
+              ...r,
+              ...transcriptTimes(r),
+            })),
+          };
+        }).pipe(
+          Effect.tapError((e) =>
+            Effect.logError("Transcript search failed", e.cause)
+          ),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        )
+      )
+      .handle("semanticSearch", ({ urlParams }) =>
+        Effect.gen(function* () {
+          const semantic = yield* SemanticSearch;
+          const results = yield* semantic.search({
+            query: urlParams.q,
+            source: urlParams.source,
+            program: urlParams.program,
+            from: urlParams.from?.epochMillis,
+            to: urlParams.to?.epochMillis,
+            limit: urlParams.limit ?? 20,
+          });
+          return {
+            results: results.map((r) => ({
+              ...r,
+              ...transcriptTimes(r),
+            })),
+          };
+        }).pipe(
+          Effect.catchTags({
+            SemanticSearchDisabledError: () =>
+              new HttpApiError.ServiceUnavailable(),
+            EmbeddingError: (e) =>
+              Effect.logError(`Query not embedded: ${e.message}`).pipe(
+                Effect.zipRight(new HttpApiError.InternalServerError())
+              ),
+            TranscriptStoreError: (e) =>
+              Effect.logError("Semantic search failed", e.cause).pipe(
+                Effect.zipRight(new HttpApiError.InternalServerError())
+              ),
+          })
+        )
+      )
+      .handle("getTopics", ({ urlParams }) =>
+        Effect.gen(function* () {
+          const store = yield* TranscriptStore;
+          const buckets = yield* store.topicTimeline({
+            source: urlParams.source,
+            from: urlParams.from?.epochMillis,
+            to: urlParams.to?.epochMillis,
+            bucketMs: (urlParams.bucket ?? 60) * 60_000,
+          });
+          return {
+            buckets: buckets.map((b) => ({
+              ...b,
+              start: DateTime.unsafeMake(b.start),
+            })),
+          };
+        }).pipe(
+          Effect.tapError((e) =>
+            Effect.logError("Topic timeline failed", e.cause)
+          ),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        )
+      )
+      .handle("getArchive", ({ path, urlParams }) =>
+        Effect.gen(function* () {
+          const timeZone = urlParams.tz ?? "UTC";
+          const zone = DateTime.zoneMakeNamed(timeZone);
+          const [year, month, day] = path.date
+            .split("-")
+            .map(Number) as [number, number, number];
+          const start = Option.flatMap(zone, (zone) =>
+            DateTime.makeZoned(
+              { year, month, day },
+              { timeZone: zone, adjustForTimeZone: true }
+            )
+          ).pipe(
+            // Rejects dates that roll over, such as February 30.
+            Option.filter(
+              (start) =>
+                DateTime.getPart(start, "month") === month &&
+                DateTime.getPart(start, "day") === day
+            )
+          );
+          if (Option.isNone(start) || Option.isNone(zone)) {
+            return yield* new HttpApiError.BadRequest();
+          }
+          const page = urlParams.page ?? 1;
+          const pageSize = urlParams.pageSize ?? 50;
+          const store = yield* TranscriptStore;
+          const { index, transcripts } = yield* store
+            .archive({
+              source: path.source,
+              from: DateTime.toEpochMillis(start.value),
+              to: DateTime.toEpochMillis(
+                DateTime.add(start.value, { days: 1 })
+              ),
+              task: urlParams.task,
+              offset: (page - 1) * pageSize,
+              limit: pageSize,
+            })
+            .pipe(
+              Effect.tapError((e) =>
+                Effect.logError("Archive query failed", e.cause)
+              ),
+              Effect.mapError(() => new HttpApiError.InternalServerError())
+            );
+
+          // Keyed by the hour's start, so the hour repeated when clocks go
+          // back isn't merged with the first one.
+          const hours = new Map<number, ArchiveHourTally>();
+          const hourOf = (ms: number) => {
+            const start = DateTime.startOf(
+              DateTime.unsafeMakeZoned(ms, { timeZone: zone.value }),
+              "hour"
+            );
+            const key = DateTime.toEpochMillis(start);
+            const existing = hours.get(key);
+            if (existing) return existing;
+            const created: ArchiveHourTally = {
+              start,
+              count: 0,
+              programs: [],
+              segments: [],
+            };
+            hours.set(key, created);
+            return created;
+          };
+          for (const { completedAt, program } of index) {
+            const entry = hourOf(completedAt);
+            entry.count++;
+            if (program !== null && entry.programs.at(-1) !== program) {
+              entry.programs.push(program);
+            }
+          }
+          for (const transcript of transcripts) {
+            hourOf(transcript.completedAt).segments.push(transcript);
+          }
+
+          return {
+            source: path.source,
+            date: path.date,
+            timeZone,
+            total: index.length,
+            page,
+            pages: Math.ceil(index.length / pageSize),
+            pageSize,
+            hours: Array.from(hours.entries())
+              .sort(([a], [b]) => a - b)
+              .map(([, h]) => ({
+                hour: DateTime.getPart(h.start, "hours"),
+                start: DateTime.toUtc(h.start),
+                count: h.count,
+                programs: h.programs,
+                segments: h.segments.map((t) => ({
+                  ...t,
+                  ...transcriptTimes(t),
+                })),
+              })),
+          };
+        })
+      )
+      .handle("getFeed", ({ urlParams }) =>
+        Effect.gen(function* () {
+          const store = yield* TranscriptStore;
+          const transcripts = yield* store.recentOf({
+            tasks: FEED_TASKS,
+            source: urlParams.source,
+            limit: urlParams.limit ?? 50,
+          });
+          const sources = yield* AudioSource.sources;
+          const sourceName = (id: string) =>
+            sources.find((s) => s.id === id)?.name ?? null;
+          const source = urlParams.source ?? null;
+          return renderFeed({
+            title:
+              source === null
+                ? "Funny Radio"
+                : `Funny Radio · ${sourceName(source) ?? source}`,
+            source,
+            transcripts,
+            sourceName,
+            updated: yield* Clock.currentTimeMillis,
+          });
+        }).pipe(
+          Effect.tapError((e) => Effect.logError("Feed failed", e.cause)),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        )
+      )
+);
+
+// Profiling endpoints answer 503 unless DEBUG_PROFILING is set.
+const profiling = ProfilingConfig.pipe(
+  Effect.orDie,
+  Effect.filterOrFail(
+    (enabled) => enabled,
+    () => new HttpApiError.ServiceUnavailable()
+  )
+);
+
+// Analysis group
+const analysisGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "analysis",
+  (handlers) =>
+    handlers.handle("getCoverage", ({ urlParams }) =>
+      Effect.gen(function* () {
+        const analysis = yield* CoverageAnalysis;
+        const hour = Math.floor(urlParams.hour.epochMillis / HOUR_MS) * HOUR_MS;
+        if (hour + HOUR_MS > (yield* Clock.currentTimeMillis)) {
+          return yield* new HttpApiError.BadRequest();
+        }
+        const diff = yield* analysis.coverage(hour).pipe(
+          Effect.tapError((e) =>
+            Effect.logError("Coverage analysis failed", e.cause)
+          ),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        );
+        return yield* Option.match(diff, {
+          onNone: () => Effect.fail(new HttpApiError.NotFound()),
+          onSome: Effect.succeed,
+        });
+      })
+    )
+);
+
+// Feedback group
+const feedbackGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "feedback",
+  (handlers) =>
+    handlers
+      .handle("addFeedback", ({ payload }) =>
+        Effect.gen(function* () {
+          const store = yield* TranscriptStore;
+          const [transcript] = yield* store.byResponseIds([payload.responseId]);
+          if (transcript === undefined) {
+            return yield* new HttpApiError.NotFound();
+          }
+          const feedback = {
+            responseId: payload.responseId,
+            rating: payload.rating,
+            comment: payload.comment?.trim() || null,
+            createdAt: yield* Clock.currentTimeMillis,
+          };
+          yield* store.saveFeedback(feedback);
+          return {
+            ...feedback,
+            createdAt: DateTime.unsafeMake(feedback.createdAt),
+          };
+        }).pipe(
+          Effect.catchTag("TranscriptStoreError", (e) =>
+            Effect.logError("Feedback not saved", e.cause).pipe(
+              Effect.zipRight(new HttpApiError.InternalServerError())
+            )
+          )
+        )
+      )
+      .handle("getFeedbackStats", ({ urlParams }) =>
+        Effect.gen(function* () {
+          const store = yield* TranscriptStore;
+          const stats = yield* store.feedbackStats({
+            from: urlParams.from?.epochMillis,
+            to: urlParams.to?.epochMillis,
+          });
+          return { stats };
+        }).pipe(
+          Effect.tapError((e) =>
+            Effect.logError("Feedback stats failed", e.cause)
+          ),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        )
+      )
+);
+
+// Fingerprints group
+const fingerprintStoreFailed = (e: { message: string }) =>
+  Effect.logError(`Failed to save fingerprints: ${e.message}`).pipe(
+    Effect.zipRight(new HttpApiError.InternalServerError())
+  );
+
+const toFingerprint = (f: Fingerprint) => ({
+  ...f,
+  firstSeenAt: DateTime.unsafeMake(f.firstSeenAt),
+  lastSeenAt: DateTime.unsafeMake(f.lastSeenAt),
+});
+
+const toRepeatedSegment = (
+  segment: RepeatedSegment,
+  labels: ReadonlyMap<string, FingerprintLabel | null>
+) => ({
+  ...segment,
+  label: labels.get(segment.fingerprint) ?? null,
+  startedAt:
+    segment.startedAt === null ? null : DateTime.unsafeMake(segment.startedAt),
+  endedAt:
+    segment.endedAt === null ? null : DateTime.unsafeMake(segment.endedAt),
+  recordedAt: DateTime.unsafeMake(segment.recordedAt),
+});
+
+const fingerprintsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "fingerprints",
+  (handlers) =>
+    handlers
+      .handle("getFingerprints", () =>
+        Fingerprints.pipe(
+          Effect.flatMap((fingerprints) => fingerprints.list),
+          Effect.map((all) => ({ fingerprints: all.map(toFingerprint) }))
+        )
+      )
+      // Labels are looked up as they are now, so marking a fingerprint
+      // marks its past airings too.
+      .handle("getRepeatedSegments", ({ urlParams }) =>
+        Effect.gen(function* () {
+          const store = yield* TranscriptStore;
+          const segments = yield* store.repeats({
+            source: urlParams.source,
+            fingerprint: urlParams.fingerprint,
+            from: urlParams.from?.epochMillis,
+            to: urlParams.to?.epochMillis,
+            limit: urlParams.limit ?? 100,
+          });
+          const fingerprints = yield* Fingerprints.pipe(
+            Effect.flatMap((f) => f.list)
+          );
+          const labels = new Map(fingerprints.map((f) => [f.id, f.label]));
+          return {
+            segments: segments.map((s) => toRepeatedSegment(s, labels)),
+          };
+        }).pipe(
+          Effect.tapError((e) =>
+            Effect.logError("Repeated segments lookup failed", e.cause)
+          ),
+          Effect.mapError(() => new HttpApiError.InternalServerError())
+        )
+      )
+      .handle("markFingerprint", ({ path, payload }) =>
+        Effect.gen(function* () {
+          const fingerprints = yield* Fingerprints;
+          const marked = yield* fingerprints
+            .mark(path.id, payload)
+            .pipe(
+              Effect.catchTag("FingerprintStoreError", fingerprintStoreFailed)
+            );
+          if (Option.isNone(marked)) {
+            return yield* new HttpApiError.NotFound();
+          }
+          return toFingerprint(marked.value);
+        })
+      )
+      .handle("deleteFingerprint", ({ path }) =>
+        Effect.gen(function* () {
+          const fingerprints = yield* Fingerprints;
+          const removed = yield* fingerprints
+            .remove(path.id)
+            .pipe(
+              Effect.catchTag("FingerprintStoreError", fingerprintStoreFailed)
+            );
+          if (!removed) return yield* new HttpApiError.NotFound();
+        })
+      )
+);
+
+// Health group
+const healthGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "health",
+  (handlers) =>
+    handlers.handle("getReady", () =>
+      Effect.gen(function* () {
+        const openai = yield* OpenAIRealtime;
+        const connection = yield* openai.connection;
+        const readiness = {
+          ready: !connection.warmup || connection.state === "open",
+          openai: connection,
+        };
+        if (!readiness.ready) return yield* Effect.fail(readiness);
+        return readiness;
+      })
+    )
+);
+
+// Debug group
+type PipelineNode = (typeof PipelineGraph.Type)["nodes"][number];
+
+// Audio goes from the source through the processor to OpenAI, and the
+// responses through the broadcaster to the clients.
+const PIPELINE_EDGES = [
+  { from: "source", to: "processor" },
+  { from: "processor", to: "openai" },
+  { from: "openai", to: "broadcaster" },
+  { from: "broadcaster", to: "clients" },
+] as const;
+
+const pipelineGraph = Effect.gen(function* () {
+  const components = yield* PipelineSupervisor.pipe(
+    Effect.flatMap((supervisor) => supervisor.status)
+  );
+  const restartsOf = (prefix: string) =>
+    components
+      .filter((c) => c.name.startsWith(prefix))
+      .reduce((sum, c) => sum + c.restarts, 0);
+  const current = yield* AudioSource.currentSource;
+  const spec = yield* Option.match(current, {
+    onNone: () => Effect.succeedNone,
+    onSome: AudioSource.findSource,
+  });
+  const stats = yield* Option.match(current, {
+    onNone: () => Effect.succeedNone,
+    onSome: (id) =>
+      SourceStats.pipe(
+        Effect.flatMap((s) => s.get(id)),
+        Effect.map(Option.some)
+      ),
+  });
+  const running = Option.exists(stats, (s) => s.running);
+
+  const source: PipelineNode = {
+    id: "source",
+    label: Option.match(spec, {
+      onNone: () => "No source",
+      onSome: (s) => s.name,
+    }),
+    state: running ? "running" : "stopped",
+    detail: Option.isNone(current)
+      ? "No source selected"
+      : Option.getOrNull(
+          Option.flatMapNullable(stats, (s) => s.lastError?.message)
+        ),
+    restarts: 0,
+  };
+
+  // As the processor checks, for each chunk.
+  const pausedBecause = yield* Effect.gen(function* () {
+    if (Option.isNone(current)) return null;
+    if (yield* AudioSource.processingPaused) return "Paused";
+    if (yield* (yield* IdleMonitor).isIdle) return "Idle without listeners";
+    if (yield* (yield* Budgets).exceeded(current.value)) {
+      return "Over its daily budget";
+    }
+    return null;
+  });
+  const processor: PipelineNode = {
+    id: "processor",
+    label: "Audio processor",
+    state: !running ? "stopped" : pausedBecause ? "paused" : "running",
+    detail: pausedBecause,
+    restarts: restartsOf("processor"),
+  };
+
+  const openai = yield* OpenAIRealtime;
+  const connection = yield* openai.connection;
+  const circuitOpen = yield* openai.paused;
+  const realtime: PipelineNode = {
+    id: "openai",
+    label: "OpenAI Realtime",
+    state: circuitOpen
+      ? "paused"
+      : connection.state === "open"
+        ? "running"
+        : "stopped",
+    detail: circuitOpen
+      ? "Circuit open after repeated failures"
+      : connection.state === "open"
+        ? null
+        : connection.state,
+    restarts: restartsOf("openai-"),
+  };
+
+  const broadcaster = yield* Broadcaster;
+  const listeners = yield* broadcaster.listeners;
+  const nodes: ReadonlyArray<PipelineNode> = [
+    source,
+    processor,
+    realtime,
+    {
+      id: "broadcaster",
+      label: "Broadcaster",
+      state: "running",
+      detail: broadcaster.distributed ? "Relayed through Redis" : null,
+      restarts: 0,
+    },
+    {
+      id: "clients",
+      label: "Stream clients",
+      state: listeners.length > 0 ? "running" : "stopped",
+      detail: `${listeners.length} connected`,
+      restarts: 0,
+    },
+  ];
+  return { nodes, edges: PIPELINE_EDGES };
+});
+
+const queueDepths = Effect.gen(function* () {
+  const audio = yield* LiveMetrics.pipe(
+    Effect.flatMap((metrics) => metrics.audioQueue)
+  );
+  const openai = yield* OpenAIRealtime.pipe(
+    Effect.flatMap((openai) => openai.inFlight)
+  );
+  const { subscribers } = yield* Broadcaster.pipe(
+    Effect.flatMap((b) => b.subscriberStats)
+  );
+  return {
+    audio: Option.getOrNull(audio),
+    openai,
+    clients: {
+      connected: subscribers.length,
+      queued: subscribers.reduce((sum, s) => sum + s.queued, 0),
+      maxQueued: subscribers.reduce((max, s) => Math.max(max, s.queued), 0),
+      dropped: subscribers.reduce((sum, s) => sum + s.dropped, 0),
+    },
+  };
+});
+
+const debugGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "debug",
+  (handlers) =>
+    handlers
+      .handle("getPipeline", () =>
+        PipelineSupervisor.pipe(
+          Effect.flatMap((supervisor) => supervisor.status),
+          Effect.map((components) => ({ components }))
+        )
+      )
+      .handle("getGraph", () => pipelineGraph)
+      .handle("getQueues", () => queueDepths)
+      .handle("getKpis", () =>
+        LiveMetrics.pipe(Effect.flatMap((metrics) => metrics.kpis))
+      )
+      .handle("getJournal", () =>
+        Effect.gen(function* () {
+          const openai = yield* OpenAIRealtime;
+          const status = yield* openai.journal;
+          if (status === null) {
+            return yield* new HttpApiError.ServiceUnavailable();
+          }
+          return status;
+        })
+      )
+      .handle("getDryRun", () =>
+        Effect.gen(function* () {
+          const openai = yield* OpenAIRealtime;
+          const estimate = yield* openai.dryRun;
+          if (estimate === null) {
+            return yield* new HttpApiError.ServiceUnavailable();
+          }
+          return estimate;
+        })
+      )
+      .handle("getHlsCache", () =>
+        Effect.gen(function* () {
+          const audioSource = yield* AudioSource;
+          const stats = yield* audioSource.hlsCacheStats;
+          if (stats === null) {
+            return yield* new HttpApiError.ServiceUnavailable();
+          }
+          return stats;
+        })
+      )
+      .handle("getMemory", () =>
+        profiling.pipe(Effect.zipRight(memoryStats))
+      )
+      .handle("getHeapSnapshot", () =>
+        profiling.pipe(
+          Effect.zipRight(heapSnapshot),
+          Effect.tap(() => Effect.log("Heap snapshot taken"))
+        )
+      )
+      .handle("getProfile", ({ urlParams }) =>
+        Effect.gen(function* () {
+          yield* profiling;
+          const seconds = urlParams.seconds ?? 10;
+          yield* Effect.log(`Profiling the CPU for ${seconds}s`);
+          return yield* cpuProfile(seconds);
+        })
+      )
+);
+
+// Reports group
+const reportsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "reports",
+  (handlers) =>
+    handlers.handle("getDailyReport", ({ urlParams }) =>
+      MetricsSnapshots.pipe(
+        Effect.flatMap((metrics) => metrics.daily(urlParams.days ?? 7)),
+        Effect.map((days) => ({ days })),
+        Effect.tapError((e) =>
+          Effect.logError("Failed to read metrics snapshots", e.cause)
+        ),
+        Effect.mapError(() => new HttpApiError.InternalServerError())
+      )
+    )
+);
+
+// Budgets group
+const budgetsGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "budgets",
+  (handlers) =>
+    handlers.handle("getBudgets", () =>
+      Budgets.pipe(
+        Effect.flatMap((budgets) => budgets.all),
+        Effect.map((sources) => ({ sources }))
+      )
+    )
+);
+
+// Config group
+const configGroupLive = HttpApiBuilder.group(
+  FunnyRadioApi,
+  "config",
+  (handlers) =>
+    handlers
+      .handle("getConfig", () =>
+        AppConfig.pipe(Effect.flatMap((config) => config.get))
+      )
+      .handle("updateConfig", ({ payload }) =>
+        Effect.gen(function* () {
+          const config = yield* AppConfig;
+          yield* config.update((c) => ({
+            ...c,
+            prompt: payload.prompt ?? c.prompt,
+            language:
+              payload.language === undefined
+                ? c.language
+                : (payload.language ?? undefined),
+          }));
+          yield* Effect.log(
+            `Prompt updated by ${(yield* requestUser) ?? "anonymous"}`
+          );
+          return yield* config.get;
+        })
+      )
+      .handle("exportConfig", () =>
+        Effect.gen(function* () {
+          const config = yield* (yield* AppConfig).saved;
+          return {
+            version: 1 as const,
+            exportedAt: yield* Clock.currentTimeMillis,
+            config,
+            presets: yield* (yield* Presets).list,
+          };
+        }).pipe(
+          Effect.catchTag("ConfigFileError", (e) =>
+            Effect.logError(`Failed to export config: ${e.message}`).pipe(
+              Effect.zipRight(new HttpApiError.InternalServerError())
+            )
+          )
+        )
+      )
+      // The bundle is decoded and validated whole before anything is
+      // written; if the presets then can't be, the config goes back too.
+      .handle("importConfig", ({ payload }) =>
+        Effect.gen(function* () {
+          const restoreConfig = yield* (yield* AppConfig).replace(
+            payload.config
+          );
+          yield* (yield* Presets).replaceAll(payload.presets).pipe(
+            Effect.tapError(() =>
+              restoreConfig.pipe(
+                Effect.catchAll((e) =>
+                  Effect.logError(
+                    `Previous configuration not restored: ${e.message}`
+                  )
+                )
+              )
+            )
+          );
+          yield* Effect.log(
+            `Configuration imported by ${(yield* requestUser) ?? "anonymous"}`
+          );
+          return {
+            sources: payload.config.sources.length,
+            playlists: payload.config.playlists.length,
+            presets: payload.presets.length,
+          };
+        }).pipe(
+          Effect.catchTags({
+            ConfigFileError: (e) =>
+              Effect.logError(`Failed to import config: ${e.message}`).pipe(
+                Effect.zipRight(new HttpApiError.InternalServerError())
+              ),
+            SourceCatalogError: catalogFailed,
+            PresetStoreError: presetStoreFailed,
+          })
+        )
+      )
+);
+
 export const FunnyRadioApiLive = HttpApiBuilder.api(FunnyRadioApi).pipe(
   Layer.provide(uiGroupLive),
+  Layer.provide(authGroupLive),
+  Layer.provide(usersGroupLive),
   Layer.provide(sourcesGroupLive),
-  Layer.provide(streamGroupLive)
+  Layer.provide(processingGroupLive),
+  Layer.provide(sessionsGroupLive),
+  Layer.provide(playlistsGroupLive),
+  Layer.provide(filesGroupLive),
+  Layer.provide(levelsGroupLive),
+  Layer.provide(comparisonGroupLive),
+  Layer.provide(experimentGroupLive),
+  Layer.provide(respondGroupLive),
+  Layer.provide(nudgeGroupLive),
+  Layer.provide(presetsGroupLive),
+  Layer.provide(pushGroupLive),
+  Layer.provide(streamGroupLive),
+  Layer.provide(speechGroupLive),
+  Layer.provide(transcriptsGroupLive),
+  Layer.provide(analysisGroupLive),
+  Layer.provide(feedbackGroupLive),
+  Layer.provide(fingerprintsGroupLive),
+  Layer.provide(healthGroupLive),
+  Layer.provide(debugGroupLive),
+  Layer.provide(reportsGroupLive),
+  Layer.provide(budgetsGroupLive),
+  Layer.provide(configGroupLive)
 );
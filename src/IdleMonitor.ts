@@ -0,0 +1,80 @@
+import { Clock, Config, Effect, HashSet, Ref, Schedule } from "effect";
+import { Broadcaster } from "./Broadcaster.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+
+const IdleConfig = Config.all({
+  afterMinutes: Config.number("IDLE_AFTER_MINUTES").pipe(
+    Config.withDefault(0)
+  ),
+  stopStream: Config.boolean("IDLE_STOP_STREAM").pipe(
+    Config.withDefault(false)
+  ),
+});
+
+// Saves OpenAI requests (and optionally ffmpeg's CPU and bandwidth) while
+// nobody is listening: once no stream client has been connected to this
+// instance for IDLE_AFTER_MINUTES, the pipeline goes idle and the audio
+// processor stops sending audio, or with IDLE_STOP_STREAM=true stops reading
+// the source altogether. The first client to connect wakes it up. Work that
+// runs without listeners, such as a listening session, holds it awake.
+// Changes are broadcast as idle and resumed messages. Off unless
+// IDLE_AFTER_MINUTES is set.
+export class IdleMonitor extends Effect.Service<IdleMonitor>()("IdleMonitor", {
+  scoped: Effect.gen(function* () {
+    const config = yield* IdleConfig;
+    const broadcaster = yield* Broadcaster;
+    const supervisor = yield* PipelineSupervisor;
+    const idle = yield* Ref.make(false);
+    const holds = yield* Ref.make(HashSet.empty<string>());
+    const lastActiveAt = yield* Ref.make(yield* Clock.currentTimeMillis);
+    const idleAfterMs = config.afterMinutes * 60_000;
+
+    const check = Effect.gen(function* () {
+      const now = yield* Clock.currentTimeMillis;
+      const active =
+        (yield* broadcaster.listeners).length > 0 ||
+        HashSet.size(yield* Ref.get(holds)) > 0;
+      if (active) {
+        yield* Ref.set(lastActiveAt, now);
+        if (!(yield* Ref.getAndSet(idle, false))) return;
+        yield* Effect.log("Listener back, leaving idle mode");
+        yield* broadcaster.publish({ type: "resumed", from: "idle" });
+        return;
+      }
+      const quietFor = now - (yield* Ref.get(lastActiveAt));
+      if (quietFor < idleAfterMs || (yield* Ref.getAndSet(idle, true))) {
+        return;
+      }
+      yield* Effect.log(
+        `No listener for ${config.afterMinutes} min, going idle` +
+          (config.stopStream ? " and stopping the stream" : "")
+      );
+      yield* broadcaster.publish({ type: "idle", idleForMs: quietFor });
+    });
+
+    if (idleAfterMs > 0) {
+      yield* check.pipe(
+        Effect.repeat(Schedule.spaced("1 second")),
+        (loop) => supervisor.supervise("idle-monitor", loop),
+        Effect.forkScoped
+      );
+    }
+
+    return {
+      stopsStream: config.stopStream,
+      isIdle: Ref.get(idle),
+      // Completes once the pipeline is no longer idle.
+      awaitActive: Ref.get(idle).pipe(
+        Effect.repeat({
+          schedule: Schedule.spaced("1 second"),
+          until: (isIdle) => !isIdle,
+        }),
+        Effect.asVoid
+      ),
+      // Keeps the pipeline awake until released, under a name of the
+      // caller's choosing.
+      hold: (name: string) => Ref.update(holds, HashSet.add(name)),
+      release: (name: string) => Ref.update(holds, HashSet.remove(name)),
+    } as const;
+  }),
+}) {}
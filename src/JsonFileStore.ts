@@ -0,0 +1,75 @@
+import { FileSystem } from "@effect/platform";
+import { Effect, Ref, Schema } from "effect";
+
+// Replaces the file's contents through a temporary file, so a crash can't
+// leave it truncated.
+export const writeFileAtomically = (
+  path: string,
+  contents: string,
+  options?: FileSystem.WriteFileStringOptions
+) =>
+  Effect.gen(function* () {
+    const fs = yield* FileSystem.FileSystem;
+    yield* fs.writeFileString(`${path}.tmp`, contents, options);
+    yield* fs.rename(`${path}.tmp`, path);
+  });
+
+export interface JsonFileStoreOptions<A, I, E> {
+  readonly path: string;
+  readonly schema: Schema.Schema<A, I>;
+  // Value before the file is first written.
+  readonly empty: A;
+  // Wraps read, decode and write failures, given with the file's path.
+  readonly error: (message: string) => E;
+  // False starts from `empty` without reading the file, e.g. for a disabled
+  // feature, which then never writes it either unless changed.
+  readonly load?: boolean;
+  // Permissions of the file, e.g. 0o600 for secrets.
+  readonly mode?: number;
+}
+
+// A value kept in memory and in a JSON file, read once when made and
+// rewritten on every change. Changes are serialized so concurrent ones can't
+// persist out of order, and only kept once written.
+export const makeJsonFileStore = <A, I, E>(
+  options: JsonFileStoreOptions<A, I, E>
+) =>
+  Effect.gen(function* () {
+    const fs = yield* FileSystem.FileSystem;
+    const { path } = options;
+    const file = Schema.parseJson(options.schema, { space: 2 });
+    const storeError = (e: { message: string }) =>
+      options.error(`${path}: ${e.message}`);
+
+    const initial = yield* Effect.gen(function* () {
+      if (options.load === false || !(yield* fs.exists(path))) {
+        return options.empty;
+      }
+      return yield* Schema.decode(file)(yield* fs.readFileString(path));
+    }).pipe(Effect.mapError(storeError));
+    const value = yield* Ref.make(initial);
+
+    const lock = yield* Effect.makeSemaphore(1);
+
+    return {
+      get: Ref.get(value),
+      // Applies `f` to the current value and persists the result, which is
+      // returned.
+      update: (f: (current: A) => A) =>
+        Effect.gen(function* () {
+          const next = f(yield* Ref.get(value));
+          const json = yield* Schema.encode(file)(next);
+          yield* writeFileAtomically(
+            path,
+            json,
+            options.mode === undefined ? undefined : { mode: options.mode }
+          );
+          yield* Ref.set(value, next);
+          return next;
+        }).pipe(
+          Effect.mapError(storeError),
+          Effect.provideService(FileSystem.FileSystem, fs),
+          lock.withPermits(1)
+        ),
+    } as const;
+  });
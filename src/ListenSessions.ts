@@ -0,0 +1,218 @@
+import { Clock, Data, Duration, Effect, Fiber, Option, Ref } from "effect";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { IdleMonitor } from "./IdleMonitor.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { RESPONSE_TASKS, type TaskId } from "./Tasks.js";
+import type { ListenSession } from "./TranscriptBackend.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+
+const SUMMARY_INSTRUCTIONS = `Voici, dans l'ordre, les commentaires et transcriptions produits pendant une session d'ecoute d'une station de radio. Resumez en 5 a 8 phrases, en francais, les principaux sujets abordes. N'inventez rien qui ne figure pas dans le texte.`;
+
+// The summary is written from the end of the session if it ran long.
+const MAX_SUMMARY_INPUT = 40_000;
+
+const TEXT_TASKS = (Object.keys(RESPONSE_TASKS) as Array<TaskId>).filter(
+  (task) => RESPONSE_TASKS[task].format === "text"
+);
+
+export interface RunningSession {
+  readonly id: string;
+  readonly source: AudioSourceId;
+  readonly startedAt: number;
+  readonly endsAt: number;
+}
+
+export class SessionRunningError extends Data.TaggedError(
+  "SessionRunningError"
+)<{ session: RunningSession }> {}
+
+// Time-boxed listening: a session selects a source for a set duration, then
+// has the processor respond to the window in progress, waits for those
+// responses, clears the source, summarizes what was said and stores the
+// summary. The end is announced with a session_ended message. One session
+// runs at a time.
+export class ListenSessions extends Effect.Service<ListenSessions>()(
+  "ListenSessions",
+  {
+    scoped: Effect.gen(function* () {
+      const audioSource = yield* AudioSource;
+      const openai = yield* OpenAIRealtime;
+      const broadcaster = yield* Broadcaster;
+      const store = yield* TranscriptStore;
+      const idle = yield* IdleMonitor;
+      const supervisor = yield* PipelineSupervisor;
+      const scope = yield* Effect.scope;
+      const current = yield* Ref.make(
+        Option.none<{
+          session: RunningSession;
+          timer: Fiber.RuntimeFiber<void>;
+        }>()
+      );
+
+      const summarize = (source: AudioSourceId, from: number, to: number) =>
+        Effect.gen(function* () {
+          const transcripts = yield* store.between({
+            source,
+            tasks: TEXT_TASKS,
+            from,
+            to,
+          });
+          if (transcripts.length === 0) {
+            return { responses: 0, summary: null };
+          }
+          const text = transcripts
+            .map((t) => t.text)
+            .join("\n\n")
+            .slice(-MAX_SUMMARY_INPUT);
+          const summary = yield* openai
+            .respondToText(SUMMARY_INSTRUCTIONS, text)
+            .pipe(
+              Effect.map((s) => s.trim() || null),
+              Effect.catchAll((e) =>
+                Effect.logWarning("Session summary failed", e).pipe(
+                  Effect.as(null)
+                )
+              )
+            );
+          return { responses: transcripts.length, summary };
+        });
+
+      const finish = (
+        session: RunningSession,
+        reason: ListenSession["reason"]
+      ) =>
+        Effect.gen(function* () {
+          yield* Effect.log(`Listening session ${session.id} ${reason}`);
+          const selected = Option.contains(
+            yield* audioSource.currentSource,
+            session.source
+          );
+          if (selected) {
+            // The processor picks the flush up with its next chunk; then its
+            // responses are left to finish before the source is cleared,
+            // which would cancel them.
+            yield* audioSource.requestFlush;
+            yield* Effect.sleep("2 seconds");
+            yield* openai.awaitIdle.pipe(
+              Effect.timeout("30 seconds"),
+              Effect.ignore
+            );
+            if (
+              Option.contains(yield* audioSource.currentSource, session.source)
+            ) {
+              yield* audioSource.setSource(null, "session");
+            }
+          }
+          const endedAt = yield* Clock.currentTimeMillis;
+          const { responses, summary } = yield* summarize(
+            session.source,
+            session.startedAt,
+            endedAt
+          );
+          const ended: ListenSession = {
+            id: session.id,
+            source: session.source,
+            startedAt: session.startedAt,
+            endedAt,
+            reason,
+            responses,
+            summary,
+          };
+          yield* store.saveSession(ended);
+          yield* broadcaster.publish({
+            type: "session_ended",
+            sessionId: ended.id,
+            source: ended.source,
+            startedAt: ended.startedAt,
+            endedAt: ended.endedAt,
+            reason: ended.reason,
+            responses: ended.responses,
+            summary: ended.summary,
+          });
+          return ended;
+        }).pipe(
+          Effect.tapError((e) =>
+            Effect.logError(`Listening session ${session.id} not saved`, e)
+          ),
+          Effect.ensuring(idle.release(session.id))
+        );
+
+      // Run in the background, and again if it crashes; its failures are
+      // logged by finish.
+      const wrapUp = (
+        session: RunningSession,
+        reason: ListenSession["reason"]
+      ) =>
+        supervisor.supervise(
+          "listen-session",
+          finish(session, reason).pipe(Effect.ignore)
+        );
+
+      // Takes the session off the current slot, if it is still there.
+      const take = (id: string) =>
+        Ref.modify(current, (running) =>
+          Option.isSome(running) && running.value.session.id === id
+            ? [Option.some(running.value), Option.none()]
+            : [Option.none(), running]
+        );
+
+      return {
+        current: Ref.get(current).pipe(
+          Effect.map(Option.map((running) => running.session))
+        ),
+        // Selects the source on behalf of `by` and schedules the end of the
+        // session.
+        start: (
+          source: AudioSourceId,
+          duration: Duration.Duration,
+          by: string | null
+        ) =>
+          Effect.gen(function* () {
+            const running = yield* Ref.get(current);
+            if (Option.isSome(running)) {
+              return yield* new SessionRunningError({
+                session: running.value.session,
+              });
+            }
+            const now = yield* Clock.currentTimeMillis;
+            const session: RunningSession = {
+              id: `ses_${crypto.randomUUID().slice(0, 8)}`,
+              source,
+              startedAt: now,
+              endsAt: now + Duration.toMillis(duration),
+            };
+            yield* audioSource.setSource(source, "session", by);
+            // Nobody needs to be connected for the session to be heard.
+            yield* idle.hold(session.id);
+            const timer = yield* Effect.sleep(duration).pipe(
+              Effect.zipRight(take(session.id)),
+              Effect.flatMap(
+                Option.match({
+                  onNone: () => Effect.void,
+                  onSome: () => wrapUp(session, "expired"),
+                })
+              ),
+              Effect.forkIn(scope)
+            );
+            yield* Ref.set(current, Option.some({ session, timer }));
+            yield* Effect.log(
+              `Listening session ${session.id} on ${source} for ${Duration.format(duration)}`
+            );
+            return session;
+          }),
+        // Ends the running session now; its wrap-up runs in the background.
+        stop: Effect.gen(function* () {
+          const running = yield* Ref.getAndSet(current, Option.none());
+          if (Option.isNone(running)) return Option.none<RunningSession>();
+          const { session, timer } = running.value;
+          yield* Fiber.interrupt(timer);
+          yield* wrapUp(session, "stopped").pipe(Effect.forkIn(scope));
+          return Option.some(session);
+        }),
+        history: (limit: number) => store.sessions(limit),
+      } as const;
+    }),
+  }
+) {}
@@ -0,0 +1,151 @@
+import { Clock, Effect, Option, Ref } from "effect";
+import type { AudioSourceId } from "./AudioSource.js";
+import { PipelineEvents } from "./PipelineEvents.js";
+
+// Rates are over the last minute, counted in one-second buckets.
+const WINDOW_SECONDS = 60;
+
+interface Bucket {
+  readonly second: number;
+  readonly responses: number;
+  readonly durationMs: number;
+  // Lag is only known for responses over a window of the stream.
+  readonly lagged: number;
+  readonly lagMs: number;
+  readonly bytes: number;
+  readonly chunks: number;
+  readonly dropped: number;
+  readonly corrupted: number;
+  readonly errors: number;
+}
+
+const emptyBucket = (second: number): Bucket => ({
+  second,
+  responses: 0,
+  durationMs: 0,
+  lagged: 0,
+  lagMs: 0,
+  bytes: 0,
+  chunks: 0,
+  dropped: 0,
+  corrupted: 0,
+  errors: 0,
+});
+
+export interface LiveKpis {
+  readonly windowMs: number;
+  readonly responses: number;
+  // Means over the window's responses; null without any.
+  readonly meanDurationMs: number | null;
+  readonly meanLagMs: number | null;
+  readonly bytesPerSecond: number;
+  readonly chunksReceived: number;
+  readonly chunksDropped: number;
+  readonly chunksCorrupted: number;
+  readonly errors: number;
+}
+
+// Chunks read from the source and waiting to be processed, as of the last
+// one processed.
+export interface AudioQueueDepth {
+  readonly source: AudioSourceId;
+  readonly queued: number;
+  readonly capacity: number;
+  readonly at: number;
+}
+
+// What the pipeline did in the last minute, for the admin dashboard: the
+// responses and their latencies, audio read, lost and broken, and errors, as
+// they happen rather than in the METRICS_SNAPSHOT_MINUTES snapshots. Also
+// keeps how far processing is behind the audio read. In memory only.
+export class LiveMetrics extends Effect.Service<LiveMetrics>()("LiveMetrics", {
+  scoped: Effect.gen(function* () {
+    const events = yield* PipelineEvents;
+    const buckets = yield* Ref.make<ReadonlyArray<Bucket>>([]);
+    const audioQueue = yield* Ref.make(Option.none<AudioQueueDepth>());
+
+    // The buckets still in the window as of `second`, oldest first.
+    const recent = (all: ReadonlyArray<Bucket>, second: number) =>
+      all.filter((b) => b.second > second - WINDOW_SECONDS);
+
+    const count = (f: (bucket: Bucket) => Bucket) =>
+      Effect.gen(function* () {
+        const second = Math.floor((yield* Clock.currentTimeMillis) / 1000);
+        yield* Ref.update(buckets, (all) => {
+          const last = all[all.length - 1];
+          return last?.second === second
+            ? [...all.slice(0, -1), f(last)]
+            : [...recent(all, second), f(emptyBucket(second))];
+        });
+      });
+
+    yield* events.on("ResponseCompleted", ({ durationMs, windowEnd }) =>
+      Effect.gen(function* () {
+        const now = yield* Clock.currentTimeMillis;
+        const lag = windowEnd === null ? null : now - windowEnd;
+        yield* count((b) => ({
+          ...b,
+          responses: b.responses + 1,
+          durationMs: b.durationMs + durationMs,
+          lagged: lag === null ? b.lagged : b.lagged + 1,
+          lagMs: lag === null ? b.lagMs : b.lagMs + lag,
+        }));
+      })
+    );
+    yield* events.on(
+      "ChunkProduced",
+      ({ source, bytes, dropped, queued, queueCapacity }) =>
+        Effect.gen(function* () {
+          yield* count((b) => ({
+            ...b,
+            bytes: b.bytes + bytes,
+            chunks: b.chunks + 1,
+            dropped: b.dropped + dropped,
+          }));
+          yield* Ref.set(
+            audioQueue,
+            Option.some({
+              source,
+              queued,
+              capacity: queueCapacity,
+              at: yield* Clock.currentTimeMillis,
+            })
+          );
+        })
+    );
+    yield* events.on("ChunkCorrupted", () =>
+      count((b) => ({ ...b, corrupted: b.corrupted + 1 }))
+    );
+    yield* events.on("Error", () =>
+      count((b) => ({ ...b, errors: b.errors + 1 }))
+    );
+
+    return {
+      kpis: Effect.gen(function* () {
+        const second = Math.floor((yield* Clock.currentTimeMillis) / 1000);
+        const window = recent(yield* Ref.get(buckets), second);
+        const sum = (f: (b: Bucket) => number) =>
+          window.reduce((total, b) => total + f(b), 0);
+        const responses = sum((b) => b.responses);
+        const lagged = sum((b) => b.lagged);
+        return {
+          windowMs: WINDOW_SECONDS * 1000,
+          responses,
+          meanDurationMs:
+            responses > 0
+              ? Math.round(sum((b) => b.durationMs) / responses)
+              : null,
+          meanLagMs:
+            lagged > 0 ? Math.round(sum((b) => b.lagMs) / lagged) : null,
+          bytesPerSecond: Math.round(sum((b) => b.bytes) / WINDOW_SECONDS),
+          chunksReceived: sum((b) => b.chunks),
+          chunksDropped: sum((b) => b.dropped),
+          chunksCorrupted: sum((b) => b.corrupted),
+          errors: sum((b) => b.errors),
+        } satisfies LiveKpis;
+      }),
+      // None before the first chunk is processed.
+      audioQueue: Ref.get(audioQueue),
+    } as const;
+  }),
+}) {}
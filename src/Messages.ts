@@ -1,9 +1,521 @@
+import { Schema } from "effect";
+import { ErrorCode } from "./PipelineErrors.js";
+import { TaskIdSchema } from "./Tasks.js";
+
 export type ServerEvent =
+  | {
+      type: "response.created";
+      response: {
+        id: string;
+        metadata?: {
+          task?: string;
+          source?: string;
+          audio_offset_ms?: string;
+          // Comma-separated source ids of a comparison response.
+          comparison?: string;
+          // Correlation id of a clip response.
+          clip?: string;
+          // Show on air when the window was captured.
+          program?: string;
+          // On-air times of the window's first and last audio, in ms since
+          // the epoch.
+          window_start?: string;
+          window_end?: string;
+          // Source's lag behind the live broadcast, if configured.
+          delay_ms?: string;
+          // Share of the window's audio lost before processing.
+          loss_ratio?: string;
+          // Prompt experiment and variant of an A/B commentary response.
+          experiment?: string;
+          variant?: string;
+          // Correlation id of a one-off response with its own instructions.
+          request?: string;
+          // Id of a listener's question to POST /ask.
+          ask?: string;
+          // Count of cancellations when the response was requested.
+          cancel_epoch?: string;
+        } | null;
+      };
+    }
   | { type: "response.output_text.delta"; response_id: string; delta: string }
-  | { type: "response.done"; response: { id: string; status: string } }
-  | { type: "error"; error: { message: string } };
+  | {
+      type: "response.output_audio_transcript.delta";
+      response_id: string;
+      delta: string;
+    }
+  | { type: "response.output_audio.delta"; response_id: string; delta: string }
+  | {
+      type: "response.done";
+      response: {
+        id: string;
+        status: string;
+        output?: ReadonlyArray<{
+          content?: ReadonlyArray<{ text?: string; transcript?: string }>;
+        }>;
+        usage?: {
+          output_tokens?: number;
+          input_token_details?: { audio_tokens?: number; text_tokens?: number };
+        };
+      };
+    }
+  | { type: "input_audio_buffer.committed"; item_id: string }
+  | {
+      type: "conversation.item.input_audio_transcription.completed";
+      item_id: string;
+      transcript: string;
+    }
+  | {
+      type: "conversation.item.input_audio_transcription.failed";
+      item_id: string;
+      error: { message: string };
+    }
+  | {
+      type: "session.updated";
+      session: {
+        audio?: { input?: { format?: { type?: string; rate?: number } } };
+      };
+    }
+  | {
+      type: "error";
+      error: {
+        message: string;
+        code?: string | null;
+        type?: string | null;
+        // Of the client event that caused it, if it was given one.
+        event_id?: string | null;
+      };
+    };
+
+// Bumped whenever a change to the messages below could break a strict
+// client: a removed or renamed field, or a changed field type. New message
+// types and new optional fields keep the version.
+export const BROADCAST_VERSION = 1;
+
+// Optional only so messages from replicas that predate it still decode.
+const DeltaSeq = Schema.Number.annotations({
+  description:
+    "Position of the delta in its response, from 0; a gap means deltas were dropped. With batch=sentence, that of the last delta its text came from",
+});
+
+const ResponseFields = {
+  responseId: Schema.String,
+  task: TaskIdSchema,
+  source: Schema.NullOr(Schema.String).annotations({
+    description:
+      "Source the response is about; drop messages for a source no longer selected",
+  }),
+  audioOffsetMs: Schema.NullOr(Schema.Number).annotations({
+    description:
+      "End of the audio window the response is about, in ms since the source started streaming",
+  }),
+  experiment: Schema.optional(Schema.String).annotations({
+    description: "Prompt experiment the response belongs to, if any",
+  }),
+  variant: Schema.optional(Schema.String).annotations({
+    description: "Variant of the experiment whose instructions were used",
+  }),
+  custom: Schema.optional(Schema.Boolean).annotations({
+    description:
+      "True for a one-off response run with instructions given to POST /respond",
+  }),
+};
+
+// One second of a source's audio, measured before silence skipping.
+export const AudioLevelReading = Schema.Struct({
+  source: Schema.String,
+  rmsDbfs: Schema.Number.annotations({
+    description: "RMS level in dBFS, floored at -120 for silence",
+  }),
+  peakDbfs: Schema.Number.annotations({
+    description: "Peak level in dBFS, floored at -120 for silence",
+  }),
+  at: Schema.Number.annotations({
+    description: "Time the second ended, in ms since the epoch",
+  }),
+}).annotations({ title: "Audio Level" });
+
+export type AudioLevelReading = typeof AudioLevelReading.Type;
+
+// Structured answer of the "digest" task.
+export const Digest = Schema.Struct({
+  headline: Schema.String,
+  bullets: Schema.Array(Schema.String),
+  entities: Schema.Array(Schema.String).annotations({
+    description: "People, places and organisations mentioned",
+  }),
+  sentiment: Schema.Literal("positive", "neutral", "negative"),
+}).annotations({ title: "Digest" });
+
+export type Digest = typeof Digest.Type;
+
+const decodeDigest = Schema.decodeUnknownOption(Schema.parseJson(Digest));
+
+// Models sometimes wrap JSON in a code block despite the instructions.
+export const stripCodeFence = (text: string) =>
+  text
+    .trim()
+    .replace(/^```(?:json)?\s*/, "")
+    .replace(/\s*```$/, "");
+
+export const parseDigest = (text: string) =>
+  decodeDigest(stripCodeFence(text));
+
+// Catalog of the messages sent to stream clients (SSE and gRPC).
+export const BroadcastMessage = Schema.Union(
+  Schema.Struct({
+    type: Schema.Literal("delta"),
+    ...ResponseFields,
+    text: Schema.String,
+    seq: Schema.optional(DeltaSeq),
+  }).annotations({ title: "delta", description: "Text chunk from a response" }),
+  Schema.Struct({
+    type: Schema.Literal("complete"),
+    ...ResponseFields,
+    text: Schema.String.annotations({
+      description:
+        "Full text of the response, the deltas put together; complete even if some deltas were dropped",
+    }),
+    wordCount: Schema.Number,
+    durationMs: Schema.Number.annotations({
+      description: "Time from the response's creation to its end",
+    }),
+    structured: Schema.NullOr(Digest).annotations({
+      description:
+        "Parsed answer of a JSON task; null for text tasks or unparseable output",
+    }),
+    program: Schema.optional(Schema.NullOr(Schema.String)).annotations({
+      description:
+        "Show on air when the window was captured, if the station's metadata is known",
+    }),
+    windowStart: Schema.optional(Schema.NullOr(Schema.Number)).annotations({
+      description:
+        "When the window's first audio went out on air, in ms since the epoch; null if unknown",
+    }),
+    windowEnd: Schema.optional(Schema.NullOr(Schema.Number)).annotations({
+      description:
+        "When the window's last audio went out on air, in ms since the epoch; null if unknown",
+    }),
+    delayMs: Schema.optional(Schema.Number).annotations({
+      description:
+        "Known lag of the source's stream behind the live broadcast, already taken off windowStart and windowEnd; absent if none is configured",
+    }),
+    lossRatio: Schema.optional(Schema.Number).annotations({
+      description:
+        "Share of the window's audio chunks lost before processing, from 0 to 1; above 0 the response was produced from incomplete audio. Absent for responses not made from a window",
+    }),
+  }).annotations({ title: "complete", description: "Response finished" }),
+  Schema.Struct({
+    type: Schema.Literal("transcript"),
+    itemId: Schema.String,
+    source: Schema.String,
+    audioOffsetMs: Schema.Number.annotations({
+      description:
+        "End of the transcribed audio, in ms since the source started streaming",
+    }),
+    text: Schema.String,
+  }).annotations({
+    title: "transcript",
+    description:
+      "Verbatim text of the last few seconds of audio, ahead of the responses; only with OPENAI_TRANSCRIPTION_MODEL",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("error"),
+    code: ErrorCode,
+    message: Schema.String.annotations({
+      description: "Details for people; match on the code instead",
+    }),
+    source: Schema.NullOr(Schema.String).annotations({
+      description: "Source being processed, or null for OpenAI errors",
+    }),
+    retryable: Schema.Boolean.annotations({
+      description:
+        "Whether the pipeline recovers by itself; false means someone has to step in",
+    }),
+    retryInMs: Schema.NullOr(Schema.Number).annotations({
+      description: "When the failed work is tried again, if known",
+    }),
+    responseId: Schema.optional(Schema.String).annotations({
+      description: "Response the error is about, e.g. one that timed out",
+    }),
+  }).annotations({
+    title: "error",
+    description: "Something failed in the pipeline or at OpenAI",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("paused"),
+    reason: Schema.optional(
+      Schema.Literal("errors", "rate_limit")
+    ).annotations({
+      description:
+        "Repeated OpenAI errors, or OPENAI_MAX_RESPONSES_PER_MINUTE reached; errors if absent",
+    }),
+    retryInMs: Schema.Number,
+  }).annotations({
+    title: "paused",
+    description:
+      "Requests to OpenAI are held back after repeated errors or by the per-minute cap",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("resumed"),
+    from: Schema.optional(
+      Schema.Literal("paused", "rate_limit", "idle", "budget")
+    ).annotations({
+      description:
+        "State that ended: paused after OpenAI errors, held back by the per-minute cap, idle without listeners, or a source's daily budget used up",
+    }),
+    source: Schema.optional(Schema.String).annotations({
+      description: "Source whose budget started over, for from: budget",
+    }),
+  }).annotations({
+    title: "resumed",
+    description:
+      "Requests to OpenAI resumed after a pause, the per-minute cap, idle period or exceeded budget",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("idle"),
+    idleForMs: Schema.Number.annotations({
+      description: "Time since the last listener left",
+    }),
+  }).annotations({
+    title: "idle",
+    description:
+      "Nobody has been listening for IDLE_AFTER_MINUTES, so audio is no longer sent to OpenAI",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("source_changed"),
+    source: Schema.String,
+    removed: Schema.Boolean,
+  }).annotations({
+    title: "source_changed",
+    description:
+      "A source was edited or removed; clients should reload the source list",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("failover"),
+    source: Schema.String,
+    from: Schema.String.annotations({ description: "URL left" }),
+    to: Schema.String.annotations({ description: "URL now streamed" }),
+    score: Schema.Number.annotations({
+      description: "Health score of the new URL, out of 100",
+    }),
+  }).annotations({
+    title: "failover",
+    description:
+      "A source is now streamed from another of its URLs, after its current one kept failing or once its primary recovered",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("server_shutdown"),
+  }).annotations({
+    title: "server_shutdown",
+    description:
+      "The server is shutting down; the stream ends after this message",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("translation"),
+    responseId: Schema.String,
+    task: TaskIdSchema,
+    source: Schema.NullOr(Schema.String),
+    lang: Schema.String.annotations({
+      description: "Language code the response was translated into",
+    }),
+    text: Schema.String,
+  }).annotations({
+    title: "translation",
+    description:
+      "A completed response translated into a language a client asked for with ?lang=; only sent to those clients",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("answer_delta"),
+    askId: Schema.String.annotations({
+      description: "Id of the question, as returned by POST /ask",
+    }),
+    responseId: Schema.String,
+    source: Schema.NullOr(Schema.String).annotations({
+      description: "Source whose audio the question was about",
+    }),
+    text: Schema.String,
+    seq: Schema.optional(DeltaSeq),
+  }).annotations({
+    title: "answer_delta",
+    description: "Next part of the answer to a question asked with POST /ask",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("answer"),
+    askId: Schema.String,
+    responseId: Schema.String,
+    source: Schema.NullOr(Schema.String),
+    question: Schema.String,
+    text: Schema.String.annotations({ description: "The whole answer" }),
+  }).annotations({
+    title: "answer",
+    description: "Answer to a question asked with POST /ask, once complete",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("comparison"),
+    responseId: Schema.String,
+    sources: Schema.Array(Schema.String),
+    text: Schema.String,
+  }).annotations({
+    title: "comparison",
+    description: "How the compared sources covered the same period",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("level"),
+    ...AudioLevelReading.fields,
+  }).annotations({
+    title: "level",
+    description: "Audio level of the selected station, once per second",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("dead_air"),
+    source: Schema.String,
+    silentForMs: Schema.Number,
+  }).annotations({
+    title: "dead_air",
+    description: "The selected station has gone silent",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("music_detected"),
+    source: Schema.String,
+    musicForMs: Schema.Number,
+  }).annotations({
+    title: "music_detected",
+    description:
+      "The selected station is playing music, which is not sent to OpenAI until speech resumes",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("repeated_segment"),
+    source: Schema.String,
+    fingerprint: Schema.String,
+    label: Schema.NullOr(Schema.Literal("ad", "jingle")),
+    skipped: Schema.Boolean,
+    startedAt: Schema.NullOr(Schema.Number),
+    endedAt: Schema.NullOr(Schema.Number),
+    durationMs: Schema.Number,
+  }).annotations({
+    title: "repeated_segment",
+    description:
+      "Audio that aired before, e.g. an ad or a jingle, was recognized by its fingerprint and, unless kept, not sent to OpenAI; sent once it ends",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("now_playing"),
+    source: Schema.String,
+    show: Schema.NullOr(Schema.String),
+    title: Schema.NullOr(Schema.String),
+  }).annotations({
+    title: "now_playing",
+    description: "The selected station's show or stream title changed",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("program_changed"),
+    source: Schema.String,
+    previous: Schema.String.annotations({
+      description: "Show that ended",
+    }),
+    program: Schema.NullOr(Schema.String).annotations({
+      description: "Show that started; null until the guide has it",
+    }),
+    at: Schema.NullOr(Schema.Number).annotations({
+      description:
+        "When the change went out on air, in ms since the epoch; null if unknown",
+    }),
+  }).annotations({
+    title: "program_changed",
+    description:
+      "The processed station moved on to another show: the window so far was responded to on its own, and later ones start from a fresh context",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("backend_changed"),
+    backend: Schema.Literal("openai", "deepgram", "whisper"),
+  }).annotations({
+    title: "backend_changed",
+    description:
+      "Another backend now produces the text: a fallback transcribes while OpenAI is paused",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("listener_joined"),
+    listenerId: Schema.String,
+    name: Schema.NullOr(Schema.String),
+    kind: Schema.Literal("sse", "ndjson", "grpc"),
+  }).annotations({
+    title: "listener_joined",
+    description:
+      "A stream client connected, with the display name it gave if any; clients also receive their own",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("session_ended"),
+    sessionId: Schema.String,
+    source: Schema.String,
+    startedAt: Schema.Number,
+    endedAt: Schema.Number,
+    reason: Schema.Literal("expired", "stopped"),
+    responses: Schema.Number,
+    summary: Schema.NullOr(Schema.String),
+  }).annotations({
+    title: "session_ended",
+    description:
+      "A listening session ended and its source was cleared; summary is null if nothing was said or it failed",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("playlist_rotated"),
+    playlist: Schema.String,
+    from: Schema.NullOr(Schema.String).annotations({
+      description: "Source left, null if none was selected",
+    }),
+    to: Schema.String.annotations({ description: "Source now selected" }),
+    index: Schema.Number.annotations({
+      description: "Position of the new source in the playlist, from 0",
+    }),
+    nextAt: Schema.Number.annotations({
+      description: "When the playlist rotates again, in ms since the epoch",
+    }),
+  }).annotations({
+    title: "playlist_rotated",
+    description:
+      "A playlist moved on to its next source, after the responses to the last window of the previous one",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("budget_exceeded"),
+    source: Schema.String,
+    tokens: Schema.Number.annotations({
+      description: "Tokens used by the source's responses today (UTC)",
+    }),
+    costUsd: Schema.Number,
+    budget: Schema.Struct({
+      tokens: Schema.NullOr(Schema.Number),
+      usd: Schema.NullOr(Schema.Number),
+    }),
+    resumesAt: Schema.Number.annotations({
+      description:
+        "Start of the next UTC day, when the source is processed again, in ms since the epoch",
+    }),
+  }).annotations({
+    title: "budget_exceeded",
+    description:
+      "A source used up its daily budget; no more of its audio is sent until the next day",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("listener_left"),
+    listenerId: Schema.String,
+    name: Schema.NullOr(Schema.String),
+  }).annotations({
+    title: "listener_left",
+    description: "A stream client disconnected",
+  })
+).annotations({ title: "Broadcast Message" });
+
+export type BroadcastMessage = typeof BroadcastMessage.Type;
+
+// Wire encoding shared by SSE and gRPC; every message carries the version.
+export const encodeBroadcastJson = (msg: BroadcastMessage) =>
+  JSON.stringify({ version: BROADCAST_VERSION, ...msg });
+
+// None for anything that isn't a message of this version's schema.
+export const decodeBroadcastJson = Schema.decodeUnknownOption(
+  Schema.parseJson(BroadcastMessage)
+);
 
-export type BroadcastMessage =
-  | { type: "delta"; responseId: string; text: string }
-  | { type: "complete"; responseId: string }
-  | { type: "error"; message: string };
+// The same, with why it isn't one.
+export const decodeBroadcastJsonEither = Schema.decodeUnknownEither(
+  Schema.parseJson(BroadcastMessage)
+);
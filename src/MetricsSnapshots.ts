@@ -0,0 +1,217 @@
+import { Clock, Config, Effect, Ref } from "effect";
+import { PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import {
+  METRICS_LATENCY_BUCKETS_MS,
+  type MetricsSnapshot,
+} from "./TranscriptBackend.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+
+export const DAY_MS = 24 * 60 * 60 * 1000;
+
+// Upper bounds of the buckets the 50th, 90th and 99th percentiles fall in;
+// the highest bound stands for anything above it too.
+export interface LatencyPercentiles {
+  readonly p50: number;
+  readonly p90: number;
+  readonly p99: number;
+}
+
+// How the pipeline held up during one UTC day.
+export interface DailyReport {
+  // Start of the day, in ms since the epoch.
+  readonly day: number;
+  // Share of the day, so far for today, the server was up taking snapshots,
+  // and audio was being read.
+  readonly coverage: number;
+  readonly uptime: number;
+  readonly responses: number;
+  // Null without responses.
+  readonly duration: LatencyPercentiles | null;
+  readonly lag: LatencyPercentiles | null;
+  readonly bytesProcessed: number;
+  readonly chunksReceived: number;
+  readonly chunksDropped: number;
+  readonly chunksCorrupted: number;
+  readonly errors: number;
+  readonly restarts: number;
+}
+
+type Tally = Omit<MetricsSnapshot, "at" | "periodMs" | "processing">;
+
+const noBuckets = () =>
+  Array.from({ length: METRICS_LATENCY_BUCKETS_MS.length + 1 }, () => 0);
+
+const emptyTally = (): Tally => ({
+  responses: 0,
+  durationBuckets: noBuckets(),
+  lagBuckets: noBuckets(),
+  bytesProcessed: 0,
+  chunksReceived: 0,
+  chunksDropped: 0,
+  chunksCorrupted: 0,
+  errors: 0,
+  restarts: 0,
+});
+
+const countIn = (buckets: ReadonlyArray<number>, ms: number) => {
+  const i = METRICS_LATENCY_BUCKETS_MS.findIndex((bound) => ms <= bound);
+  const index = i === -1 ? METRICS_LATENCY_BUCKETS_MS.length : i;
+  return buckets.map((n, j) => (j === index ? n + 1 : n));
+};
+
+const addBuckets = (a: ReadonlyArray<number>, b: ReadonlyArray<number>) =>
+  a.map((n, i) => n + (b[i] ?? 0));
+
+const percentiles = (
+  buckets: ReadonlyArray<number>
+): LatencyPercentiles | null => {
+  const total = buckets.reduce((sum, n) => sum + n, 0);
+  if (total === 0) return null;
+  const at = (q: number) => {
+    let seen = 0;
+    const i = buckets.findIndex((n) => (seen += n) >= q * total);
+    return METRICS_LATENCY_BUCKETS_MS[
+      Math.min(i, METRICS_LATENCY_BUCKETS_MS.length - 1)
+    ]!;
+  };
+  return { p50: at(0.5), p90: at(0.9), p99: at(0.99) };
+};
+
+// Puts a day's snapshots together. Those are assigned to the day they end in.
+const dailyReport = (
+  day: number,
+  length: number,
+  snapshots: ReadonlyArray<MetricsSnapshot>
+): DailyReport => {
+  const sum = (f: (s: MetricsSnapshot) => number) =>
+    snapshots.reduce((total, s) => total + f(s), 0);
+  const merged = (f: (s: MetricsSnapshot) => ReadonlyArray<number>) =>
+    snapshots.reduce((all, s) => addBuckets(all, f(s)), noBuckets());
+  const ratio = (ms: number) =>
+    length > 0 ? Math.min(1, Math.round((ms / length) * 1000) / 1000) : 0;
+  return {
+    day,
+    coverage: ratio(sum((s) => s.periodMs)),
+    uptime: ratio(sum((s) => (s.processing ? s.periodMs : 0))),
+    responses: sum((s) => s.responses),
+    duration: percentiles(merged((s) => s.durationBuckets)),
+    lag: percentiles(merged((s) => s.lagBuckets)),
+    bytesProcessed: sum((s) => s.bytesProcessed),
+    chunksReceived: sum((s) => s.chunksReceived),
+    chunksDropped: sum((s) => s.chunksDropped),
+    chunksCorrupted: sum((s) => s.chunksCorrupted ?? 0),
+    errors: sum((s) => s.errors),
+    restarts: sum((s) => s.restarts),
+  };
+};
+
+// Keeps the pipeline's KPIs in the transcript store, so whether it keeps up
+// can be judged over weeks rather than since the last restart: every
+// METRICS_SNAPSHOT_MINUTES (default 5, 0 to disable) the responses and their
+// latencies, audio read, dropped and corrupted, errors and component restarts
+// since the last snapshot are saved, and once more on shutdown. Set it to 0
+// on instances that don't process audio, as they have nothing to report.
+export class MetricsSnapshots extends Effect.Service<MetricsSnapshots>()(
+  "MetricsSnapshots",
+  {
+    scoped: Effect.gen(function* () {
+      const minutes = yield* Config.number("METRICS_SNAPSHOT_MINUTES").pipe(
+        Config.withDefault(5)
+      );
+      const events = yield* PipelineEvents;
+      const supervisor = yield* PipelineSupervisor;
+      const store = yield* TranscriptStore;
+
+      const tally = yield* Ref.make(emptyTally());
+      const restartsSoFar = supervisor.status.pipe(
+        Effect.map((all) => all.reduce((sum, c) => sum + c.restarts, 0))
+      );
+      const lastRestarts = yield* Ref.make(yield* restartsSoFar);
+      const lastAt = yield* Ref.make(yield* Clock.currentTimeMillis);
+
+      const snapshot = Effect.gen(function* () {
+        const at = yield* Clock.currentTimeMillis;
+        const since = yield* Ref.getAndSet(lastAt, at);
+        const restarts = yield* restartsSoFar;
+        const counted = yield* Ref.getAndSet(tally, emptyTally());
+        const taken: MetricsSnapshot = {
+          ...counted,
+          at,
+          periodMs: at - since,
+          processing: counted.chunksReceived > 0,
+          restarts: restarts - (yield* Ref.getAndSet(lastRestarts, restarts)),
+        };
+        yield* store.saveSnapshot(taken).pipe(
+          Effect.catchAll((e) =>
+            Effect.logError("Failed to store metrics snapshot", e.cause)
+          )
+        );
+      });
+
+      if (minutes > 0) {
+        yield* events.on("ResponseCompleted", ({ durationMs, windowEnd }) =>
+          Effect.gen(function* () {
+            const now = yield* Clock.currentTimeMillis;
+            yield* Ref.update(tally, (t) => ({
+              ...t,
+              responses: t.responses + 1,
+              durationBuckets: countIn(t.durationBuckets, durationMs),
+              lagBuckets:
+                windowEnd === null
+                  ? t.lagBuckets
+                  : countIn(t.lagBuckets, now - windowEnd),
+            }));
+          })
+        );
+        yield* events.on("ChunkProduced", ({ bytes, dropped }) =>
+          Ref.update(tally, (t) => ({
+            ...t,
+            bytesProcessed: t.bytesProcessed + bytes,
+            chunksReceived: t.chunksReceived + 1,
+            chunksDropped: t.chunksDropped + dropped,
+          }))
+        );
+        yield* events.on("ChunkCorrupted", () =>
+          Ref.update(tally, (t) => ({
+            ...t,
+            chunksCorrupted: t.chunksCorrupted + 1,
+          }))
+        );
+        yield* events.on("Error", () =>
+          Ref.update(tally, (t) => ({ ...t, errors: t.errors + 1 }))
+        );
+
+        yield* snapshot.pipe(
+          Effect.delay(`${minutes} minutes`),
+          Effect.forever,
+          (loop) => supervisor.supervise("metrics-snapshots", loop),
+          Effect.forkScoped
+        );
+        yield* Effect.addFinalizer(() => snapshot);
+      } else {
+        yield* Effect.log("Metrics snapshots disabled");
+      }
+
+      return {
+        // The last `days` UTC days, today included, most recent first. Days
+        // without snapshots are reported with a coverage of 0.
+        daily: (days: number) =>
+          Effect.gen(function* () {
+            const now = yield* Clock.currentTimeMillis;
+            const today = Math.floor(now / DAY_MS) * DAY_MS;
+            const from = today - (days - 1) * DAY_MS;
+            const snapshots = yield* store.snapshots(from, now + 1);
+            return Array.from({ length: days }, (_, i) => {
+              const day = today - i * DAY_MS;
+              return dailyReport(
+                day,
+                Math.min(now - day, DAY_MS),
+                snapshots.filter((s) => s.at >= day && s.at < day + DAY_MS)
+              );
+            });
+          }),
+      } as const;
+    }),
+  }
+) {}
@@ -0,0 +1,104 @@
+import { Effect } from "effect";
+
+// Features of one chunk of audio: linear RMS level and zero-crossing rate.
+export interface ChunkFeatures {
+  readonly rms: number;
+  readonly zcr: number;
+}
+
+// Quieter than this (about -50 dBFS) a second is neither speech nor music.
+const SILENT_RMS = 0.003;
+// Speech pauses between syllables and words, so many of its chunks are much
+// quieter than average; music rarely does.
+const MAX_MUSIC_LOW_ENERGY = 0.2;
+// Speech alternates voiced and unvoiced sounds, so its zero-crossing rate
+// swings from chunk to chunk; sustained notes keep it steady.
+const MAX_MUSIC_ZCR_VARIATION = 0.7;
+// Consecutive speech seconds that end a music segment.
+const RESUME_SECONDS = 2;
+
+const mean = (values: ReadonlyArray<number>) =>
+  values.reduce((sum, v) => sum + v, 0) / values.length;
+
+// Classic low-energy ratio and zero-crossing variability heuristics. Both
+// must point to music, so speech over a music bed is kept.
+export const isMusic = (chunks: ReadonlyArray<ChunkFeatures>): boolean => {
+  if (chunks.length === 0) return false;
+  const rms = chunks.map((c) => c.rms);
+  const meanRms = mean(rms);
+  if (meanRms < SILENT_RMS) return false;
+  const lowEnergy = rms.filter((r) => r < meanRms / 2).length / chunks.length;
+
+  const zcr = chunks.map((c) => c.zcr);
+  const meanZcr = mean(zcr);
+  const zcrDeviation = Math.sqrt(mean(zcr.map((z) => (z - meanZcr) ** 2)));
+  const zcrVariation = meanZcr === 0 ? 0 : zcrDeviation / meanZcr;
+
+  return (
+    lowEnergy < MAX_MUSIC_LOW_ENERGY && zcrVariation < MAX_MUSIC_ZCR_VARIATION
+  );
+};
+
+export type MusicChange = "started" | "ended";
+
+export interface MusicDetector {
+  // Adds a chunk of `bytes` bytes; returns a change once a second of audio
+  // completes and tips the decision.
+  readonly add: (features: ChunkFeatures, bytes: number) => MusicChange | null;
+  readonly inMusic: () => boolean;
+  readonly reset: () => void;
+}
+
+// Classifies each second of audio and reports a music segment once at least
+// 80% of the last `windowSeconds` seconds were music, until speech is back
+// for two seconds in a row.
+export const makeMusicDetector = (
+  bytesPerSecond: number,
+  windowSeconds: number
+) =>
+  Effect.sync((): MusicDetector => {
+    let chunks: Array<ChunkFeatures> = [];
+    let bytesInSecond = 0;
+    // Most recent last.
+    let seconds: Array<boolean> = [];
+    let inMusic = false;
+
+    const decide = (): MusicChange | null => {
+      if (inMusic) {
+        const recent = seconds.slice(-RESUME_SECONDS);
+        if (recent.length === RESUME_SECONDS && recent.every((m) => !m)) {
+          // A new segment needs a full window of music again.
+          inMusic = false;
+          seconds = [];
+          return "ended";
+        }
+        return null;
+      }
+      if (seconds.length < windowSeconds) return null;
+      const music = seconds.filter((m) => m).length;
+      if (music >= windowSeconds * 0.8) {
+        inMusic = true;
+        return "started";
+      }
+      return null;
+    };
+
+    return {
+      add: (features, bytes) => {
+        chunks.push(features);
+        bytesInSecond += bytes;
+        if (bytesInSecond < bytesPerSecond) return null;
+        seconds = [...seconds, isMusic(chunks)].slice(-windowSeconds);
+        chunks = [];
+        bytesInSecond = 0;
+        return decide();
+      },
+      inMusic: () => inMusic,
+      reset: () => {
+        chunks = [];
+        bytesInSecond = 0;
+        seconds = [];
+        inMusic = false;
+      },
+    };
+  });
@@ -0,0 +1,284 @@
+import {
+  closeSync,
+  existsSync,
+  ftruncateSync,
+  mkdirSync,
+  openSync,
+  readFileSync,
+  writeFileSync,
+  writeSync,
+} from "node:fs";
+import { dirname } from "node:path";
+import { Config } from "effect";
+import type { InputFormatSpec } from "./AudioFormat.js";
+import type { ResponseRequest } from "./OpenAIRealtime.js";
+
+// Write-ahead journal of the audio appends, commits and response requests
+// sent to OpenAI. With OPENAI_JOURNAL set to a file path, every such message
+// is written there before it is sent, and dropped once OpenAI acknowledges
+// the commit that covers it; the file therefore only ever holds what could
+// still be lost. What a crashed run left behind is reported on the next
+// start, and with OPENAI_JOURNAL_RESEND=true its audio is sent again and its
+// last window's responses requested again. Writes are synchronous, which
+// costs a little latency per chunk but means nothing is sent unjournaled.
+export const OpenAIJournalConfig = Config.all({
+  path: Config.option(Config.string("OPENAI_JOURNAL")),
+  resend: Config.boolean("OPENAI_JOURNAL_RESEND").pipe(
+    Config.withDefault(false)
+  ),
+});
+
+export type JournalMessageType =
+  | "input_audio_buffer.append"
+  | "input_audio_buffer.commit"
+  | "response.create";
+
+// Labels of a journaled commit, as the realtime client queues them.
+export interface JournalCommit {
+  readonly source: string;
+  readonly audioOffsetMs: number;
+  readonly request: ResponseRequest | null;
+}
+
+// A journaled message, without its audio.
+export interface JournalEntry {
+  readonly at: number;
+  readonly type: JournalMessageType;
+  // Audio bytes of an append.
+  readonly bytes: number | null;
+  readonly source: string | null;
+  // Task of a response request.
+  readonly task: string | null;
+}
+
+export interface JournalSummary {
+  // Audio sent since the last commit OpenAI acknowledged.
+  readonly audioBytes: number;
+  readonly audioMs: number;
+  // Commits sent but not acknowledged.
+  readonly commits: number;
+  // Responses requested since the last acknowledged commit; they may or may
+  // not have finished.
+  readonly responses: number;
+  // Time of the oldest journaled message, null if there is none.
+  readonly since: number | null;
+}
+
+// What a previous run left in the journal.
+export interface RecoveredJournal {
+  readonly spec: Pick<InputFormatSpec, "format" | "sampleRate">;
+  readonly summary: JournalSummary;
+  // Append messages, to send again as they are.
+  readonly appends: ReadonlyArray<{ frame: string; bytes: number }>;
+  // Request of the last commit that closed a window, if any.
+  readonly request: ResponseRequest | null;
+}
+
+interface JournalRecord {
+  readonly entry: JournalEntry;
+  readonly line: string;
+}
+
+interface Header {
+  readonly at: number;
+  readonly spec: Pick<InputFormatSpec, "format" | "sampleRate"> & {
+    readonly bytesPerSecond: number;
+  };
+}
+
+// Appends are base64, three bytes per four characters less the padding.
+const base64Bytes = (audio: string) =>
+  Math.floor((audio.length * 3) / 4) -
+  (audio.endsWith("==") ? 2 : audio.endsWith("=") ? 1 : 0);
+
+const summarize = (
+  entries: ReadonlyArray<JournalEntry>,
+  bytesPerSecond: number
+): JournalSummary => {
+  const audioBytes = entries.reduce((n, e) => n + (e.bytes ?? 0), 0);
+  return {
+    audioBytes,
+    audioMs: Math.round((audioBytes / bytesPerSecond) * 1000),
+    commits: entries.filter((e) => e.type === "input_audio_buffer.commit")
+      .length,
+    responses: entries.filter((e) => e.type === "response.create").length,
+    since: entries[0]?.at ?? null,
+  };
+};
+
+const parseLine = (line: string) => {
+  try {
+    return JSON.parse(line);
+  } catch {
+    return null;
+  }
+};
+
+// Reads a journal left by a previous run. Lines cut short by a crash are
+// skipped.
+export const readJournal = (path: string): RecoveredJournal | null => {
+  if (!existsSync(path)) return null;
+  let header: Header | null = null;
+  const entries: Array<JournalEntry> = [];
+  const appends: Array<string> = [];
+  let request: ResponseRequest | null = null;
+  for (const line of readFileSync(path, "utf8").split("\n")) {
+    const parsed = parseLine(line);
+    if (parsed === null) continue;
+    if (parsed.spec) {
+      header = parsed;
+      continue;
+    }
+    const { at, message, commit } = parsed;
+    switch (message?.type) {
+      case "input_audio_buffer.append": {
+        const bytes = base64Bytes(message.audio);
+        appends.push({ frame: JSON.stringify(message), bytes });
+        entries.push({
+          at,
+          type: message.type,
+          bytes,
+          source: null,
+          task: null,
+        });
+        break;
+      }
+      case "input_audio_buffer.commit":
+        // Journals written before windows had on-air times lack them.
+        if (commit?.request) {
+          request = {
+            windowStart: null,
+            windowEnd: null,
+            delayMs: 0,
+            lossRatio: 0,
+            ...commit.request,
+          };
+        }
+        entries.push({
+          at,
+          type: message.type,
+          bytes: null,
+          source: commit?.source ?? null,
+          task: null,
+        });
+        break;
+      case "response.create":
+        entries.push({
+          at,
+          type: message.type,
+          bytes: null,
+          source: message.response?.metadata?.source ?? null,
+          task: message.response?.metadata?.task ?? null,
+        });
+        break;
+    }
+  }
+  if (header === null || entries.length === 0) return null;
+  return {
+    spec: { format: header.spec.format, sampleRate: header.spec.sampleRate },
+    summary: summarize(entries, header.spec.bytesPerSecond),
+    appends,
+    request,
+  };
+};
+
+export type Journal = ReturnType<typeof openJournal>;
+
+// Starts a new journal at `path`, replacing the previous one.
+export const openJournal = (path: string, spec: InputFormatSpec) => {
+  mkdirSync(dirname(path), { recursive: true });
+  const header = JSON.stringify({
+    at: Date.now(),
+    spec: {
+      format: spec.format,
+      sampleRate: spec.sampleRate,
+      bytesPerSecond: spec.bytesPerSecond,
+    },
+  });
+  writeFileSync(path, `${header}\n`);
+  // Opened for appending, so writes land at the end even after a rewrite.
+  const fd = openSync(path, "a");
+  let records: Array<JournalRecord> = [];
+
+  const write = (entry: JournalEntry, line: string) => {
+    writeSync(fd, `${line}\n`);
+    records.push({ entry, line });
+  };
+
+  // Keeps only the records from `from` on, rewriting the file.
+  const keep = (from: number) => {
+    records = records.slice(from);
+    ftruncateSync(fd, 0);
+    writeSync(
+      fd,
+      [header, ...records.map((r) => r.line)].map((l) => `${l}\n`).join("")
+    );
+  };
+
+  return {
+    path,
+    // `frame` is the append message as sent.
+    append: (frame: string, bytes: number) => {
+      const at = Date.now();
+      write(
+        {
+          at,
+          type: "input_audio_buffer.append",
+          bytes,
+          source: null,
+          task: null,
+        },
+        `{"at":${at},"message":${frame}}`
+      );
+    },
+    commit: (commit: JournalCommit) => {
+      const at = Date.now();
+      write(
+        {
+          at,
+          type: "input_audio_buffer.commit",
+          bytes: null,
+          source: commit.source,
+          task: null,
+        },
+        JSON.stringify({
+          at,
+          message: { type: "input_audio_buffer.commit" },
+          commit,
+        })
+      );
+    },
+    response: (message: {
+      response: { metadata?: { task?: string; source?: string } };
+    }) => {
+      const at = Date.now();
+      write(
+        {
+          at,
+          type: "response.create",
+          bytes: null,
+          source: message.response.metadata?.source ?? null,
+          task: message.response.metadata?.task ?? null,
+        },
+        JSON.stringify({ at, message })
+      );
+    },
+    // OpenAI acknowledged the oldest commit: it and everything before it
+    // are safe.
+    acknowledge: () => {
+      const index = records.findIndex(
+        (r) => r.entry.type === "input_audio_buffer.commit"
+      );
+      if (index >= 0) keep(index + 1);
+    },
+    // The buffer was cleared on purpose, so nothing in it counts as lost.
+    clear: () => keep(records.length),
+    entries: (): ReadonlyArray<JournalEntry> => records.map((r) => r.entry),
+    summary: () =>
+      summarize(
+        records.map((r) => r.entry),
+        spec.bytesPerSecond
+      ),
+    close: () => closeSync(fd),
+  };
+};
@@ -1,59 +1,613 @@
 import {
+  Clock,
   Config,
+  ConfigError,
   Data,
+  Deferred,
+  Duration,
   Effect,
+  Either,
+  HashMap,
   Match,
+  Option,
   Queue,
   Redacted,
+  Ref,
   Schedule,
+  Schema,
   Stream,
   PubSub,
   Scope,
 } from "effect";
-import type { ServerEvent, BroadcastMessage } from "./Messages.js";
-import { systemInstruction } from "./SystemPrompt.js";
+import {
+  DevReplayConfig,
+  isRecording,
+  isReplaying,
+  makeEventRecorder,
+  startReplayServer,
+} from "./DevReplay.js";
+import { DryRunConfig, startDryRunServer } from "./DryRun.js";
+import { type Digest, parseDigest, type ServerEvent } from "./Messages.js";
+import { AppConfig, type NoiseReduction } from "./AppConfig.js";
+import { Broadcaster } from "./Broadcaster.js";
+import {
+  DEFAULT_PCM_RATE,
+  describeSpec,
+  inputFormatSpec,
+  type InputFormatSpec,
+} from "./AudioFormat.js";
+import type { AudioSourceId } from "./AudioSource.js";
+import {
+  applyPostProcessing,
+  feedPostProcessing,
+  flushPostProcessing,
+  INITIAL_POST_PROCESSING,
+  type PostProcessingState,
+  type PostProcessor,
+} from "./PostProcessing.js";
+import {
+  type Journal,
+  OpenAIJournalConfig,
+  openJournal,
+  readJournal,
+} from "./OpenAIJournal.js";
+import {
+  openaiError,
+  pipelineError,
+  type PipelineError,
+} from "./PipelineErrors.js";
+import { PipelineEvent, PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { makeRequestGovernor } from "./RequestGovernor.js";
+import { RESPONSE_TASKS, type TaskId } from "./Tasks.js";
+
+// The model goes in the query string under `modelParam`, kept alongside any
+// parameters a gateway URL already has; an empty name leaves it out, for
+// gateways that pick the model themselves.
+const openaiUrl = (baseUrl: string, modelParam: string, model: string) => {
+  const url = new URL(baseUrl);
+  if (modelParam) url.searchParams.set(modelParam, model);
+  return url.toString();
+};
+
+const decodeHeaders = Schema.decodeUnknownEither(
+  Schema.parseJson(Schema.Record({ key: Schema.String, value: Schema.String }))
+);
+
+// Extra headers as a JSON object, e.g. for a gateway's own credentials. The
+// value is not echoed on error since it may hold secrets.
+const ExtraHeaders = Config.redacted("OPENAI_HEADERS").pipe(
+  Config.mapOrFail((json) =>
+    Either.mapLeft(decodeHeaders(Redacted.value(json)), () =>
+      ConfigError.InvalidData(
+        ["OPENAI_HEADERS"],
+        "Expected a JSON object of header names to string values"
+      )
+    )
+  ),
+  Config.withDefault({})
+);
 
-const OPENAI_URL = "wss://api.openai.com/v1/realtime?model=gpt-realtime-mini";
+export type OutputModality = "text" | "audio";
 
-const sessionUpdate = {
+// Spoken commentary is requested at this rate whatever the input rate.
+export const SPEECH_SAMPLE_RATE = 24000;
+
+// Spoken commentary chunk: SPEECH_SAMPLE_RATE mono s16le PCM.
+export interface SpeechChunk {
+  readonly responseId: string;
+  readonly task: TaskId;
+  readonly pcm: Uint8Array;
+}
+
+// Transcription of every committed item, for the two-stage pipeline.
+interface TranscriptionConfig {
+  readonly model: string;
+  readonly language: string;
+}
+
+const noiseReductionOf = (type: NoiseReduction | null) =>
+  type === null ? null : { type };
+
+const makeSessionUpdate = (
+  model: string,
+  instructions: string,
+  input: InputFormatSpec,
+  modality: OutputModality,
+  voice: string,
+  transcription: TranscriptionConfig | null,
+  noiseReduction: NoiseReduction | null
+) => ({
   type: "session.update",
   session: {
     type: "realtime",
     audio: {
       input: {
-        format: { type: "audio/pcm", rate: 24000 },
+        format: input.session,
         turn_detection: null,
-        noise_reduction: null,
+        noise_reduction: noiseReductionOf(noiseReduction),
+        ...(transcription && { transcription }),
       },
+      ...(modality === "audio"
+        ? {
+            output: {
+              format: { type: "audio/pcm", rate: SPEECH_SAMPLE_RATE },
+              voice,
+            },
+          }
+        : {}),
     },
-    instructions: systemInstruction,
-    model: "gpt-realtime-mini",
-    output_modalities: ["text"],
+    instructions,
+    model,
+    output_modalities: [modality],
     tracing: "auto",
   },
+});
+
+const APPEND_PREFIX = Buffer.from(
+  '{"type":"input_audio_buffer.append","audio":"',
+  "latin1"
+);
+const APPEND_SUFFIX = Buffer.from('"}', "latin1");
+
+// Audio waiting in the socket's send buffer beyond which the connection to
+// OpenAI is reported as not keeping up.
+const WRITE_BUFFER_SECONDS = 10;
+
+// Longest batch of audio sent in one append.
+const MAX_APPEND_BATCH_MS = 500;
+
+// Audio waiting in the send buffer beyond which appends are batched as much
+// as they can be, whatever OPENAI_APPEND_BATCH_MS says.
+const BATCH_BACKLOG_SECONDS = 1;
+
+// Chunks are coalesced into appends of about this much audio, cutting the
+// message rate at the cost of as much latency; 0 sends each chunk as it
+// comes.
+const AppendBatchConfig = Config.integer("OPENAI_APPEND_BATCH_MS").pipe(
+  Config.withDefault(0),
+  Config.validate({
+    message: `Expected an append batch of 0 to ${MAX_APPEND_BATCH_MS}ms`,
+    validation: (ms) => ms >= 0 && ms <= MAX_APPEND_BATCH_MS,
+  })
+);
+
+const BASE64_ALPHABET = Buffer.from(
+  "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789+/",
+  "latin1"
+);
+
+// Encodes `src` as base64 into `dst` starting at `offset`, returning the end
+// offset. `dst` must have room for Math.ceil(src.length / 3) * 4 bytes.
+export const encodeBase64Into = (
+  src: Uint8Array,
+  dst: Buffer,
+  offset: number
+) => {
+  let o = offset;
+  let i = 0;
+  for (; i + 2 < src.length; i += 3) {
+    const n = (src[i]! << 16) | (src[i + 1]! << 8) | src[i + 2]!;
+    dst[o++] = BASE64_ALPHABET[(n >> 18) & 63]!;
+    dst[o++] = BASE64_ALPHABET[(n >> 12) & 63]!;
+    dst[o++] = BASE64_ALPHABET[(n >> 6) & 63]!;
+    dst[o++] = BASE64_ALPHABET[n & 63]!;
+  }
+  const rest = src.length - i;
+  if (rest > 0) {
+    const n = (src[i]! << 16) | (rest === 2 ? src[i + 1]! << 8 : 0);
+    dst[o++] = BASE64_ALPHABET[(n >> 18) & 63]!;
+    dst[o++] = BASE64_ALPHABET[(n >> 12) & 63]!;
+    dst[o++] = rest === 2 ? BASE64_ALPHABET[(n >> 6) & 63]! : 0x3d;
+    dst[o++] = 0x3d;
+  }
+  return o;
+};
+
+// A window's response request, held until its commit is acknowledged.
+export interface ResponseRequest {
+  readonly tasks: ReadonlyArray<TaskId>;
+  // Source the window was captured from.
+  readonly source: AudioSourceId;
+  // Position of the window's end in the source stream.
+  readonly audioOffsetMs: number;
+  // Show on air, if the station's metadata is known.
+  readonly program: string | null;
+  // When the window's first and last audio went out on air, in ms since the
+  // epoch; null if unknown.
+  readonly windowStart: number | null;
+  readonly windowEnd: number | null;
+  // The source's known lag behind the live broadcast, already taken off the
+  // window's times.
+  readonly delayMs: number;
+  // Share of the window's audio chunks lost before processing, from 0 to 1.
+  readonly lossRatio: number;
+}
+
+// On-air times of a window, as response metadata.
+const windowMetadata = (request: ResponseRequest) => ({
+  ...(request.windowStart !== null && {
+    window_start: String(request.windowStart),
+  }),
+  ...(request.windowEnd !== null && {
+    window_end: String(request.windowEnd),
+  }),
+  ...(request.delayMs > 0 && { delay_ms: String(request.delayMs) }),
+  loss_ratio: String(request.lossRatio),
+});
+
+// Reads back a number from response metadata.
+const metadataNumber = (value: string | undefined) => {
+  const n = Number(value);
+  return value !== undefined && Number.isFinite(n) ? n : null;
 };
 
+export interface ExperimentVariant {
+  readonly id: string;
+  // Commentary instructions; {{prompt}} is replaced by the current ones, and
+  // null keeps them as they are (a control variant).
+  readonly instructions: string | null;
+}
+
+// Audio committed since the previous commit, and the window request it
+// closes if any.
+interface PendingCommit {
+  readonly source: AudioSourceId;
+  readonly audioOffsetMs: number;
+  readonly request: ResponseRequest | null;
+}
+
+// Transcription of a committed item, kept until its window's responses are
+// created.
+interface ItemTranscript {
+  readonly source: AudioSourceId;
+  readonly audioOffsetMs: number;
+  // Empty if the transcription failed.
+  readonly text: Deferred.Deferred<string>;
+}
+
+// A/B test of commentary instructions over the next `remaining` windows:
+// each runs one commentary response per variant instead of one in total.
+export interface Experiment {
+  readonly id: string;
+  readonly variants: ReadonlyArray<ExperimentVariant>;
+  readonly remaining: number;
+}
+
+// Recent audio of one source, in the session's input format.
+export interface ComparisonClip {
+  readonly source: AudioSourceId;
+  readonly name: string;
+  readonly audio: Uint8Array;
+}
+
+interface ResponseInfo {
+  readonly task: TaskId;
+  readonly source: AudioSourceId | null;
+  readonly audioOffsetMs: number | null;
+  readonly program: string | null;
+  readonly windowStart: number | null;
+  readonly windowEnd: number | null;
+  readonly delayMs: number | null;
+  readonly lossRatio: number | null;
+  readonly experiment: { readonly id: string; readonly variant: string } | null;
+  // Run with instructions given to POST /respond rather than the task's.
+  readonly custom: boolean;
+  // Set once response.cancel is sent; late deltas are then dropped and it
+  // is never published as complete.
+  readonly cancelled: boolean;
+  // Post-processors in effect when the response was created; none for JSON
+  // tasks, whose output must stay parseable.
+  readonly postProcessing: ReadonlyArray<PostProcessor>;
+  readonly text: PostProcessingState;
+  // Text published so far, for the complete message.
+  readonly published: string;
+  // Deltas published so far, the seq of the next one.
+  readonly deltas: number;
+  readonly createdAt: number;
+}
+
+const UNKNOWN_RESPONSE: ResponseInfo = {
+  task: "commentary",
+  source: null,
+  audioOffsetMs: null,
+  program: null,
+  windowStart: null,
+  windowEnd: null,
+  delayMs: null,
+  lossRatio: null,
+  experiment: null,
+  custom: false,
+  cancelled: false,
+  postProcessing: [],
+  text: INITIAL_POST_PROCESSING,
+  published: "",
+  deltas: 0,
+  createdAt: 0,
+};
+
+const countWords = (text: string) =>
+  text.split(/\s+/).filter((word) => word.length > 0).length;
+
+const responseTags = (info: ResponseInfo) => ({
+  ...(info.experiment && {
+    experiment: info.experiment.id,
+    variant: info.experiment.variant,
+  }),
+  ...(info.custom && { custom: true }),
+});
+
+// Full text of a finished response, whether it was produced as text or as
+// audio with a transcript.
+const outputText = (
+  response: Extract<ServerEvent, { type: "response.done" }>["response"]
+) =>
+  (response.output ?? [])
+    .flatMap((item) => item.content ?? [])
+    .map((part) => part.text ?? part.transcript ?? "")
+    .join("");
+
+// Input of a commentary written from the window's transcript; the task
+// instructions speak of an audio excerpt.
+const transcriptMessage = (text: string) => ({
+  type: "message",
+  role: "user",
+  content: [
+    {
+      type: "input_text",
+      text: `Transcription de l'extrait audio :\n\n${text}`,
+    },
+  ],
+});
+
+// Earlier commentary kept in the conversation for later windows to refer to.
+interface MemoryItem {
+  readonly id: string;
+  readonly source: AudioSourceId | null;
+  readonly tokens: number;
+  // As added to the conversation, with its time.
+  readonly text: string;
+}
+
+const memoryMessage = (item: MemoryItem) => ({
+  type: "conversation.item.create",
+  item: {
+    id: item.id,
+    type: "message",
+    role: "assistant",
+    content: [{ type: "output_text", text: item.text }],
+  },
+});
+
+// Rough count, about four characters per token for French text.
+const estimateTokens = (text: string) => Math.ceil(text.length / 4);
+
+// Item ids are limited to 32 characters.
+const memoryItemId = () =>
+  `mem_${crypto.randomUUID().replaceAll("-", "").slice(0, 24)}`;
+
+// Listener's steer of the commentary, e.g. "focus on the sports segment
+// coming up", kept in the conversation as a user message until it expires.
+export interface Nudge {
+  readonly itemId: string;
+  readonly text: string;
+  readonly expiresAt: number;
+}
+
+const nudgeItemId = () =>
+  `nudge_${crypto.randomUUID().replaceAll("-", "").slice(0, 24)}`;
+
+const nudgeMessage = (nudge: Nudge) => ({
+  type: "conversation.item.create",
+  item: {
+    id: nudge.itemId,
+    type: "message",
+    role: "user",
+    content: [
+      {
+        type: "input_text",
+        text: `Consigne de l'auditeur pour les prochains commentaires : ${nudge.text}`,
+      },
+    ],
+  },
+});
+
+const ASK_INSTRUCTIONS = `Un auditeur vous pose une question sur ce qui vient de passer a l'antenne. Repondez en francais, en une a trois phrases, uniquement a partir des extraits audio et des commentaires qui precedent la question. Si la reponse n'y figure pas, dites-le simplement, sans l'inventer.`;
+
+// Windows a question is answered over, about two minutes at the default
+// window size, with the audio committed since the last one.
+const ASK_WINDOWS = 8;
+
+// A listener's question about the audio sent, answered on the stream as
+// answer_delta and answer messages tagged with its id.
+interface Ask {
+  readonly id: string;
+  readonly question: string;
+  readonly source: AudioSourceId | null;
+  readonly postProcessing: ReadonlyArray<PostProcessor>;
+  readonly text: PostProcessingState;
+  readonly published: string;
+  readonly deltas: number;
+}
+
+// The first session is opened at startup rather than when first needed.
+const WarmupConfig = Config.boolean("OPENAI_WARMUP").pipe(
+  Config.withDefault(false)
+);
+
+// Sessions rotated this long after the limit was reached are handed over
+// even without a window boundary, or an acknowledgement, to wait for.
+const ROTATION_WAIT_MS = 2 * 60 * 1000;
+
+// Client event ids of the messages making up a source's windows, so an
+// error OpenAI reports about one can be told apart from the errors of other
+// requests (questions, translations, tags...).
+const WINDOW_EVENT_ID = "window";
+const windowResponseEventId = (source: AudioSourceId) =>
+  `${WINDOW_EVENT_ID}:${source}`;
+
+const COMMIT_MESSAGE = JSON.stringify({
+  type: "input_audio_buffer.commit",
+  event_id: WINDOW_EVENT_ID,
+});
+
+export class ClipResponseError extends Data.TaggedError("ClipResponseError")<{
+  message: string;
+}> {}
+
+export class NoBufferedAudioError extends Data.TaggedError(
+  "NoBufferedAudioError"
+) {}
+
+export class CustomResponseError extends Data.TaggedError(
+  "CustomResponseError"
+)<{ message: string }> {}
+
 class WebSocketError extends Data.TaggedError("WebSocketError")<{
   cause: unknown;
 }> {}
 
+// OpenAI still couldn't be reached after the connection's retries.
+export class OpenAIConnectionError extends Data.TaggedError(
+  "OpenAIConnectionError"
+)<{ message: string; cause: unknown }> {}
+
 export class OpenAIRealtime extends Effect.Service<OpenAIRealtime>()(
   "OpenAIRealtime",
   {
     effect: Effect.gen(function* () {
-      const apiKey = yield* Config.redacted("OPENAI_API_KEY");
+      const devReplay = yield* DevReplayConfig;
+      const dryRunConfig = yield* DryRunConfig;
+      // Replayed and dry-run sessions never reach OpenAI, so no key is
+      // needed.
+      const apiKey =
+        isReplaying(devReplay) || dryRunConfig.enabled
+          ? Redacted.make("replay")
+          : yield* Config.redacted("OPENAI_API_KEY");
+      // Overridable to go through an LLM gateway, use a regional endpoint or
+      // point at a fake server (see e2e/).
+      const realtimeUrl = yield* Config.string("OPENAI_REALTIME_URL").pipe(
+        Config.withDefault("wss://api.openai.com/v1/realtime")
+      );
+      const modelParam = yield* Config.string("OPENAI_MODEL_PARAM").pipe(
+        Config.withDefault("model")
+      );
+      const organization = yield* Config.option(
+        Config.string("OPENAI_ORGANIZATION")
+      );
+      const project = yield* Config.option(Config.string("OPENAI_PROJECT"));
+      const headers = {
+        Authorization: `Bearer ${Redacted.value(apiKey)}`,
+        ...Option.match(organization, {
+          onNone: () => ({}),
+          onSome: (id) => ({ "OpenAI-Organization": id }),
+        }),
+        ...Option.match(project, {
+          onNone: () => ({}),
+          onSome: (id) => ({ "OpenAI-Project": id }),
+        }),
+        ...(yield* ExtraHeaders),
+      };
+      const maxResponsesPerMinute = yield* Config.integer(
+        "OPENAI_MAX_RESPONSES_PER_MINUTE"
+      ).pipe(Config.withDefault(30));
+      const failureThreshold = yield* Config.integer(
+        "OPENAI_CIRCUIT_THRESHOLD"
+      ).pipe(Config.withDefault(3));
+      // A response whose response.done hasn't arrived by then is given up on.
+      const responseTimeout = yield* Config.integer(
+        "OPENAI_RESPONSE_TIMEOUT_SECONDS"
+      ).pipe(Config.withDefault(60));
+      // Sessions are rotated after this long, before OpenAI's 60-minute cap
+      // drops them; 0 never rotates.
+      const rotateMinutes = yield* Config.number(
+        "OPENAI_SESSION_ROTATE_MINUTES"
+      ).pipe(Config.withDefault(55));
+      const outputModality = yield* Config.literal(
+        "text",
+        "audio"
+      )("OPENAI_OUTPUT_MODALITY").pipe(Config.withDefault("text"));
+      // Tokens of earlier commentary given to each new window as context;
+      // 0 keeps every window independent.
+      const memoryTokens = yield* Config.integer(
+        "CONVERSATION_MEMORY_TOKENS"
+      ).pipe(Config.withDefault(0));
+      const voice = yield* Config.string("OPENAI_VOICE").pipe(
+        Config.withDefault("marin")
+      );
+      // Two-stage pipeline: with a transcription model (e.g.
+      // gpt-4o-transcribe or whisper-1), every commit is transcribed and
+      // published as a transcript message within seconds, and commentary is
+      // written from that text instead of the audio.
+      const transcriptionModel = yield* Config.option(
+        Config.string("OPENAI_TRANSCRIPTION_MODEL")
+      );
+      // Shared with the STT fallbacks: the language spoken on air.
+      const transcriptionLanguage = yield* Config.string("STT_LANGUAGE").pipe(
+        Config.withDefault("fr")
+      );
+      const transcription = Option.match(transcriptionModel, {
+        onNone: () => null,
+        onSome: (name): TranscriptionConfig => ({
+          model: name,
+          language: transcriptionLanguage,
+        }),
+      });
+      const requestedInputFormat = yield* Config.literal(
+        "pcm",
+        "pcmu",
+        "pcma"
+      )("OPENAI_INPUT_FORMAT").pipe(Config.withDefault("pcm"));
+      // 24kHz for OpenAI; 16kHz for backends that expect it.
+      const pcmRate = yield* Config.literal(
+        16000,
+        24000
+      )("OPENAI_INPUT_RATE").pipe(Config.withDefault(DEFAULT_PCM_RATE));
+      const requestedSpec = inputFormatSpec(requestedInputFormat, pcmRate);
+      const fallbackSpec = inputFormatSpec("pcm");
+      const appConfig = yield* AppConfig;
+      const broadcaster = yield* Broadcaster;
+      const events = yield* PipelineEvents;
+      const supervisor = yield* PipelineSupervisor;
+      // The model only applies on restart.
+      const { model, prompt } = yield* appConfig.get;
       const scope = yield* Scope.make();
+      const dryRun = dryRunConfig.enabled
+        ? yield* startDryRunServer(
+            dryRunConfig,
+            requestedSpec.bytesPerSecond
+          ).pipe(Scope.extend(scope))
+        : null;
+      const url =
+        dryRun !== null
+          ? dryRun.url
+          : isReplaying(devReplay)
+            ? yield* startReplayServer(devReplay.dir).pipe(Scope.extend(scope))
+            : openaiUrl(realtimeUrl, modelParam, model);
+      if (dryRun !== null) {
+        yield* Effect.logWarning(
+          "Dry run: nothing is sent to OpenAI, responses are cost estimates"
+        );
+      }
+      const recordEvent = isRecording(devReplay)
+        ? makeEventRecorder(devReplay.dir)
+        : undefined;
 
-      yield* Effect.log("Connecting to OpenAI Realtime API...");
+      const warmup = yield* WarmupConfig;
+      const appendBatchMs = yield* AppendBatchConfig;
 
       const incomingQueue = yield* Queue.unbounded<ServerEvent>();
-      const broadcastPubSub = yield* PubSub.unbounded<BroadcastMessage>();
+      const speechPubSub = yield* PubSub.sliding<SpeechChunk>(256);
+      yield* Scope.addFinalizer(
+        scope,
+        Queue.shutdown(incomingQueue).pipe(
+          Effect.zipRight(PubSub.shutdown(speechPubSub))
+        )
+      );
 
       const connectWithRetry = Effect.async<WebSocket, WebSocketError>(
         (resume) => {
-          const ws = new WebSocket(OPENAI_URL, {
-            headers: { Authorization: `Bearer ${Redacted.value(apiKey)}` },
-          });
+          const ws = new WebSocket(url, { headers });
           ws.addEventListener("open", () => resume(Effect.succeed(ws)));
           ws.addEventListener("error", (e) =>
             resume(Effect.fail(new WebSocketError({ cause: e })))
@@ -70,68 +624,2020 @@ export class OpenAIRealtime extends Effect.Service<OpenAIRealtime>()(
         )
       );
 
-      const ws = yield* Effect.acquireRelease(connectWithRetry, (ws) =>
-        Effect.sync(() => ws.close()).pipe(
-          Effect.tap(() => Queue.shutdown(incomingQueue)),
-          Effect.tap(() => PubSub.shutdown(broadcastPubSub))
-        )
+      // The session being written to, replaced when sessions are rotated;
+      // null until something needs it, unless OPENAI_WARMUP opens it at
+      // startup.
+      let ws: WebSocket | null = null;
+      let connecting = false;
+      let sessionStartedAt = 0;
+
+      // Sessions handed over before acknowledging their commits; their late
+      // acknowledgements would be taken for the new session's.
+      const abandoned = new WeakSet<WebSocket>();
+
+      // Messages of every session, the old one's included while it finishes
+      // its responses, are handled alike.
+      const listen = (socket: WebSocket) =>
+        socket.addEventListener("message", (e) => {
+          try {
+            const event = JSON.parse(e.data as string);
+            recordEvent?.(event);
+            if (
+              abandoned.has(socket) &&
+              event.type === "input_audio_buffer.committed"
+            ) {
+              return;
+            }
+            Queue.unsafeOffer(incomingQueue, event);
+          } catch (err) {
+            console.error("Failed to parse OpenAI WebSocket message:", err);
+          }
+        });
+
+      // With the instructions currently in effect.
+      const sendSessionUpdate = (socket: WebSocket, input: InputFormatSpec) =>
+        Effect.gen(function* () {
+          const session = makeSessionUpdate(
+            model,
+            yield* Ref.get(instructions),
+            input,
+            outputModality,
+            voice,
+            transcription,
+            yield* Ref.get(noiseReduction)
+          );
+          socket.send(JSON.stringify(session));
+        });
+
+      // A non-default input format or rate is only used once the session
+      // confirms it; otherwise the session falls back to 24kHz PCM. Runs
+      // before the message handler starts, so nothing else is reading the
+      // queue.
+      const negotiateInputFormat = (socket: WebSocket) =>
+        Effect.gen(function* () {
+          yield* sendSessionUpdate(socket, requestedSpec);
+          if (
+            requestedSpec.format === fallbackSpec.format &&
+            requestedSpec.sampleRate === fallbackSpec.sampleRate
+          ) {
+            return requestedSpec;
+          }
+
+          const reply = yield* Queue.take(incomingQueue).pipe(
+            Effect.repeat({
+              until: (e) => e.type === "session.updated" || e.type === "error",
+            }),
+            Effect.timeout("10 seconds"),
+            Effect.option
+          );
+          const accepted = Option.exists(reply, (e) => {
+            if (e.type !== "session.updated") return false;
+            const format = e.session.audio?.input?.format;
+            return (
+              format?.type === requestedSpec.session.type &&
+              (format.rate === undefined ||
+                format.rate === requestedSpec.session.rate)
+            );
+          });
+          if (accepted) return requestedSpec;
+
+          yield* Effect.logWarning(
+            `Input format ${describeSpec(requestedSpec)} not accepted, falling back to ${describeSpec(fallbackSpec)}`
+          );
+          yield* sendSessionUpdate(socket, fallbackSpec);
+          return fallbackSpec;
+        });
+
+      // Negotiated by the first session; sessions opened after it use it too.
+      let inputSpec = requestedSpec;
+
+      const send = (msg: object) =>
+        Effect.flatMap(session, (socket) =>
+          Effect.sync(() => socket.send(JSON.stringify(msg)))
+        );
+
+      // A rotation waits for the next window to close on the old session,
+      // then holds back the audio of the one after until the old session has
+      // acknowledged its commits.
+      let rotation:
+        | { phase: "pending"; next: WebSocket; openedAt: number; since: number }
+        | {
+            phase: "draining";
+            next: WebSocket;
+            openedAt: number;
+            since: number;
+            held: Array<string>;
+            heldCommits: number;
+          }
+        | null = null;
+      // Whether the session's buffer holds uncommitted audio.
+      let appendedSinceCommit = false;
+
+      // Appends and commits go to the new session once they are held back.
+      const sendAudio = (socket: WebSocket, message: string) => {
+        if (rotation?.phase === "draining") {
+          rotation.held.push(message);
+        } else {
+          socket.send(message);
+        }
+      };
+
+      const dropHeldAudio = Effect.sync(() => {
+        if (rotation?.phase === "draining") {
+          rotation.held = [];
+          rotation.heldCommits = 0;
+        }
+      });
+
+      // What the previous run left unacknowledged is read before the journal
+      // is started over.
+      const journalConfig = yield* OpenAIJournalConfig;
+      const recovered = Option.isSome(journalConfig.path)
+        ? yield* Effect.sync(() => readJournal(journalConfig.path.value))
+        : null;
+      if (recovered !== null) {
+        const { audioMs, commits, responses } = recovered.summary;
+        yield* Effect.logWarning(
+          `Previous run lost ${(audioMs / 1000).toFixed(1)}s of audio sent to OpenAI (${commits} unacknowledged commit(s), ${responses} response(s) requested since the last acknowledged one)`
+        );
+      }
+      // Opened with the first session, in the format it negotiated.
+      let journal: Journal | null = null;
+
+      // Commentary instructions currently in effect; the audio processor
+      // switches them to the selected source's template.
+      const instructions = yield* Ref.make(prompt);
+      // Likewise with the selected source's noise reduction.
+      const noiseReduction = yield* Ref.make<NoiseReduction | null>(null);
+
+      // Each sent commit is queued until OpenAI acknowledges it. A commit that
+      // closes a window carries the request to run over the window's items.
+      const pendingCommits = yield* Ref.make<ReadonlyArray<PendingCommit>>([]);
+      const windowItems = yield* Ref.make<ReadonlyArray<string>>([]);
+      // The last window whose responses were requested, for one-off
+      // requests about the audio already sent.
+      const lastWindow = yield* Ref.make<{
+        request: ResponseRequest;
+        items: ReadonlyArray<string>;
+      } | null>(null);
+      // Audio items of the last ASK_WINDOWS windows, oldest first, for
+      // questions about what was just said.
+      const recentItems = yield* Ref.make<
+        ReadonlyArray<ReadonlyArray<string>>
+      >([]);
+      const transcripts = yield* Ref.make(
+        HashMap.empty<string, ItemTranscript>()
+      );
+      // Commentary responses waiting on their window's transcripts, and a
+      // count of cancellations so they can tell theirs is no longer wanted.
+      const awaitingTranscripts = yield* Ref.make(0);
+      const cancellations = yield* Ref.make(0);
+      const memory = yield* Ref.make<ReadonlyArray<MemoryItem>>([]);
+      // The show each source last moved on from; commentary still finishing
+      // on it isn't remembered.
+      const endedPrograms = yield* Ref.make(
+        HashMap.empty<AudioSourceId, string>()
+      );
+      const responses = yield* Ref.make(HashMap.empty<string, ResponseInfo>());
+      // Responses given up on after the timeout, with when; their late events
+      // are ignored until as long again has passed.
+      const expired = yield* Ref.make(HashMap.empty<string, number>());
+      // Comparison responses and the sources they compare; their text is
+      // only published once complete.
+      const comparisons = yield* Ref.make(
+        HashMap.empty<string, ReadonlyArray<AudioSourceId>>()
+      );
+      // One-off responses awaiting their id, keyed by the id sent in their
+      // metadata.
+      const requested = yield* Ref.make(
+        HashMap.empty<string, Deferred.Deferred<string>>()
+      );
+      // Questions awaiting their answer, keyed by their ask id until
+      // response.created, then by response id; the id is handed over once
+      // the response exists.
+      const asks = yield* Ref.make(HashMap.empty<string, Ask>());
+      const askStarts = yield* Ref.make(
+        HashMap.empty<string, Deferred.Deferred<string>>()
+      );
+      // Clip responses awaiting their text, keyed by the id sent in their
+      // metadata until response.created, then by response id.
+      const clips = yield* Ref.make(
+        HashMap.empty<string, Deferred.Deferred<string, ClipResponseError>>()
+      );
+      // Bumped, by source, on errors of the commits and window responses of
+      // a source, so its audio processor can notice and replay the window
+      // it is working on.
+      const windowFailures = yield* Ref.make(
+        HashMap.empty<AudioSourceId, number>()
+      );
+      const experiment = yield* Ref.make(Option.none<Experiment>());
+      const nudge = yield* Ref.make(Option.none<Nudge>());
+
+      // The running experiment, counting the window against it; it ends
+      // once its last window is taken.
+      const takeExperimentWindow = Ref.modify(experiment, (current) =>
+        Option.match(current, {
+          onNone: () => [Option.none<Experiment>(), current],
+          onSome: (e) => [
+            current,
+            e.remaining > 1
+              ? Option.some({ ...e, remaining: e.remaining - 1 })
+              : Option.none(),
+          ],
+        })
+      );
+
+      const governor = yield* makeRequestGovernor(
+        {
+          maxResponsesPerMinute,
+          failureThreshold,
+          baseBackoff: "10 seconds",
+          maxBackoff: "5 minutes",
+        },
+        (event) => {
+          switch (event._tag) {
+            case "Opened":
+            case "Capped":
+              return broadcaster.publish({
+                type: "paused",
+                reason: event._tag === "Opened" ? "errors" : "rate_limit",
+                retryInMs: Duration.toMillis(event.retryIn),
+              });
+            case "Closed":
+              return broadcaster.publish({ type: "resumed", from: "paused" });
+            case "Uncapped":
+              return broadcaster.publish({
+                type: "resumed",
+                from: "rate_limit",
+              });
+          }
+        }
       ).pipe(Scope.extend(scope));
 
-      ws.addEventListener("message", (e) => {
-        try {
-          Queue.unsafeOffer(incomingQueue, JSON.parse(e.data as string));
-        } catch (err) {
-          console.error("Failed to parse OpenAI WebSocket message:", err);
+      const recordWindowFailure = (source: AudioSourceId | null) =>
+        source === null
+          ? Effect.void
+          : Ref.update(windowFailures, (all) =>
+              HashMap.set(
+                all,
+                source,
+                Option.getOrElse(HashMap.get(all, source), () => 0) + 1
+              )
+            );
+
+      // The source of a window response, null for other responses.
+      const windowSource = (info: ResponseInfo) =>
+        info.custom || info.audioOffsetMs === null ? null : info.source;
+
+      // The source whose window a client event belonged to, if any: the
+      // response's, or the oldest unacknowledged commit's.
+      const windowSourceOfEvent = (eventId: string | null | undefined) =>
+        Effect.gen(function* () {
+          if (eventId === WINDOW_EVENT_ID) {
+            const [head] = yield* Ref.get(pendingCommits);
+            return head?.source ?? null;
+          }
+          return eventId?.startsWith(`${WINDOW_EVENT_ID}:`)
+            ? eventId.slice(WINDOW_EVENT_ID.length + 1)
+            : null;
+        });
+
+      const reportError = (error: PipelineError) =>
+        broadcaster
+          .publish({ type: "error", ...error })
+          .pipe(Effect.zipRight(events.publish(PipelineEvent.Error(error))));
+
+      // Tokens a finished response used, as OpenAI counted them, charged to
+      // its source's budget.
+      const recordUsage = (
+        source: AudioSourceId | null,
+        response: Extract<ServerEvent, { type: "response.done" }>["response"]
+      ) => {
+        const usage = response.usage;
+        if (source === null || !usage) return Effect.void;
+        return events.publish(
+          PipelineEvent.ResponseUsage({
+            source,
+            audioTokens: usage.input_token_details?.audio_tokens ?? 0,
+            textTokens: usage.input_token_details?.text_tokens ?? 0,
+            outputTokens: usage.output_tokens ?? 0,
+          })
+        );
+      };
+
+      // OpenAI acknowledged the oldest commit, or rejected it as empty.
+      const popPendingCommit = Ref.modify(pendingCommits, ([head, ...rest]) => [
+        head ?? null,
+        rest,
+      ]).pipe(Effect.tap(() => Effect.sync(() => journal?.acknowledge())));
+
+      // Journaled before it is sent, like the appends it covers. A window's
+      // commit is the last a rotating session is sent.
+      const commitTo = (socket: WebSocket, commit: PendingCommit) =>
+        Ref.update(pendingCommits, (queue) => [...queue, commit]).pipe(
+          Effect.tap(() => Effect.sync(() => journal?.commit(commit))),
+          Effect.zipRight(
+            Effect.sync(() => {
+              appendedSinceCommit = false;
+              if (rotation?.phase === "draining") rotation.heldCommits++;
+              sendAudio(socket, COMMIT_MESSAGE);
+              if (rotation?.phase === "pending" && commit.request !== null) {
+                rotation = {
+                  ...rotation,
+                  phase: "draining",
+                  held: [],
+                  heldCommits: 0,
+                };
+              }
+            })
+          )
+        );
+
+      // Batched audio goes ahead of the commit covering it.
+      const sendCommit = (commit: PendingCommit) =>
+        flushBatch.pipe(
+          Effect.zipRight(session),
+          Effect.flatMap((socket) => commitTo(socket, commit))
+        );
+
+      const clearJournal = Effect.sync(() => journal?.clear());
+
+      // The transcription of an item, published and handed to the
+      // commentary of its window.
+      const transcribed = (itemId: string, text: string) =>
+        Effect.gen(function* () {
+          const item = HashMap.get(yield* Ref.get(transcripts), itemId);
+          if (Option.isNone(item)) return;
+          const { postProcessing } = yield* appConfig.get;
+          const processed = applyPostProcessing(postProcessing, text.trim());
+          yield* Deferred.succeed(item.value.text, processed);
+          if (processed === "") return;
+          yield* broadcaster.publish({
+            type: "transcript",
+            itemId,
+            source: item.value.source,
+            audioOffsetMs: item.value.audioOffsetMs,
+            text: processed,
+          });
+        });
+
+      // Text of the window, once every item is transcribed or the wait is
+      // given up on; an item left out only leaves a gap.
+      const windowTranscript = (items: ReadonlyArray<ItemTranscript>) =>
+        Effect.forEach(items, (item) =>
+          Deferred.await(item.text).pipe(
+            Effect.timeout("30 seconds"),
+            Effect.orElseSucceed(() => "")
+          )
+        ).pipe(
+          Effect.map((texts) => texts.filter((t) => t !== "").join("\n"))
+        );
+
+      // Adds a finished commentary to the conversation, timestamped so the
+      // model can tell how long ago it was said, and deletes the oldest ones
+      // once over the token budget.
+      const remember = (source: AudioSourceId | null, text: string) =>
+        Effect.gen(function* () {
+          const tokens = estimateTokens(text);
+          if (tokens === 0 || tokens > memoryTokens) return;
+          const time = new Date().toLocaleTimeString("fr-FR", {
+            hour: "2-digit",
+            minute: "2-digit",
+          });
+          const item: MemoryItem = {
+            id: memoryItemId(),
+            source,
+            tokens,
+            text: `[${time}] ${text}`,
+          };
+          yield* send(memoryMessage(item));
+          const dropped = yield* Ref.modify(memory, (items) => {
+            const all = [...items, item];
+            let total = all.reduce((n, item) => n + item.tokens, 0);
+            let kept = 0;
+            while (total > memoryTokens) total -= all[kept++]!.tokens;
+            return [all.slice(0, kept), all.slice(kept)];
+          });
+          yield* Effect.forEach(dropped, (item) =>
+            send({ type: "conversation.item.delete", item_id: item.id })
+          );
+        });
+
+      const clearNudge = Ref.getAndSet(nudge, Option.none()).pipe(
+        Effect.tap(
+          Option.match({
+            onNone: () => Effect.void,
+            onSome: (previous) =>
+              send({
+                type: "conversation.item.delete",
+                item_id: previous.itemId,
+              }),
+          })
+        )
+      );
+
+      // The nudge in effect, dropped from the conversation once expired.
+      const activeNudge = Effect.gen(function* () {
+        const current = yield* Ref.get(nudge);
+        if (Option.isNone(current)) return current;
+        if (current.value.expiresAt > (yield* Clock.currentTimeMillis)) {
+          return current;
         }
+        yield* clearNudge;
+        yield* Effect.log("Nudge expired");
+        return Option.none<Nudge>();
       });
 
-      ws.send(JSON.stringify(sessionUpdate));
+      // Commentary of the same source, oldest first, then the nudge if any,
+      // placed before the window's audio.
+      const memoryFor = (source: AudioSourceId | null) =>
+        Effect.all([Ref.get(memory), activeNudge]).pipe(
+          Effect.map(([items, current]) => [
+            ...items
+              .filter((item) => item.source === source)
+              .map((item) => item.id),
+            ...Option.toArray(current).map((n) => n.itemId),
+          ])
+        );
 
-      yield* Effect.log("Connected to OpenAI Realtime API");
+      // Tasks run as out-of-band responses so they can proceed in parallel
+      // over the same committed audio. With transcription, commentary is
+      // written from the window's text instead, once it is in, without
+      // holding up the other tasks or the message reader.
+      const createTaskResponses = (request: ResponseRequest) =>
+        Effect.gen(function* () {
+          const items = yield* Ref.getAndSet(windowItems, []);
+          if (items.length === 0) return;
+          yield* Ref.set(lastWindow, { request, items });
+          yield* Ref.update(recentItems, (windows) =>
+            [...windows, items].slice(-ASK_WINDOWS)
+          );
+          const remembered = yield* memoryFor(request.source);
+          const itemTranscripts = yield* Ref.modify(transcripts, (all) => [
+            items.flatMap((id) => Option.toArray(HashMap.get(all, id))),
+            HashMap.removeMany(all, items),
+          ]);
+          const epoch = yield* Ref.get(cancellations);
+          const audioInput = items.map((id) => ({
+            type: "item_reference",
+            id,
+          }));
+          yield* Effect.forEach(request.tasks, (task) => {
+            const fromText =
+              task === "commentary" && itemTranscripts.length > 0;
+            const respond = Effect.gen(function* () {
+              const input = fromText
+                ? yield* windowTranscript(itemTranscripts).pipe(
+                    Effect.map((text) =>
+                      text === "" ? [] : [transcriptMessage(text)]
+                    )
+                  )
+                : audioInput;
+              // Cancelled while waiting, e.g. for a change of station.
+              if ((yield* Ref.get(cancellations)) !== epoch) return;
+              if (input.length === 0) {
+                return yield* Effect.log(
+                  "Skipping commentary: nothing was transcribed"
+                );
+              }
+              const base =
+                task === "commentary"
+                  ? yield* Ref.get(instructions)
+                  : RESPONSE_TASKS[task].instructions;
+              const trial =
+                task === "commentary"
+                  ? yield* takeExperimentWindow
+                  : Option.none<Experiment>();
+              const runs = Option.match(trial, {
+                onNone: () => [{ instructions: base, tags: {} }],
+                onSome: (e) =>
+                  e.variants.map((v) => ({
+                    instructions:
+                      v.instructions?.replaceAll("{{prompt}}", base) ?? base,
+                    tags: { experiment: e.id, variant: v.id },
+                  })),
+              });
+              yield* Effect.forEach(runs, (run) =>
+                Effect.gen(function* () {
+                  if (!(yield* governor.tryAcquire)) {
+                    return yield* Effect.logWarning(
+                      `Skipping "${task}" response: request budget exhausted or circuit open`
+                    );
+                  }
+                  const message = {
+                    type: "response.create",
+                    event_id: windowResponseEventId(request.source),
+                    response: {
+                      conversation: "none",
+                      instructions: run.instructions,
+                      // Metadata values must be strings.
+                      metadata: {
+                        task,
+                        source: request.source,
+                        audio_offset_ms: String(request.audioOffsetMs),
+                        cancel_epoch: String(epoch),
+                        ...windowMetadata(request),
+                        // Metadata values are capped at 512 characters.
+                        ...(request.program && {
+                          program: request.program.slice(0, 512),
+                        }),
+                        ...run.tags,
+                      },
+                      input: [
+                        ...(task === "commentary"
+                          ? remembered.map((id) => ({
+                              type: "item_reference",
+                              id,
+                            }))
+                          : []),
+                        ...input,
+                      ],
+                    },
+                  };
+                  journal?.response(message);
+                  yield* send(message);
+                })
+              );
+            });
+            return fromText
+              ? Ref.update(awaitingTranscripts, (n) => n + 1).pipe(
+                  Effect.zipRight(
+                    respond.pipe(
+                      Effect.ensuring(
+                        Ref.update(awaitingTranscripts, (n) => n - 1)
+                      ),
+                      Effect.forkIn(scope)
+                    )
+                  )
+                )
+              : respond;
+          });
+        });
+
+      // Adds a committed item to the window and, when it closes the window,
+      // runs the window's tasks.
+      const committed = (itemId: string) =>
+        Effect.gen(function* () {
+          yield* Ref.update(windowItems, (items) => [...items, itemId]);
+          const commit = yield* popPendingCommit;
+          if (commit === null) return;
+          if (transcription) {
+            const text = yield* Deferred.make<string>();
+            yield* Ref.update(
+              transcripts,
+              HashMap.set(itemId, {
+                source: commit.source,
+                audioOffsetMs: commit.audioOffsetMs,
+                text,
+              })
+            );
+          }
+          if (commit.request) yield* createTaskResponses(commit.request);
+        });
+
+      const infoOf = (responseId: string) =>
+        Effect.zipWith(Ref.get(responses), Ref.get(expired), (infos, ids) =>
+          HashMap.get(infos, responseId).pipe(
+            Option.getOrElse(() =>
+              HashMap.has(ids, responseId)
+                ? { ...UNKNOWN_RESPONSE, cancelled: true }
+                : UNKNOWN_RESPONSE
+            )
+          )
+        );
+
+      // Comparison and clip responses are not streamed to clients.
+      const isInternal = (responseId: string) =>
+        Effect.zipWith(
+          Ref.get(comparisons),
+          Ref.get(clips),
+          (compared, clipped) =>
+            HashMap.has(compared, responseId) || HashMap.has(clipped, responseId)
+        );
+
+      // Answers stream through their own messages, post-processed like
+      // responses.
+      const publishAnswerDelta = (responseId: string, delta: string) =>
+        Effect.gen(function* () {
+          const ask = HashMap.get(yield* Ref.get(asks), responseId);
+          if (Option.isNone(ask)) return false;
+          const [text, state] = feedPostProcessing(
+            ask.value.postProcessing,
+            ask.value.text,
+            delta
+          );
+          yield* Ref.update(
+            asks,
+            HashMap.modify(responseId, (a) => ({
+              ...a,
+              text: state,
+              published: a.published + text,
+              deltas: a.deltas + (text === "" ? 0 : 1),
+            }))
+          );
+          if (text !== "") {
+            yield* broadcaster.publish({
+              type: "answer_delta",
+              askId: ask.value.id,
+              responseId,
+              source: ask.value.source,
+              text,
+              seq: ask.value.deltas,
+            });
+          }
+          return true;
+        });
+
+      const publishText = (
+        responseId: string,
+        info: ResponseInfo,
+        text: string
+      ) =>
+        text === ""
+          ? Effect.void
+          : broadcaster.publish({
+              type: "delta",
+              responseId,
+              task: info.task,
+              source: info.source,
+              text,
+              seq: info.deltas,
+              audioOffsetMs: info.audioOffsetMs,
+              ...responseTags(info),
+            });
+
+      // What post-processing held back goes out first, so the complete text
+      // is what was streamed.
+      const publishComplete = (
+        responseId: string,
+        info: ResponseInfo,
+        structured: Digest | null
+      ) =>
+        Effect.gen(function* () {
+          const [rest] = flushPostProcessing(info.postProcessing, info.text);
+          yield* publishText(responseId, info, rest);
+          const text = info.published + rest;
+          const now = yield* Clock.currentTimeMillis;
+          const durationMs = info.createdAt > 0 ? now - info.createdAt : 0;
+          yield* broadcaster.publish({
+            type: "complete",
+            responseId,
+            task: info.task,
+            source: info.source,
+            audioOffsetMs: info.audioOffsetMs,
+            structured,
+            text,
+            wordCount: countWords(text),
+            durationMs,
+            program: info.program,
+            windowStart: info.windowStart,
+            windowEnd: info.windowEnd,
+            ...(info.delayMs !== null && { delayMs: info.delayMs }),
+            ...(info.lossRatio !== null && { lossRatio: info.lossRatio }),
+            ...responseTags(info),
+          });
+          yield* events.publish(
+            PipelineEvent.ResponseCompleted({
+              responseId,
+              task: info.task,
+              source: info.source,
+              program: info.program,
+              text,
+              durationMs,
+              windowStart: info.windowStart,
+              windowEnd: info.windowEnd,
+            })
+          );
+        });
+
+      // Deltas go through the post-processing chain, which may hold some
+      // text back until the response is done.
+      const publishDelta = (msg: { response_id: string; delta: string }) =>
+        Effect.gen(function* () {
+          if (yield* isInternal(msg.response_id)) return;
+          if (yield* publishAnswerDelta(msg.response_id, msg.delta)) return;
+          const info = yield* infoOf(msg.response_id);
+          if (info.cancelled) return;
+          const [text, state] = feedPostProcessing(
+            info.postProcessing,
+            info.text,
+            msg.delta
+          );
+          yield* Ref.update(
+            responses,
+            HashMap.modify(msg.response_id, (i) => ({
+              ...i,
+              text: state,
+              published: i.published + text,
+              deltas: i.deltas + (text === "" ? 0 : 1),
+            }))
+          );
+          yield* publishText(msg.response_id, info, text);
+        });
 
       const handleMessage = Match.type<ServerEvent>().pipe(
-        Match.when({ type: "response.output_text.delta" }, (msg) =>
-          PubSub.publish(broadcastPubSub, {
-            type: "delta",
-            responseId: msg.response_id,
-            text: msg.delta,
+        Match.when({ type: "input_audio_buffer.committed" }, (msg) =>
+          committed(msg.item_id)
+        ),
+        Match.when(
+          { type: "conversation.item.input_audio_transcription.completed" },
+          (msg) => transcribed(msg.item_id, msg.transcript)
+        ),
+        Match.when(
+          { type: "conversation.item.input_audio_transcription.failed" },
+          (msg) =>
+            Effect.logWarning(
+              `Transcription of ${msg.item_id} failed: ${msg.error.message}`
+            ).pipe(Effect.zipRight(transcribed(msg.item_id, "")))
+        ),
+        Match.when({ type: "response.created" }, (msg) => {
+          const clip = msg.response.metadata?.clip;
+          if (clip) {
+            return Ref.update(clips, (all) =>
+              Option.match(HashMap.get(all, clip), {
+                onNone: () => all,
+                onSome: (deferred) =>
+                  HashMap.set(
+                    HashMap.remove(all, clip),
+                    msg.response.id,
+                    deferred
+                  ),
+              })
+            );
+          }
+          const compared = msg.response.metadata?.comparison;
+          if (compared) {
+            return Ref.update(
+              comparisons,
+              HashMap.set(msg.response.id, compared.split(","))
+            );
+          }
+          const askId = msg.response.metadata?.ask;
+          if (askId) {
+            return Effect.gen(function* () {
+              const ask = yield* Ref.modify(asks, (all) => [
+                HashMap.get(all, askId),
+                HashMap.remove(all, askId),
+              ]);
+              if (Option.isNone(ask)) return;
+              yield* Ref.update(asks, HashMap.set(msg.response.id, ask.value));
+              const started = HashMap.get(yield* Ref.get(askStarts), askId);
+              if (Option.isSome(started)) {
+                yield* Deferred.succeed(started.value, msg.response.id);
+              }
+            });
+          }
+          const task = msg.response.metadata?.task;
+          if (!task || !(task in RESPONSE_TASKS)) return Effect.void;
+          const offset = metadataNumber(
+            msg.response.metadata?.audio_offset_ms
+          );
+          const source = msg.response.metadata?.source ?? null;
+          const request = msg.response.metadata?.request;
+          const epoch = metadataNumber(msg.response.metadata?.cancel_epoch);
+          return Effect.all([
+            appConfig.get,
+            Clock.currentTimeMillis,
+            Ref.get(cancellations),
+          ]).pipe(
+            Effect.flatMap(([config, now, current]) => {
+              // Requested before a cancellation that went out before OpenAI
+              // created it, so cancelResponses couldn't name it.
+              const cancelled = epoch !== null && epoch !== current;
+              return Ref.update(
+                responses,
+                HashMap.set(msg.response.id, {
+                  task: task as TaskId,
+                  source,
+                  audioOffsetMs: offset,
+                  program: msg.response.metadata?.program ?? null,
+                  windowStart: metadataNumber(
+                    msg.response.metadata?.window_start
+                  ),
+                  windowEnd: metadataNumber(msg.response.metadata?.window_end),
+                  delayMs: metadataNumber(msg.response.metadata?.delay_ms),
+                  lossRatio: metadataNumber(
+                    msg.response.metadata?.loss_ratio
+                  ),
+                  experiment:
+                    msg.response.metadata?.experiment &&
+                    msg.response.metadata.variant
+                      ? {
+                          id: msg.response.metadata.experiment,
+                          variant: msg.response.metadata.variant,
+                        }
+                      : null,
+                  custom: request !== undefined,
+                  cancelled,
+                  postProcessing:
+                    RESPONSE_TASKS[task as TaskId].format === "json"
+                      ? []
+                      : config.postProcessing,
+                  text: INITIAL_POST_PROCESSING,
+                  published: "",
+                  deltas: 0,
+                  createdAt: now,
+                })
+              ).pipe(
+                Effect.zipRight(
+                  cancelled
+                    ? send({
+                        type: "response.cancel",
+                        response_id: msg.response.id,
+                      }).pipe(
+                        Effect.zipRight(
+                          Effect.log(
+                            `Cancelled response ${msg.response.id}, requested before a cancellation`
+                          )
+                        )
+                      )
+                    : events.publish(
+                        PipelineEvent.ResponseStarted({
+                          responseId: msg.response.id,
+                          task: task as TaskId,
+                          source,
+                        })
+                      )
+                )
+              );
+            }),
+            Effect.zipRight(
+              request === undefined
+                ? Effect.void
+                : Ref.get(requested).pipe(
+                    Effect.flatMap((all) =>
+                      Option.match(HashMap.get(all, request), {
+                        onNone: () => Effect.void,
+                        onSome: (d) => Deferred.succeed(d, msg.response.id),
+                      })
+                    )
+                  )
+            )
+          );
+        }),
+        Match.when({ type: "response.output_text.delta" }, publishDelta),
+        Match.when(
+          { type: "response.output_audio_transcript.delta" },
+          publishDelta
+        ),
+        Match.when({ type: "response.output_audio.delta" }, (msg) =>
+          Effect.gen(function* () {
+            if (yield* isInternal(msg.response_id)) return;
+            const info = yield* infoOf(msg.response_id);
+            if (info.cancelled) return;
+            yield* PubSub.publish(speechPubSub, {
+              responseId: msg.response_id,
+              task: info.task,
+              pcm: Buffer.from(msg.delta, "base64"),
+            });
           })
         ),
         Match.when({ type: "response.done" }, (msg) =>
-          PubSub.publish(broadcastPubSub, {
-            type: "complete",
-            responseId: msg.response.id,
+          Effect.gen(function* () {
+            const clip = yield* Ref.modify(clips, (all) => [
+              HashMap.get(all, msg.response.id),
+              HashMap.remove(all, msg.response.id),
+            ]);
+            if (Option.isSome(clip)) {
+              if (msg.response.status === "completed") {
+                yield* Deferred.succeed(clip.value, outputText(msg.response));
+                yield* governor.recordSuccess;
+              } else {
+                yield* Deferred.fail(
+                  clip.value,
+                  new ClipResponseError({
+                    message: `Response ${msg.response.status}`,
+                  })
+                );
+                if (msg.response.status === "failed") {
+                  yield* governor.recordFailure;
+                }
+              }
+              return;
+            }
+
+            const ask = yield* Ref.modify(asks, (all) => [
+              HashMap.get(all, msg.response.id),
+              HashMap.remove(all, msg.response.id),
+            ]);
+            if (Option.isSome(ask)) {
+              yield* recordUsage(ask.value.source, msg.response);
+              const [rest] = flushPostProcessing(
+                ask.value.postProcessing,
+                ask.value.text
+              );
+              if (rest !== "") {
+                yield* broadcaster.publish({
+                  type: "answer_delta",
+                  askId: ask.value.id,
+                  responseId: msg.response.id,
+                  source: ask.value.source,
+                  text: rest,
+                  seq: ask.value.deltas,
+                });
+              }
+              if (msg.response.status === "completed") {
+                yield* broadcaster.publish({
+                  type: "answer",
+                  askId: ask.value.id,
+                  responseId: msg.response.id,
+                  source: ask.value.source,
+                  question: ask.value.question,
+                  text: ask.value.published + rest,
+                });
+                yield* governor.recordSuccess;
+              } else if (msg.response.status === "failed") {
+                yield* governor.recordFailure;
+              }
+              return;
+            }
+
+            const compared = yield* Ref.modify(comparisons, (all) => [
+              HashMap.get(all, msg.response.id),
+              HashMap.remove(all, msg.response.id),
+            ]);
+            if (Option.isSome(compared)) {
+              if (msg.response.status === "completed") {
+                const { postProcessing } = yield* appConfig.get;
+                yield* broadcaster.publish({
+                  type: "comparison",
+                  responseId: msg.response.id,
+                  sources: compared.value,
+                  text: applyPostProcessing(
+                    postProcessing,
+                    outputText(msg.response)
+                  ),
+                });
+                yield* governor.recordSuccess;
+              } else if (msg.response.status === "failed") {
+                // No window to replay, so the audio processor isn't told.
+                yield* governor.recordFailure;
+              }
+              return;
+            }
+
+            const wasExpired = yield* Ref.modify(expired, (ids) => [
+              HashMap.has(ids, msg.response.id),
+              HashMap.remove(ids, msg.response.id),
+            ]);
+            if (wasExpired) return;
+
+            const info = yield* infoOf(msg.response.id);
+            yield* recordUsage(info.source, msg.response);
+            // Its listeners moved on; what was streamed before the
+            // cancellation is left unfinished.
+            if (info.cancelled) {
+              return yield* Ref.update(
+                responses,
+                HashMap.remove(msg.response.id)
+              );
+            }
+            const expectsJson =
+              RESPONSE_TASKS[info.task].format === "json" &&
+              msg.response.status === "completed";
+            const structured = expectsJson
+              ? parseDigest(outputText(msg.response))
+              : Option.none();
+            if (expectsJson && Option.isNone(structured)) {
+              yield* Effect.logWarning(
+                `Response ${msg.response.id} is not a valid ${info.task}`
+              );
+            }
+            yield* publishComplete(
+              msg.response.id,
+              info,
+              Option.getOrNull(structured)
+            );
+            yield* Ref.update(responses, HashMap.remove(msg.response.id));
+            if (msg.response.status === "failed") {
+              yield* governor.recordFailure;
+              yield* recordWindowFailure(windowSource(info));
+            } else if (msg.response.status === "completed") {
+              yield* governor.recordSuccess;
+              // Only one variant of an experiment could be remembered; none
+              // is, so no variant colours the next windows.
+              // Commentary of a show that has ended would carry it over into
+              // the next one.
+              const stale =
+                info.source !== null &&
+                info.program !== null &&
+                Option.contains(
+                  HashMap.get(yield* Ref.get(endedPrograms), info.source),
+                  info.program
+                );
+              if (
+                info.task === "commentary" &&
+                info.experiment === null &&
+                !info.custom &&
+                !stale &&
+                memoryTokens > 0
+              ) {
+                yield* remember(info.source, outputText(msg.response));
+              }
+            }
           })
         ),
         Match.when({ type: "error" }, (msg) =>
           Effect.gen(function* () {
             yield* Effect.logError(`OpenAI error: ${msg.error.message}`);
-            yield* PubSub.publish(broadcastPubSub, {
-              type: "error",
-              message: msg.error.message,
-            });
+            if (msg.error.code === "input_audio_buffer_commit_empty") {
+              const commit = yield* popPendingCommit;
+              if (commit?.request) yield* createTaskResponses(commit.request);
+            } else {
+              yield* governor.recordFailure;
+              yield* recordWindowFailure(
+                yield* windowSourceOfEvent(msg.error.event_id)
+              );
+            }
+            yield* reportError(openaiError(msg.error));
           })
         ),
         Match.orElse(() => Effect.void)
       );
 
-      yield* Stream.fromQueue(incomingQueue).pipe(
-        Stream.runForEach(handleMessage),
-        Effect.catchAllCause((cause) =>
-          Effect.logError("OpenAI message handler failed", cause)
+      // Hands writing over to the new session: the conversation's memory and
+      // nudge are recreated there, then the held audio is sent. The old
+      // session is left to finish its responses before it is closed.
+      const swapSession = Effect.gen(function* () {
+        if (rotation === null) return;
+        const old = ws;
+        const next = rotation.next;
+        const held = rotation.phase === "draining" ? rotation.held : [];
+        ws = next;
+        sessionStartedAt = rotation.openedAt;
+        rotation = null;
+        // Earlier audio stays in the old session's conversation.
+        yield* Ref.set(recentItems, []);
+        yield* Effect.forEach(yield* Ref.get(memory), (item) =>
+          send(memoryMessage(item))
+        );
+        yield* Option.match(yield* Ref.get(nudge), {
+          onNone: () => Effect.void,
+          onSome: (current) => send(nudgeMessage(current)),
+        });
+        yield* Effect.sync(() => held.forEach((message) => next.send(message)));
+        yield* Effect.log("Rotated to a new OpenAI session");
+        yield* Effect.sync(() => old?.close()).pipe(
+          Effect.delay(`${responseTimeout} seconds`),
+          Effect.forkIn(scope)
+        );
+      });
+
+      // A rotation that can't wait, e.g. past ROTATION_WAIT_MS, gives up on
+      // the old session's unacknowledged commits and uncommitted audio:
+      // their windows get no responses, and the items listed so far are the
+      // old conversation's, so the new session starts a fresh window. Held
+      // commits are the new session's and stay queued.
+      const abandonRotation = (reason: string) =>
+        Effect.gen(function* () {
+          if (rotation === null) return;
+          const held = rotation.phase === "draining" ? rotation.heldCommits : 0;
+          const dropped = yield* Ref.modify(pendingCommits, (queue) => {
+            const old = Math.max(queue.length - held, 0);
+            return [old, queue.slice(old)];
+          });
+          const uncommitted =
+            rotation.phase === "pending" && appendedSinceCommit;
+          if (rotation.phase === "pending") appendedSinceCommit = false;
+          if (ws !== null) abandoned.add(ws);
+          yield* Ref.set(windowItems, []);
+          yield* Ref.set(transcripts, HashMap.empty());
+          yield* clearJournal;
+          yield* Effect.logWarning(
+            `Rotating the OpenAI session ${reason}, abandoning ${dropped} unacknowledged commit(s)${uncommitted ? " and uncommitted audio" : ""}`
+          );
+        });
+
+      // Once every commit sent to the old session is acknowledged.
+      const completeRotation = Effect.gen(function* () {
+        const pending = (yield* Ref.get(pendingCommits)).length;
+        if (rotation?.phase === "draining" && pending <= rotation.heldCommits) {
+          yield* swapSession;
+        }
+      });
+
+      // Picks up with the next message after a crash; ends once the socket
+      // is closed.
+      const startReader = Stream.fromQueue(incomingQueue).pipe(
+        Stream.runForEach((msg) =>
+          handleMessage(msg).pipe(Effect.zipRight(completeRotation))
         ),
+        (reader) => supervisor.supervise("openai-reader", reader),
         Effect.forkIn(scope)
       );
 
-      const send = (msg: object) =>
-        Effect.sync(() => ws.send(JSON.stringify(msg)));
+      // Sends the journaled audio again, and requests the responses of the
+      // window it was meant for; without one, it joins the next window.
+      const resendJournal = (socket: WebSocket) =>
+        Effect.gen(function* () {
+          if (
+            !journalConfig.resend ||
+            recovered === null ||
+            recovered.appends.length === 0
+          ) {
+            return;
+          }
+          if (
+            recovered.spec.format !== inputSpec.format ||
+            recovered.spec.sampleRate !== inputSpec.sampleRate
+          ) {
+            return yield* Effect.logWarning(
+              "Not re-sending the journaled audio: it was sent in another input format"
+            );
+          }
+          yield* Effect.log(
+            `Re-sending ${(recovered.summary.audioMs / 1000).toFixed(1)}s of journaled audio`
+          );
+          yield* Effect.forEach(recovered.appends, ({ frame, bytes }) =>
+            Effect.sync(() => {
+              journal?.append(frame, bytes);
+              socket.send(frame);
+            })
+          );
+          if (recovered.request) {
+            yield* commitTo(socket, {
+              source: recovered.request.source,
+              audioOffsetMs: recovered.request.audioOffsetMs,
+              request: recovered.request,
+            });
+          }
+        });
+
+      // The first session: its input format is negotiated before the message
+      // handler starts, so nothing else is reading the queue, and the journal
+      // is opened in that format.
+      const startSession = Effect.gen(function* () {
+        if (ws !== null) return ws;
+        connecting = true;
+        yield* Effect.log(
+          `Connecting to OpenAI Realtime API at ${new URL(url).host}...`
+        );
+        const socket = yield* Effect.acquireRelease(connectWithRetry, (s) =>
+          Effect.sync(() => s.close())
+        ).pipe(Scope.extend(scope));
+        listen(socket);
+        inputSpec = yield* negotiateInputFormat(socket);
+        journal = yield* Option.match(journalConfig.path, {
+          onNone: () => Effect.succeed(null),
+          onSome: (path) =>
+            Effect.acquireRelease(
+              Effect.sync(() => openJournal(path, inputSpec)),
+              (journal) => Effect.sync(() => journal.close())
+            ).pipe(Scope.extend(scope)),
+        });
+        yield* startReader;
+        yield* resendJournal(socket);
+        ws = socket;
+        sessionStartedAt = yield* Clock.currentTimeMillis;
+        yield* Effect.log(
+          `Connected to OpenAI Realtime API (input format: ${describeSpec(inputSpec)})`
+        );
+        return socket;
+      }).pipe(
+        Effect.ensuring(
+          Effect.sync(() => {
+            connecting = false;
+          })
+        )
+      );
+
+      // The session to write to, opened by the first message sent. A
+      // connection still failing after its retries fails that caller; the
+      // next one tries again.
+      const connectLock = yield* Effect.makeSemaphore(1);
+      const session: Effect.Effect<WebSocket, OpenAIConnectionError> =
+        Effect.suspend(() =>
+          ws !== null
+            ? Effect.succeed(ws)
+            : startSession.pipe(
+                connectLock.withPermits(1),
+                Effect.mapError(
+                  (e) =>
+                    new OpenAIConnectionError({
+                      message: "Could not connect to OpenAI",
+                      cause: e.cause,
+                    })
+                )
+              )
+        );
+
+      // A new session, configured like the current one.
+      const openSession = Effect.gen(function* () {
+        const socket = yield* Effect.acquireRelease(connectWithRetry, (s) =>
+          Effect.sync(() => s.close())
+        ).pipe(Scope.extend(scope));
+        listen(socket);
+        yield* sendSessionUpdate(socket, inputSpec);
+        return socket;
+      });
+
+      // With reconnectOnStuck, a session that let a response time out is
+      // replaced right away, in case the session itself is stuck; a rotation
+      // in progress is finished early instead. A replayed session only has
+      // the recorded connection.
+      const replaceStuckSession = Effect.gen(function* () {
+        if (ws === null || isReplaying(devReplay)) return;
+        if (rotation === null) {
+          const now = yield* Clock.currentTimeMillis;
+          rotation = {
+            phase: "pending",
+            next: yield* openSession,
+            openedAt: now,
+            since: now,
+          };
+        }
+        yield* abandonRotation("after a response timed out");
+        yield* swapSession;
+      }).pipe(
+        Effect.catchTag("WebSocketError", (e) =>
+          Effect.logWarning("Could not replace the OpenAI session", e.cause)
+        )
+      );
+
+      // Without response.done (a dropped event, an API bug) a response would
+      // stay tracked forever, holding up awaitIdle and leaving its clients
+      // without a complete. It is cancelled, completed with the text
+      // streamed so far and counted as a failure, so the audio processor
+      // replays its window and repeated timeouts open the circuit breaker.
+      // Its late events are ignored for as long again.
+      const expireStuckResponses = Effect.gen(function* () {
+        const now = yield* Clock.currentTimeMillis;
+        const timeoutMs = responseTimeout * 1000;
+        yield* Ref.update(
+          expired,
+          HashMap.filter((at) => now - at <= timeoutMs)
+        );
+        const stuck = yield* Ref.modify(responses, (infos) => {
+          const timedOut = HashMap.filter(
+            infos,
+            (info) => now - info.createdAt > timeoutMs
+          );
+          return [
+            Array.from(timedOut),
+            HashMap.removeMany(infos, HashMap.keys(timedOut)),
+          ];
+        });
+        if (stuck.length === 0) return;
+        yield* Ref.update(expired, (ids) =>
+          stuck.reduce((all, [id]) => HashMap.set(all, id, now), ids)
+        );
+        yield* Effect.forEach(stuck, ([id, info]) =>
+          Effect.gen(function* () {
+            yield* Effect.logWarning(
+              `Response ${id} timed out after ${responseTimeout}s, cancelling it`
+            );
+            yield* send({ type: "response.cancel", response_id: id });
+            if (!info.cancelled) yield* publishComplete(id, info, null);
+            yield* reportError(
+              pipelineError("response_timeout", `Response ${id} timed out`, {
+                responseId: id,
+              })
+            );
+            yield* governor.recordFailure;
+            yield* recordWindowFailure(windowSource(info));
+          })
+        );
+        if ((yield* appConfig.get).reconnectOnStuck) {
+          yield* replaceStuckSession;
+        }
+      });
+
+      yield* expireStuckResponses.pipe(
+        Effect.repeat(Schedule.spaced("5 seconds")),
+        (loop) => supervisor.supervise("openai-timeouts", loop),
+        Effect.forkIn(scope)
+      );
+
+      // With OPENAI_WARMUP, the session the next rotation switches to is
+      // opened ahead of time, and renewed before it gets old itself.
+      let standby: { socket: WebSocket; openedAt: number } | null = null;
+
+      const keepStandby = Effect.gen(function* () {
+        if (ws === null) return;
+        const now = yield* Clock.currentTimeMillis;
+        if (
+          standby !== null &&
+          standby.socket.readyState === WebSocket.OPEN &&
+          now - standby.openedAt < rotateMinutes * 30_000
+        ) {
+          return;
+        }
+        standby?.socket.close();
+        standby = null;
+        const socket = yield* openSession;
+        standby = { socket, openedAt: yield* Clock.currentTimeMillis };
+      }).pipe(
+        Effect.catchTag("WebSocketError", (e) =>
+          Effect.logWarning("Could not open a standby OpenAI session", e.cause)
+        )
+      );
+
+      // Sessions are rotated before OpenAI ends them. Without a window
+      // closing, the new session takes over once the old one's buffer is
+      // empty, or after ROTATION_WAIT_MS. A replayed session only has the
+      // recorded connection.
+      const rotateSession = Effect.gen(function* () {
+        const now = yield* Clock.currentTimeMillis;
+        if (rotation === null) {
+          if (ws === null || now - sessionStartedAt < rotateMinutes * 60_000) {
+            return;
+          }
+          const ready =
+            standby?.socket.readyState === WebSocket.OPEN ? standby : null;
+          standby = null;
+          if (ready !== null) {
+            // Its instructions may have changed since it was opened.
+            yield* sendSessionUpdate(ready.socket, inputSpec);
+          }
+          const next = ready?.socket ?? (yield* openSession);
+          rotation = {
+            phase: "pending",
+            next,
+            openedAt: ready?.openedAt ?? now,
+            since: now,
+          };
+          return yield* Effect.log(
+            "Rotating the OpenAI session at the next window"
+          );
+        }
+        const pending = (yield* Ref.get(pendingCommits)).length;
+        const idle =
+          rotation?.phase === "pending" &&
+          !appendedSinceCommit &&
+          pending === 0;
+        if (idle) return yield* swapSession;
+        if (rotation && now - rotation.since > ROTATION_WAIT_MS) {
+          yield* abandonRotation(`after ${ROTATION_WAIT_MS / 1000}s`);
+          yield* swapSession;
+        }
+      }).pipe(
+        Effect.catchTag("WebSocketError", (e) =>
+          Effect.logWarning("Could not open a new OpenAI session", e.cause)
+        )
+      );
+
+      if (rotateMinutes > 0 && !isReplaying(devReplay)) {
+        yield* rotateSession.pipe(
+          Effect.repeat(Schedule.spaced("15 seconds")),
+          (loop) => supervisor.supervise("openai-rotation", loop),
+          Effect.forkIn(scope)
+        );
+        if (warmup) {
+          yield* keepStandby.pipe(
+            Effect.repeat(Schedule.spaced("15 seconds")),
+            (loop) => supervisor.supervise("openai-standby", loop),
+            Effect.forkIn(scope)
+          );
+        }
+      }
+
+      // Reported once each time the send buffer fills up, base64 taking four
+      // bytes for three.
+      const writeBufferFull = yield* Ref.make(false);
+      const checkWriteBuffer = Effect.gen(function* () {
+        const limit = Math.ceil(
+          (inputSpec.bytesPerSecond * WRITE_BUFFER_SECONDS * 4) / 3
+        );
+        const full = (ws?.bufferedAmount ?? 0) > limit;
+        if ((yield* Ref.getAndSet(writeBufferFull, full)) || !full) return;
+        const error = pipelineError(
+          "write_queue_full",
+          `Over ${WRITE_BUFFER_SECONDS}s of audio waiting to be sent to OpenAI`
+        );
+        yield* Effect.logWarning(error.message);
+        yield* reportError(error);
+      });
+
+      // Append frames are built in a single reusable buffer: the JSON envelope
+      // is copied in once and the PCM is base64-encoded straight after it.
+      let frame = Buffer.allocUnsafe(0);
+      const sendAppend = (pcm: Uint8Array) =>
+        Effect.flatMap(session, (socket) =>
+          Effect.sync(() => {
+            const size =
+              APPEND_PREFIX.length +
+              Math.ceil(pcm.length / 3) * 4 +
+              APPEND_SUFFIX.length;
+            if (frame.length < size) {
+              frame = Buffer.allocUnsafe(size);
+              APPEND_PREFIX.copy(frame, 0);
+            }
+            const end = encodeBase64Into(pcm, frame, APPEND_PREFIX.length);
+            APPEND_SUFFIX.copy(frame, end);
+            const message = frame.toString(
+              "latin1",
+              0,
+              end + APPEND_SUFFIX.length
+            );
+            journal?.append(message, pcm.length);
+            appendedSinceCommit = true;
+            sendAudio(socket, message);
+          })
+        ).pipe(Effect.zipRight(checkWriteBuffer));
+
+      // Chunks waiting to be sent as one append. While the send buffer backs
+      // up, they are batched up to MAX_APPEND_BATCH_MS even without
+      // OPENAI_APPEND_BATCH_MS, so a slow connection has fewer, larger
+      // messages to get through.
+      let batch = Buffer.allocUnsafe(0);
+      let batchLength = 0;
+      let backlogged = false;
+
+      const flushBatch = Effect.suspend(() => {
+        if (batchLength === 0) return Effect.void;
+        const pcm = batch.subarray(0, batchLength);
+        batchLength = 0;
+        return sendAppend(pcm);
+      });
+
+      const dropBatch = Effect.sync(() => {
+        batchLength = 0;
+      });
+
+      const checkBacklog = Effect.gen(function* () {
+        const limit = Math.ceil(
+          (inputSpec.bytesPerSecond * BATCH_BACKLOG_SECONDS * 4) / 3
+        );
+        const now = (ws?.bufferedAmount ?? 0) > limit;
+        if (now === backlogged) return;
+        backlogged = now;
+        yield* Effect.log(
+          now
+            ? `OpenAI connection backed up, batching appends up to ${MAX_APPEND_BATCH_MS}ms`
+            : "OpenAI connection caught up"
+        );
+      });
+
+      const appendAudio = (pcm: Uint8Array) =>
+        Effect.gen(function* () {
+          yield* checkBacklog;
+          const batchMs = backlogged ? MAX_APPEND_BATCH_MS : appendBatchMs;
+          if (batchMs === 0) return yield* sendAppend(pcm);
+          // Copied, as the chunk goes back to its pool once appended.
+          if (batch.length < batchLength + pcm.length) {
+            const grown = Buffer.allocUnsafe(
+              Math.max(batch.length * 2, batchLength + pcm.length)
+            );
+            batch.copy(grown, 0, 0, batchLength);
+            batch = grown;
+          }
+          batch.set(pcm, batchLength);
+          batchLength += pcm.length;
+          if (batchLength >= (inputSpec.bytesPerSecond * batchMs) / 1000) {
+            yield* flushBatch;
+          }
+        });
+
+      // One-off response over inline input, outside the live window, whose
+      // text is returned instead of broadcast.
+      const respondInline = (
+        instructions: string,
+        content:
+          | { type: "input_audio"; audio: string }
+          | { type: "input_text"; text: string }
+      ) =>
+        Effect.gen(function* () {
+          if (!(yield* governor.tryAcquire)) {
+            return yield* new ClipResponseError({
+              message: "Request budget exhausted or circuit open",
+            });
+          }
+          const id = crypto.randomUUID();
+          const deferred = yield* Deferred.make<string, ClipResponseError>();
+          yield* Ref.update(clips, HashMap.set(id, deferred));
+          yield* send({
+            type: "response.create",
+            response: {
+              conversation: "none",
+              instructions,
+              metadata: { clip: id },
+              input: [{ type: "message", role: "user", content: [content] }],
+            },
+          });
+          return yield* Deferred.await(deferred).pipe(
+            Effect.timeoutFail({
+              duration: "2 minutes",
+              onTimeout: () =>
+                new ClipResponseError({ message: "No response in time" }),
+            }),
+            Effect.ensuring(
+              Ref.update(clips, (all) =>
+                HashMap.filter(all, (d) => d !== deferred)
+              )
+            )
+          );
+        });
+
+      const respondToClip = (instructions: string, audio: Uint8Array) =>
+        respondInline(instructions, {
+          type: "input_audio",
+          audio: Buffer.from(audio).toString("base64"),
+        });
+
+      // A connection of its own that runs one clip response at a time, so
+      // several clips can be worked on side by side without holding up the
+      // live session. Closed with the scope. A replayed session only has the
+      // recorded connection, so its clips go through that one.
+      const openClipConnection = Effect.gen(function* () {
+        if (isReplaying(devReplay)) return respondToClip;
+        // For the input format the live session negotiated.
+        yield* session;
+        const clipQueue = yield* Queue.unbounded<ServerEvent>();
+        const current = yield* Ref.make(
+          Option.none<Deferred.Deferred<string, ClipResponseError>>()
+        );
+        const settle = (result: Effect.Effect<string, ClipResponseError>) =>
+          Ref.getAndSet(current, Option.none()).pipe(
+            Effect.flatMap(
+              Option.match({
+                onNone: () => Effect.void,
+                onSome: (deferred) => Deferred.complete(deferred, result),
+              })
+            )
+          );
+        const clipWs = yield* Effect.acquireRelease(
+          connectWithRetry,
+          (socket) =>
+            Effect.sync(() => socket.close()).pipe(
+              Effect.zipRight(Queue.shutdown(clipQueue))
+            )
+        ).pipe(
+          Effect.mapError(
+            () => new ClipResponseError({ message: "Could not connect" })
+          )
+        );
+        clipWs.addEventListener("message", (e) => {
+          try {
+            Queue.unsafeOffer(clipQueue, JSON.parse(e.data as string));
+          } catch (err) {
+            console.error("Failed to parse OpenAI WebSocket message:", err);
+          }
+        });
+        clipWs.addEventListener("close", () => {
+          Effect.runFork(Queue.shutdown(clipQueue));
+        });
+        const clipSend = (msg: object) =>
+          Effect.sync(() => clipWs.send(JSON.stringify(msg)));
+        yield* clipSend(
+          makeSessionUpdate(model, prompt, inputSpec, "text", voice, null, null)
+        );
+        yield* Stream.fromQueue(clipQueue).pipe(
+          Stream.runForEach((msg) =>
+            Effect.gen(function* () {
+              if (msg.type === "response.done") {
+                if (msg.response.status === "completed") {
+                  yield* settle(Effect.succeed(outputText(msg.response)));
+                  yield* governor.recordSuccess;
+                } else {
+                  yield* settle(
+                    new ClipResponseError({
+                      message: `Response ${msg.response.status}`,
+                    })
+                  );
+                  if (msg.response.status === "failed") {
+                    yield* governor.recordFailure;
+                  }
+                }
+              } else if (msg.type === "error") {
+                yield* Effect.logError(`OpenAI error: ${msg.error.message}`);
+                yield* settle(
+                  new ClipResponseError({ message: msg.error.message })
+                );
+              }
+            })
+          ),
+          Effect.ensuring(
+            settle(new ClipResponseError({ message: "Connection closed" }))
+          ),
+          Effect.forkScoped
+        );
+
+        return (instructions: string, audio: Uint8Array) =>
+          Effect.gen(function* () {
+            if (!(yield* governor.tryAcquire)) {
+              return yield* new ClipResponseError({
+                message: "Request budget exhausted or circuit open",
+              });
+            }
+            const deferred = yield* Deferred.make<string, ClipResponseError>();
+            yield* Ref.set(current, Option.some(deferred));
+            yield* clipSend({
+              type: "response.create",
+              response: {
+                conversation: "none",
+                instructions,
+                input: [
+                  {
+                    type: "message",
+                    role: "user",
+                    content: [
+                      {
+                        type: "input_audio",
+                        audio: Buffer.from(audio).toString("base64"),
+                      },
+                    ],
+                  },
+                ],
+              },
+            });
+            return yield* Deferred.await(deferred).pipe(
+              Effect.timeoutFail({
+                duration: "2 minutes",
+                onTimeout: () =>
+                  new ClipResponseError({ message: "No response in time" }),
+              }),
+              Effect.ensuring(Ref.set(current, Option.none()))
+            );
+          });
+      });
+
+      // Otherwise the first audio sent waits for the connection.
+      if (warmup) yield* session;
+
+      // Responses running, and commits waiting to start theirs or for their
+      // transcript.
+      const inFlight = Effect.gen(function* () {
+        const running =
+          HashMap.size(yield* Ref.get(responses)) +
+          HashMap.size(yield* Ref.get(comparisons)) +
+          HashMap.size(yield* Ref.get(clips));
+        const waiting =
+          (yield* Ref.get(pendingCommits)).filter(
+            (commit) => commit.request !== null
+          ).length + (yield* Ref.get(awaitingTranscripts));
+        return { running, waiting };
+      });
 
       return {
-        appendAudio: (base64: string) =>
-          send({ type: "input_audio_buffer.append", audio: base64 }),
-        commitBuffer: () => send({ type: "input_audio_buffer.commit" }),
-        requestResponse: () => send({ type: "response.create" }),
-        subscribe: PubSub.subscribe(broadcastPubSub),
+        appendAudio,
+        // The source and offset label the commit's transcript, if any.
+        commitBuffer: (commit: {
+          source: AudioSourceId;
+          audioOffsetMs: number;
+        }) => sendCommit({ ...commit, request: null }),
+        // Commits the buffer and, once acknowledged, runs every task over the
+        // audio committed since the previous request. The request's source
+        // and offset are echoed on every message of the resulting responses.
+        requestResponse: (request: ResponseRequest) =>
+          sendCommit({
+            source: request.source,
+            audioOffsetMs: request.audioOffsetMs,
+            request,
+          }),
+        // Drops everything appended or committed since the last response
+        // request, both locally and on the server.
+        clearBuffer: () =>
+          Ref.set(pendingCommits, []).pipe(
+            Effect.zipRight(dropBatch),
+            Effect.zipRight(Ref.set(windowItems, [])),
+            Effect.zipRight(Ref.set(transcripts, HashMap.empty())),
+            Effect.zipRight(clearJournal),
+            Effect.zipRight(dropHeldAudio),
+            Effect.zipRight(send({ type: "input_audio_buffer.clear" }))
+          ),
+        // Runs a one-off response over clips of several sources sent inline,
+        // published as a "comparison" message once complete.
+        compareSources: (
+          instructions: string,
+          clips: ReadonlyArray<ComparisonClip>
+        ) =>
+          Effect.gen(function* () {
+            if (!(yield* governor.tryAcquire)) {
+              return yield* Effect.logWarning(
+                "Skipping comparison: request budget exhausted or circuit open"
+              );
+            }
+            yield* send({
+              type: "response.create",
+              response: {
+                conversation: "none",
+                instructions,
+                metadata: {
+                  comparison: clips.map((clip) => clip.source).join(","),
+                },
+                input: [
+                  {
+                    type: "message",
+                    role: "user",
+                    content: clips.flatMap((clip) => [
+                      { type: "input_text", text: `Extrait de ${clip.name} :` },
+                      {
+                        type: "input_audio",
+                        audio: Buffer.from(clip.audio).toString("base64"),
+                      },
+                    ]),
+                  },
+                ],
+              },
+            });
+          }),
+        // Runs a one-off response of the task with other instructions, over
+        // the last window's audio and whatever was committed since, streamed
+        // like the task's own responses. Returns the response id once OpenAI
+        // has created it.
+        respondWith: (task: TaskId, instructions: string) =>
+          Effect.gen(function* () {
+            const last = yield* Ref.get(lastWindow);
+            const items = [
+              ...(last?.items ?? []),
+              ...(yield* Ref.get(windowItems)),
+            ];
+            if (items.length === 0) return yield* new NoBufferedAudioError();
+            if (!(yield* governor.tryAcquire)) {
+              return yield* new CustomResponseError({
+                message: "Request budget exhausted or circuit open",
+              });
+            }
+            const remembered =
+              task === "commentary"
+                ? yield* memoryFor(last?.request.source ?? null)
+                : [];
+            const id = crypto.randomUUID();
+            const deferred = yield* Deferred.make<string>();
+            yield* Ref.update(requested, HashMap.set(id, deferred));
+            const message = {
+              type: "response.create",
+              response: {
+                conversation: "none",
+                instructions,
+                metadata: {
+                  task,
+                  request: id,
+                  ...(last && {
+                    source: last.request.source,
+                    audio_offset_ms: String(last.request.audioOffsetMs),
+                    ...windowMetadata(last.request),
+                    ...(last.request.program && {
+                      program: last.request.program.slice(0, 512),
+                    }),
+                  }),
+                },
+                input: [...remembered, ...items].map((itemId) => ({
+                  type: "item_reference",
+                  id: itemId,
+                })),
+              },
+            };
+            journal?.response(message);
+            yield* send(message);
+            return yield* Deferred.await(deferred).pipe(
+              Effect.timeoutFail({
+                duration: "30 seconds",
+                onTimeout: () =>
+                  new CustomResponseError({
+                    message: "OpenAI did not start the response",
+                  }),
+              }),
+              Effect.ensuring(Ref.update(requested, HashMap.remove(id)))
+            );
+          }),
+        // Answers a listener's question from the last windows' audio and
+        // the source's commentary memory, streamed as answer_delta and answer
+        // messages. Returns the question's id, which they carry, and the
+        // response id once OpenAI has created it.
+        ask: (question: string) =>
+          Effect.gen(function* () {
+            const windows = yield* Ref.get(recentItems);
+            const items = [...windows.flat(), ...(yield* Ref.get(windowItems))];
+            if (items.length === 0) return yield* new NoBufferedAudioError();
+            if (!(yield* governor.tryAcquire)) {
+              return yield* new CustomResponseError({
+                message: "Request budget exhausted or circuit open",
+              });
+            }
+            const source = (yield* Ref.get(lastWindow))?.request.source ?? null;
+            const remembered = (yield* Ref.get(memory))
+              .filter((item) => item.source === source)
+              .map((item) => item.id);
+            const id = `ask_${crypto.randomUUID().slice(0, 8)}`;
+            const started = yield* Deferred.make<string>();
+            yield* Ref.update(askStarts, HashMap.set(id, started));
+            yield* Ref.update(
+              asks,
+              HashMap.set(id, {
+                id,
+                question,
+                source,
+                postProcessing: (yield* appConfig.get).postProcessing,
+                text: INITIAL_POST_PROCESSING,
+                published: "",
+                deltas: 0,
+              })
+            );
+            const message = {
+              type: "response.create",
+              response: {
+                conversation: "none",
+                instructions: ASK_INSTRUCTIONS,
+                metadata: { ask: id },
+                input: [
+                  ...[...remembered, ...items].map((itemId) => ({
+                    type: "item_reference",
+                    id: itemId,
+                  })),
+                  {
+                    type: "message",
+                    role: "user",
+                    content: [{ type: "input_text", text: question }],
+                  },
+                ],
+              },
+            };
+            journal?.response(message);
+            yield* send(message);
+            const responseId = yield* Deferred.await(started).pipe(
+              Effect.timeoutFail({
+                duration: "30 seconds",
+                onTimeout: () =>
+                  new CustomResponseError({
+                    message: "OpenAI did not start the response",
+                  }),
+              }),
+              Effect.tapError(() => Ref.update(asks, HashMap.remove(id))),
+              Effect.ensuring(Ref.update(askStarts, HashMap.remove(id)))
+            );
+            return { askId: id, responseId };
+          }),
+        // Runs a one-off response over audio sent inline.
+        respondToClip,
+        // Opens a connection for clips alone and returns its respondToClip,
+        // which must not be called again before the previous call ends.
+        openClipConnection,
+        // Same, over text, e.g. to classify a finished response.
+        respondToText: (instructions: string, text: string) =>
+          respondInline(instructions, { type: "input_text", text }),
+        // Cancels every response still in progress and drops uncommitted
+        // audio, e.g. when the listener switches stations.
+        cancelResponses: () =>
+          Effect.gen(function* () {
+            const active = yield* Ref.modify(responses, (infos) => {
+              const ids = HashMap.keys(
+                HashMap.filter(infos, (info) => !info.cancelled)
+              );
+              return [
+                Array.from(ids),
+                HashMap.map(infos, (info) => ({ ...info, cancelled: true })),
+              ];
+            });
+            yield* Effect.forEach(active, (id) =>
+              send({ type: "response.cancel", response_id: id })
+            );
+            yield* Ref.set(pendingCommits, []);
+            yield* dropBatch;
+            yield* Ref.set(windowItems, []);
+            yield* Ref.set(recentItems, []);
+            yield* Ref.set(transcripts, HashMap.empty());
+            yield* Ref.update(cancellations, (n) => n + 1);
+            yield* clearJournal;
+            yield* dropHeldAudio;
+            if (ws !== null) yield* send({ type: "input_audio_buffer.clear" });
+            if (active.length > 0) {
+              yield* Effect.log(`Cancelled ${active.length} response(s)`);
+            }
+          }),
+        // Runs each variant's commentary over the next `windows` windows.
+        // Replaces any experiment still running.
+        startExperiment: (
+          id: string,
+          variants: ReadonlyArray<ExperimentVariant>,
+          windows: number
+        ) =>
+          Ref.set(
+            experiment,
+            Option.some({ id, variants, remaining: windows })
+          ).pipe(
+            Effect.zipRight(
+              Effect.log(
+                `Experiment ${id} started: ${variants.length} variants over ${windows} windows`
+              )
+            )
+          ),
+        getExperiment: Ref.get(experiment),
+        stopExperiment: Ref.getAndSet(experiment, Option.none()),
+        // Steers the commentary of the next windows until `durationMs` has
+        // passed, without resetting the session. Replaces any nudge in
+        // effect.
+        nudge: (text: string, durationMs: number) =>
+          Effect.gen(function* () {
+            yield* clearNudge;
+            const next: Nudge = {
+              itemId: nudgeItemId(),
+              text,
+              expiresAt: (yield* Clock.currentTimeMillis) + durationMs,
+            };
+            yield* send(nudgeMessage(next));
+            yield* Ref.set(nudge, Option.some(next));
+            yield* Effect.log(`Nudge for ${durationMs / 60_000} min: ${text}`);
+            return next;
+          }),
+        getNudge: activeNudge,
+        clearNudge,
+        // Forgets the source's earlier commentary once `program` has ended,
+        // so the next show starts from a fresh context.
+        endProgram: (source: AudioSourceId, program: string) =>
+          Effect.gen(function* () {
+            yield* Ref.update(endedPrograms, HashMap.set(source, program));
+            const forgotten = yield* Ref.modify(memory, (items) => [
+              items.filter((item) => item.source === source),
+              items.filter((item) => item.source !== source),
+            ]);
+            yield* Effect.forEach(forgotten, (item) =>
+              send({ type: "conversation.item.delete", item_id: item.id })
+            );
+          }),
+        setInstructions: (text: string) =>
+          Ref.getAndSet(instructions, text).pipe(
+            // A session not yet opened starts with them.
+            Effect.flatMap((previous) =>
+              previous === text || ws === null
+                ? Effect.void
+                : send({
+                    type: "session.update",
+                    session: { type: "realtime", instructions: text },
+                  }).pipe(
+                    Effect.zipRight(Effect.log("Session instructions updated"))
+                  )
+            )
+          ),
+        setNoiseReduction: (type: NoiseReduction | null) =>
+          Ref.getAndSet(noiseReduction, type).pipe(
+            Effect.flatMap((previous) =>
+              previous === type || ws === null
+                ? Effect.void
+                : send({
+                    type: "session.update",
+                    session: {
+                      type: "realtime",
+                      audio: {
+                        input: { noise_reduction: noiseReductionOf(type) },
+                      },
+                    },
+                  }).pipe(
+                    Effect.zipRight(
+                      Effect.log(`Noise reduction set to ${type ?? "off"}`)
+                    )
+                  )
+            )
+          ),
+        inFlight,
+        // Completes once no response is running or waiting on its commit,
+        // e.g. to let them finish before shutting down.
+        awaitIdle: inFlight.pipe(
+          Effect.map(({ running, waiting }) => running + waiting === 0),
+          Effect.repeat({
+            schedule: Schedule.spaced("100 millis"),
+            until: (idle) => idle,
+          }),
+          Effect.asVoid
+        ),
+        // Failures of the source's commits and window responses so far.
+        windowFailures: (source: AudioSourceId) =>
+          Ref.get(windowFailures).pipe(
+            Effect.map((all) =>
+              Option.getOrElse(HashMap.get(all, source), () => 0)
+            )
+          ),
+        // Null without OPENAI_JOURNAL, or before the first session.
+        journal: Effect.sync(() =>
+          journal === null
+            ? null
+            : {
+                path: journal.path,
+                recovered: recovered?.summary ?? null,
+                current: journal.summary(),
+                entries: journal.entries(),
+              }
+        ),
+        // Null unless OPENAI_DRY_RUN is set.
+        dryRun:
+          dryRun === null
+            ? Effect.succeed(null)
+            : Effect.sync(() => dryRun.estimate()),
+        // True while the circuit breaker holds requests back.
+        paused: governor.isOpen,
+        // Negotiated format and rate appendAudio expects; byte counts of the
+        // audio sent must use its bytesPerSecond. Opens the session if it
+        // isn't yet.
+        inputSpec: Effect.map(session, () => inputSpec),
+        // Whether the session is open, and the standby kept with
+        // OPENAI_WARMUP.
+        connection: Effect.gen(function* () {
+          const now = yield* Clock.currentTimeMillis;
+          return {
+            warmup,
+            state:
+              ws !== null
+                ? ("open" as const)
+                : connecting
+                  ? ("connecting" as const)
+                  : ("not_connected" as const),
+            sessionAgeMs: ws === null ? null : now - sessionStartedAt,
+            standby: standby?.socket.readyState === WebSocket.OPEN,
+          };
+        }),
+        outputModality,
+        // Spoken commentary, only produced when the output modality is audio.
+        subscribeSpeech: PubSub.subscribe(speechPubSub),
       } as const;
     }),
   }
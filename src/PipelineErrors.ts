@@ -0,0 +1,140 @@
+import {
+  HttpClient,
+  HttpClientRequest,
+  HttpClientResponse,
+} from "@effect/platform";
+import { Config, Effect, Layer, Option, Schema } from "effect";
+import { AppConfig } from "./AppConfig.js";
+import { PipelineEvents } from "./PipelineEvents.js";
+
+export const ErrorCode = Schema.Literal(
+  "openai_rate_limit",
+  "openai_auth",
+  "openai_error",
+  "response_timeout",
+  "ffmpeg_exit",
+  "source_unreachable",
+  "write_queue_full",
+  "transcription_failed",
+  "internal"
+).annotations({
+  title: "Error Code",
+  description: "Kind of failure, for clients to react to",
+});
+
+export type ErrorCode = typeof ErrorCode.Type;
+
+// Whether the pipeline gets over each kind of error by itself. A rejected
+// API key stays rejected until someone replaces it.
+const RETRYABLE: Record<ErrorCode, boolean> = {
+  openai_rate_limit: true,
+  openai_auth: false,
+  openai_error: true,
+  response_timeout: true,
+  ffmpeg_exit: true,
+  source_unreachable: true,
+  write_queue_full: true,
+  transcription_failed: true,
+  internal: true,
+};
+
+export interface PipelineError {
+  readonly code: ErrorCode;
+  // Details for people; clients should match on the code.
+  readonly message: string;
+  // Source being processed; null for errors not tied to one.
+  readonly source: string | null;
+  readonly retryable: boolean;
+  // When the failed work is tried again, if known.
+  readonly retryInMs: number | null;
+  // Response the error is about, if any.
+  readonly responseId?: string;
+}
+
+export const pipelineError = (
+  code: ErrorCode,
+  message: string,
+  options: {
+    source?: string | null;
+    retryInMs?: number | null;
+    responseId?: string;
+  } = {}
+): PipelineError => ({
+  code,
+  message,
+  source: options.source ?? null,
+  retryable: RETRYABLE[code],
+  retryInMs: options.retryInMs ?? null,
+  ...(options.responseId !== undefined && { responseId: options.responseId }),
+});
+
+// OpenAI says how long to wait in the text of a rate limit error, e.g.
+// "Please try again in 1.5s" or "in 820ms".
+const retryDelayMs = (message: string) => {
+  const match = /try again in (\d+(?:\.\d+)?)\s*(ms|s)\b/i.exec(message);
+  if (!match) return null;
+  const value = Number.parseFloat(match[1]!);
+  return Math.ceil(match[2] === "ms" ? value : value * 1000);
+};
+
+// Classifies an error event of the Realtime API.
+export const openaiError = (error: {
+  message: string;
+  code?: string | null;
+  type?: string | null;
+}) => {
+  if (
+    error.code === "rate_limit_exceeded" ||
+    error.type === "rate_limit_error"
+  ) {
+    return pipelineError("openai_rate_limit", error.message, {
+      retryInMs: retryDelayMs(error.message),
+    });
+  }
+  if (
+    error.code === "invalid_api_key" ||
+    error.type === "authentication_error" ||
+    error.type === "permission_error"
+  ) {
+    return pipelineError("openai_auth", error.message);
+  }
+  return pipelineError("openai_error", error.message);
+};
+
+// Posts every pipeline error to the config's `webhooks.errors`, or
+// ERROR_WEBHOOK_URL, as JSON, so alerting can page on what won't recover by
+// itself (retryable: false) and let the rest be. Off unless a URL is set.
+export const ErrorWebhookLive = Layer.scopedDiscard(
+  Effect.gen(function* () {
+    const envUrl = yield* Config.option(Config.string("ERROR_WEBHOOK_URL"));
+    const appConfig = yield* AppConfig;
+    const client = yield* HttpClient.HttpClient;
+    const events = yield* PipelineEvents;
+    yield* events.on("Error", (error) =>
+      Effect.gen(function* () {
+        const { webhooks } = yield* appConfig.get;
+        const url = Option.orElse(
+          Option.fromNullable(webhooks.errors),
+          () => envUrl
+        );
+        if (Option.isNone(url)) return;
+        yield* HttpClientRequest.post(url.value).pipe(
+          HttpClientRequest.bodyUnsafeJson({
+            event: "error",
+            code: error.code,
+            message: error.message,
+            source: error.source,
+            retryable: error.retryable,
+            retryInMs: error.retryInMs,
+          }),
+          (request) => client.execute(request),
+          Effect.flatMap(HttpClientResponse.filterStatusOk),
+          Effect.timeout("5 seconds"),
+          Effect.catchAllCause((cause) =>
+            Effect.logWarning("Error webhook failed", cause)
+          )
+        );
+      })
+    );
+  })
+);
@@ -0,0 +1,102 @@
+import { Data, Effect, PubSub, Stream } from "effect";
+import type { AudioSourceId } from "./AudioSource.js";
+import type { ChunkCorruption } from "./ChunkIntegrity.js";
+import type { PipelineError } from "./PipelineErrors.js";
+import type { TaskId } from "./Tasks.js";
+
+// What happens inside the pipeline, as opposed to the BroadcastMessages sent
+// to clients. Internal and unversioned: fields may change freely.
+export type PipelineEvent = Data.TaggedEnum<{
+  // A processing run started on the source.
+  SourceSelected: { readonly source: AudioSourceId };
+  // A chunk of decoded audio was read, paused or not.
+  // `dropped` chunks were lost just before this one, and `queued` were read
+  // after it and still waiting, out of the `queueCapacity` kept.
+  ChunkProduced: {
+    readonly source: AudioSourceId;
+    readonly bytes: number;
+    readonly dropped: number;
+    readonly queued: number;
+    readonly queueCapacity: number;
+  };
+  // A chunk was found broken and realigned, or dropped on a bad checksum.
+  ChunkCorrupted: {
+    readonly source: AudioSourceId;
+    readonly kind: ChunkCorruption;
+  };
+  ResponseStarted: {
+    readonly responseId: string;
+    readonly task: TaskId;
+    readonly source: string | null;
+  };
+  // A response was published as complete; cancelled ones never are.
+  // `windowStart` and `windowEnd` are when its window's first and last audio
+  // went out on air, if known.
+  ResponseCompleted: {
+    readonly responseId: string;
+    readonly task: TaskId;
+    readonly source: string | null;
+    readonly program: string | null;
+    readonly text: string;
+    readonly durationMs: number;
+    readonly windowStart: number | null;
+    readonly windowEnd: number | null;
+  };
+  // OpenAI's count of the tokens a response over the source's audio used.
+  ResponseUsage: {
+    readonly source: AudioSourceId;
+    readonly audioTokens: number;
+    readonly textTokens: number;
+    readonly outputTokens: number;
+  };
+  // Pipeline failures carry their source; OpenAI errors have none.
+  Error: PipelineError;
+}>;
+
+export const PipelineEvent = Data.taggedEnum<PipelineEvent>();
+
+export type EventOf<Tag extends PipelineEvent["_tag"]> = Extract<
+  PipelineEvent,
+  { readonly _tag: Tag }
+>;
+
+// In-process bus the pipeline modules publish to, so features like stats,
+// alerts or persistence can attach to the pipeline without the modules
+// knowing about them.
+export class PipelineEvents extends Effect.Service<PipelineEvents>()(
+  "PipelineEvents",
+  {
+    scoped: Effect.gen(function* () {
+      const pubsub = yield* Effect.acquireRelease(
+        PubSub.unbounded<PipelineEvent>(),
+        PubSub.shutdown
+      );
+
+      return {
+        publish: (event: PipelineEvent) =>
+          PubSub.publish(pubsub, event).pipe(Effect.asVoid),
+        // Runs `f` on every event with the tag, in order, until the caller's
+        // scope closes. Subscribes right away, so nothing published after
+        // this returns is missed; a failing handler is logged and skipped.
+        on: <Tag extends PipelineEvent["_tag"]>(
+          tag: Tag,
+          f: (event: EventOf<Tag>) => Effect.Effect<void>
+        ) =>
+          Effect.gen(function* () {
+            const subscription = yield* PubSub.subscribe(pubsub);
+            yield* Stream.fromQueue(subscription).pipe(
+              Stream.filter(PipelineEvent.$is(tag)),
+              Stream.runForEach((event) =>
+                f(event as EventOf<Tag>).pipe(
+                  Effect.catchAllCause((cause) =>
+                    Effect.logWarning(`${tag} handler failed`, cause)
+                  )
+                )
+              ),
+              Effect.forkScoped
+            );
+          }),
+      } as const;
+    }),
+  }
+) {}
@@ -0,0 +1,130 @@
+import { Cause, Clock, Effect, HashMap, Ref } from "effect";
+
+export interface ComponentStatus {
+  readonly name: string;
+  readonly running: boolean;
+  readonly restarts: number;
+  readonly lastCrash: {
+    readonly at: number;
+    readonly message: string;
+    // True for defects (thrown exceptions, bugs) rather than failures.
+    readonly defect: boolean;
+  } | null;
+}
+
+const BASE_BACKOFF_MS = 1_000;
+const MAX_BACKOFF_MS = 60_000;
+// A component that ran this long before crashing starts over from the base
+// delay.
+const HEALTHY_MS = 60_000;
+
+// Keeps the long-running loops of the pipeline alive. A supervised component
+// that fails or dies is logged with a crash report, restarted after an
+// exponential backoff (1s doubling up to 1min) and counted, for
+// GET /debug/pipeline. Without it a defect in, say, the OpenAI message loop
+// would end its fiber and stop the output while the HTTP server kept
+// serving. Interruption stops a component for good.
+export class PipelineSupervisor extends Effect.Service<PipelineSupervisor>()(
+  "PipelineSupervisor",
+  {
+    effect: Effect.gen(function* () {
+      const components = yield* Ref.make(
+        HashMap.empty<string, ComponentStatus>()
+      );
+
+      const update = (
+        name: string,
+        f: (s: ComponentStatus) => ComponentStatus
+      ) => Ref.update(components, HashMap.modify(name, f));
+
+      const crashed = (
+        name: string,
+        cause: Cause.Cause<unknown>,
+        startedAt: number,
+        consecutive: Ref.Ref<number>
+      ) =>
+        Effect.gen(function* () {
+          const now = yield* Clock.currentTimeMillis;
+          if (now - startedAt >= HEALTHY_MS) yield* Ref.set(consecutive, 0);
+          const attempt = yield* Ref.updateAndGet(consecutive, (n) => n + 1);
+          const delay = Math.min(
+            BASE_BACKOFF_MS * 2 ** (attempt - 1),
+            MAX_BACKOFF_MS
+          );
+          const error = Cause.squash(cause);
+          const defect = Cause.isDie(cause);
+          yield* update(name, (s) => ({
+            ...s,
+            restarts: s.restarts + 1,
+            lastCrash: {
+              at: now,
+              message: error instanceof Error ? error.message : String(error),
+              defect,
+            },
+          }));
+          yield* Effect.logError(
+            `${name} ${defect ? "crashed" : "failed"}, restarting in ${delay}ms`,
+            cause
+          ).pipe(
+            Effect.annotateLogs({
+              component: name,
+              attempt,
+              uptimeMs: now - startedAt,
+              defect,
+            })
+          );
+          yield* Effect.sleep(delay);
+        });
+
+      return {
+        // Runs the component, restarting it whenever it fails or dies.
+        // Completes when the component does. Counts carry over when a
+        // component of the same name is supervised again, e.g. after a
+        // reconnection.
+        supervise: <A, E, R>(name: string, component: Effect.Effect<A, E, R>) =>
+          Effect.gen(function* () {
+            yield* Ref.update(components, (all) =>
+              HashMap.has(all, name)
+                ? all
+                : HashMap.set(all, name, {
+                    name,
+                    running: false,
+                    restarts: 0,
+                    lastCrash: null,
+                  })
+            );
+            const consecutive = yield* Ref.make(0);
+            const run = Effect.gen(function* () {
+              const startedAt = yield* Clock.currentTimeMillis;
+              yield* update(name, (s) => ({ ...s, running: true }));
+              return yield* component.pipe(
+                Effect.ensuring(
+                  update(name, (s) => ({ ...s, running: false }))
+                ),
+                Effect.tapErrorCause((cause) =>
+                  Cause.isInterruptedOnly(cause)
+                    ? Effect.void
+                    : crashed(name, cause, startedAt, consecutive)
+                )
+              );
+            });
+            return yield* run.pipe(
+              Effect.sandbox,
+              Effect.retry({
+                while: (cause) => !Cause.isInterruptedOnly(cause),
+              }),
+              Effect.unsandbox
+            );
+          }),
+        // Every component supervised so far, by name.
+        status: Ref.get(components).pipe(
+          Effect.map((all) =>
+            Array.from(HashMap.values(all)).sort((a, b) =>
+              a.name.localeCompare(b.name)
+            )
+          )
+        ),
+      } as const;
+    }),
+  }
+) {}
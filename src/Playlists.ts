@@ -0,0 +1,193 @@
+import { Clock, Data, Effect, Fiber, Option, Ref } from "effect";
+import { AppConfig, type PlaylistConfig } from "./AppConfig.js";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+
+export interface RunningPlaylist {
+  readonly playlist: string;
+  readonly source: AudioSourceId;
+  // Position of the source in the playlist.
+  readonly index: number;
+  readonly startedAt: number;
+  readonly nextAt: number;
+}
+
+export class NoPlayableSourceError extends Data.TaggedError(
+  "NoPlayableSourceError"
+)<{ playlist: string }> {}
+
+// Channel surfing: a playlist from the config file selects each of its
+// sources in turn, for its `minutes` each, on behalf of whoever started it.
+// Between two sources the processor responds to the window in progress and
+// those responses are left to finish, as at the end of a listening session,
+// so the last minutes of a station are heard before the next one starts.
+// Sources that no longer exist are skipped. Each rotation is broadcast as a
+// playlist_rotated message. One playlist runs at a time; it stops at its next
+// rotation if the source was changed otherwise meanwhile or the playlist was
+// removed from the config.
+export class Playlists extends Effect.Service<Playlists>()("Playlists", {
+  scoped: Effect.gen(function* () {
+    const appConfig = yield* AppConfig;
+    const audioSource = yield* AudioSource;
+    const openai = yield* OpenAIRealtime;
+    const broadcaster = yield* Broadcaster;
+    const supervisor = yield* PipelineSupervisor;
+    const scope = yield* Effect.scope;
+    const current = yield* Ref.make(
+      Option.none<{
+        running: RunningPlaylist;
+        timer: Fiber.RuntimeFiber<void>;
+      }>()
+    );
+
+    const find = (id: string) =>
+      appConfig.get.pipe(
+        Effect.map((c) =>
+          Option.fromNullable(c.playlists.find((p) => p.id === id))
+        )
+      );
+
+    // The first source of the playlist from position `from` on that still
+    // exists, wrapping around.
+    const sourceFrom = (playlist: PlaylistConfig, from: number) =>
+      Effect.gen(function* () {
+        const count = playlist.sources.length;
+        for (let i = 0; i < count; i++) {
+          const index = (from + i) % count;
+          const source = playlist.sources[index]!;
+          if (Option.isSome(yield* audioSource.findSource(source))) {
+            return Option.some({ index, source });
+          }
+          yield* Effect.logWarning(
+            `Playlist ${playlist.id}: source ${source} no longer exists, skipped`
+          );
+        }
+        return Option.none<{ index: number; source: AudioSourceId }>();
+      });
+
+    // Selects the source once the responses to the last window of the one
+    // selected are done; returns the one left.
+    const rotate = (
+      playlist: PlaylistConfig,
+      next: { index: number; source: AudioSourceId },
+      by: string | null
+    ) =>
+      Effect.gen(function* () {
+        const from = Option.getOrNull(yield* audioSource.currentSource);
+        if (from !== null && from !== next.source) {
+          // The processor picks the flush up with its next chunk.
+          yield* audioSource.requestFlush;
+          yield* Effect.sleep("2 seconds");
+          yield* openai.awaitIdle.pipe(
+            Effect.timeout("30 seconds"),
+            Effect.ignore
+          );
+        }
+        yield* audioSource.setSource(next.source, "playlist", by);
+        const now = yield* Clock.currentTimeMillis;
+        const running: RunningPlaylist = {
+          playlist: playlist.id,
+          source: next.source,
+          index: next.index,
+          startedAt: now,
+          nextAt: now + playlist.minutes * 60_000,
+        };
+        yield* broadcaster.publish({
+          type: "playlist_rotated",
+          playlist: playlist.id,
+          from,
+          to: next.source,
+          index: next.index,
+          nextAt: running.nextAt,
+        });
+        yield* Effect.log(
+          `Playlist ${playlist.id} on ${next.source} for ${playlist.minutes} min`
+        );
+        return running;
+      });
+
+    const stopped = (running: RunningPlaylist, reason: string) =>
+      Ref.update(current, (slot) =>
+        Option.filter(slot, (s) => s.running.startedAt !== running.startedAt)
+      ).pipe(
+        Effect.zipRight(
+          Effect.log(`Playlist ${running.playlist} stopped: ${reason}`)
+        )
+      );
+
+    // Waits for each rotation in turn, until the playlist can't go on. A
+    // restart after a crash picks up from the last rotation made.
+    const schedule = (first: RunningPlaylist, by: string | null) =>
+      Effect.gen(function* () {
+        const latest = yield* Ref.make(first);
+        const nextRotation = Effect.gen(function* () {
+          const last = yield* Ref.get(latest);
+          const now = yield* Clock.currentTimeMillis;
+          yield* Effect.sleep(Math.max(last.nextAt - now, 0));
+          const playlist = yield* find(last.playlist);
+          if (Option.isNone(playlist)) {
+            yield* stopped(last, "removed from the config");
+            return false;
+          }
+          const selected = yield* audioSource.currentSource;
+          if (!Option.contains(selected, last.source)) {
+            yield* stopped(last, "source changed");
+            return false;
+          }
+          const next = yield* sourceFrom(playlist.value, last.index + 1);
+          if (Option.isNone(next)) {
+            yield* stopped(last, "no source left");
+            return false;
+          }
+          const running = yield* rotate(playlist.value, next.value, by);
+          yield* Ref.set(latest, running);
+          yield* Ref.update(current, (slot) =>
+            Option.map(slot, (s) => ({ ...s, running }))
+          );
+          return true;
+        });
+        yield* nextRotation.pipe(
+          Effect.repeat({ while: (more) => more }),
+          (loop) => supervisor.supervise("playlist", loop)
+        );
+      });
+
+    // Serialized so concurrent starts can't leave two playlists rotating.
+    const lock = yield* Effect.makeSemaphore(1);
+
+    const stop = Effect.gen(function* () {
+      const slot = yield* Ref.getAndSet(current, Option.none());
+      if (Option.isNone(slot)) return Option.none<RunningPlaylist>();
+      yield* Fiber.interrupt(slot.value.timer);
+      yield* Effect.log(`Playlist ${slot.value.running.playlist} stopped`);
+      return Option.some(slot.value.running);
+    });
+
+    return {
+      find,
+      current: Ref.get(current).pipe(
+        Effect.map(Option.map((slot) => slot.running))
+      ),
+      // Selects the playlist's first source on behalf of `by` and schedules
+      // the rotations, replacing any playlist running.
+      start: (playlist: PlaylistConfig, by: string | null) =>
+        Effect.gen(function* () {
+          const first = yield* sourceFrom(playlist, 0);
+          if (Option.isNone(first)) {
+            return yield* new NoPlayableSourceError({ playlist: playlist.id });
+          }
+          yield* stop;
+          const running = yield* rotate(playlist, first.value, by);
+          const timer = yield* schedule(running, by).pipe(
+            Effect.forkIn(scope)
+          );
+          yield* Ref.set(current, Option.some({ running, timer }));
+          return running;
+        }).pipe(lock.withPermits(1)),
+      // Stops rotating; the source selected stays selected.
+      stop: lock.withPermits(1)(stop),
+    } as const;
+  }),
+}) {}
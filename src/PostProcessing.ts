@@ -0,0 +1,187 @@
+import { Schema } from "effect";
+
+// Processors applied, in order, to the text of responses before it is
+// broadcast and stored.
+export const PostProcessor = Schema.Union(
+  Schema.Struct({
+    type: Schema.Literal("profanity"),
+    words: Schema.optional(Schema.Array(Schema.NonEmptyString)).annotations({
+      description: "Words masked in addition to the built-in list",
+    }),
+  }).annotations({
+    title: "profanity",
+    description: "Masks swear words, keeping their first letter",
+  }),
+  Schema.Struct({ type: Schema.Literal("pii") }).annotations({
+    title: "pii",
+    description:
+      "Replaces email addresses, phone, card and IBAN numbers with placeholders",
+  }),
+  Schema.Struct({ type: Schema.Literal("markdown") }).annotations({
+    title: "markdown",
+    description:
+      "Strips Markdown markup (emphasis, headings, links, code) and turns list items into bullets",
+  }),
+  Schema.Struct({
+    type: Schema.Literal("truncate"),
+    maxLength: Schema.Int.pipe(Schema.positive()).annotations({
+      description: "Characters kept per response; the rest is replaced by …",
+    }),
+  }).annotations({
+    title: "truncate",
+    description: "Caps the length of each response; best placed last",
+  })
+).annotations({ title: "Post Processor" });
+
+export type PostProcessor = typeof PostProcessor.Type;
+
+const PROFANITY = [
+  "bordel",
+  "chier",
+  "con",
+  "conasse",
+  "connard",
+  "connasse",
+  "conne",
+  "couille",
+  "couilles",
+  "encule",
+  "enculé",
+  "enfoiré",
+  "foutre",
+  "merde",
+  "merdique",
+  "pute",
+  "putain",
+  "salaud",
+  "salope",
+  "bitch",
+  "fuck",
+  "fucking",
+  "shit",
+];
+
+const escapeRegExp = (text: string) =>
+  text.replace(/[.*+?^${}()|[\]\\]/g, "\\$&");
+
+const maskProfanity = (words: ReadonlyArray<string>) => {
+  const pattern = new RegExp(
+    `(?<![\\p{L}\\p{N}])(?:${[...PROFANITY, ...words]
+      .map(escapeRegExp)
+      .join("|")})(?![\\p{L}\\p{N}])`,
+    "giu"
+  );
+  return (text: string) =>
+    text.replace(pattern, (word) => word[0] + "*".repeat(word.length - 1));
+};
+
+// Checked in order: card and IBAN numbers before phone numbers, which would
+// otherwise match part of them.
+const PII: ReadonlyArray<readonly [RegExp, string]> = [
+  [/[\p{L}\p{N}._%+-]+@[\p{L}\p{N}.-]+\.\p{L}{2,}/gu, "[email]"],
+  [
+    /\b[A-Z]{2}\d{2}(?:[ ]?[A-Z0-9]{4}){3,7}(?:[ ]?[A-Z0-9]{1,3})?\b/g,
+    "[IBAN]",
+  ],
+  [/\b\d{4}(?:[ -]?\d{4}){2}[ -]?\d{1,7}\b/g, "[carte]"],
+  [/(?:\+33[ .-]?|\b0)[1-9](?:[ .-]?\d{2}){4}\b/g, "[téléphone]"],
+];
+
+const redactPii = (text: string) =>
+  PII.reduce(
+    (out, [pattern, placeholder]) => out.replace(pattern, placeholder),
+    text
+  );
+
+const stripMarkdown = (text: string) =>
+  text
+    .replace(/```[^\n]*\n?/g, "")
+    .replace(/`([^`\n]+)`/g, "$1")
+    .replace(/!?\[([^\]\n]*)\]\([^)\n]*\)/g, "$1")
+    .replace(/^[ \t]*#{1,6}[ \t]+/gm, "")
+    .replace(/^[ \t]*>[ \t]?/gm, "")
+    .replace(/^([ \t]*)[-*+][ \t]+/gm, "$1• ")
+    .replace(/(\*\*|__)(?=\S)([^\n]*?\S)\1/g, "$2")
+    .replace(
+      /(?<![\p{L}\p{N}*_])([*_])(?=\S)([^\n*_]*?\S)\1(?![\p{L}\p{N}*_])/gu,
+      "$2"
+    );
+
+// Applies the chain to a piece of a response; `emitted` is how many characters
+// of that response were already output, for truncation.
+export const applyPostProcessing = (
+  chain: ReadonlyArray<PostProcessor>,
+  text: string,
+  emitted = 0
+) =>
+  chain.reduce((out, processor) => {
+    switch (processor.type) {
+      case "profanity":
+        return maskProfanity(processor.words ?? [])(out);
+      case "pii":
+        return redactPii(out);
+      case "markdown":
+        return stripMarkdown(out);
+      case "truncate": {
+        const room = processor.maxLength - emitted;
+        if (room <= 0) return "";
+        return out.length > room ? `${out.slice(0, room)}…` : out;
+      }
+    }
+  }, text);
+
+// Streaming state of one response: text received but not yet output, and
+// characters output so far.
+export interface PostProcessingState {
+  readonly pending: string;
+  readonly emitted: number;
+}
+
+export const INITIAL_POST_PROCESSING: PostProcessingState = {
+  pending: "",
+  emitted: 0,
+};
+
+const output = (
+  chain: ReadonlyArray<PostProcessor>,
+  state: PostProcessingState,
+  text: string
+): readonly [string, PostProcessingState] => {
+  const out = applyPostProcessing(chain, text, state.emitted);
+  return [out, { ...state, emitted: state.emitted + out.length }];
+};
+
+// End of the last complete sentence or line, -1 if there is none.
+export const lastSentenceEnd = (text: string) => {
+  let end = -1;
+  for (const match of text.matchAll(/[.!?…](?=\s)|\n/g)) {
+    end = match.index + match[0].length;
+  }
+  return end;
+};
+
+// Feeds a delta through the chain, returning the text to output now. Without
+// processors deltas pass through untouched; otherwise they are held back until
+// a sentence or line ends, so processors never see a word or number cut in two.
+export const feedPostProcessing = (
+  chain: ReadonlyArray<PostProcessor>,
+  state: PostProcessingState,
+  delta: string
+): readonly [string, PostProcessingState] => {
+  if (chain.length === 0) return [delta, state];
+  const pending = state.pending + delta;
+  const end = lastSentenceEnd(pending);
+  if (end < 0) return ["", { ...state, pending }];
+  return output(
+    chain,
+    { ...state, pending: pending.slice(end) },
+    pending.slice(0, end)
+  );
+};
+
+// Outputs whatever is still held back, once the response is done.
+export const flushPostProcessing = (
+  chain: ReadonlyArray<PostProcessor>,
+  state: PostProcessingState
+): readonly [string, PostProcessingState] =>
+  output(chain, { ...state, pending: "" }, state.pending);
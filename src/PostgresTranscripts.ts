@@ -0,0 +1,552 @@
+import { SQL } from "bun";
+import { Effect, Redacted } from "effect";
+import type { AudioSourceId } from "./AudioSource.js";
+import { type Digest, encodeBroadcastJson } from "./Messages.js";
+import type { SpeakerSegment } from "./SpeakerSegments.js";
+import type { TaskId } from "./Tasks.js";
+import {
+  type CoverageDiff,
+  type EmbeddedChunk,
+  type FeedbackStats,
+  fromBlob,
+  fromBroadcastRows,
+  HIT_END,
+  HIT_START,
+  type ListenSession,
+  markSnippet,
+  type MetricsSnapshot,
+  type RepeatedSegment,
+  timelineBuckets,
+  toBlob,
+  type Transcript,
+  type TranscriptBackend,
+  TranscriptStoreError,
+} from "./TranscriptBackend.js";
+
+// Words are indexed as they are, like SQLite's unicode61 tokenizer, rather
+// than stemmed for one language.
+const SCHEMA = `
+CREATE TABLE IF NOT EXISTS transcripts (
+  id BIGSERIAL PRIMARY KEY,
+  response_id TEXT NOT NULL UNIQUE,
+  task TEXT NOT NULL,
+  source TEXT,
+  program TEXT,
+  text TEXT NOT NULL,
+  completed_at BIGINT NOT NULL,
+  window_start BIGINT,
+  window_end BIGINT,
+  segments JSONB NOT NULL DEFAULT '[]',
+  search TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', text)) STORED
+);
+CREATE INDEX IF NOT EXISTS transcripts_completed_at ON transcripts (completed_at);
+CREATE INDEX IF NOT EXISTS transcripts_search ON transcripts USING GIN (search);
+CREATE TABLE IF NOT EXISTS transcript_tags (
+  response_id TEXT PRIMARY KEY,
+  sentiment TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS transcript_topics (
+  response_id TEXT NOT NULL,
+  topic TEXT NOT NULL,
+  PRIMARY KEY (response_id, topic)
+);
+CREATE TABLE IF NOT EXISTS transcript_embeddings (
+  response_id TEXT NOT NULL,
+  model TEXT NOT NULL,
+  position INTEGER NOT NULL,
+  text TEXT NOT NULL,
+  vector BYTEA NOT NULL,
+  PRIMARY KEY (response_id, model, position)
+);
+CREATE TABLE IF NOT EXISTS transcript_feedback (
+  id BIGSERIAL PRIMARY KEY,
+  response_id TEXT NOT NULL,
+  rating SMALLINT NOT NULL,
+  comment TEXT,
+  created_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transcript_feedback_response ON transcript_feedback (response_id);
+CREATE TABLE IF NOT EXISTS broadcast_log (
+  key TEXT PRIMARY KEY,
+  at BIGINT NOT NULL,
+  json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS broadcast_log_at ON broadcast_log (at);
+CREATE TABLE IF NOT EXISTS repeated_segments (
+  id BIGSERIAL PRIMARY KEY,
+  fingerprint TEXT NOT NULL,
+  source TEXT NOT NULL,
+  started_at BIGINT,
+  ended_at BIGINT,
+  duration_ms INTEGER NOT NULL,
+  skipped BOOLEAN NOT NULL,
+  recorded_at BIGINT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS repeated_segments_recorded ON repeated_segments (recorded_at);
+CREATE TABLE IF NOT EXISTS listen_sessions (
+  id TEXT PRIMARY KEY,
+  source TEXT NOT NULL,
+  started_at BIGINT NOT NULL,
+  ended_at BIGINT NOT NULL,
+  reason TEXT NOT NULL,
+  responses INTEGER NOT NULL,
+  summary TEXT
+);
+CREATE TABLE IF NOT EXISTS coverage_diffs (
+  hour BIGINT PRIMARY KEY,
+  json TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS metrics_snapshots (
+  at BIGINT NOT NULL,
+  json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_snapshots_at ON metrics_snapshots (at);
+`;
+
+// ts_headline's options, wrapping hits in markSnippet's markers.
+const HEADLINE_OPTIONS = `StartSel=${HIT_START}, StopSel=${HIT_END}, MaxWords=16, MinWords=8`;
+
+// BIGINT columns and counts come back as strings.
+interface TranscriptRow {
+  readonly response_id: string;
+  readonly task: TaskId;
+  readonly source: AudioSourceId | null;
+  readonly program: string | null;
+  readonly text: string;
+  readonly completed_at: string;
+  readonly window_start: string | null;
+  readonly window_end: string | null;
+  readonly segments: ReadonlyArray<SpeakerSegment>;
+}
+
+const orNull = (value: string | null) =>
+  value === null ? null : Number(value);
+
+const fromRow = (row: TranscriptRow): Transcript => ({
+  responseId: row.response_id,
+  task: row.task,
+  source: row.source,
+  program: row.program,
+  text: row.text,
+  completedAt: Number(row.completed_at),
+  windowStart: orNull(row.window_start),
+  windowEnd: orNull(row.window_end),
+  segments: row.segments,
+});
+
+// Transcripts in PostgreSQL at `url`, for deployments that keep them in one
+// place for several instances or tools. Tables are created on first use.
+export const makePostgresTranscripts = (url: Redacted.Redacted) =>
+  Effect.gen(function* () {
+    const sql = yield* Effect.acquireRelease(
+      Effect.tryPromise({
+        try: async () => {
+          const sql = new SQL(Redacted.value(url));
+          await sql.unsafe(SCHEMA).simple();
+          return sql;
+        },
+        catch: (cause) => new TranscriptStoreError({ cause }),
+      }),
+      (sql) => Effect.promise(() => sql.close())
+    );
+
+    const use = <A>(f: (sql: SQL) => Promise<A>) =>
+      Effect.tryPromise({
+        try: () => f(sql),
+        catch: (cause) => new TranscriptStoreError({ cause }),
+      });
+
+    const columns = sql`response_id, task, source, program, text, completed_at,
+      window_start, window_end, segments`;
+
+    const transcripts = (f: (sql: SQL) => Promise<Array<TranscriptRow>>) =>
+      use(f).pipe(Effect.map((rows) => rows.map(fromRow)));
+
+    const backend: TranscriptBackend = {
+      insert: (t) =>
+        use(
+          (sql) => sql`
+            INSERT INTO transcripts (response_id, task, source, program, text,
+              completed_at, window_start, window_end, segments)
+            VALUES (${t.responseId}, ${t.task}, ${t.source}, ${t.program},
+              ${t.text}, ${t.completedAt}, ${t.windowStart}, ${t.windowEnd},
+              ${JSON.stringify(t.segments)}::jsonb)
+            ON CONFLICT (response_id) DO NOTHING`
+        ),
+      saveTags: (responseId, tags) =>
+        use((sql) =>
+          sql.begin(async (tx) => {
+            await tx`
+              INSERT INTO transcript_tags (response_id, sentiment)
+              VALUES (${responseId}, ${tags.sentiment})
+              ON CONFLICT (response_id)
+              DO UPDATE SET sentiment = EXCLUDED.sentiment`;
+            await tx`
+              DELETE FROM transcript_topics WHERE response_id = ${responseId}`;
+            for (const topic of tags.topics) {
+              await tx`
+                INSERT INTO transcript_topics (response_id, topic)
+                VALUES (${responseId}, ${topic})
+                ON CONFLICT DO NOTHING`;
+            }
+          })
+        ),
+      topicTimeline: (query) =>
+        use(async (sql) => {
+          const source = query.source ?? null;
+          const from = query.from ?? null;
+          const to = query.to ?? null;
+          const bucket = query.bucketMs;
+          const start = sql`(t.completed_at / ${bucket}) * ${bucket}`;
+          const filter = sql`
+            (${source}::text IS NULL OR t.source = ${source})
+            AND (${from}::bigint IS NULL OR t.completed_at >= ${from})
+            AND (${to}::bigint IS NULL OR t.completed_at < ${to})`;
+          const topicRows: Array<{
+            start: string;
+            topic: string;
+            count: string;
+          }> = await sql`
+            SELECT ${start} AS start, x.topic, COUNT(*) AS count
+            FROM transcripts t
+            JOIN transcript_topics x ON x.response_id = t.response_id
+            WHERE ${filter}
+            GROUP BY 1, x.topic
+            ORDER BY 1, count DESC, x.topic`;
+          const sentimentRows: Array<{
+            start: string;
+            sentiment: Digest["sentiment"];
+            count: string;
+          }> = await sql`
+            SELECT ${start} AS start, x.sentiment, COUNT(*) AS count
+            FROM transcripts t
+            JOIN transcript_tags x ON x.response_id = t.response_id
+            WHERE ${filter}
+            GROUP BY 1, x.sentiment`;
+          return timelineBuckets(
+            sentimentRows.map((row) => ({
+              ...row,
+              start: Number(row.start),
+              count: Number(row.count),
+            })),
+            topicRows.map((row) => ({
+              ...row,
+              start: Number(row.start),
+              count: Number(row.count),
+            }))
+          );
+        }),
+      saveEmbeddings: (responseId, model, chunks) =>
+        use((sql) =>
+          sql.begin(async (tx) => {
+            await tx`
+              DELETE FROM transcript_embeddings
+              WHERE response_id = ${responseId} AND model = ${model}`;
+            for (const [position, chunk] of chunks.entries()) {
+              await tx`
+                INSERT INTO transcript_embeddings
+                  (response_id, model, position, text, vector)
+                VALUES (${responseId}, ${model}, ${position}, ${chunk.text},
+                  ${Buffer.from(toBlob(chunk.vector))})`;
+            }
+          })
+        ),
+      embeddings: (model) =>
+        use(async (sql) => {
+          const rows: Array<{
+            response_id: string;
+            source: AudioSourceId | null;
+            program: string | null;
+            completed_at: string;
+            text: string;
+            vector: Uint8Array;
+          }> = await sql`
+            SELECT e.response_id, t.source, t.program, t.completed_at, e.text,
+              e.vector
+            FROM transcript_embeddings e
+            JOIN transcripts t ON t.response_id = e.response_id
+            WHERE e.model = ${model}`;
+          return rows.map(
+            (row): EmbeddedChunk => ({
+              responseId: row.response_id,
+              source: row.source,
+              program: row.program,
+              completedAt: Number(row.completed_at),
+              text: row.text,
+              vector: fromBlob(row.vector),
+            })
+          );
+        }),
+      unembedded: (model, tasks, limit) =>
+        transcripts(
+          (sql) => sql`
+            SELECT ${columns} FROM transcripts t
+            WHERE task IN ${sql(tasks)}
+              AND NOT EXISTS (
+                SELECT 1 FROM transcript_embeddings e
+                WHERE e.response_id = t.response_id AND e.model = ${model}
+              )
+            ORDER BY completed_at DESC LIMIT ${limit}`
+        ),
+      byResponseIds: (responseIds) =>
+        responseIds.length === 0
+          ? Effect.succeed([])
+          : transcripts(
+              (sql) => sql`
+                SELECT ${columns} FROM transcripts
+                WHERE response_id IN ${sql(responseIds)}`
+            ),
+      between: (params) =>
+        transcripts(
+          (sql) => sql`
+            SELECT ${columns} FROM transcripts
+            WHERE source = ${params.source}
+              AND completed_at >= ${params.from}
+              AND completed_at < ${params.to}
+              AND task IN ${sql(params.tasks)}
+            ORDER BY completed_at`
+        ),
+      archive: (params) =>
+        use(async (sql) => {
+          const task = params.task ?? null;
+          const where = sql`
+            WHERE source = ${params.source}
+              AND completed_at >= ${params.from}
+              AND completed_at < ${params.to}
+              AND (${task}::text IS NULL OR task = ${task})`;
+          const index: Array<{ completed_at: string; program: string | null }> =
+            await sql`
+              SELECT completed_at, program FROM transcripts ${where}
+              ORDER BY completed_at, id`;
+          const rows: Array<TranscriptRow> = await sql`
+            SELECT ${columns} FROM transcripts ${where}
+            ORDER BY completed_at, id
+            LIMIT ${params.limit} OFFSET ${params.offset}`;
+          return {
+            index: index.map((row) => ({
+              completedAt: Number(row.completed_at),
+              program: row.program,
+            })),
+            transcripts: rows.map(fromRow),
+          };
+        }),
+      saveFeedback: (feedback) =>
+        use(
+          (sql) => sql`
+            INSERT INTO transcript_feedback
+              (response_id, rating, comment, created_at)
+            VALUES (${feedback.responseId}, ${feedback.rating},
+              ${feedback.comment}, ${feedback.createdAt})`
+        ),
+      feedbackStats: (params) =>
+        use(async (sql) => {
+          const from = params.from ?? null;
+          const to = params.to ?? null;
+          const rows: Array<{
+            source: AudioSourceId | null;
+            task: TaskId;
+            count: string;
+            average_rating: string;
+            low: string;
+            high: string;
+            comments: string;
+          }> = await sql`
+            SELECT t.source, t.task, COUNT(*) AS count,
+              AVG(f.rating) AS average_rating,
+              COUNT(*) FILTER (WHERE f.rating <= 2) AS low,
+              COUNT(*) FILTER (WHERE f.rating >= 4) AS high,
+              COUNT(f.comment) AS comments
+            FROM transcript_feedback f
+            JOIN transcripts t ON t.response_id = f.response_id
+            WHERE (${from}::bigint IS NULL OR f.created_at >= ${from})
+              AND (${to}::bigint IS NULL OR f.created_at < ${to})
+            GROUP BY t.source, t.task
+            ORDER BY count DESC, t.source, t.task`;
+          return rows.map(
+            (row): FeedbackStats => ({
+              source: row.source,
+              task: row.task,
+              count: Number(row.count),
+              averageRating: Number(row.average_rating),
+              low: Number(row.low),
+              high: Number(row.high),
+              comments: Number(row.comments),
+            })
+          );
+        }),
+      saveRepeat: (segment) =>
+        use(
+          (sql) => sql`
+            INSERT INTO repeated_segments
+              (fingerprint, source, started_at, ended_at, duration_ms,
+               skipped, recorded_at)
+            VALUES (${segment.fingerprint}, ${segment.source},
+              ${segment.startedAt}, ${segment.endedAt}, ${segment.durationMs},
+              ${segment.skipped}, ${segment.recordedAt})`
+        ),
+      repeats: (query) =>
+        use(async (sql) => {
+          const source = query.source ?? null;
+          const fingerprint = query.fingerprint ?? null;
+          const from = query.from ?? null;
+          const to = query.to ?? null;
+          const rows: Array<{
+            fingerprint: string;
+            source: AudioSourceId;
+            started_at: string | null;
+            ended_at: string | null;
+            duration_ms: number;
+            skipped: boolean;
+            recorded_at: string;
+          }> = await sql`
+            SELECT fingerprint, source, started_at, ended_at, duration_ms,
+              skipped, recorded_at
+            FROM repeated_segments
+            WHERE (${source}::text IS NULL OR source = ${source})
+              AND (${fingerprint}::text IS NULL OR fingerprint = ${fingerprint})
+              AND (${from}::bigint IS NULL OR recorded_at >= ${from})
+              AND (${to}::bigint IS NULL OR recorded_at < ${to})
+            ORDER BY recorded_at DESC, id DESC LIMIT ${query.limit}`;
+          return rows.map(
+            (row): RepeatedSegment => ({
+              fingerprint: row.fingerprint,
+              source: row.source,
+              startedAt: row.started_at === null ? null : Number(row.started_at),
+              endedAt: row.ended_at === null ? null : Number(row.ended_at),
+              durationMs: row.duration_ms,
+              skipped: row.skipped,
+              recordedAt: Number(row.recorded_at),
+            })
+          );
+        }),
+      logBroadcast: (entry) =>
+        use(
+          (sql) => sql`
+            INSERT INTO broadcast_log (key, at, json)
+            VALUES (${entry.key}, ${entry.at},
+              ${encodeBroadcastJson(entry.message)})
+            ON CONFLICT (key) DO NOTHING`
+        ),
+      broadcastsSince: (since, limit) =>
+        use(async (sql) =>
+          fromBroadcastRows(
+            await sql`
+              SELECT key, at, json FROM broadcast_log
+              WHERE at >= ${since} ORDER BY at, key LIMIT ${limit}`
+          )
+        ),
+      pruneBroadcasts: (before) =>
+        use((sql) => sql`DELETE FROM broadcast_log WHERE at < ${before}`),
+      saveSession: (session) =>
+        use(
+          (sql) => sql`
+            INSERT INTO listen_sessions
+              (id, source, started_at, ended_at, reason, responses, summary)
+            VALUES (${session.id}, ${session.source}, ${session.startedAt},
+              ${session.endedAt}, ${session.reason}, ${session.responses},
+              ${session.summary})
+            ON CONFLICT (id) DO UPDATE SET
+              source = EXCLUDED.source,
+              started_at = EXCLUDED.started_at,
+              ended_at = EXCLUDED.ended_at,
+              reason = EXCLUDED.reason,
+              responses = EXCLUDED.responses,
+              summary = EXCLUDED.summary`
+        ),
+      sessions: (limit) =>
+        use(async (sql) => {
+          const rows: Array<{
+            id: string;
+            source: AudioSourceId;
+            started_at: string;
+            ended_at: string;
+            reason: ListenSession["reason"];
+            responses: number;
+            summary: string | null;
+          }> = await sql`
+            SELECT id, source, started_at, ended_at, reason, responses, summary
+            FROM listen_sessions ORDER BY ended_at DESC LIMIT ${limit}`;
+          return rows.map(
+            (row): ListenSession => ({
+              id: row.id,
+              source: row.source,
+              startedAt: Number(row.started_at),
+              endedAt: Number(row.ended_at),
+              reason: row.reason,
+              responses: row.responses,
+              summary: row.summary,
+            })
+          );
+        }),
+      saveSnapshot: (snapshot) =>
+        use(
+          (sql) => sql`
+            INSERT INTO metrics_snapshots (at, json)
+            VALUES (${snapshot.at}, ${JSON.stringify(snapshot)})`
+        ),
+      snapshots: (from, to) =>
+        use(async (sql) => {
+          const rows: Array<{ json: string }> = await sql`
+            SELECT json FROM metrics_snapshots
+            WHERE at >= ${from} AND at < ${to} ORDER BY at`;
+          return rows.map((row) => JSON.parse(row.json) as MetricsSnapshot);
+        }),
+      saveCoverage: (diff) =>
+        use(
+          (sql) => sql`
+            INSERT INTO coverage_diffs (hour, json)
+            VALUES (${diff.hour}, ${JSON.stringify(diff)})
+            ON CONFLICT (hour) DO UPDATE SET json = EXCLUDED.json`
+        ),
+      coverage: (hour) =>
+        use(async (sql) => {
+          const rows: Array<{ json: string }> = await sql`
+            SELECT json FROM coverage_diffs WHERE hour = ${hour}`;
+          const row = rows[0];
+          return row === undefined
+            ? null
+            : (JSON.parse(row.json) as CoverageDiff);
+        }),
+      recent: (limit) =>
+        transcripts(
+          (sql) => sql`
+            SELECT ${columns} FROM transcripts
+            ORDER BY completed_at DESC LIMIT ${limit}`
+        ),
+      recentOf: (params) => {
+        const source = params.source ?? null;
+        return transcripts(
+          (sql) => sql`
+            SELECT ${columns} FROM transcripts
+            WHERE task IN ${sql(params.tasks)}
+              AND (${source}::text IS NULL OR source = ${source})
+            ORDER BY completed_at DESC LIMIT ${params.limit}`
+        );
+      },
+      search: (params) => {
+        if (params.query.trim() === "") return Effect.succeed([]);
+        const source = params.source ?? null;
+        const program = params.program ?? null;
+        const from = params.from ?? null;
+        const to = params.to ?? null;
+        return use(async (sql) => {
+          const rows: Array<TranscriptRow & { snippet: string }> = await sql`
+            SELECT ${columns},
+              ts_headline('simple', text, q, ${HEADLINE_OPTIONS}) AS snippet
+            FROM transcripts, plainto_tsquery('simple', ${params.query}) q
+            WHERE search @@ q
+              AND (${source}::text IS NULL OR source = ${source})
+              AND (${program}::text IS NULL OR program = ${program})
+              AND (${from}::bigint IS NULL OR completed_at >= ${from})
+              AND (${to}::bigint IS NULL OR completed_at < ${to})
+            ORDER BY ts_rank(search, q) DESC
+            LIMIT ${params.limit}`;
+          return rows.map((row) => ({
+            ...fromRow(row),
+            snippet: markSnippet(row.snippet),
+          }));
+        });
+      },
+    };
+    return backend;
+  });
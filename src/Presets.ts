@@ -0,0 +1,93 @@
+import { Config, Data, Effect, Option, Schema } from "effect";
+import { AppConfig, WindowConfig } from "./AppConfig.js";
+import { AudioSource } from "./AudioSource.js";
+import { makeJsonFileStore } from "./JsonFileStore.js";
+
+export const Preset = Schema.Struct({
+  id: Schema.String.pipe(Schema.pattern(/^[a-z0-9_-]+$/)).annotations({
+    description: "Preset identifier",
+  }),
+  name: Schema.NonEmptyString.annotations({
+    description: "Label shown in the UI, e.g. Morning news digest",
+  }),
+  source: Schema.optional(Schema.String).annotations({
+    description: "Source to select",
+  }),
+  prompt: Schema.optional(Schema.NonEmptyString).annotations({
+    description: "Commentary instructions",
+  }),
+  window: Schema.optional(WindowConfig),
+  language: Schema.optional(Schema.NonEmptyString).annotations({
+    description: "Language to write commentary in",
+  }),
+}).annotations({ title: "Preset" });
+
+export type Preset = typeof Preset.Type;
+
+export class PresetStoreError extends Data.TaggedError("PresetStoreError")<{
+  message: string;
+}> {}
+
+// Named combinations of source and commentary settings, kept in a JSON file
+// (PRESETS_FILE, defaults to presets.json) so they survive restarts.
+export class Presets extends Effect.Service<Presets>()("Presets", {
+  effect: Effect.gen(function* () {
+    const appConfig = yield* AppConfig;
+    const audioSource = yield* AudioSource;
+    const path = yield* Config.string("PRESETS_FILE").pipe(
+      Config.withDefault("presets.json")
+    );
+
+    const store = yield* makeJsonFileStore({
+      path,
+      schema: Schema.Array(Preset),
+      empty: [],
+      error: (message) => new PresetStoreError({ message }),
+    });
+    const modify = (f: (all: ReadonlyArray<Preset>) => ReadonlyArray<Preset>) =>
+      Effect.asVoid(store.update(f));
+
+    const get = (id: string) =>
+      store.get.pipe(
+        Effect.map((all) => Option.fromNullable(all.find((p) => p.id === id)))
+      );
+
+    return {
+      list: store.get,
+      get,
+      // Replaces all the presets at once.
+      replaceAll: (all: ReadonlyArray<Preset>) => modify(() => all),
+      // Replaces any preset with the same id.
+      save: (preset: Preset) =>
+        modify((all) => [...all.filter((p) => p.id !== preset.id), preset]),
+      // Returns false if there was no such preset.
+      remove: (id: string) =>
+        Effect.gen(function* () {
+          if (Option.isNone(yield* get(id))) return false;
+          yield* modify((all) => all.filter((p) => p.id !== id));
+          return true;
+        }),
+      // Applies the preset's settings on top of the effective config (until
+      // the next config reload) and selects its source, on behalf of `by`.
+      apply: (preset: Preset, by: string | null) =>
+        Effect.gen(function* () {
+          yield* appConfig.update((c) => ({
+            ...c,
+            prompt: preset.prompt ?? c.prompt,
+            window: preset.window ?? c.window,
+            language: preset.language ?? c.language,
+          }));
+          if (preset.source) {
+            if (Option.isSome(yield* audioSource.findSource(preset.source))) {
+              yield* audioSource.setSource(preset.source, "preset", by);
+            } else {
+              yield* Effect.logWarning(
+                `Preset ${preset.id}: source ${preset.source} no longer exists`
+              );
+            }
+          }
+          yield* Effect.log(`Preset applied: ${preset.name}`);
+        }),
+    } as const;
+  }),
+}) {}
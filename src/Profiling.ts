@@ -0,0 +1,41 @@
+import { heapStats, profile } from "bun:jsc";
+import { Config, Effect } from "effect";
+
+// Runtime profiling for chasing regressions in the audio hot path, exposed
+// under /debug with DEBUG_PROFILING=true. Off by default: a heap snapshot
+// briefly stops the process and holds everything in memory, and a profile
+// samples every thread's stack while it runs.
+export const ProfilingConfig = Config.boolean("DEBUG_PROFILING").pipe(
+  Config.withDefault(false)
+);
+
+// Microseconds between samples of a CPU profile.
+const SAMPLE_INTERVAL_US = 1000;
+
+export const memoryStats = Effect.sync(() => {
+  const memory = process.memoryUsage();
+  const heap = heapStats();
+  return {
+    rss: memory.rss,
+    heapUsed: memory.heapUsed,
+    heapTotal: memory.heapTotal,
+    external: memory.external,
+    arrayBuffers: memory.arrayBuffers,
+    objectCount: heap.objectCount,
+    // Most common object types, most numerous first.
+    objectTypes: Object.entries(heap.objectTypeCounts)
+      .sort(([, a], [, b]) => b - a)
+      .slice(0, 20)
+      .map(([type, count]) => ({ type, count })),
+  };
+});
+
+// V8 format, which Chrome DevTools' Memory tab opens.
+export const heapSnapshot = Effect.sync(() => Bun.generateHeapSnapshot("v8"));
+
+// Samples whatever runs during the next `seconds`: the hottest functions,
+// then the hottest bytecodes, as JavaScriptCore reports them.
+export const cpuProfile = (seconds: number) =>
+  Effect.promise(() =>
+    profile(() => Bun.sleep(seconds * 1000), SAMPLE_INTERVAL_US)
+  ).pipe(Effect.map((p) => `${p.functions}\n${p.bytecodes}`));
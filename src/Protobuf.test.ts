@@ -0,0 +1,66 @@
+import { describe, expect, test } from "bun:test";
+import {
+  decodeMessage,
+  encodeMessage,
+  getNumber,
+  getString,
+  ProtobufDecodeError,
+} from "./Protobuf.js";
+
+const bytes = (...values: Array<number>) => Uint8Array.from(values);
+
+describe("decodeMessage", () => {
+  test("reads back what encodeMessage wrote", () => {
+    const msg = decodeMessage(
+      encodeMessage([
+        [1, "franceinfo"],
+        [2, 300],
+        [3, bytes(1, 2, 3)],
+      ])
+    );
+    expect(getString(msg, 1)).toBe("franceinfo");
+    expect(getNumber(msg, 2)).toBe(300);
+    expect(msg.get(3)).toEqual([bytes(1, 2, 3)]);
+  });
+
+  test("rejects a varint cut short", () => {
+    // Field 2, varint, with its continuation bit set on the last byte.
+    expect(() => decodeMessage(bytes(0x10, 0xac))).toThrow(
+      ProtobufDecodeError
+    );
+    // A key cut short.
+    expect(() => decodeMessage(bytes(0x80))).toThrow(ProtobufDecodeError);
+  });
+
+  test("rejects a varint longer than ten bytes", () => {
+    expect(() =>
+      decodeMessage(bytes(0x08, ...Array(10).fill(0xff), 0x01))
+    ).toThrow(ProtobufDecodeError);
+  });
+
+  test("rejects a length past the end of the buffer", () => {
+    // Field 1, length-delimited, 5 bytes declared, 3 present.
+    expect(() => decodeMessage(bytes(0x0a, 5, 0x61, 0x62, 0x63))).toThrow(
+      ProtobufDecodeError
+    );
+    // The length itself cut short.
+    expect(() => decodeMessage(bytes(0x0a, 0x80))).toThrow(
+      ProtobufDecodeError
+    );
+  });
+
+  test("rejects fixed-size fields cut short", () => {
+    // Field 1, 64-bit, 4 bytes present.
+    expect(() => decodeMessage(bytes(0x09, 1, 2, 3, 4))).toThrow(
+      ProtobufDecodeError
+    );
+    // Field 1, 32-bit, 2 bytes present.
+    expect(() => decodeMessage(bytes(0x0d, 1, 2))).toThrow(
+      ProtobufDecodeError
+    );
+  });
+
+  test("rejects unsupported wire types", () => {
+    expect(() => decodeMessage(bytes(0x0b))).toThrow(ProtobufDecodeError);
+  });
+});
@@ -0,0 +1,118 @@
+// Minimal proto3 wire-format codec covering the scalar and message fields used
+// by the gRPC API (strings, unsigned varints and embedded messages).
+
+export type FieldValue = string | number | boolean | Uint8Array | null | undefined;
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+const pushVarint = (out: number[], value: number) => {
+  let n = value;
+  while (n >= 0x80) {
+    out.push((n % 0x80) | 0x80);
+    n = Math.floor(n / 0x80);
+  }
+  out.push(n);
+};
+
+const pushBytes = (out: number[], field: number, bytes: Uint8Array) => {
+  pushVarint(out, (field << 3) | 2);
+  pushVarint(out, bytes.length);
+  for (const b of bytes) out.push(b);
+};
+
+// Fields holding proto3 default values (empty, zero, false) are omitted.
+// Repeated fields are expressed by listing the same field number again.
+export const encodeMessage = (
+  fields: ReadonlyArray<readonly [number, FieldValue]>
+): Uint8Array => {
+  const out: number[] = [];
+  for (const [field, value] of fields) {
+    if (value === null || value === undefined) continue;
+    if (typeof value === "string") {
+      if (value.length > 0) pushBytes(out, field, encoder.encode(value));
+    } else if (typeof value === "number" || typeof value === "boolean") {
+      const n = Number(value);
+      if (n !== 0) {
+        pushVarint(out, field << 3);
+        pushVarint(out, Math.max(0, Math.trunc(n)));
+      }
+    } else {
+      pushBytes(out, field, value);
+    }
+  }
+  return Uint8Array.from(out);
+};
+
+export type DecodedMessage = ReadonlyMap<number, ReadonlyArray<number | Uint8Array>>;
+
+// Thrown for input that isn't a well-formed message, such as one cut short.
+export class ProtobufDecodeError extends Error {
+  override readonly name = "ProtobufDecodeError";
+}
+
+// Longest varint encoding of a 64-bit value.
+const MAX_VARINT_BYTES = 10;
+
+export const decodeMessage = (buf: Uint8Array): DecodedMessage => {
+  const fields = new Map<number, Array<number | Uint8Array>>();
+  let pos = 0;
+
+  const readVarint = () => {
+    let result = 0;
+    let scale = 1;
+    for (let i = 0; i < MAX_VARINT_BYTES; i++) {
+      if (pos >= buf.length) throw new ProtobufDecodeError("Truncated varint");
+      const b = buf[pos++]!;
+      result += (b & 0x7f) * scale;
+      if (b < 0x80) return result;
+      scale *= 0x80;
+    }
+    throw new ProtobufDecodeError("Varint too long");
+  };
+
+  // The next `length` bytes, which must all be there.
+  const take = (length: number) => {
+    if (pos + length > buf.length) {
+      throw new ProtobufDecodeError("Truncated field");
+    }
+    return buf.subarray(pos, (pos += length));
+  };
+
+  while (pos < buf.length) {
+    const key = readVarint();
+    const field = Math.floor(key / 8);
+    const wireType = key & 7;
+    let value: number | Uint8Array;
+    switch (wireType) {
+      case 0:
+        value = readVarint();
+        break;
+      case 1:
+        value = take(8);
+        break;
+      case 2:
+        value = take(readVarint());
+        break;
+      case 5:
+        value = take(4);
+        break;
+      default:
+        throw new ProtobufDecodeError(`Unsupported wire type ${wireType}`);
+    }
+    const values = fields.get(field) ?? [];
+    values.push(value);
+    fields.set(field, values);
+  }
+  return fields;
+};
+
+export const getString = (msg: DecodedMessage, field: number) => {
+  const value = msg.get(field)?.at(-1);
+  return value instanceof Uint8Array ? decoder.decode(value) : "";
+};
+
+export const getNumber = (msg: DecodedMessage, field: number) => {
+  const value = msg.get(field)?.at(-1);
+  return typeof value === "number" ? value : 0;
+};
@@ -0,0 +1,198 @@
+import { HttpClient, HttpClientRequest } from "@effect/platform";
+import { Config, Data, Effect, Option, Redacted, Schema, Stream } from "effect";
+import { Broadcaster } from "./Broadcaster.js";
+import { makeJsonFileStore } from "./JsonFileStore.js";
+import type { BroadcastMessage } from "./Messages.js";
+import { pushRequest, type VapidKeys } from "./WebPush.js";
+
+export const PushSubscription = Schema.Struct({
+  endpoint: Schema.String.pipe(Schema.startsWith("https://")).annotations({
+    description: "Push service URL given by the browser",
+  }),
+  keys: Schema.Struct({
+    p256dh: Schema.NonEmptyString,
+    auth: Schema.NonEmptyString,
+  }),
+}).annotations({ title: "Push Subscription" });
+
+export type PushSubscription = typeof PushSubscription.Type;
+
+export class PushDisabledError extends Data.TaggedError("PushDisabledError") {}
+
+export class PushStoreError extends Data.TaggedError("PushStoreError")<{
+  message: string;
+}> {}
+
+interface PushMessage {
+  readonly title: string;
+  readonly body: string;
+  // Replaces an earlier notification with the same tag instead of stacking.
+  readonly tag: string;
+  readonly urgency: "normal" | "high";
+}
+
+// Alerts and digests are worth a notification; the rest of the stream is not.
+const toNotification = (
+  msg: BroadcastMessage
+): Option.Option<PushMessage> => {
+  switch (msg.type) {
+    case "dead_air":
+      return Option.some({
+        title: `Silence sur ${msg.source}`,
+        body: `Aucun son depuis ${Math.round(msg.silentForMs / 1000)} s`,
+        tag: `dead_air-${msg.source}`,
+        urgency: "high",
+      });
+    // The per-minute cap lifts within the minute; not worth waking anyone.
+    case "paused":
+      if (msg.reason === "rate_limit") return Option.none();
+      return Option.some({
+        title: "Commentaires en pause",
+        body: `Trop d'erreurs OpenAI, reprise dans ${Math.round(msg.retryInMs / 1000)} s`,
+        tag: "paused",
+        urgency: "high",
+      });
+    case "complete":
+      if (!msg.structured) return Option.none();
+      return Option.some({
+        title: msg.structured.headline,
+        body: msg.structured.bullets.map((b) => `• ${b}`).join("\n"),
+        tag: `digest-${msg.source ?? "radio"}`,
+        urgency: "normal",
+      });
+    default:
+      return Option.none();
+  }
+};
+
+// Sends alerts and completed digests to subscribed browsers through Web Push,
+// so they arrive even with the page closed. Needs a VAPID key pair
+// (VAPID_PUBLIC_KEY, VAPID_PRIVATE_KEY); without one it is disabled.
+// Subscriptions are kept in PUSH_SUBSCRIPTIONS_FILE (defaults to
+// push-subscriptions.json) and dropped once their push service rejects them.
+export class PushNotifications extends Effect.Service<PushNotifications>()(
+  "PushNotifications",
+  {
+    scoped: Effect.gen(function* () {
+      const client = yield* HttpClient.HttpClient;
+      const broadcaster = yield* Broadcaster;
+      const keys = yield* Config.option(
+        Config.all({
+          publicKey: Config.string("VAPID_PUBLIC_KEY"),
+          privateKey: Config.redacted("VAPID_PRIVATE_KEY"),
+        })
+      );
+      const subject = yield* Config.string("VAPID_SUBJECT").pipe(
+        Config.withDefault("mailto:admin@localhost")
+      );
+      const path = yield* Config.string("PUSH_SUBSCRIPTIONS_FILE").pipe(
+        Config.withDefault("push-subscriptions.json")
+      );
+
+      const store = yield* makeJsonFileStore({
+        path,
+        schema: Schema.Array(PushSubscription),
+        empty: [],
+        error: (message) => new PushStoreError({ message }),
+        load: Option.isSome(keys),
+      });
+      const modify = (
+        f: (
+          all: ReadonlyArray<PushSubscription>
+        ) => ReadonlyArray<PushSubscription>
+      ) => Effect.asVoid(store.update(f));
+
+      const unsubscribe = (endpoint: string) =>
+        modify((all) => all.filter((s) => s.endpoint !== endpoint));
+
+      if (Option.isNone(keys)) {
+        yield* Effect.log(
+          "Web Push disabled: set VAPID_PUBLIC_KEY and VAPID_PRIVATE_KEY to enable it"
+        );
+      } else {
+        const vapid: VapidKeys = {
+          publicKey: keys.value.publicKey,
+          privateKey: Redacted.value(keys.value.privateKey),
+          subject,
+        };
+
+        const send = (
+          subscription: PushSubscription,
+          notification: PushMessage
+        ) =>
+          Effect.gen(function* () {
+            const { url, headers, body } = pushRequest(
+              subscription,
+              vapid,
+              JSON.stringify({
+                title: notification.title,
+                body: notification.body,
+                tag: notification.tag,
+              }),
+              { ttl: 3600, urgency: notification.urgency }
+            );
+            const response = yield* HttpClientRequest.post(url).pipe(
+              HttpClientRequest.setHeaders(headers),
+              HttpClientRequest.bodyUint8Array(body, headers["Content-Type"]),
+              (request) => client.execute(request),
+              Effect.timeout("10 seconds")
+            );
+            // Gone or unknown: the browser unsubscribed or the key changed.
+            if (response.status === 404 || response.status === 410) {
+              yield* Effect.log(`Push subscription expired: ${url}`);
+              return yield* unsubscribe(subscription.endpoint);
+            }
+            if (response.status >= 300) {
+              yield* Effect.logWarning(
+                `Push service rejected a notification (${response.status}): ${url}`
+              );
+            }
+          }).pipe(
+            Effect.scoped,
+            Effect.catchAll((e) =>
+              Effect.logWarning("Failed to send push notification", e)
+            )
+          );
+
+        const subscription = yield* broadcaster.subscribe;
+        yield* Stream.fromQueue(subscription).pipe(
+          Stream.filterMap(toNotification),
+          Stream.runForEach((notification) =>
+            store.get.pipe(
+              Effect.flatMap((all) =>
+                Effect.forEach(all, (s) => send(s, notification), {
+                  concurrency: 8,
+                  discard: true,
+                })
+              )
+            )
+          ),
+          Effect.forkScoped
+        );
+        yield* Effect.log("Web Push enabled");
+      }
+
+      const enabled = Option.match(keys, {
+        onNone: () => Effect.fail(new PushDisabledError()),
+        onSome: (k) => Effect.succeed(k.publicKey),
+      });
+
+      return {
+        // Key browsers pass as applicationServerKey when subscribing.
+        publicKey: enabled,
+        // Replaces any subscription with the same endpoint.
+        subscribe: (subscription: PushSubscription) =>
+          enabled.pipe(
+            Effect.zipRight(
+              modify((all) => [
+                ...all.filter((s) => s.endpoint !== subscription.endpoint),
+                subscription,
+              ])
+            )
+          ),
+        unsubscribe: (endpoint: string) =>
+          enabled.pipe(Effect.zipRight(unsubscribe(endpoint))),
+      } as const;
+    }),
+  }
+) {}
@@ -0,0 +1,146 @@
+import {
+  Deferred,
+  Effect,
+  Option,
+  Queue,
+  Ref,
+  Schema,
+  Scope,
+  Stream,
+} from "effect";
+
+export const RemoteFormat = Schema.Literal("pcm", "opus").annotations({
+  description:
+    "pcm: raw 16-bit little-endian mono at sampleRate; opus: MediaRecorder output, WebM or Ogg",
+});
+
+export type RemoteFormat = typeof RemoteFormat.Type;
+
+export interface RemoteParams {
+  readonly format: RemoteFormat;
+  // Of pcm audio; Opus is always decoded at 48kHz.
+  readonly sampleRate: number;
+}
+
+// ffmpeg input options for audio pushed in a format; containers are probed.
+export const remoteInputArgs = (params: RemoteParams) =>
+  params.format === "pcm"
+    ? ["-f", "s16le", "-ar", String(params.sampleRate), "-ac", "1"]
+    : [];
+
+export const remoteSampleRate = (params: RemoteParams) =>
+  params.format === "pcm" ? params.sampleRate : 48000;
+
+// Frames kept while nothing reads a source's audio, e.g. while another
+// source is selected. Older pcm frames are dropped; a container can't lose
+// any, so its connection is ended instead.
+const QUEUE_FRAMES = 256;
+
+// Close code of a connection ended because its container stream overflowed,
+// so the browser starts a new recording rather than giving up.
+export const REMOTE_OVERFLOW_CLOSE_CODE = 4000;
+
+export type RemoteEnd = "replaced" | "overflow";
+
+// A browser pushing audio for a source, until it disconnects or the
+// connection is ended.
+export interface RemoteConnection {
+  readonly params: RemoteParams;
+  readonly push: (frame: Uint8Array) => Effect.Effect<void>;
+  // The audio for a new ffmpeg: a container's first frame, which holds its
+  // header (e.g. MediaRecorder's WebM EBML header), then the frames pushed
+  // since the previous reader stopped. Ends with the connection.
+  readonly frames: Stream.Stream<Uint8Array>;
+  // Completed once another connection for the same source replaces this
+  // one, or a container stream overflows.
+  readonly ended: Deferred.Deferred<RemoteEnd>;
+}
+
+export interface RemoteAudio {
+  // Registers a connection for the scope's lifetime.
+  readonly connect: (
+    sourceId: string,
+    params: RemoteParams
+  ) => Effect.Effect<RemoteConnection, never, Scope.Scope>;
+  readonly current: (
+    sourceId: string
+  ) => Effect.Effect<Option.Option<RemoteConnection>>;
+}
+
+// Connections of websocket sources, one per source: the latest wins, so a
+// reloaded page takes over from the one it replaced.
+export const makeRemoteAudio = Effect.gen(function* () {
+  const connections = yield* Ref.make<ReadonlyMap<string, RemoteConnection>>(
+    new Map()
+  );
+
+  const connect = (sourceId: string, params: RemoteParams) =>
+    Effect.acquireRelease(
+      Effect.gen(function* () {
+        const container = params.format !== "pcm";
+        const audio = yield* (container
+          ? Queue.bounded<Uint8Array>(QUEUE_FRAMES)
+          : Queue.sliding<Uint8Array>(QUEUE_FRAMES));
+        const header = yield* Deferred.make<Uint8Array>();
+        const ended = yield* Deferred.make<RemoteEnd>();
+        const connection: RemoteConnection = {
+          params,
+          push: (frame) =>
+            Effect.gen(function* () {
+              if (container && (yield* Deferred.succeed(header, frame))) {
+                return;
+              }
+              if (container && (yield* Queue.isFull(audio))) {
+                yield* Effect.logWarning(
+                  `Audio pushed to ${sourceId} not read, ending the connection`
+                );
+                yield* Deferred.succeed(ended, "overflow");
+                return;
+              }
+              yield* Queue.offer(audio, frame);
+            }),
+          frames: container
+            ? Stream.unwrap(
+                Deferred.await(header).pipe(
+                  Effect.map((first) =>
+                    Stream.concat(Stream.make(first), Stream.fromQueue(audio))
+                  ),
+                  Effect.raceFirst(
+                    Queue.awaitShutdown(audio).pipe(Effect.as(Stream.empty))
+                  )
+                )
+              )
+            : Stream.fromQueue(audio),
+          ended,
+        };
+        const previous = yield* Ref.modify(connections, (all) => [
+          all.get(sourceId),
+          new Map(all).set(sourceId, connection),
+        ]);
+        // Its handler then returns, which releases it.
+        if (previous !== undefined) {
+          yield* Deferred.succeed(previous.ended, "replaced");
+        }
+        return { connection, audio };
+      }),
+      ({ connection, audio }) =>
+        Effect.gen(function* () {
+          yield* Queue.shutdown(audio);
+          yield* Ref.update(connections, (all) => {
+            if (all.get(sourceId) !== connection) return all;
+            const next = new Map(all);
+            next.delete(sourceId);
+            return next;
+          });
+        })
+    ).pipe(Effect.map(({ connection }) => connection));
+
+  const remote: RemoteAudio = {
+    connect,
+    current: (sourceId) =>
+      Ref.get(connections).pipe(
+        Effect.map((all) => Option.fromNullable(all.get(sourceId)))
+      ),
+  };
+  return remote;
+});
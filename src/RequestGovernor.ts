@@ -0,0 +1,125 @@
+import { Clock, Duration, Effect, Random, Ref } from "effect";
+
+export interface GovernorOptions {
+  readonly maxResponsesPerMinute: number;
+  readonly failureThreshold: number;
+  readonly baseBackoff: Duration.DurationInput;
+  readonly maxBackoff: Duration.DurationInput;
+}
+
+// The circuit opening and closing, and the per-minute cap starting and
+// ceasing to turn requests away.
+export type GovernorEvent =
+  | { readonly _tag: "Opened"; readonly retryIn: Duration.Duration }
+  | { readonly _tag: "Closed" }
+  | { readonly _tag: "Capped"; readonly retryIn: Duration.Duration }
+  | { readonly _tag: "Uncapped" };
+
+interface CircuitState {
+  readonly open: boolean;
+  readonly consecutiveFailures: number;
+  readonly trips: number;
+}
+
+// Caps response.create calls per minute and trips a circuit breaker after
+// repeated OpenAI errors. An open circuit closes itself after a jittered,
+// exponentially growing backoff.
+export const makeRequestGovernor = (
+  options: GovernorOptions,
+  onEvent: (event: GovernorEvent) => Effect.Effect<void>
+) =>
+  Effect.gen(function* () {
+    const scope = yield* Effect.scope;
+    const sent = yield* Ref.make<ReadonlyArray<number>>([]);
+    // Whether the last request was turned away by the per-minute cap.
+    const capped = yield* Ref.make(false);
+    const circuit = yield* Ref.make<CircuitState>({
+      open: false,
+      consecutiveFailures: 0,
+      trips: 0,
+    });
+
+    const backoffFor = (trips: number) =>
+      Random.nextRange(0.5, 1.5).pipe(
+        Effect.map((jitter) =>
+          Duration.min(
+            Duration.times(
+              Duration.decode(options.baseBackoff),
+              2 ** (trips - 1) * jitter
+            ),
+            Duration.decode(options.maxBackoff)
+          )
+        )
+      );
+
+    const close = Effect.gen(function* () {
+      yield* Ref.update(circuit, (s) => ({
+        ...s,
+        open: false,
+        consecutiveFailures: 0,
+      }));
+      yield* Effect.log("OpenAI circuit closed, resuming requests");
+      yield* onEvent({ _tag: "Closed" });
+    });
+
+    const trip = Effect.gen(function* () {
+      const state = yield* Ref.updateAndGet(circuit, (s) => ({
+        ...s,
+        open: true,
+        trips: s.trips + 1,
+      }));
+      const retryIn = yield* backoffFor(state.trips);
+      yield* Effect.logWarning(
+        `OpenAI circuit opened after ${state.consecutiveFailures} errors, retrying in ${Duration.format(retryIn)}`
+      );
+      yield* onEvent({ _tag: "Opened", retryIn });
+      yield* close.pipe(Effect.delay(retryIn), Effect.forkIn(scope));
+    });
+
+    return {
+      isOpen: Ref.get(circuit).pipe(Effect.map((s) => s.open)),
+      // Claims a response.create slot, or returns false if the circuit is
+      // open or the per-minute budget is spent. The cap turning requests
+      // away is announced once, until a slot is claimed again.
+      tryAcquire: Effect.gen(function* () {
+        if ((yield* Ref.get(circuit)).open) return false;
+        const now = yield* Clock.currentTimeMillis;
+        const recent = yield* Ref.modify(sent, (times) => {
+          const recent = times.filter((t) => now - t < 60_000);
+          return [
+            recent,
+            recent.length < options.maxResponsesPerMinute
+              ? [...recent, now]
+              : recent,
+          ];
+        });
+        const acquired = recent.length < options.maxResponsesPerMinute;
+        const wasCapped = yield* Ref.getAndSet(capped, !acquired);
+        if (!acquired && !wasCapped) {
+          const retryIn = Duration.millis(60_000 - (now - (recent[0] ?? now)));
+          yield* Effect.logWarning(
+            `OpenAI request cap reached, next slot in ${Duration.format(retryIn)}`
+          );
+          yield* onEvent({ _tag: "Capped", retryIn });
+        } else if (acquired && wasCapped) {
+          yield* onEvent({ _tag: "Uncapped" });
+        }
+        return acquired;
+      }),
+      recordFailure: Effect.gen(function* () {
+        const state = yield* Ref.updateAndGet(circuit, (s) => ({
+          ...s,
+          consecutiveFailures: s.consecutiveFailures + 1,
+        }));
+        if (
+          !state.open &&
+          state.consecutiveFailures >= options.failureThreshold
+        ) {
+          yield* trip;
+        }
+      }),
+      recordSuccess: Ref.update(circuit, (s) =>
+        s.open ? s : { ...s, consecutiveFailures: 0, trips: 0 }
+      ),
+    } as const;
+  });
@@ -0,0 +1,47 @@
+import { Effect } from "effect";
+
+export interface RingBuffer {
+  readonly write: (chunk: Uint8Array) => void;
+  // Oldest-first views over the buffered bytes (at most two).
+  readonly read: () => ReadonlyArray<Buffer>;
+  readonly size: () => number;
+  readonly clear: () => void;
+}
+
+// Fixed-capacity byte ring that keeps the most recent `capacity` bytes written,
+// overwriting the oldest ones once full.
+export const makeRingBuffer = (capacity: number) =>
+  Effect.sync((): RingBuffer => {
+    const data = Buffer.allocUnsafe(capacity);
+    let start = 0;
+    let length = 0;
+
+    const write = (chunk: Uint8Array) => {
+      const src =
+        chunk.length > capacity ? chunk.subarray(chunk.length - capacity) : chunk;
+      const end = (start + length) % capacity;
+      const first = Math.min(src.length, capacity - end);
+      data.set(src.subarray(0, first), end);
+      data.set(src.subarray(first), 0);
+
+      const overflow = Math.max(0, length + src.length - capacity);
+      start = (start + overflow) % capacity;
+      length = Math.min(capacity, length + src.length);
+    };
+
+    return {
+      write,
+      read: () => {
+        if (length === 0) return [];
+        const end = start + length;
+        return end <= capacity
+          ? [data.subarray(start, end)]
+          : [data.subarray(start), data.subarray(0, end - capacity)];
+      },
+      size: () => length,
+      clear: () => {
+        start = 0;
+        length = 0;
+      },
+    };
+  });
@@ -0,0 +1,514 @@
+import { S3Client } from "bun";
+import { Effect, Schedule } from "effect";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import type { TaskId } from "./Tasks.js";
+import {
+  type CoverageDiff,
+  type EmbeddedChunk,
+  type Feedback,
+  type FeedbackStats,
+  HIT_END,
+  HIT_START,
+  type ListenSession,
+  type LoggedBroadcast,
+  markSnippet,
+  type MetricsSnapshot,
+  type RepeatedSegment,
+  timelineBuckets,
+  type Transcript,
+  type TranscriptBackend,
+  type TranscriptMatch,
+  TranscriptStoreError,
+  type TranscriptTags,
+} from "./TranscriptBackend.js";
+
+// One line of a JSONL object. Later lines replace earlier ones, except that a
+// transcript is never replaced.
+type Line =
+  | ({ readonly type: "transcript" } & Transcript)
+  | ({ readonly type: "tags"; readonly responseId: string } & TranscriptTags)
+  | {
+      readonly type: "embeddings";
+      readonly responseId: string;
+      readonly model: string;
+      // Vectors as base64 of their float32 bytes.
+      readonly chunks: ReadonlyArray<{ text: string; vector: string }>;
+    }
+  | ({ readonly type: "session" } & ListenSession)
+  | ({ readonly type: "coverage" } & CoverageDiff)
+  | ({ readonly type: "snapshot" } & MetricsSnapshot)
+  | ({ readonly type: "feedback" } & Feedback)
+  | ({ readonly type: "repeat" } & RepeatedSegment)
+  | ({ readonly type: "broadcast" } & LoggedBroadcast);
+
+type Sentiment = TranscriptTags["sentiment"];
+
+type EmbeddingsLine = Extract<Line, { type: "embeddings" }>;
+
+const FLUSH_INTERVAL = "1 minute";
+
+const SNIPPET_WORDS = 16;
+
+// Words as FTS5's unicode61 tokenizer sees them: lowercase, without
+// diacritics or punctuation.
+const normalizeWord = (word: string) =>
+  word
+    .normalize("NFD")
+    .replace(/\p{Diacritic}/gu, "")
+    .replace(/[^\p{L}\p{N}]/gu, "")
+    .toLowerCase();
+
+const toVector = (base64: string) =>
+  new Float32Array(new Uint8Array(Buffer.from(base64, "base64")).buffer);
+
+const byNewest = (a: Transcript, b: Transcript) =>
+  b.completedAt - a.completedAt;
+
+const byOldest = (a: Transcript, b: Transcript) =>
+  a.completedAt - b.completedAt;
+
+// Transcripts as JSONL objects in an S3 bucket under `prefix`, for archives
+// that outlive the app. Everything is read into memory at start and queried
+// there; changes are written as a new object every minute, and on shutdown.
+// Credentials and endpoint come from the S3_* or AWS_* environment variables.
+export const makeS3Transcripts = (bucket: string, prefix: string) =>
+  Effect.gen(function* () {
+    const supervisor = yield* PipelineSupervisor;
+    const client = new S3Client({ bucket });
+    const transcripts = new Map<string, Transcript>();
+    const tags = new Map<string, TranscriptTags>();
+    // By model, then response id.
+    const embedded = new Map<string, Map<string, EmbeddingsLine>>();
+    const sessions = new Map<string, ListenSession>();
+    // By hour.
+    const coverage = new Map<number, CoverageDiff>();
+    const snapshots: Array<MetricsSnapshot> = [];
+    const feedback: Array<Feedback> = [];
+    const repeats: Array<RepeatedSegment> = [];
+    // By key; pruning only forgets them here, older objects keep theirs.
+    const broadcasts = new Map<string, LoggedBroadcast>();
+    let pending: Array<string> = [];
+
+    const apply = (line: Line) => {
+      switch (line.type) {
+        case "transcript": {
+          const { type: _, ...transcript } = line;
+          if (!transcripts.has(line.responseId)) {
+            transcripts.set(line.responseId, transcript);
+          }
+          break;
+        }
+        case "tags":
+          tags.set(line.responseId, {
+            topics: line.topics,
+            sentiment: line.sentiment,
+          });
+          break;
+        case "embeddings": {
+          const forModel = embedded.get(line.model) ?? new Map();
+          forModel.set(line.responseId, line);
+          embedded.set(line.model, forModel);
+          break;
+        }
+        case "session": {
+          const { type: _, ...session } = line;
+          sessions.set(line.id, session);
+          break;
+        }
+        case "coverage": {
+          const { type: _, ...diff } = line;
+          coverage.set(line.hour, diff);
+          break;
+        }
+        case "snapshot": {
+          const { type: _, ...snapshot } = line;
+          snapshots.push(snapshot);
+          break;
+        }
+        case "feedback": {
+          const { type: _, ...rating } = line;
+          feedback.push(rating);
+          break;
+        }
+        case "repeat": {
+          const { type: _, ...segment } = line;
+          repeats.push(segment);
+          break;
+        }
+        case "broadcast": {
+          const { type: _, ...entry } = line;
+          if (!broadcasts.has(entry.key)) broadcasts.set(entry.key, entry);
+          break;
+        }
+      }
+    };
+
+    const write = (line: Line) =>
+      Effect.sync(() => {
+        apply(line);
+        pending.push(JSON.stringify(line));
+      });
+
+    // Object keys sort in the order they were written.
+    const load = Effect.tryPromise({
+      try: async () => {
+        const keys: Array<string> = [];
+        let continuationToken: string | undefined;
+        do {
+          const page = await client.list({ prefix, continuationToken });
+          keys.push(...(page.contents ?? []).map((object) => object.key));
+          continuationToken = page.isTruncated
+            ? page.nextContinuationToken
+            : undefined;
+        } while (continuationToken);
+        for (const key of keys.sort()) {
+          const text = await client.file(key).text();
+          for (const line of text.split("\n")) {
+            if (line.trim() !== "") apply(JSON.parse(line));
+          }
+        }
+        return keys.length;
+      },
+      catch: (cause) => new TranscriptStoreError({ cause }),
+    });
+
+    const flush = Effect.suspend(() => {
+      if (pending.length === 0) return Effect.void;
+      const lines = pending;
+      pending = [];
+      const now = new Date();
+      const key =
+        `${prefix}${now.toISOString().slice(0, 10)}/` +
+        `${now.getTime()}-${crypto.randomUUID()}.jsonl`;
+      return Effect.tryPromise({
+        try: () => client.write(key, `${lines.join("\n")}\n`),
+        catch: (cause) => new TranscriptStoreError({ cause }),
+      }).pipe(
+        // Kept for the next flush rather than lost.
+        Effect.tapError(() =>
+          Effect.sync(() => {
+            pending = [...lines, ...pending];
+          })
+        ),
+        Effect.asVoid
+      );
+    });
+
+    const objects = yield* load;
+    yield* Effect.log(
+      `Loaded ${transcripts.size} transcripts from ${objects} objects in s3://${bucket}/${prefix}`
+    );
+    yield* flush.pipe(
+      Effect.catchAll((e) =>
+        Effect.logError("Failed to write transcripts to S3", e.cause)
+      ),
+      Effect.repeat(Schedule.spaced(FLUSH_INTERVAL)),
+      (loop) => supervisor.supervise("s3-flush", loop),
+      Effect.forkScoped
+    );
+    yield* Effect.addFinalizer(() =>
+      flush.pipe(
+        Effect.catchAll((e) =>
+          Effect.logError("Failed to write transcripts to S3", e.cause)
+        )
+      )
+    );
+
+    const all = () => Array.from(transcripts.values());
+
+    const inRange = (t: Transcript, from?: number, to?: number) =>
+      (from === undefined || t.completedAt >= from) &&
+      (to === undefined || t.completedAt < to);
+
+    const ofTasks = (tasks: ReadonlyArray<TaskId>) => (t: Transcript) =>
+      tasks.includes(t.task);
+
+    // Every query word must be in the text. The snippet is the words around
+    // the first hit, with hits marked.
+    const match = (
+      t: Transcript,
+      words: ReadonlySet<string>
+    ): TranscriptMatch | null => {
+      const tokens = t.text.split(/\s+/).filter((token) => token !== "");
+      const hits = tokens.map((token) => words.has(normalizeWord(token)));
+      const found = new Set(
+        tokens.filter((_, i) => hits[i]).map(normalizeWord)
+      );
+      if (found.size < words.size) return null;
+      const first = hits.indexOf(true);
+      const start = Math.max(0, first - SNIPPET_WORDS / 2);
+      const end = Math.min(tokens.length, start + SNIPPET_WORDS);
+      const snippet = tokens
+        .slice(start, end)
+        .map((token, i) =>
+          hits[start + i] ? `${HIT_START}${token}${HIT_END}` : token
+        )
+        .join(" ");
+      const before = start > 0 ? "…" : "";
+      const after = end < tokens.length ? "…" : "";
+      return { ...t, snippet: markSnippet(`${before}${snippet}${after}`) };
+    };
+
+    const backend: TranscriptBackend = {
+      insert: (transcript) =>
+        Effect.suspend(() =>
+          transcripts.has(transcript.responseId)
+            ? Effect.void
+            : write({ type: "transcript", ...transcript })
+        ),
+      saveTags: (responseId, t) => write({ type: "tags", responseId, ...t }),
+      topicTimeline: (query) =>
+        Effect.sync(() => {
+          // Counts by bucket start, then sentiment or topic.
+          const sentiments = new Map<number, Map<Sentiment, number>>();
+          const topics = new Map<number, Map<string, number>>();
+          const count = <K>(
+            counts: Map<number, Map<K, number>>,
+            start: number,
+            key: K
+          ) => {
+            const bucket = counts.get(start) ?? new Map<K, number>();
+            bucket.set(key, (bucket.get(key) ?? 0) + 1);
+            counts.set(start, bucket);
+          };
+          for (const t of all()) {
+            const tagged = tags.get(t.responseId);
+            if (
+              !tagged ||
+              (query.source !== undefined && t.source !== query.source) ||
+              !inRange(t, query.from, query.to)
+            ) {
+              continue;
+            }
+            const start =
+              Math.floor(t.completedAt / query.bucketMs) * query.bucketMs;
+            count(sentiments, start, tagged.sentiment);
+            for (const topic of new Set(tagged.topics)) {
+              count(topics, start, topic);
+            }
+          }
+          return timelineBuckets(
+            Array.from(sentiments).flatMap(([start, counts]) =>
+              Array.from(counts, ([sentiment, n]) => ({
+                start,
+                sentiment,
+                count: n,
+              }))
+            ),
+            Array.from(topics).flatMap(([start, counts]) =>
+              Array.from(counts, ([topic, n]) => ({
+                start,
+                topic,
+                count: n,
+              })).sort(
+                (a, b) => b.count - a.count || a.topic.localeCompare(b.topic)
+              )
+            )
+          );
+        }),
+      saveEmbeddings: (responseId, model, chunks) =>
+        write({
+          type: "embeddings",
+          responseId,
+          model,
+          chunks: chunks.map((chunk) => ({
+            text: chunk.text,
+            vector: Buffer.from(
+              chunk.vector.buffer,
+              chunk.vector.byteOffset,
+              chunk.vector.byteLength
+            ).toString("base64"),
+          })),
+        }),
+      embeddings: (model) =>
+        Effect.sync(() =>
+          Array.from(embedded.get(model)?.values() ?? []).flatMap((line) => {
+            const t = transcripts.get(line.responseId);
+            if (!t) return [];
+            return line.chunks.map(
+              (chunk): EmbeddedChunk => ({
+                responseId: line.responseId,
+                source: t.source,
+                program: t.program,
+                completedAt: t.completedAt,
+                text: chunk.text,
+                vector: toVector(chunk.vector),
+              })
+            );
+          })
+        ),
+      unembedded: (model, tasks, limit) =>
+        Effect.sync(() => {
+          const done = embedded.get(model);
+          return all()
+            .filter((t) => ofTasks(tasks)(t) && !done?.has(t.responseId))
+            .sort(byNewest)
+            .slice(0, limit);
+        }),
+      byResponseIds: (responseIds) =>
+        Effect.sync(() =>
+          responseIds.flatMap((id) => {
+            const t = transcripts.get(id);
+            return t ? [t] : [];
+          })
+        ),
+      between: (params) =>
+        Effect.sync(() =>
+          all()
+            .filter(
+              (t) =>
+                t.source === params.source &&
+                ofTasks(params.tasks)(t) &&
+                inRange(t, params.from, params.to)
+            )
+            .sort(byOldest)
+        ),
+      archive: (params) =>
+        Effect.sync(() => {
+          const matching = all()
+            .filter(
+              (t) =>
+                t.source === params.source &&
+                (params.task === undefined || t.task === params.task) &&
+                inRange(t, params.from, params.to)
+            )
+            .sort(byOldest);
+          return {
+            index: matching.map((t) => ({
+              completedAt: t.completedAt,
+              program: t.program,
+            })),
+            transcripts: matching.slice(
+              params.offset,
+              params.offset + params.limit
+            ),
+          };
+        }),
+      saveFeedback: (rating) => write({ type: "feedback", ...rating }),
+      saveRepeat: (segment) => write({ type: "repeat", ...segment }),
+      repeats: (query) =>
+        Effect.sync(() =>
+          repeats
+            .filter(
+              (r) =>
+                (query.source === undefined || r.source === query.source) &&
+                (query.fingerprint === undefined ||
+                  r.fingerprint === query.fingerprint) &&
+                (query.from === undefined || r.recordedAt >= query.from) &&
+                (query.to === undefined || r.recordedAt < query.to)
+            )
+            .sort((a, b) => b.recordedAt - a.recordedAt)
+            .slice(0, query.limit)
+        ),
+      logBroadcast: (entry) =>
+        broadcasts.has(entry.key)
+          ? Effect.void
+          : write({ type: "broadcast", ...entry }),
+      broadcastsSince: (since, limit) =>
+        Effect.sync(() =>
+          Array.from(broadcasts.values())
+            .filter((entry) => entry.at >= since)
+            .sort((a, b) => a.at - b.at)
+            .slice(0, limit)
+        ),
+      pruneBroadcasts: (before) =>
+        Effect.sync(() => {
+          for (const [key, entry] of broadcasts) {
+            if (entry.at < before) broadcasts.delete(key);
+          }
+        }),
+      feedbackStats: (params) =>
+        Effect.sync(() => {
+          const groups = new Map<string, FeedbackStats>();
+          for (const f of feedback) {
+            const t = transcripts.get(f.responseId);
+            if (
+              !t ||
+              (params.from !== undefined && f.createdAt < params.from) ||
+              (params.to !== undefined && f.createdAt >= params.to)
+            ) {
+              continue;
+            }
+            const key = JSON.stringify([t.source, t.task]);
+            const stats = groups.get(key) ?? {
+              source: t.source,
+              task: t.task,
+              count: 0,
+              averageRating: 0,
+              low: 0,
+              high: 0,
+              comments: 0,
+            };
+            groups.set(key, {
+              ...stats,
+              count: stats.count + 1,
+              // The sum, until divided below.
+              averageRating: stats.averageRating + f.rating,
+              low: stats.low + (f.rating <= 2 ? 1 : 0),
+              high: stats.high + (f.rating >= 4 ? 1 : 0),
+              comments: stats.comments + (f.comment === null ? 0 : 1),
+            });
+          }
+          return Array.from(groups.values())
+            .map((s) => ({ ...s, averageRating: s.averageRating / s.count }))
+            .sort(
+              (a, b) =>
+                b.count - a.count ||
+                (a.source ?? "").localeCompare(b.source ?? "") ||
+                a.task.localeCompare(b.task)
+            );
+        }),
+      saveSession: (session) => write({ type: "session", ...session }),
+      sessions: (limit) =>
+        Effect.sync(() =>
+          Array.from(sessions.values())
+            .sort((a, b) => b.endedAt - a.endedAt)
+            .slice(0, limit)
+        ),
+      saveSnapshot: (snapshot) => write({ type: "snapshot", ...snapshot }),
+      snapshots: (from, to) =>
+        Effect.sync(() =>
+          snapshots
+            .filter((s) => s.at >= from && s.at < to)
+            .sort((a, b) => a.at - b.at)
+        ),
+      saveCoverage: (diff) => write({ type: "coverage", ...diff }),
+      coverage: (hour) => Effect.sync(() => coverage.get(hour) ?? null),
+      recent: (limit) =>
+        Effect.sync(() => all().sort(byNewest).slice(0, limit)),
+      recentOf: (params) =>
+        Effect.sync(() =>
+          all()
+            .filter(
+              (t) =>
+                ofTasks(params.tasks)(t) &&
+                (params.source === undefined || t.source === params.source)
+            )
+            .sort(byNewest)
+            .slice(0, params.limit)
+        ),
+      // Without a relevance rank, best matches are the most recent.
+      search: (params) =>
+        Effect.sync(() => {
+          const words = new Set(
+            params.query
+              .split(/\s+/)
+              .map(normalizeWord)
+              .filter((word) => word !== "")
+          );
+          if (words.size === 0) return [];
+          return all()
+            .filter(
+              (t) =>
+                (params.source === undefined || t.source === params.source) &&
+                (params.program === undefined ||
+                  t.program === params.program) &&
+                inRange(t, params.from, params.to)
+            )
+            .sort(byNewest)
+            .flatMap((t) => match(t, words) ?? [])
+            .slice(0, params.limit);
+        }),
+    };
+    return backend;
+  });
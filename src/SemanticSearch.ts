@@ -0,0 +1,303 @@
+import {
+  HttpClient,
+  HttpClientRequest,
+  HttpClientResponse,
+} from "@effect/platform";
+import {
+  Clock,
+  Config,
+  Data,
+  Effect,
+  Option,
+  Queue,
+  Redacted,
+  Ref,
+  Schema,
+  Stream,
+} from "effect";
+import type { AudioSourceId } from "./AudioSource.js";
+import { type EventOf, PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { parseSpeakerSegments } from "./SpeakerSegments.js";
+import { RESPONSE_TASKS, type TaskId } from "./Tasks.js";
+import type { EmbeddedChunk, Transcript } from "./TranscriptBackend.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+
+export class SemanticSearchDisabledError extends Data.TaggedError(
+  "SemanticSearchDisabledError"
+) {}
+
+export class EmbeddingError extends Data.TaggedError("EmbeddingError")<{
+  message: string;
+}> {}
+
+export interface SemanticSearchQuery {
+  readonly query: string;
+  readonly source?: AudioSourceId | undefined;
+  readonly program?: string | undefined;
+  readonly from?: number | undefined;
+  readonly to?: number | undefined;
+  readonly limit: number;
+}
+
+export interface SemanticMatch extends Transcript {
+  // Chunk closest to the query.
+  readonly snippet: string;
+  // Cosine similarity of that chunk to the query, from -1 to 1.
+  readonly score: number;
+}
+
+const EmbeddingsResponse = Schema.Struct({
+  data: Schema.Array(
+    Schema.Struct({
+      index: Schema.Number,
+      embedding: Schema.Array(Schema.Number),
+    })
+  ),
+});
+
+const SemanticSearchConfig = Config.all({
+  enabled: Config.boolean("SEMANTIC_SEARCH").pipe(Config.withDefault(false)),
+  apiKey: Config.option(Config.redacted("OPENAI_API_KEY")),
+  apiUrl: Config.string("OPENAI_API_URL").pipe(
+    Config.withDefault("https://api.openai.com/v1")
+  ),
+  model: Config.string("EMBEDDING_MODEL").pipe(
+    Config.withDefault("text-embedding-3-small")
+  ),
+  dimensions: Config.integer("EMBEDDING_DIMENSIONS").pipe(
+    Config.withDefault(512)
+  ),
+});
+
+// Tasks whose text is worth searching; digests are JSON.
+const TEXT_TASKS = (Object.keys(RESPONSE_TASKS) as Array<TaskId>).filter(
+  (task) => RESPONSE_TASKS[task].format === "text"
+);
+
+// Transcripts embedded per request while catching up on stored ones.
+const BACKFILL_BATCH = 20;
+
+// A transcription is embedded per speaker turn, so a search lands on the
+// turn that talks about it; other responses are short enough to embed whole.
+const chunksOf = (transcript: Transcript) => {
+  const turns = transcript.segments
+    .map((s) => (s.speaker ? `${s.speaker}: ${s.text}` : s.text).trim())
+    .filter((text) => text.length > 0);
+  return turns.length > 1 ? turns : [transcript.text.trim()];
+};
+
+// Unit length, so a dot product is the cosine similarity.
+const normalize = (values: ReadonlyArray<number>) => {
+  const vector = Float32Array.from(values);
+  const norm = Math.hypot(...vector);
+  if (norm > 0) for (let i = 0; i < vector.length; i++) vector[i]! /= norm;
+  return vector;
+};
+
+const dot = (a: Float32Array, b: Float32Array) => {
+  let sum = 0;
+  for (let i = 0; i < Math.min(a.length, b.length); i++) sum += a[i]! * b[i]!;
+  return sum;
+};
+
+// Finds stored transcripts by meaning rather than words. Every completed
+// text response is split into chunks, embedded with the OpenAI embeddings
+// API and stored next to its transcript; the vectors of the model in use are
+// kept in memory and searched exhaustively, which stays fast for the few
+// hundred thousand chunks a station produces in a year. Transcripts stored
+// before it was enabled are embedded in the background at startup. Enabled
+// with SEMANTIC_SEARCH=true.
+export class SemanticSearch extends Effect.Service<SemanticSearch>()(
+  "SemanticSearch",
+  {
+    scoped: Effect.gen(function* () {
+      const config = yield* SemanticSearchConfig;
+      const client = yield* HttpClient.HttpClient;
+      const events = yield* PipelineEvents;
+      const supervisor = yield* PipelineSupervisor;
+      const store = yield* TranscriptStore;
+      const index = yield* Ref.make<ReadonlyArray<EmbeddedChunk>>([]);
+      const enabled = config.enabled && Option.isSome(config.apiKey);
+      if (config.enabled && !enabled) {
+        yield* Effect.logWarning("Semantic search needs OPENAI_API_KEY");
+      }
+
+      const embed = (inputs: ReadonlyArray<string>) =>
+        HttpClientRequest.post(`${config.apiUrl}/embeddings`).pipe(
+          HttpClientRequest.bearerToken(
+            Redacted.value(Option.getOrThrow(config.apiKey))
+          ),
+          HttpClientRequest.bodyUnsafeJson({
+            model: config.model,
+            input: inputs,
+            dimensions: config.dimensions,
+          }),
+          (request) => client.execute(request),
+          Effect.flatMap(HttpClientResponse.filterStatusOk),
+          Effect.flatMap(HttpClientResponse.schemaBodyJson(EmbeddingsResponse)),
+          Effect.timeout("30 seconds"),
+          Effect.scoped,
+          Effect.map((body) =>
+            [...body.data]
+              .sort((a, b) => a.index - b.index)
+              .map((d) => normalize(d.embedding))
+          ),
+          Effect.mapError(
+            (e) =>
+              new EmbeddingError({
+                message: e instanceof Error ? e.message : String(e),
+              })
+          )
+        );
+
+      // Embeds the transcripts in one request, then stores and indexes them.
+      const embedAll = (transcripts: ReadonlyArray<Transcript>) =>
+        Effect.gen(function* () {
+          const chunks = transcripts.map(chunksOf);
+          const vectors = yield* embed(chunks.flat());
+          let next = 0;
+          for (const [i, transcript] of transcripts.entries()) {
+            const embedded = chunks[i]!.map((text) => ({
+              text,
+              vector: vectors[next++]!,
+            }));
+            yield* store.saveEmbeddings(
+              transcript.responseId,
+              config.model,
+              embedded
+            );
+            // A transcript can be embedded both live and by the catch-up.
+            yield* Ref.update(index, (all) => [
+              ...all.filter((c) => c.responseId !== transcript.responseId),
+              ...embedded.map(
+                (chunk): EmbeddedChunk => ({
+                  ...chunk,
+                  responseId: transcript.responseId,
+                  source: transcript.source,
+                  program: transcript.program,
+                  completedAt: transcript.completedAt,
+                })
+              ),
+            ]);
+          }
+        });
+
+      if (!enabled) {
+        yield* Effect.log("Semantic search disabled");
+      } else {
+        yield* Ref.set(index, yield* store.embeddings(config.model));
+
+        // Newest first, until every stored transcript is embedded; stops at
+        // the first failure so an outage doesn't loop.
+        yield* store.unembedded(config.model, TEXT_TASKS, BACKFILL_BATCH).pipe(
+          Effect.flatMap((batch) =>
+            batch.length === 0
+              ? Effect.succeed(false)
+              : embedAll(batch).pipe(Effect.as(true))
+          ),
+          Effect.repeat({ while: (more) => more }),
+          Effect.catchAll((e) =>
+            Effect.logWarning("Embedding stored transcripts failed", e)
+          ),
+          Effect.forkScoped
+        );
+
+        // Queued from the start, for the supervised loop below. Unlike the
+        // broadcast, pipeline events are only seen by the replica that ran
+        // the response, so each one is embedded once.
+        const completed =
+          yield* Queue.unbounded<EventOf<"ResponseCompleted">>();
+        yield* events.on("ResponseCompleted", (msg) =>
+          Queue.offer(completed, msg)
+        );
+
+        yield* Stream.fromQueue(completed).pipe(
+          Stream.filter(
+            (msg) =>
+              msg.text.trim() !== "" &&
+              RESPONSE_TASKS[msg.task].format === "text"
+          ),
+          Stream.runForEach((msg) =>
+            Effect.gen(function* () {
+              const transcript: Transcript = {
+                responseId: msg.responseId,
+                task: msg.task,
+                source: msg.source,
+                program: msg.program,
+                text: msg.text,
+                completedAt: yield* Clock.currentTimeMillis,
+                windowStart: msg.windowStart,
+                windowEnd: msg.windowEnd,
+                segments:
+                  msg.task === "transcribe"
+                    ? parseSpeakerSegments(msg.text)
+                    : [],
+              };
+              // In the background, so a slow answer doesn't hold up the
+              // next responses.
+              yield* embedAll([transcript]).pipe(
+                Effect.catchAll((e) =>
+                  Effect.logWarning(
+                    `Response ${msg.responseId} not embedded`,
+                    e
+                  )
+                ),
+                Effect.forkScoped
+              );
+            })
+          ),
+          (loop) => supervisor.supervise("semantic-search", loop),
+          Effect.forkScoped
+        );
+        yield* Effect.log(`Semantic search enabled (${config.model})`);
+      }
+
+      const search = (query: SemanticSearchQuery) =>
+        Effect.gen(function* () {
+          if (query.query.trim() === "") return [];
+          const [vector] = yield* embed([query.query]);
+          const best = new Map<string, { text: string; score: number }>();
+          for (const chunk of yield* Ref.get(index)) {
+            if (
+              (query.source && chunk.source !== query.source) ||
+              (query.program && chunk.program !== query.program) ||
+              (query.from !== undefined && chunk.completedAt < query.from) ||
+              (query.to !== undefined && chunk.completedAt >= query.to)
+            ) {
+              continue;
+            }
+            const score = dot(vector!, chunk.vector);
+            const current = best.get(chunk.responseId);
+            if (!current || score > current.score) {
+              best.set(chunk.responseId, { text: chunk.text, score });
+            }
+          }
+          const top = Array.from(best.entries())
+            .sort(([, a], [, b]) => b.score - a.score)
+            .slice(0, query.limit);
+          const transcripts = new Map(
+            (yield* store.byResponseIds(top.map(([id]) => id))).map((t) => [
+              t.responseId,
+              t,
+            ])
+          );
+          return top.flatMap(([id, match]): Array<SemanticMatch> => {
+            const transcript = transcripts.get(id);
+            return transcript
+              ? [{ ...transcript, snippet: match.text, score: match.score }]
+              : [];
+          });
+        });
+
+      return {
+        // Best matches first, one per transcript. An empty query matches
+        // nothing.
+        search: (query: SemanticSearchQuery) =>
+          enabled
+            ? search(query)
+            : Effect.fail(new SemanticSearchDisabledError()),
+      } as const;
+    }),
+  }
+) {}
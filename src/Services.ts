@@ -0,0 +1,76 @@
+import { FetchHttpClient } from "@effect/platform";
+import { BunContext } from "@effect/platform-bun";
+import { Layer } from "effect";
+import { Accounts } from "./Accounts.js";
+import { AppConfig } from "./AppConfig.js";
+import type { AudioSource } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { Budgets } from "./Budgets.js";
+import { Comparison } from "./Comparison.js";
+import { CoverageAnalysis } from "./CoverageAnalysis.js";
+import { FileJobs } from "./FileJobs.js";
+import { Fingerprints } from "./Fingerprints.js";
+import { IdleMonitor } from "./IdleMonitor.js";
+import { ListenSessions } from "./ListenSessions.js";
+import { LiveMetrics } from "./LiveMetrics.js";
+import { MetricsSnapshots } from "./MetricsSnapshots.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { ErrorWebhookLive } from "./PipelineErrors.js";
+import { PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { Playlists } from "./Playlists.js";
+import { Presets } from "./Presets.js";
+import { PushNotifications } from "./PushNotifications.js";
+import { SemanticSearch } from "./SemanticSearch.js";
+import { SourceStats } from "./SourceStats.js";
+import { StationMetadata } from "./StationMetadata.js";
+import { SttFallback } from "./SttFallback.js";
+import { Tagging } from "./Tagging.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+import { Translations } from "./Translations.js";
+
+// Every service of the server, over the given audio source: the ffmpeg one
+// in production, a synthetic one in the end-to-end check, which so runs the
+// same graph.
+export const makeServicesLive = <E, R>(
+  audioSource: Layer.Layer<AudioSource, E, R>
+) =>
+  Layer.mergeAll(
+    Layer.mergeAll(
+      Tagging.Default,
+      CoverageAnalysis.Default,
+      ListenSessions.Default,
+      MetricsSnapshots.Default,
+      SemanticSearch.Default.pipe(Layer.provide(FetchHttpClient.layer))
+    ).pipe(Layer.provideMerge(TranscriptStore.Default)),
+    Comparison.Default,
+    Playlists.Default,
+    Budgets.Default.pipe(Layer.provide(BunContext.layer)),
+    LiveMetrics.Default,
+    SourceStats.Default,
+    Translations.Default,
+    SttFallback.Default.pipe(
+      Layer.provide(Layer.mergeAll(BunContext.layer, FetchHttpClient.layer))
+    ),
+    StationMetadata.Default.pipe(Layer.provide(FetchHttpClient.layer)),
+    FileJobs.Default.pipe(Layer.provide(BunContext.layer)),
+    Presets.Default.pipe(Layer.provide(BunContext.layer)),
+    Accounts.Default.pipe(Layer.provide(BunContext.layer)),
+    Fingerprints.Default.pipe(Layer.provide(BunContext.layer)),
+    PushNotifications.Default.pipe(
+      Layer.provide(Layer.mergeAll(BunContext.layer, FetchHttpClient.layer))
+    ),
+    ErrorWebhookLive.pipe(Layer.provide(FetchHttpClient.layer))
+  ).pipe(
+    Layer.provideMerge(
+      Layer.mergeAll(audioSource, OpenAIRealtime.Default, IdleMonitor.Default)
+    ),
+    Layer.provideMerge(
+      Layer.mergeAll(
+        AppConfig.Default.pipe(Layer.provide(BunContext.layer)),
+        Broadcaster.Default,
+        PipelineEvents.Default,
+        PipelineSupervisor.Default
+      )
+    )
+  );
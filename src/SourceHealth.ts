@@ -0,0 +1,167 @@
+import { Clock, Config, Effect, Ref } from "effect";
+import type { SourceConfig } from "./AppConfig.js";
+
+// How a stream read from one of a source's URLs went wrong: ffmpeg exited
+// before any audio came through, exited later, or stopped producing audio.
+export type StreamFailure = "unreachable" | "exited" | "stalled";
+
+// Points taken off a URL's score for each failure, out of 100.
+const PENALTIES: Record<StreamFailure, number> = {
+  unreachable: 40,
+  exited: 20,
+  stalled: 25,
+};
+
+// Points a URL gets back for every minute without failures, so one that was
+// left for a backup is tried again once the backup fails in turn.
+const RECOVERY_PER_MINUTE = 5;
+
+const MAX_SCORE = 100;
+
+// FAILOVER_THRESHOLD (default 50) is the score under which a source's URL is
+// passed over for the next one; STREAM_STALL_SECONDS (default 30) is how long
+// a stream may go without audio before it is counted as stalled and
+// restarted.
+export const SourceHealthConfig = Config.all({
+  threshold: Config.number("FAILOVER_THRESHOLD").pipe(
+    Config.withDefault(50),
+    Config.validate({
+      message: "Expected FAILOVER_THRESHOLD to be between 0 and 100",
+      validation: (score) => score >= 0 && score <= MAX_SCORE,
+    })
+  ),
+  stallSeconds: Config.number("STREAM_STALL_SECONDS").pipe(
+    Config.withDefault(30),
+    Config.validate({
+      message: "Expected STREAM_STALL_SECONDS to be positive",
+      validation: (seconds) => seconds > 0,
+    })
+  ),
+});
+
+export interface UrlHealth {
+  readonly url: string;
+  readonly score: number;
+  readonly failures: number;
+  readonly lastFailure: {
+    readonly kind: StreamFailure;
+    readonly at: number;
+  } | null;
+  readonly active: boolean;
+}
+
+interface Entry {
+  // Score right after the last failure, recovering from `at` on.
+  readonly score: number;
+  readonly at: number;
+  readonly failures: number;
+  readonly kind: StreamFailure;
+}
+
+// The primary URL, then the backups in the order they are tried.
+export const sourceUrls = (source: SourceConfig) => [
+  source.url,
+  ...(source.backupUrls ?? []),
+];
+
+const key = (source: SourceConfig, url: string) => `${source.id} ${url}`;
+
+const scoreAt = (entry: Entry | undefined, now: number) =>
+  entry === undefined
+    ? MAX_SCORE
+    : Math.min(
+        MAX_SCORE,
+        entry.score + ((now - entry.at) / 60_000) * RECOVERY_PER_MINUTE
+      );
+
+// Health of the URLs each source is read from, scored from the failures of
+// their streams. A source is read from its first URL scoring at least
+// `threshold`, or the best one if none does, so it falls back on a backup
+// once its primary URL fails repeatedly, and returns to it on a restart once
+// it has had time to recover.
+export const makeSourceHealth = (threshold: number) =>
+  Effect.gen(function* () {
+    const entries = yield* Ref.make(new Map<string, Entry>());
+    // URL each source was last started from.
+    const active = yield* Ref.make(new Map<string, string>());
+
+    const activeUrl = (source: SourceConfig) =>
+      Effect.map(Ref.get(active), (all) => {
+        const url = all.get(source.id);
+        return url !== undefined && sourceUrls(source).includes(url)
+          ? url
+          : source.url;
+      });
+
+    const scores = (source: SourceConfig, now: number) =>
+      Effect.map(Ref.get(entries), (all) =>
+        sourceUrls(source).map((url) => ({
+          url,
+          score: scoreAt(all.get(key(source, url)), now),
+        }))
+      );
+
+    return {
+      // URL to start the source's stream from, and the one it replaces if
+      // that changed since its last start.
+      pick: (source: SourceConfig) =>
+        Effect.gen(function* () {
+          const now = yield* Clock.currentTimeMillis;
+          const urls = yield* scores(source, now);
+          const chosen =
+            urls.find((u) => u.score >= threshold) ??
+            urls.reduce((best, u) => (u.score > best.score ? u : best));
+          const previous = yield* Ref.modify(active, (all) => [
+            all.get(source.id),
+            new Map(all).set(source.id, chosen.url),
+          ]);
+          return {
+            url: chosen.url,
+            score: Math.round(chosen.score),
+            // Only a URL still configured; an edit isn't a failover.
+            replaced:
+              previous !== undefined &&
+              previous !== chosen.url &&
+              urls.some((u) => u.url === previous)
+                ? previous
+                : null,
+          };
+        }),
+      // URL the source was last started from, its primary if none or if it
+      // is no longer configured.
+      current: activeUrl,
+      // Takes a failure off the URL's score; returns the new score.
+      report: (source: SourceConfig, url: string, kind: StreamFailure) =>
+        Effect.flatMap(Clock.currentTimeMillis, (now) =>
+          Ref.modify(entries, (all) => {
+            const entry = all.get(key(source, url));
+            const score = Math.max(0, scoreAt(entry, now) - PENALTIES[kind]);
+            return [
+              Math.round(score),
+              new Map(all).set(key(source, url), {
+                score,
+                at: now,
+                failures: (entry?.failures ?? 0) + 1,
+                kind,
+              }),
+            ];
+          })
+        ),
+      health: (source: SourceConfig) =>
+        Effect.gen(function* () {
+          const now = yield* Clock.currentTimeMillis;
+          const all = yield* Ref.get(entries);
+          const current = yield* activeUrl(source);
+          return sourceUrls(source).map((url): UrlHealth => {
+            const entry = all.get(key(source, url));
+            return {
+              url,
+              score: Math.round(scoreAt(entry, now)),
+              failures: entry?.failures ?? 0,
+              lastFailure: entry ? { kind: entry.kind, at: entry.at } : null,
+              active: url === current,
+            };
+          });
+        }),
+    } as const;
+  });
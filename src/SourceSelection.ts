@@ -0,0 +1,96 @@
+import { FileSystem } from "@effect/platform";
+import { Config, Effect, Option, Ref, Schema } from "effect";
+import { writeFileAtomically } from "./JsonFileStore.js";
+
+export const SelectionReason = Schema.Literal(
+  "request",
+  "preset",
+  "catch-up",
+  "session",
+  "playlist",
+  "removed",
+  "restored"
+).annotations({
+  description:
+    "request: through the API or gRPC; preset: a preset was applied; catch-up: restarted behind live; session: a listening session started or ended; playlist: a playlist rotated; removed: the source was removed; restored: selected again at startup",
+});
+
+export type SelectionReason = typeof SelectionReason.Type;
+
+export const SelectionEvent = Schema.Struct({
+  at: Schema.Number.annotations({
+    description: "When the selection changed, in ms since the epoch",
+  }),
+  source: Schema.NullOr(Schema.String).annotations({
+    description: "Source selected, null when the selection was cleared",
+  }),
+  by: Schema.NullOr(Schema.String).annotations({
+    description:
+      "Account that made the change; null without accounts or when the server did",
+  }),
+  reason: SelectionReason,
+}).annotations({ title: "Selection Event" });
+
+export type SelectionEvent = typeof SelectionEvent.Type;
+
+const decodeEvent = Schema.decodeUnknownOption(
+  Schema.parseJson(SelectionEvent)
+);
+const encodeEvent = Schema.encodeSync(Schema.parseJson(SelectionEvent));
+
+// Events kept in memory, and in the file once it is compacted at startup.
+const MAX_HISTORY = 500;
+
+// SELECTION_FILE (default selection.jsonl) keeps every change of the
+// selected source, one JSON event per line.
+export const SelectionFileConfig = Config.string("SELECTION_FILE").pipe(
+  Config.withDefault("selection.jsonl")
+);
+
+// The selected source as a log of changes: who made each one, when and why.
+// The current selection is the last event's source, so it survives restarts.
+// Lines that no longer decode are skipped; a log grown past twice the history
+// kept is rewritten with its last events at startup. A failed write is logged
+// and the selection changes anyway. Appends are expected one at a time.
+export const makeSelectionLog = (path: string) =>
+  Effect.gen(function* () {
+    const fs = yield* FileSystem.FileSystem;
+
+    const lines = (yield* fs.exists(path))
+      ? (yield* fs.readFileString(path)).split("\n").filter((l) => l !== "")
+      : [];
+    const loaded = lines.flatMap((line) => Option.toArray(decodeEvent(line)));
+    const events = yield* Ref.make(loaded.slice(-MAX_HISTORY));
+
+    if (lines.length > 2 * MAX_HISTORY) {
+      const kept = yield* Ref.get(events);
+      yield* writeFileAtomically(
+        path,
+        kept.map((e) => `${encodeEvent(e)}\n`).join("")
+      );
+      yield* Effect.log(
+        `Selection log compacted from ${lines.length} to ${kept.length} events`
+      );
+    }
+
+    return {
+      // Source of the last event, none if there is none or it was a clear.
+      last: Option.flatMap(Option.fromNullable(loaded.at(-1)), (e) =>
+        Option.fromNullable(e.source)
+      ),
+      append: (event: SelectionEvent) =>
+        fs
+          .writeFileString(path, `${encodeEvent(event)}\n`, { flag: "a" })
+          .pipe(
+            Effect.catchAll((e) =>
+              Effect.logError(`Failed to log selection to ${path}`, e)
+            ),
+            Effect.zipRight(
+              Ref.update(events, (all) => [...all, event].slice(-MAX_HISTORY))
+            )
+          ),
+      // Most recent first.
+      history: (limit: number) =>
+        Ref.get(events).pipe(Effect.map((all) => all.slice(-limit).reverse())),
+    } as const;
+  });
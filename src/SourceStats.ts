@@ -0,0 +1,200 @@
+import {
+  Clock,
+  Config,
+  Effect,
+  HashMap,
+  Option,
+  Ref,
+  Schedule,
+  Stream,
+} from "effect";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+
+export interface SourceStatus {
+  readonly running: boolean;
+  // Start of the current run, if running.
+  readonly startedAt: number | null;
+  // Audio received from the source since the server started, all runs.
+  readonly bytesProcessed: number;
+  // Audio chunks processed, and lost before processing, all runs.
+  readonly chunksReceived: number;
+  readonly chunksDropped: number;
+  // Chunks found broken, all runs, by what was wrong: see ChunkCorruption.
+  readonly chunksCorrupted: {
+    readonly oddLength: number;
+    readonly slipped: number;
+    readonly checksum: number;
+  };
+  readonly lastResponseAt: number | null;
+  readonly lastError: { readonly message: string; readonly at: number } | null;
+  // Last background check of the source's URL; null until it is checked.
+  readonly probe: {
+    readonly up: boolean;
+    readonly at: number;
+    readonly error: string | null;
+  } | null;
+}
+
+const IDLE: SourceStatus = {
+  running: false,
+  startedAt: null,
+  bytesProcessed: 0,
+  chunksReceived: 0,
+  chunksDropped: 0,
+  chunksCorrupted: { oddLength: 0, slipped: 0, checksum: 0 },
+  lastResponseAt: null,
+  lastError: null,
+  probe: null,
+};
+
+// Sources checked at once; each check holds a connection or an ffprobe.
+const PROBE_CONCURRENCY = 4;
+
+// Runtime health of each source's pipeline, for GET /sources. All updates go
+// through a single Ref, so concurrent pipelines and the broadcast listener
+// can't overwrite each other's changes. Every SOURCE_PROBE_INTERVAL_SECONDS
+// (default 300, 0 to disable) each source that isn't running is checked in
+// the background, so clients can tell dead streams before selecting them;
+// running sources are skipped, as their pipeline already tells.
+export class SourceStats extends Effect.Service<SourceStats>()("SourceStats", {
+  scoped: Effect.gen(function* () {
+    const broadcaster = yield* Broadcaster;
+    const events = yield* PipelineEvents;
+    const audioSource = yield* AudioSource;
+    const supervisor = yield* PipelineSupervisor;
+    const probeInterval = yield* Config.integer(
+      "SOURCE_PROBE_INTERVAL_SECONDS"
+    ).pipe(Config.withDefault(300));
+    const stats = yield* Ref.make(
+      HashMap.empty<AudioSourceId, SourceStatus>()
+    );
+
+    const update = (id: AudioSourceId, f: (s: SourceStatus) => SourceStatus) =>
+      Ref.update(stats, (all) =>
+        HashMap.set(
+          all,
+          id,
+          f(Option.getOrElse(HashMap.get(all, id), () => IDLE))
+        )
+      );
+
+    const recordError = (id: AudioSourceId, message: string) =>
+      Clock.currentTimeMillis.pipe(
+        Effect.flatMap((at) =>
+          update(id, (s) => ({ ...s, lastError: { message, at } }))
+        )
+      );
+
+    const subscription = yield* broadcaster.subscribe;
+    yield* Stream.fromQueue(subscription).pipe(
+      Stream.runForEach((msg) =>
+        Effect.gen(function* () {
+          if (msg.type === "complete" && msg.source) {
+            const at = yield* Clock.currentTimeMillis;
+            yield* update(msg.source, (s) => ({ ...s, lastResponseAt: at }));
+          }
+        })
+      ),
+      Effect.forkScoped
+    );
+
+    yield* events.on("ChunkProduced", ({ source, bytes, dropped }) =>
+      update(source, (s) => ({
+        ...s,
+        bytesProcessed: s.bytesProcessed + bytes,
+        chunksReceived: s.chunksReceived + 1,
+        chunksDropped: s.chunksDropped + dropped,
+      }))
+    );
+    yield* events.on("ChunkCorrupted", ({ source, kind }) =>
+      update(source, (s) => {
+        const key = kind === "odd_length" ? "oddLength" : kind;
+        return {
+          ...s,
+          chunksCorrupted: {
+            ...s.chunksCorrupted,
+            [key]: s.chunksCorrupted[key] + 1,
+          },
+        };
+      })
+    );
+    // OpenAI errors aren't tied to a source; they are charged to the
+    // pipelines running when they happen.
+    yield* events.on("Error", ({ source, message }) =>
+      Effect.gen(function* () {
+        if (source) return yield* recordError(source, message);
+        const running = HashMap.keys(
+          HashMap.filter(yield* Ref.get(stats), (s) => s.running)
+        );
+        yield* Effect.forEach(running, (id) => recordError(id, message));
+      })
+    );
+
+    const probeAll = Effect.gen(function* () {
+      const all = yield* Ref.get(stats);
+      const sources = (yield* audioSource.sources).filter(
+        (source) =>
+          !Option.exists(HashMap.get(all, source.id), (s) => s.running)
+      );
+      yield* Effect.forEach(
+        sources,
+        (source) =>
+          audioSource.probe(source).pipe(
+            Effect.as(null),
+            Effect.catchAll((e) => Effect.succeed(e.message)),
+            Effect.flatMap((error) =>
+              Effect.gen(function* () {
+                const at = yield* Clock.currentTimeMillis;
+                const previous = Option.getOrNull(
+                  HashMap.get(yield* Ref.get(stats), source.id)
+                )?.probe;
+                if (error !== null && previous?.up !== false) {
+                  yield* Effect.logWarning(
+                    `Source ${source.id} is unreachable: ${error}`
+                  );
+                } else if (error === null && previous?.up === false) {
+                  yield* Effect.log(`Source ${source.id} is reachable again`);
+                }
+                yield* update(source.id, (s) => ({
+                  ...s,
+                  probe: { up: error === null, at, error },
+                }));
+              })
+            )
+          ),
+        { concurrency: PROBE_CONCURRENCY, discard: true }
+      );
+    });
+
+    if (probeInterval > 0) {
+      yield* probeAll.pipe(
+        Effect.repeat(Schedule.spaced(`${probeInterval} seconds`)),
+        (loop) => supervisor.supervise("source-prober", loop),
+        Effect.forkScoped
+      );
+    }
+
+    return {
+      // Marks the source's pipeline running until the returned effect's
+      // scope closes.
+      track: (id: AudioSourceId) =>
+        Effect.acquireRelease(
+          Clock.currentTimeMillis.pipe(
+            Effect.flatMap((now) =>
+              update(id, (s) => ({ ...s, running: true, startedAt: now }))
+            )
+          ),
+          () => update(id, (s) => ({ ...s, running: false, startedAt: null }))
+        ),
+      get: (id: AudioSourceId) =>
+        Ref.get(stats).pipe(
+          Effect.map((all) =>
+            Option.getOrElse(HashMap.get(all, id), () => IDLE)
+          )
+        ),
+    } as const;
+  }),
+}) {}
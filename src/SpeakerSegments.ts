@@ -0,0 +1,27 @@
+// Speaker turns in a diarized transcript. The transcribe task asks the model
+// to start every turn with a "Label:" prefix; text before the first label has
+// no speaker.
+export interface SpeakerSegment {
+  readonly speaker: string | null;
+  readonly text: string;
+}
+
+const TURN = /^\s*([\p{L}][\p{L}\p{N} '’.-]{0,39})\s*:\s*(.*)$/u;
+
+export const parseSpeakerSegments = (
+  transcript: string
+): ReadonlyArray<SpeakerSegment> => {
+  const segments: Array<{ speaker: string | null; text: string }> = [];
+  for (const line of transcript.split("\n")) {
+    const turn = TURN.exec(line);
+    const current = segments.at(-1);
+    if (turn) {
+      segments.push({ speaker: turn[1]!.trim(), text: turn[2]!.trim() });
+    } else if (current) {
+      current.text = `${current.text} ${line.trim()}`.trim();
+    } else if (line.trim()) {
+      segments.push({ speaker: null, text: line.trim() });
+    }
+  }
+  return segments.filter((s) => s.text.length > 0);
+};
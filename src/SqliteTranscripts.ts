@@ -0,0 +1,817 @@
+import { Database } from "bun:sqlite";
+import { Effect } from "effect";
+import type { AudioSourceId } from "./AudioSource.js";
+import { type Digest, encodeBroadcastJson } from "./Messages.js";
+import type { SpeakerSegment } from "./SpeakerSegments.js";
+import type { TaskId } from "./Tasks.js";
+import {
+  type CoverageDiff,
+  type EmbeddedChunk,
+  type Feedback,
+  type FeedbackStats,
+  fromBlob,
+  fromBroadcastRows,
+  HIT_END,
+  HIT_START,
+  type ListenSession,
+  type LoggedBroadcast,
+  markSnippet,
+  type MetricsSnapshot,
+  type RepeatedSegment,
+  type RepeatQuery,
+  timelineBuckets,
+  toBlob,
+  type TopicTimelineQuery,
+  type Transcript,
+  type TranscriptBackend,
+  type TranscriptMatch,
+  type TranscriptSearch,
+  TranscriptStoreError,
+  type TranscriptTags,
+} from "./TranscriptBackend.js";
+
+const SCHEMA = `
+CREATE TABLE IF NOT EXISTS transcripts (
+  id INTEGER PRIMARY KEY,
+  response_id TEXT NOT NULL UNIQUE,
+  task TEXT NOT NULL,
+  source TEXT,
+  text TEXT NOT NULL,
+  completed_at INTEGER NOT NULL,
+  program TEXT,
+  window_start INTEGER,
+  window_end INTEGER
+);
+CREATE INDEX IF NOT EXISTS transcripts_completed_at ON transcripts (completed_at);
+CREATE VIRTUAL TABLE IF NOT EXISTS transcripts_fts USING fts5(
+  text, content='transcripts', content_rowid='id', tokenize='unicode61 remove_diacritics 2'
+);
+CREATE TRIGGER IF NOT EXISTS transcripts_ai AFTER INSERT ON transcripts BEGIN
+  INSERT INTO transcripts_fts (rowid, text) VALUES (new.id, new.text);
+END;
+CREATE TRIGGER IF NOT EXISTS transcripts_ad AFTER DELETE ON transcripts BEGIN
+  INSERT INTO transcripts_fts (transcripts_fts, rowid, text) VALUES ('delete', old.id, old.text);
+END;
+CREATE TABLE IF NOT EXISTS transcript_segments (
+  transcript_id INTEGER NOT NULL REFERENCES transcripts (id),
+  position INTEGER NOT NULL,
+  speaker TEXT,
+  text TEXT NOT NULL,
+  PRIMARY KEY (transcript_id, position)
+);
+CREATE TRIGGER IF NOT EXISTS transcripts_ad_segments AFTER DELETE ON transcripts BEGIN
+  DELETE FROM transcript_segments WHERE transcript_id = old.id;
+END;
+CREATE TABLE IF NOT EXISTS transcript_tags (
+  response_id TEXT PRIMARY KEY,
+  sentiment TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS transcript_topics (
+  response_id TEXT NOT NULL,
+  topic TEXT NOT NULL,
+  PRIMARY KEY (response_id, topic)
+);
+CREATE TRIGGER IF NOT EXISTS transcripts_ad_tags AFTER DELETE ON transcripts BEGIN
+  DELETE FROM transcript_tags WHERE response_id = old.response_id;
+  DELETE FROM transcript_topics WHERE response_id = old.response_id;
+END;
+CREATE TABLE IF NOT EXISTS transcript_embeddings (
+  response_id TEXT NOT NULL,
+  model TEXT NOT NULL,
+  position INTEGER NOT NULL,
+  text TEXT NOT NULL,
+  vector BLOB NOT NULL,
+  PRIMARY KEY (response_id, model, position)
+);
+CREATE TRIGGER IF NOT EXISTS transcripts_ad_embeddings AFTER DELETE ON transcripts BEGIN
+  DELETE FROM transcript_embeddings WHERE response_id = old.response_id;
+END;
+CREATE TABLE IF NOT EXISTS transcript_feedback (
+  id INTEGER PRIMARY KEY,
+  response_id TEXT NOT NULL,
+  rating INTEGER NOT NULL,
+  comment TEXT,
+  created_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS transcript_feedback_response ON transcript_feedback (response_id);
+CREATE TRIGGER IF NOT EXISTS transcripts_ad_feedback AFTER DELETE ON transcripts BEGIN
+  DELETE FROM transcript_feedback WHERE response_id = old.response_id;
+END;
+CREATE TABLE IF NOT EXISTS repeated_segments (
+  id INTEGER PRIMARY KEY,
+  fingerprint TEXT NOT NULL,
+  source TEXT NOT NULL,
+  started_at INTEGER,
+  ended_at INTEGER,
+  duration_ms INTEGER NOT NULL,
+  skipped INTEGER NOT NULL,
+  recorded_at INTEGER NOT NULL
+);
+CREATE INDEX IF NOT EXISTS repeated_segments_recorded ON repeated_segments (recorded_at);
+CREATE TABLE IF NOT EXISTS broadcast_log (
+  key TEXT PRIMARY KEY,
+  at INTEGER NOT NULL,
+  json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS broadcast_log_at ON broadcast_log (at);
+CREATE TABLE IF NOT EXISTS listen_sessions (
+  id TEXT PRIMARY KEY,
+  source TEXT NOT NULL,
+  started_at INTEGER NOT NULL,
+  ended_at INTEGER NOT NULL,
+  reason TEXT NOT NULL,
+  responses INTEGER NOT NULL,
+  summary TEXT
+);
+CREATE TABLE IF NOT EXISTS coverage_diffs (
+  hour INTEGER PRIMARY KEY,
+  json TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS metrics_snapshots (
+  at INTEGER NOT NULL,
+  json TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS metrics_snapshots_at ON metrics_snapshots (at);
+`;
+
+// Columns added after the first release, for databases created before them.
+const MIGRATIONS: ReadonlyArray<{ column: string; sql: string }> = [
+  {
+    column: "program",
+    sql: "ALTER TABLE transcripts ADD COLUMN program TEXT",
+  },
+  {
+    column: "window_start",
+    sql: "ALTER TABLE transcripts ADD COLUMN window_start INTEGER",
+  },
+  {
+    column: "window_end",
+    sql: "ALTER TABLE transcripts ADD COLUMN window_end INTEGER",
+  },
+];
+
+const migrate = (db: Database) => {
+  const columns = new Set(
+    db
+      .query<{ name: string }, []>("PRAGMA table_info(transcripts)")
+      .all()
+      .map((c) => c.name)
+  );
+  for (const { column, sql } of MIGRATIONS) {
+    if (!columns.has(column)) db.exec(sql);
+  }
+};
+
+interface TranscriptRow {
+  readonly id: number;
+  readonly response_id: string;
+  readonly task: TaskId;
+  readonly source: AudioSourceId | null;
+  readonly program: string | null;
+  readonly text: string;
+  readonly completed_at: number;
+  readonly window_start: number | null;
+  readonly window_end: number | null;
+}
+
+interface SegmentRow {
+  readonly transcript_id: number;
+  readonly speaker: string | null;
+  readonly text: string;
+}
+
+const fromRow = (
+  row: TranscriptRow,
+  segments: ReadonlyArray<SpeakerSegment>
+): Transcript => ({
+  responseId: row.response_id,
+  task: row.task,
+  source: row.source,
+  program: row.program,
+  text: row.text,
+  completedAt: row.completed_at,
+  windowStart: row.window_start,
+  windowEnd: row.window_end,
+  segments,
+});
+
+// Loads the speaker segments of the given transcript rows, in turn order.
+const segmentsByTranscript = (db: Database, ids: ReadonlyArray<number>) => {
+  const byId = new Map<number, Array<SpeakerSegment>>();
+  if (ids.length === 0) return byId;
+  const rows = db
+    .query<SegmentRow, Array<number>>(
+      `SELECT transcript_id, speaker, text FROM transcript_segments
+       WHERE transcript_id IN (${ids.map(() => "?").join(", ")})
+       ORDER BY transcript_id, position`
+    )
+    .all(...ids);
+  for (const row of rows) {
+    const segments = byId.get(row.transcript_id) ?? [];
+    segments.push({ speaker: row.speaker, text: row.text });
+    byId.set(row.transcript_id, segments);
+  }
+  return byId;
+};
+
+const withSegments = <R extends TranscriptRow>(
+  db: Database,
+  rows: ReadonlyArray<R>
+) => {
+  const segments = segmentsByTranscript(
+    db,
+    rows.map((row) => row.id)
+  );
+  return rows.map((row) => ({
+    row,
+    transcript: fromRow(row, segments.get(row.id) ?? []),
+  }));
+};
+
+// Turns free text into an FTS5 query matching every word, so user input can't
+// trip over the MATCH syntax.
+const toFtsQuery = (query: string) =>
+  query
+    .split(/\s+/)
+    .filter((word) => word.length > 0)
+    .map((word) => `"${word.replaceAll('"', '""')}"`)
+    .join(" ");
+
+// Transcripts in a SQLite file, indexed with FTS5 for full-text search. The
+// default backend: nothing to run besides the app.
+export const makeSqliteTranscripts = (path: string) =>
+  Effect.gen(function* () {
+    const db = yield* Effect.acquireRelease(
+      Effect.try({
+        try: () => {
+          const db = new Database(path, { create: true, strict: true });
+          db.exec("PRAGMA journal_mode = WAL;");
+          db.exec(SCHEMA);
+          migrate(db);
+          return db;
+        },
+        catch: (cause) => new TranscriptStoreError({ cause }),
+      }),
+      (db) => Effect.sync(() => db.close())
+    );
+
+    const use = <A>(f: (db: Database) => A) =>
+      Effect.try({
+        try: () => f(db),
+        catch: (cause) => new TranscriptStoreError({ cause }),
+      });
+
+    const insert = (t: Transcript) =>
+      use((db) =>
+        db.transaction(() => {
+          const { changes, lastInsertRowid } = db
+            .query(
+              `INSERT OR IGNORE INTO transcripts (response_id, task, source, program, text, completed_at, window_start, window_end)
+               VALUES ($responseId, $task, $source, $program, $text, $completedAt, $windowStart, $windowEnd)`
+            )
+            .run({
+              responseId: t.responseId,
+              task: t.task,
+              source: t.source,
+              program: t.program,
+              text: t.text,
+              completedAt: t.completedAt,
+              windowStart: t.windowStart,
+              windowEnd: t.windowEnd,
+            });
+          if (changes === 0) return;
+          const insertSegment = db.query(
+            `INSERT INTO transcript_segments (transcript_id, position, speaker, text)
+             VALUES ($id, $position, $speaker, $text)`
+          );
+          t.segments.forEach((segment, position) =>
+            insertSegment.run({
+              id: Number(lastInsertRowid),
+              position,
+              speaker: segment.speaker,
+              text: segment.text,
+            })
+          );
+        })()
+      );
+
+    // Filters shared by the timeline queries.
+    const timelineFrom = (table: string) => `FROM transcripts t
+      JOIN ${table} x ON x.response_id = t.response_id
+      WHERE ($source IS NULL OR t.source = $source)
+        AND ($from IS NULL OR t.completed_at >= $from)
+        AND ($to IS NULL OR t.completed_at < $to)`;
+
+    const backend: TranscriptBackend = {
+      insert,
+      saveTags: (responseId: string, tags: TranscriptTags) =>
+        use((db) =>
+          db.transaction(() => {
+            db.query(
+              `INSERT OR REPLACE INTO transcript_tags (response_id, sentiment)
+               VALUES ($responseId, $sentiment)`
+            ).run({ responseId, sentiment: tags.sentiment });
+            db.query(
+              "DELETE FROM transcript_topics WHERE response_id = $responseId"
+            ).run({ responseId });
+            const insertTopic = db.query(
+              `INSERT OR IGNORE INTO transcript_topics (response_id, topic)
+               VALUES ($responseId, $topic)`
+            );
+            for (const topic of tags.topics) {
+              insertTopic.run({ responseId, topic });
+            }
+          })()
+        ),
+      topicTimeline: (query: TopicTimelineQuery) =>
+        use((db) => {
+          const params = {
+            source: query.source ?? null,
+            from: query.from ?? null,
+            to: query.to ?? null,
+            bucket: query.bucketMs,
+          };
+          const bucketStart =
+            "CAST(t.completed_at / $bucket AS INTEGER) * $bucket";
+          const topicRows = db
+            .query<
+              { start: number; topic: string; count: number },
+              typeof params
+            >(
+              `SELECT ${bucketStart} AS start, x.topic, COUNT(*) AS count
+               ${timelineFrom("transcript_topics")}
+               GROUP BY start, x.topic
+               ORDER BY start, count DESC, x.topic`
+            )
+            .all(params);
+          const sentimentRows = db
+            .query<
+              { start: number; sentiment: Digest["sentiment"]; count: number },
+              typeof params
+            >(
+              `SELECT ${bucketStart} AS start, x.sentiment, COUNT(*) AS count
+               ${timelineFrom("transcript_tags")}
+               GROUP BY start, x.sentiment`
+            )
+            .all(params);
+
+          return timelineBuckets(sentimentRows, topicRows);
+        }),
+      saveEmbeddings: (
+        responseId: string,
+        model: string,
+        chunks: ReadonlyArray<{ text: string; vector: Float32Array }>
+      ) =>
+        use((db) =>
+          db.transaction(() => {
+            db.query(
+              `DELETE FROM transcript_embeddings
+               WHERE response_id = $responseId AND model = $model`
+            ).run({ responseId, model });
+            const insertChunk = db.query(
+              `INSERT INTO transcript_embeddings (response_id, model, position, text, vector)
+               VALUES ($responseId, $model, $position, $text, $vector)`
+            );
+            chunks.forEach((chunk, position) =>
+              insertChunk.run({
+                responseId,
+                model,
+                position,
+                text: chunk.text,
+                vector: toBlob(chunk.vector),
+              })
+            );
+          })()
+        ),
+      embeddings: (model: string) =>
+        use((db) =>
+          db
+            .query<
+              {
+                response_id: string;
+                source: AudioSourceId | null;
+                program: string | null;
+                completed_at: number;
+                text: string;
+                vector: Uint8Array;
+              },
+              { model: string }
+            >(
+              `SELECT e.response_id, t.source, t.program, t.completed_at, e.text, e.vector
+               FROM transcript_embeddings e
+               JOIN transcripts t ON t.response_id = e.response_id
+               WHERE e.model = $model`
+            )
+            .all({ model })
+            .map(
+              (row): EmbeddedChunk => ({
+                responseId: row.response_id,
+                source: row.source,
+                program: row.program,
+                completedAt: row.completed_at,
+                text: row.text,
+                vector: fromBlob(row.vector),
+              })
+            )
+        ),
+      unembedded: (
+        model: string,
+        tasks: ReadonlyArray<TaskId>,
+        limit: number
+      ) =>
+        use((db) =>
+          withSegments(
+            db,
+            db
+              .query<TranscriptRow, Array<string | number>>(
+                `SELECT id, response_id, task, source, program, text, completed_at,
+                        window_start, window_end
+                 FROM transcripts t
+                 WHERE task IN (${tasks.map(() => "?").join(", ")})
+                   AND NOT EXISTS (
+                     SELECT 1 FROM transcript_embeddings e
+                     WHERE e.response_id = t.response_id AND e.model = ?
+                   )
+                 ORDER BY completed_at DESC LIMIT ?`
+              )
+              .all(...tasks, model, limit)
+          ).map(({ transcript }) => transcript)
+        ),
+      byResponseIds: (responseIds: ReadonlyArray<string>) =>
+        use((db) =>
+          responseIds.length === 0
+            ? []
+            : withSegments(
+                db,
+                db
+                  .query<TranscriptRow, Array<string>>(
+                    `SELECT id, response_id, task, source, program, text, completed_at,
+                            window_start, window_end
+                     FROM transcripts
+                     WHERE response_id IN (${responseIds.map(() => "?").join(", ")})`
+                  )
+                  .all(...responseIds)
+              ).map(({ transcript }) => transcript)
+        ),
+      between: (params: {
+        source: AudioSourceId;
+        tasks: ReadonlyArray<TaskId>;
+        from: number;
+        to: number;
+      }) =>
+        use((db) =>
+          withSegments(
+            db,
+            db
+              .query<TranscriptRow, Array<string | number>>(
+                `SELECT id, response_id, task, source, program, text, completed_at,
+                        window_start, window_end
+                 FROM transcripts
+                 WHERE source = ? AND completed_at >= ? AND completed_at < ?
+                   AND task IN (${params.tasks.map(() => "?").join(", ")})
+                 ORDER BY completed_at`
+              )
+              .all(params.source, params.from, params.to, ...params.tasks)
+          ).map(({ transcript }) => transcript)
+        ),
+      archive: (params: {
+        source: AudioSourceId;
+        from: number;
+        to: number;
+        task?: TaskId | undefined;
+        offset: number;
+        limit: number;
+      }) =>
+        use((db) => {
+          const filter = {
+            source: params.source,
+            from: params.from,
+            to: params.to,
+            task: params.task ?? null,
+          };
+          const where = `WHERE source = $source
+              AND completed_at >= $from AND completed_at < $to
+              AND ($task IS NULL OR task = $task)`;
+          const index = db
+            .query<
+              { completed_at: number; program: string | null },
+              typeof filter
+            >(
+              `SELECT completed_at, program FROM transcripts ${where}
+               ORDER BY completed_at, id`
+            )
+            .all(filter);
+          const rows = db
+            .query<
+              TranscriptRow,
+              typeof filter & { offset: number; limit: number }
+            >(
+              `SELECT id, response_id, task, source, program, text, completed_at,
+                      window_start, window_end
+               FROM transcripts ${where}
+               ORDER BY completed_at, id LIMIT $limit OFFSET $offset`
+            )
+            .all({ ...filter, offset: params.offset, limit: params.limit });
+          return {
+            index: index.map((row) => ({
+              completedAt: row.completed_at,
+              program: row.program,
+            })),
+            transcripts: withSegments(db, rows).map(
+              ({ transcript }) => transcript
+            ),
+          };
+        }),
+      saveFeedback: (feedback: Feedback) =>
+        use((db) => {
+          db.query(
+            `INSERT INTO transcript_feedback (response_id, rating, comment, created_at)
+             VALUES ($responseId, $rating, $comment, $createdAt)`
+          ).run({ ...feedback });
+        }),
+      feedbackStats: (params: {
+        from?: number | undefined;
+        to?: number | undefined;
+      }) =>
+        use((db) =>
+          db
+            .query<
+              {
+                source: AudioSourceId | null;
+                task: TaskId;
+                count: number;
+                average_rating: number;
+                low: number;
+                high: number;
+                comments: number;
+              },
+              { from: number | null; to: number | null }
+            >(
+              `SELECT t.source, t.task, COUNT(*) AS count, AVG(f.rating) AS average_rating,
+                      SUM(f.rating <= 2) AS low, SUM(f.rating >= 4) AS high,
+                      COUNT(f.comment) AS comments
+               FROM transcript_feedback f
+               JOIN transcripts t ON t.response_id = f.response_id
+               WHERE ($from IS NULL OR f.created_at >= $from)
+                 AND ($to IS NULL OR f.created_at < $to)
+               GROUP BY t.source, t.task
+               ORDER BY count DESC, t.source, t.task`
+            )
+            .all({ from: params.from ?? null, to: params.to ?? null })
+            .map(
+              (row): FeedbackStats => ({
+                source: row.source,
+                task: row.task,
+                count: row.count,
+                averageRating: row.average_rating,
+                low: row.low,
+                high: row.high,
+                comments: row.comments,
+              })
+            )
+        ),
+      saveRepeat: (segment: RepeatedSegment) =>
+        use((db) => {
+          db.query(
+            `INSERT INTO repeated_segments
+               (fingerprint, source, started_at, ended_at, duration_ms, skipped, recorded_at)
+             VALUES ($fingerprint, $source, $startedAt, $endedAt, $durationMs, $skipped, $recordedAt)`
+          ).run({ ...segment, skipped: segment.skipped ? 1 : 0 });
+        }),
+      repeats: (query: RepeatQuery) =>
+        use((db) =>
+          db
+            .query<
+              {
+                fingerprint: string;
+                source: AudioSourceId;
+                started_at: number | null;
+                ended_at: number | null;
+                duration_ms: number;
+                skipped: number;
+                recorded_at: number;
+              },
+              {
+                source: string | null;
+                fingerprint: string | null;
+                from: number | null;
+                to: number | null;
+                limit: number;
+              }
+            >(
+              `SELECT fingerprint, source, started_at, ended_at, duration_ms, skipped, recorded_at
+               FROM repeated_segments
+               WHERE ($source IS NULL OR source = $source)
+                 AND ($fingerprint IS NULL OR fingerprint = $fingerprint)
+                 AND ($from IS NULL OR recorded_at >= $from)
+                 AND ($to IS NULL OR recorded_at < $to)
+               ORDER BY recorded_at DESC, id DESC LIMIT $limit`
+            )
+            .all({
+              source: query.source ?? null,
+              fingerprint: query.fingerprint ?? null,
+              from: query.from ?? null,
+              to: query.to ?? null,
+              limit: query.limit,
+            })
+            .map(
+              (row): RepeatedSegment => ({
+                fingerprint: row.fingerprint,
+                source: row.source,
+                startedAt: row.started_at,
+                endedAt: row.ended_at,
+                durationMs: row.duration_ms,
+                skipped: row.skipped === 1,
+                recordedAt: row.recorded_at,
+              })
+            )
+        ),
+      logBroadcast: (entry: LoggedBroadcast) =>
+        use((db) => {
+          db.query(
+            `INSERT OR IGNORE INTO broadcast_log (key, at, json)
+             VALUES ($key, $at, $json)`
+          ).run({
+            key: entry.key,
+            at: entry.at,
+            json: encodeBroadcastJson(entry.message),
+          });
+        }),
+      broadcastsSince: (since: number, limit: number) =>
+        use((db) =>
+          fromBroadcastRows(
+            db
+              .query<
+                { key: string; at: number; json: string },
+                { since: number; limit: number }
+              >(
+                `SELECT key, at, json FROM broadcast_log
+                 WHERE at >= $since ORDER BY at, rowid LIMIT $limit`
+              )
+              .all({ since, limit })
+          )
+        ),
+      pruneBroadcasts: (before: number) =>
+        use((db) => {
+          db.query("DELETE FROM broadcast_log WHERE at < $before").run({
+            before,
+          });
+        }),
+      saveSession: (session: ListenSession) =>
+        use((db) => {
+          db.query(
+            `INSERT OR REPLACE INTO listen_sessions (id, source, started_at, ended_at, reason, responses, summary)
+             VALUES ($id, $source, $startedAt, $endedAt, $reason, $responses, $summary)`
+          ).run({ ...session });
+        }),
+      sessions: (limit: number) =>
+        use((db) =>
+          db
+            .query<
+              {
+                id: string;
+                source: AudioSourceId;
+                started_at: number;
+                ended_at: number;
+                reason: ListenSession["reason"];
+                responses: number;
+                summary: string | null;
+              },
+              { limit: number }
+            >(
+              `SELECT id, source, started_at, ended_at, reason, responses, summary
+               FROM listen_sessions ORDER BY ended_at DESC LIMIT $limit`
+            )
+            .all({ limit })
+            .map(
+              (row): ListenSession => ({
+                id: row.id,
+                source: row.source,
+                startedAt: row.started_at,
+                endedAt: row.ended_at,
+                reason: row.reason,
+                responses: row.responses,
+                summary: row.summary,
+              })
+            )
+        ),
+      saveSnapshot: (snapshot: MetricsSnapshot) =>
+        use((db) => {
+          db.query(
+            "INSERT INTO metrics_snapshots (at, json) VALUES ($at, $json)"
+          ).run({ at: snapshot.at, json: JSON.stringify(snapshot) });
+        }),
+      snapshots: (from: number, to: number) =>
+        use((db) =>
+          db
+            .query<{ json: string }, { from: number; to: number }>(
+              `SELECT json FROM metrics_snapshots
+               WHERE at >= $from AND at < $to ORDER BY at`
+            )
+            .all({ from, to })
+            .map((row) => JSON.parse(row.json) as MetricsSnapshot)
+        ),
+      saveCoverage: (diff: CoverageDiff) =>
+        use((db) => {
+          db.query(
+            "INSERT OR REPLACE INTO coverage_diffs (hour, json) VALUES ($hour, $json)"
+          ).run({ hour: diff.hour, json: JSON.stringify(diff) });
+        }),
+      coverage: (hour: number) =>
+        use((db) => {
+          const row = db
+            .query<{ json: string }, { hour: number }>(
+              "SELECT json FROM coverage_diffs WHERE hour = $hour"
+            )
+            .get({ hour });
+          return row === null ? null : (JSON.parse(row.json) as CoverageDiff);
+        }),
+      recent: (limit: number) =>
+        use((db) =>
+          withSegments(
+            db,
+            db
+              .query<TranscriptRow, { limit: number }>(
+                `SELECT id, response_id, task, source, program, text, completed_at,
+                        window_start, window_end
+                 FROM transcripts ORDER BY completed_at DESC LIMIT $limit`
+              )
+              .all({ limit })
+          ).map(({ transcript }) => transcript)
+        ),
+      recentOf: (params: {
+        tasks: ReadonlyArray<TaskId>;
+        source?: AudioSourceId | undefined;
+        limit: number;
+      }) =>
+        use((db) =>
+          withSegments(
+            db,
+            db
+              .query<TranscriptRow, Array<string | number | null>>(
+                `SELECT id, response_id, task, source, program, text, completed_at,
+                        window_start, window_end
+                 FROM transcripts
+                 WHERE task IN (${params.tasks.map(() => "?").join(", ")})
+                   AND (? IS NULL OR source = ?)
+                 ORDER BY completed_at DESC LIMIT ?`
+              )
+              .all(
+                ...params.tasks,
+                params.source ?? null,
+                params.source ?? null,
+                params.limit
+              )
+          ).map(({ transcript }) => transcript)
+        ),
+      search: (params: TranscriptSearch) =>
+        use((db) => {
+          const match = toFtsQuery(params.query);
+          if (match === "") return [];
+          const rows = db
+            .query<
+              TranscriptRow & { snippet: string },
+              {
+                match: string;
+                hitStart: string;
+                hitEnd: string;
+                source: string | null;
+                program: string | null;
+                from: number | null;
+                to: number | null;
+                limit: number;
+              }
+            >(
+              `SELECT t.id, t.response_id, t.task, t.source, t.program, t.text, t.completed_at,
+                      t.window_start, t.window_end,
+                      snippet(transcripts_fts, 0, $hitStart, $hitEnd, '…', 16) AS snippet
+               FROM transcripts_fts
+               JOIN transcripts t ON t.id = transcripts_fts.rowid
+               WHERE transcripts_fts MATCH $match
+                 AND ($source IS NULL OR t.source = $source)
+                 AND ($program IS NULL OR t.program = $program)
+                 AND ($from IS NULL OR t.completed_at >= $from)
+                 AND ($to IS NULL OR t.completed_at < $to)
+               ORDER BY rank
+               LIMIT $limit`
+            )
+            .all({
+              match,
+              hitStart: HIT_START,
+              hitEnd: HIT_END,
+              source: params.source ?? null,
+              program: params.program ?? null,
+              from: params.from ?? null,
+              to: params.to ?? null,
+              limit: params.limit,
+            });
+          return withSegments(db, rows).map(
+            ({ row, transcript }): TranscriptMatch => ({
+              ...transcript,
+              snippet: markSnippet(row.snippet),
+            })
+          );
+        }),
+    };
+    return backend;
+  });
@@ -0,0 +1,302 @@
+import {
+  HttpClient,
+  HttpClientRequest,
+  HttpClientResponse,
+} from "@effect/platform";
+import {
+  Clock,
+  Config,
+  Effect,
+  HashMap,
+  Option,
+  Redacted,
+  Ref,
+  Schedule,
+  Schema,
+  Stream,
+} from "effect";
+import {
+  AppConfig,
+  sourceType,
+  type NowPlayingProvider,
+  type SourceConfig,
+} from "./AppConfig.js";
+import { AudioSource, type AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+
+export const NowPlaying = Schema.Struct({
+  provider: Schema.Literal("radiofrance", "icy"),
+  show: Schema.NullOr(Schema.String).annotations({
+    description: "Program on air (Radio France only)",
+  }),
+  title: Schema.NullOr(Schema.String).annotations({
+    description:
+      "Episode title, or the ICY stream title (often artist - track)",
+  }),
+  endsAt: Schema.NullOr(Schema.Number).annotations({
+    description:
+      "When the show is scheduled to end, in ms since the epoch (Radio France only)",
+  }),
+  fetchedAt: Schema.Number.annotations({
+    description: "Time of the lookup, in ms since the epoch",
+  }),
+}).annotations({ title: "Now Playing" });
+
+export type NowPlaying = typeof NowPlaying.Type;
+
+// A show on air, with its scheduled end if the guide gives one.
+export interface Program {
+  readonly show: string;
+  readonly endsAt: number | null;
+}
+
+// Radio France streams are looked up in its Open API by station (the first
+// path segment, e.g. FRANCEINTER); ICY streams are asked for their
+// metadata. Other types carry neither.
+export const metadataProvider = (
+  source: SourceConfig
+): NowPlayingProvider => {
+  if (source.nowPlaying) return source.nowPlaying;
+  const url = URL.parse(source.url);
+  if (!url || !url.protocol.startsWith("http")) return { type: "none" };
+  if (url.hostname === "stream.radiofrance.fr") {
+    const station = url.pathname.split("/")[1];
+    return station
+      ? { type: "radiofrance", station: station.toUpperCase() }
+      : { type: "none" };
+  }
+  return sourceType(source) === "icy" ? { type: "icy" } : { type: "none" };
+};
+
+const RADIO_FRANCE_API = "https://openapi.radiofrance.fr/v1/graphql";
+
+const liveQuery = (station: string) =>
+  `{ live(station: ${station}) { show { end diffusion { title show { title } } } } }`;
+
+const Titled = Schema.Struct({
+  title: Schema.optional(Schema.NullOr(Schema.String)),
+});
+
+const RadioFranceLive = Schema.Struct({
+  data: Schema.Struct({
+    live: Schema.NullOr(
+      Schema.Struct({
+        show: Schema.NullOr(
+          Schema.Struct({
+            // Scheduled end, in seconds since the epoch.
+            end: Schema.optional(Schema.NullOr(Schema.Number)),
+            diffusion: Schema.NullOr(
+              Schema.Struct({
+                ...Titled.fields,
+                show: Schema.optional(Schema.NullOr(Titled)),
+              })
+            ),
+          })
+        ),
+      })
+    ),
+  }),
+});
+
+const ICY_TITLE = /StreamTitle='(.*?)';/;
+
+// Results are kept this long; the selected source is refreshed as often.
+const REFRESH_MS = 30_000;
+
+// Current show of each station, for the nowplaying endpoint, the
+// now_playing message and the `program` of completed responses. Radio France
+// lookups need RADIOFRANCE_API_TOKEN (free, from the Open API developer
+// portal); without it only ICY streams are looked up. Failures are logged and
+// leave the station without metadata.
+export class StationMetadata extends Effect.Service<StationMetadata>()(
+  "StationMetadata",
+  {
+    scoped: Effect.gen(function* () {
+      const client = yield* HttpClient.HttpClient;
+      const appConfig = yield* AppConfig;
+      const audioSource = yield* AudioSource;
+      const broadcaster = yield* Broadcaster;
+      const token = yield* Config.option(
+        Config.redacted("RADIOFRANCE_API_TOKEN")
+      );
+      const cache = yield* Ref.make(
+        HashMap.empty<AudioSourceId, Option.Option<NowPlaying>>()
+      );
+      const fetchedAt = yield* Ref.make(
+        HashMap.empty<AudioSourceId, number>()
+      );
+
+      const radioFrance = (station: string) =>
+        Effect.gen(function* () {
+          if (Option.isNone(token)) return Option.none();
+          const body = yield* HttpClientRequest.post(RADIO_FRANCE_API).pipe(
+            HttpClientRequest.setHeader("x-token", Redacted.value(token.value)),
+            HttpClientRequest.bodyUnsafeJson({ query: liveQuery(station) }),
+            (request) => client.execute(request),
+            Effect.flatMap(HttpClientResponse.filterStatusOk),
+            Effect.flatMap(HttpClientResponse.schemaBodyJson(RadioFranceLive)),
+            Effect.scoped
+          );
+          const step = body.data.live?.show;
+          const diffusion = step?.diffusion;
+          if (!diffusion) return Option.none();
+          return Option.some({
+            provider: "radiofrance" as const,
+            show: diffusion.show?.title ?? null,
+            title: diffusion.title ?? null,
+            endsAt: step.end ? step.end * 1000 : null,
+          });
+        });
+
+      // Reads the stream up to its first metadata block, every `metaint`
+      // bytes of audio: one length byte (in 16-byte units), then the text.
+      const icy = (url: string) =>
+        Effect.gen(function* () {
+          const response = yield* HttpClientRequest.get(url).pipe(
+            HttpClientRequest.setHeader("Icy-MetaData", "1"),
+            (request) => client.execute(request)
+          );
+          const metaint = Number(response.headers["icy-metaint"]);
+          if (!(metaint > 0)) return Option.none();
+          const needsMore = (buf: Buffer) =>
+            buf.length <= metaint ||
+            buf.length < metaint + 1 + buf[metaint]! * 16;
+          const buf = yield* response.stream.pipe(
+            Stream.runFoldWhile(Buffer.alloc(0), needsMore, (acc, chunk) =>
+              Buffer.concat([acc, chunk])
+            )
+          );
+          if (needsMore(buf)) return Option.none();
+          const meta = buf
+            .subarray(metaint + 1, metaint + 1 + buf[metaint]! * 16)
+            .toString("utf8");
+          const title = ICY_TITLE.exec(meta)?.[1];
+          return title
+            ? Option.some({
+                provider: "icy" as const,
+                show: null,
+                title,
+                endsAt: null,
+              })
+            : Option.none();
+        }).pipe(Effect.scoped);
+
+      const lookup = (source: SourceConfig) =>
+        Effect.gen(function* () {
+          const provider = metadataProvider(source);
+          const found =
+            provider.type === "radiofrance"
+              ? yield* radioFrance(provider.station)
+              : provider.type === "icy"
+                ? yield* icy(source.url)
+                : Option.none();
+          const now = yield* Clock.currentTimeMillis;
+          return Option.map(
+            found,
+            (n): NowPlaying => ({ ...n, fetchedAt: now })
+          );
+        }).pipe(
+          Effect.timeout("10 seconds"),
+          Effect.tapError((e) =>
+            Effect.logWarning(`Now playing lookup failed for ${source.id}`, e)
+          ),
+          Effect.orElseSucceed(() => Option.none<NowPlaying>())
+        );
+
+      const refresh = (source: SourceConfig) =>
+        Effect.gen(function* () {
+          const next = yield* lookup(source);
+          const previous = yield* Ref.modify(cache, (all) => [
+            HashMap.get(all, source.id).pipe(Option.flatten),
+            HashMap.set(all, source.id, next),
+          ]);
+          yield* Ref.update(
+            fetchedAt,
+            HashMap.set(source.id, yield* Clock.currentTimeMillis)
+          );
+          const changed = (n: NowPlaying) =>
+            Option.match(previous, {
+              onNone: () => true,
+              onSome: (p) => p.show !== n.show || p.title !== n.title,
+            });
+          if (Option.isSome(next) && changed(next.value)) {
+            yield* broadcaster.publish({
+              type: "now_playing",
+              source: source.id,
+              show: next.value.show,
+              title: next.value.title,
+            });
+          }
+          return next;
+        });
+
+      const findSource = (id: AudioSourceId) =>
+        appConfig.get.pipe(
+          Effect.map((config) =>
+            Option.fromNullable(config.sources.find((s) => s.id === id))
+          )
+        );
+
+      // Cached result, looked up again once older than the refresh period.
+      const nowPlaying = (source: SourceConfig) =>
+        Effect.gen(function* () {
+          const now = yield* Clock.currentTimeMillis;
+          const at = HashMap.get(yield* Ref.get(fetchedAt), source.id);
+          if (Option.isSome(at) && now - at.value < REFRESH_MS) {
+            return HashMap.get(yield* Ref.get(cache), source.id).pipe(
+              Option.flatten
+            );
+          }
+          return yield* refresh(source);
+        });
+
+      // The selected station is kept fresh so the pipeline never waits on a
+      // lookup.
+      yield* Effect.gen(function* () {
+        const current = yield* audioSource.currentSource;
+        if (Option.isNone(current)) return;
+        const source = yield* findSource(current.value);
+        if (Option.isSome(source)) yield* nowPlaying(source.value);
+      }).pipe(Effect.repeat(Schedule.spaced("5 seconds")), Effect.forkScoped);
+
+      const cached = (id: AudioSourceId) =>
+        Ref.get(cache).pipe(
+          Effect.map((all) => HashMap.get(all, id).pipe(Option.flatten))
+        );
+
+      return {
+        nowPlaying,
+        // Show on air as last seen, without waiting on a lookup.
+        currentShow: (id: AudioSourceId) =>
+          cached(id).pipe(
+            Effect.map(
+              Option.flatMap((n) => Option.fromNullable(n.show ?? n.title))
+            )
+          ),
+        // Same, from the program guide only: ICY titles are tracks, not
+        // shows.
+        currentProgram: (id: AudioSourceId) =>
+          cached(id).pipe(
+            Effect.map(
+              Option.flatMap(
+                (n): Option.Option<Program> =>
+                  n.show === null
+                    ? Option.none()
+                    : Option.some({ show: n.show, endsAt: n.endsAt })
+              )
+            )
+          ),
+        // Looks the station up now, e.g. once its show is due to end.
+        refresh: (id: AudioSourceId) =>
+          findSource(id).pipe(
+            Effect.flatMap(
+              Option.match({
+                onNone: () => Effect.succeed(Option.none<NowPlaying>()),
+                onSome: refresh,
+              })
+            )
+          ),
+      } as const;
+    }),
+  }
+) {}
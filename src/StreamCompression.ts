@@ -0,0 +1,79 @@
+import * as zlib from "node:zlib";
+import { Config, Effect, Option, Stream } from "effect";
+
+export type StreamEncoding = "br" | "gzip" | "deflate";
+
+// Off by default: some proxies buffer compressed responses whole, which
+// would hold messages back.
+export const StreamCompressionConfig = Config.boolean(
+  "STREAM_COMPRESSION"
+).pipe(Config.withDefault(false));
+
+// Best encoding the client accepts, brotli first; q=0 rules one out.
+export const negotiateEncoding = (
+  acceptEncoding: string | undefined
+): Option.Option<StreamEncoding> => {
+  const accepted = new Set<string>();
+  for (const part of (acceptEncoding ?? "").split(",")) {
+    const [name, ...params] = part.trim().toLowerCase().split(";");
+    const q = params
+      .map((p) => p.trim())
+      .find((p) => p.startsWith("q="));
+    if (name && (!q || Number.parseFloat(q.slice(2)) > 0)) accepted.add(name);
+  }
+  const encodings: ReadonlyArray<StreamEncoding> = ["br", "gzip", "deflate"];
+  return Option.fromNullable(encodings.find((e) => accepted.has(e)));
+};
+
+const makeCompressor = (encoding: StreamEncoding) => {
+  switch (encoding) {
+    case "br":
+      return {
+        compressor: zlib.createBrotliCompress({
+          params: { [zlib.constants.BROTLI_PARAM_QUALITY]: 5 },
+        }),
+        flushKind: zlib.constants.BROTLI_OPERATION_FLUSH,
+      };
+    case "gzip":
+      return {
+        compressor: zlib.createGzip(),
+        flushKind: zlib.constants.Z_SYNC_FLUSH,
+      };
+    case "deflate":
+      return {
+        compressor: zlib.createDeflate(),
+        flushKind: zlib.constants.Z_SYNC_FLUSH,
+      };
+  }
+};
+
+// Compresses with one stream-wide dictionary, so repeated field names and
+// words keep getting cheaper, and flushes after every chunk so each message
+// reaches the client as soon as it is sent rather than when the compressor's
+// buffer fills.
+export const compressStream =
+  (encoding: StreamEncoding) =>
+  <E, R>(chunks: Stream.Stream<Uint8Array, E, R>) =>
+    Stream.unwrapScoped(
+      Effect.acquireRelease(
+        Effect.sync(() => makeCompressor(encoding)),
+        ({ compressor }) => Effect.sync(() => compressor.close())
+      ).pipe(
+        Effect.map(({ compressor, flushKind }) =>
+          chunks.pipe(
+            Stream.mapEffect((chunk) =>
+              Effect.async<Uint8Array>((resume) => {
+                compressor.write(chunk);
+                // The output is buffered by the time the flush completes.
+                compressor.flush(flushKind, () => {
+                  const out: Array<Buffer> = [];
+                  let piece: Buffer | null;
+                  while ((piece = compressor.read()) !== null) out.push(piece);
+                  resume(Effect.succeed(Buffer.concat(out)));
+                });
+              })
+            )
+          )
+        )
+      )
+    );
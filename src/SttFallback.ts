@@ -0,0 +1,307 @@
+import {
+  Command,
+  FileSystem,
+  HttpClient,
+  HttpClientRequest,
+  HttpClientResponse,
+} from "@effect/platform";
+import {
+  Clock,
+  Config,
+  Data,
+  Effect,
+  Option,
+  Redacted,
+  Ref,
+  Schema,
+} from "effect";
+import { AppConfig } from "./AppConfig.js";
+import type { InputFormatSpec } from "./AudioFormat.js";
+import { FfmpegConfig, type AudioSourceId } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { pipelineError } from "./PipelineErrors.js";
+import { PipelineEvent, PipelineEvents } from "./PipelineEvents.js";
+import { applyPostProcessing } from "./PostProcessing.js";
+
+export type FallbackBackend = "deepgram" | "whisper";
+
+// Backend producing the selected source's text: OpenAI, or a fallback while
+// its circuit is open.
+export type SttBackend = "openai" | FallbackBackend;
+
+export class SttError extends Data.TaggedError("SttError")<{
+  backend: FallbackBackend;
+  message: string;
+}> {}
+
+const DeepgramResponse = Schema.Struct({
+  results: Schema.Struct({
+    channels: Schema.Array(
+      Schema.Struct({
+        alternatives: Schema.Array(
+          Schema.Struct({ transcript: Schema.String })
+        ),
+      })
+    ),
+  }),
+});
+
+const DEEPGRAM_ENCODINGS = {
+  pcm: "linear16",
+  pcmu: "mulaw",
+  pcma: "alaw",
+} as const;
+
+const SttConfig = Config.all({
+  backends: Config.array(
+    Config.literal("deepgram", "whisper")(),
+    "STT_FALLBACKS"
+  ).pipe(Config.withDefault([])),
+  language: Config.string("STT_LANGUAGE").pipe(Config.withDefault("fr")),
+  deepgramKey: Config.option(Config.redacted("DEEPGRAM_API_KEY")),
+  deepgramModel: Config.string("DEEPGRAM_MODEL").pipe(
+    Config.withDefault("nova-2")
+  ),
+  whisperCommand: Config.string("WHISPER_COMMAND").pipe(
+    Config.withDefault("whisper-cli")
+  ),
+  whisperModel: Config.option(Config.string("WHISPER_MODEL")),
+});
+
+const countWords = (text: string) =>
+  text.split(/\s+/).filter((word) => word.length > 0).length;
+
+// Transcription of audio windows while OpenAI's circuit is open, so the
+// stream doesn't go quiet during an outage. STT_FALLBACKS lists the backends
+// to try in order (e.g. "deepgram,whisper"); each window goes to the first
+// one that answers. Deepgram gets the raw window over its REST API, whisper
+// (whisper.cpp's CLI) a 16kHz WAV written to a temporary directory. Results
+// are published as transcribe responses, and every switch between OpenAI
+// and a fallback as a backend_changed message.
+export class SttFallback extends Effect.Service<SttFallback>()("SttFallback", {
+  effect: Effect.gen(function* () {
+    const fs = yield* FileSystem.FileSystem;
+    const client = yield* HttpClient.HttpClient;
+    const broadcaster = yield* Broadcaster;
+    const events = yield* PipelineEvents;
+    const appConfig = yield* AppConfig;
+    const config = yield* SttConfig;
+    const bin = yield* FfmpegConfig;
+    const active = yield* Ref.make<SttBackend>("openai");
+    // Bumped for every chunk OpenAI gets, so a window finishing after the
+    // circuit closed doesn't switch the backend back to a fallback.
+    const openaiChunks = yield* Ref.make(0);
+
+    const backends: Array<FallbackBackend> = [];
+    for (const backend of config.backends) {
+      const missing =
+        backend === "deepgram"
+          ? Option.isNone(config.deepgramKey) && "DEEPGRAM_API_KEY"
+          : Option.isNone(config.whisperModel) && "WHISPER_MODEL";
+      if (missing) {
+        yield* Effect.logWarning(`STT fallback ${backend} needs ${missing}`);
+      } else {
+        backends.push(backend);
+      }
+    }
+    if (backends.length > 0) {
+      yield* Effect.log(`STT fallbacks: ${backends.join(" → ")}`);
+    }
+
+    const deepgram = (spec: InputFormatSpec, audio: Uint8Array) =>
+      Effect.gen(function* () {
+        const key = Option.getOrThrow(config.deepgramKey);
+        const params = new URLSearchParams({
+          model: config.deepgramModel,
+          language: config.language,
+          encoding: DEEPGRAM_ENCODINGS[spec.format],
+          sample_rate: String(spec.sampleRate),
+          channels: "1",
+          smart_format: "true",
+        });
+        const response = yield* HttpClientRequest.post(
+          `https://api.deepgram.com/v1/listen?${params}`
+        ).pipe(
+          HttpClientRequest.setHeader(
+            "Authorization",
+            `Token ${Redacted.value(key)}`
+          ),
+          HttpClientRequest.bodyUint8Array(audio, "application/octet-stream"),
+          (request) => client.execute(request),
+          Effect.flatMap(HttpClientResponse.filterStatusOk),
+          Effect.flatMap(HttpClientResponse.schemaBodyJson(DeepgramResponse)),
+          Effect.timeout("20 seconds"),
+          Effect.scoped
+        );
+        const [channel] = response.results.channels;
+        return channel?.alternatives[0]?.transcript ?? "";
+      });
+
+    const whisper = (spec: InputFormatSpec, audio: Uint8Array) =>
+      Effect.gen(function* () {
+        const dir = yield* fs.makeTempDirectoryScoped({ prefix: "stt-" });
+        const raw = `${dir}/window.raw`;
+        const wav = `${dir}/window.wav`;
+        yield* fs.writeFile(raw, audio);
+        // The spec's output options describe the raw input just as well.
+        const converted = yield* Command.make(
+          bin.ffmpeg,
+          "-v",
+          "error",
+          ...spec.ffmpegArgs,
+          "-i",
+          raw,
+          "-ar",
+          "16000",
+          "-ac",
+          "1",
+          "-c:a",
+          "pcm_s16le",
+          wav
+        ).pipe(Command.exitCode);
+        if (converted !== 0) {
+          return yield* Effect.fail(`ffmpeg exited with code ${converted}`);
+        }
+        const out = yield* Command.make(
+          config.whisperCommand,
+          "-m",
+          Option.getOrThrow(config.whisperModel),
+          "-l",
+          config.language,
+          "-nt",
+          "-np",
+          "-f",
+          wav
+        ).pipe(Command.string);
+        return out
+          .split("\n")
+          .map((line) => line.trim())
+          .filter((line) => line.length > 0)
+          .join(" ");
+      }).pipe(Effect.timeout("60 seconds"), Effect.scoped);
+
+    const run = (
+      backend: FallbackBackend,
+      spec: InputFormatSpec,
+      audio: Uint8Array
+    ) =>
+      (backend === "deepgram"
+        ? deepgram(spec, audio)
+        : whisper(spec, audio)
+      ).pipe(
+        Effect.mapError(
+          (e) =>
+            new SttError({
+              backend,
+              message: e instanceof Error ? e.message : String(e),
+            })
+        )
+      );
+
+    const setActive = (backend: SttBackend) =>
+      Effect.gen(function* () {
+        if ((yield* Ref.getAndSet(active, backend)) === backend) return;
+        yield* Effect.log(`Transcription backend: ${backend}`);
+        yield* broadcaster.publish({ type: "backend_changed", backend });
+      });
+
+    // Tries each backend in turn; the first answer wins.
+    const transcribe = (spec: InputFormatSpec, audio: Uint8Array) =>
+      Effect.firstSuccessOf(
+        backends.map((backend) =>
+          run(backend, spec, audio).pipe(
+            Effect.map((text) => ({ backend, text })),
+            Effect.tapError((e) =>
+              Effect.logWarning(
+                `STT fallback ${e.backend} failed: ${e.message}`
+              )
+            )
+          )
+        )
+      );
+
+    return {
+      enabled: backends.length > 0,
+      // Called for every chunk OpenAI processes, so the switch back is
+      // announced as soon as its circuit closes.
+      useOpenAI: Ref.update(openaiChunks, (n) => n + 1).pipe(
+        Effect.zipRight(setActive("openai"))
+      ),
+      transcribeWindow: (params: {
+        source: AudioSourceId;
+        spec: InputFormatSpec;
+        audio: Uint8Array;
+        audioOffsetMs: number;
+        program: string | null;
+        windowStart: number | null;
+        windowEnd: number | null;
+        delayMs: number;
+        lossRatio: number;
+      }) =>
+        Effect.gen(function* () {
+          const start = yield* Clock.currentTimeMillis;
+          const chunks = yield* Ref.get(openaiChunks);
+          const result = yield* transcribe(params.spec, params.audio).pipe(
+            Effect.option
+          );
+          if (Option.isNone(result)) {
+            return yield* broadcaster.publish({
+              type: "error",
+              ...pipelineError(
+                "transcription_failed",
+                "All fallback transcription backends failed",
+                { source: params.source }
+              ),
+            });
+          }
+          if ((yield* Ref.get(openaiChunks)) === chunks) {
+            yield* setActive(result.value.backend);
+          }
+          const { postProcessing } = yield* appConfig.get;
+          const text = applyPostProcessing(
+            postProcessing,
+            result.value.text.trim()
+          );
+          if (text.length === 0) return;
+          const fields = {
+            responseId: `stt_${crypto.randomUUID()}`,
+            task: "transcribe",
+            source: params.source,
+            audioOffsetMs: params.audioOffsetMs,
+          } as const;
+          yield* broadcaster.publish({
+            type: "delta",
+            ...fields,
+            text,
+            seq: 0,
+          });
+          const durationMs = (yield* Clock.currentTimeMillis) - start;
+          yield* broadcaster.publish({
+            type: "complete",
+            ...fields,
+            text,
+            wordCount: countWords(text),
+            durationMs,
+            structured: null,
+            program: params.program,
+            windowStart: params.windowStart,
+            windowEnd: params.windowEnd,
+            ...(params.delayMs > 0 && { delayMs: params.delayMs }),
+            lossRatio: params.lossRatio,
+          });
+          yield* events.publish(
+            PipelineEvent.ResponseCompleted({
+              responseId: fields.responseId,
+              task: fields.task,
+              source: fields.source,
+              program: params.program,
+              text,
+              durationMs,
+              windowStart: params.windowStart,
+              windowEnd: params.windowEnd,
+            })
+          );
+        }),
+    } as const;
+  }),
+}) {}
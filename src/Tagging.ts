@@ -0,0 +1,84 @@
+import { Config, Effect, Option, Schema, Stream } from "effect";
+import { Broadcaster } from "./Broadcaster.js";
+import { Digest, stripCodeFence } from "./Messages.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { RESPONSE_TASKS } from "./Tasks.js";
+import { TranscriptStore } from "./TranscriptStore.js";
+
+const TAGGING_INSTRUCTIONS = `Classez le texte suivant et repondez uniquement par un objet JSON, sans texte autour ni bloc de code, de la forme {"topics": ["sujet", ...], "sentiment": "positive" | "neutral" | "negative"}. Donnez 1 a 3 sujets d'un ou deux mots, en minuscules et en francais (par exemple "politique", "economie", "sport", "meteo"). Le sentiment est celui des faits rapportes, pas du ton du texte.`;
+
+const Tags = Schema.Struct({
+  topics: Schema.Array(Schema.String),
+  sentiment: Digest.fields.sentiment,
+});
+
+const decodeTags = Schema.decodeUnknownOption(Schema.parseJson(Tags));
+
+const parseTags = (text: string) =>
+  decodeTags(stripCodeFence(text)).pipe(
+    Option.map((tags) => ({
+      ...tags,
+      topics: [
+        ...new Set(
+          tags.topics
+            .map((topic) => topic.trim().toLowerCase())
+            .filter((topic) => topic.length > 0)
+        ),
+      ].slice(0, 3),
+    }))
+  );
+
+// Tags every completed text response with topics and a sentiment, through a
+// one-off text response on the same session, for the GET /topics timeline.
+// Disabled with TOPIC_TAGGING=false; skipped when the request budget is spent.
+export class Tagging extends Effect.Service<Tagging>()("Tagging", {
+  scoped: Effect.gen(function* () {
+    const enabled = yield* Config.boolean("TOPIC_TAGGING").pipe(
+      Config.withDefault(true)
+    );
+    const broadcaster = yield* Broadcaster;
+    const openai = yield* OpenAIRealtime;
+    const store = yield* TranscriptStore;
+
+    const tag = (responseId: string, text: string) =>
+      Effect.gen(function* () {
+        const answer = yield* openai.respondToText(TAGGING_INSTRUCTIONS, text);
+        const tags = parseTags(answer);
+        if (Option.isNone(tags)) {
+          return yield* Effect.logWarning(
+            `Response ${responseId} not tagged: unexpected classification`
+          );
+        }
+        yield* store.saveTags(responseId, tags.value);
+      }).pipe(
+        Effect.catchAll((e) =>
+          Effect.logWarning(`Response ${responseId} not tagged`, e)
+        )
+      );
+
+    if (!enabled) {
+      yield* Effect.log("Topic tagging disabled");
+      return {} as const;
+    }
+
+    const subscription = yield* broadcaster.subscribe;
+
+    yield* Stream.fromQueue(subscription).pipe(
+      Stream.runForEach((msg) => {
+        if (msg.type !== "complete" || msg.text.trim() === "") {
+          return Effect.void;
+        }
+        if (RESPONSE_TASKS[msg.task].format !== "text") return Effect.void;
+        // Classified in the background so a slow answer doesn't hold up the
+        // next responses.
+        return tag(msg.responseId, msg.text).pipe(
+          Effect.forkScoped,
+          Effect.asVoid
+        );
+      }),
+      Effect.forkScoped
+    );
+
+    return {} as const;
+  }),
+}) {}
@@ -0,0 +1,45 @@
+import { Schema } from "effect";
+import { systemInstruction } from "./SystemPrompt.js";
+
+// Tasks with format "json" answer with a Digest object (see Messages.ts),
+// parsed when the response completes.
+export const RESPONSE_TASKS = {
+  commentary: {
+    name: "Commentaire",
+    format: "text",
+    instructions: systemInstruction,
+  },
+  transcribe: {
+    name: "Transcription",
+    format: "text",
+    instructions: `Transcrivez fidelement l'extrait audio en francais, sans commentaire ni reformulation. Commencez chaque tour de parole par une nouvelle ligne indiquant l'orateur suivi de deux-points : son nom s'il est connu, sinon "Animateur", "Invite" ou "Intervenant 1", "Intervenant 2"...`,
+  },
+  summarize: {
+    name: "Résumé",
+    format: "text",
+    instructions: `Resumez l'extrait audio en 2 ou 3 phrases neutres et factuelles.`,
+  },
+  quotes: {
+    name: "Citations",
+    format: "text",
+    instructions: `Extrayez les citations directes prononcees dans l'extrait audio, une par ligne, avec le nom de l'orateur s'il est connu. Repondez "Aucune citation" s'il n'y en a pas.`,
+  },
+  digest: {
+    name: "Synthèse",
+    format: "json",
+    instructions: `Analysez l'extrait audio et repondez uniquement par un objet JSON, sans texte autour ni bloc de code, de la forme {"headline": "titre court", "bullets": ["point cle", ...], "entities": ["personne, lieu ou organisation citee", ...], "sentiment": "positive" | "neutral" | "negative"}.`,
+  },
+} as const;
+
+export type TaskId = keyof typeof RESPONSE_TASKS;
+
+export const TaskIdSchema = Schema.Literal(
+  "commentary",
+  "transcribe",
+  "summarize",
+  "quotes",
+  "digest"
+).annotations({
+  title: "Task ID",
+  description: "Identifier for a response task run over each audio window",
+});
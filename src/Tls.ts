@@ -0,0 +1,177 @@
+import { HttpMiddleware, HttpServerResponse } from "@effect/platform";
+import type { Server } from "bun";
+import { Clock, Config, Deferred, Effect, Option, Schedule } from "effect";
+import {
+  cachedCertificate,
+  type Certificate,
+  LETS_ENCRYPT_DIRECTORY,
+  obtainCertificate,
+} from "./Acme.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+
+// HTTPS without a reverse proxy in front: from TLS_CERT_FILE and
+// TLS_KEY_FILE, or from a certificate for ACME_DOMAINS obtained from Let's
+// Encrypt (or ACME_DIRECTORY_URL) and kept in ACME_CACHE_DIR. With either,
+// TLS_REDIRECT_PORT serves plain HTTP that redirects to HTTPS; ACME needs it
+// on port 80 (its default there) to answer http-01 challenges.
+export const TlsConfig = Config.all({
+  certFile: Config.option(Config.string("TLS_CERT_FILE")),
+  keyFile: Config.option(Config.string("TLS_KEY_FILE")),
+  acmeDomains: Config.array(Config.string(), "ACME_DOMAINS").pipe(
+    Config.withDefault([])
+  ),
+  acmeEmail: Config.option(Config.string("ACME_EMAIL")),
+  acmeDirectory: Config.string("ACME_DIRECTORY_URL").pipe(
+    Config.withDefault(LETS_ENCRYPT_DIRECTORY)
+  ),
+  acmeCacheDir: Config.string("ACME_CACHE_DIR").pipe(
+    Config.withDefault("acme")
+  ),
+  redirectPort: Config.option(Config.port("TLS_REDIRECT_PORT")),
+  // Strict-Transport-Security max-age in seconds; 0 sends no header.
+  hstsMaxAge: Config.integer("TLS_HSTS_MAX_AGE").pipe(Config.withDefault(0)),
+});
+
+// Renewed once it expires within this long, checked daily.
+const RENEW_BEFORE_MS = 30 * 24 * 60 * 60 * 1000;
+
+// Plain HTTP on `port`: ACME challenges are answered, anything else is sent
+// to the same URL over HTTPS.
+const startRedirectServer = (
+  port: number,
+  httpsPort: number,
+  challenges: Map<string, string>
+) =>
+  Effect.acquireRelease(
+    Effect.sync(() =>
+      Bun.serve({
+        port,
+        fetch: (req) => {
+          const url = new URL(req.url);
+          const token = url.pathname.match(
+            /^\/\.well-known\/acme-challenge\/([\w-]+)$/
+          )?.[1];
+          if (token !== undefined) {
+            const answer = challenges.get(token);
+            return answer === undefined
+              ? new Response("Not found", { status: 404 })
+              : new Response(answer);
+          }
+          url.protocol = "https:";
+          url.port = httpsPort === 443 ? "" : String(httpsPort);
+          return Response.redirect(url.toString(), 301);
+        },
+      })
+    ),
+    (server) => Effect.sync(() => server.stop())
+  ).pipe(
+    Effect.tap(() => Effect.log(`Redirecting HTTP on port ${port} to HTTPS`))
+  );
+
+// BunHttpServer doesn't hand out the Bun server it starts, which renewed
+// certificates are reloaded into, so its Bun.serve call on `port` is caught
+// on the way through.
+const serverOn = (port: number) =>
+  Effect.acquireRelease(
+    Effect.gen(function* () {
+      const started = yield* Deferred.make<Server>();
+      const bun = Bun as { serve: typeof Bun.serve };
+      const serve = bun.serve;
+      bun.serve = ((options: Parameters<typeof serve>[0]) => {
+        const server = serve(options);
+        if (server.port === port) {
+          bun.serve = serve;
+          Deferred.unsafeDone(started, Effect.succeed(server));
+        }
+        return server;
+      }) as typeof serve;
+      return { started, restore: () => void (bun.serve = serve) };
+    }),
+    ({ restore }) => Effect.sync(restore)
+  ).pipe(Effect.map(({ started }) => Deferred.await(started)));
+
+// Bun.serve TLS options for the HTTP server on `port`, or none without TLS
+// configured. Starts the redirect server, and with ACME obtains the
+// certificate first if none is cached (or it is due for renewal) and checks
+// it daily after that, reloading the server with a renewed one.
+export const tlsServerOptions = (port: number) =>
+  Effect.gen(function* () {
+    const config = yield* TlsConfig;
+    const challenges = new Map<string, string>();
+    const redirect = (defaultPort: Option.Option<number>) =>
+      Option.match(Option.orElse(config.redirectPort, () => defaultPort), {
+        onNone: () => Effect.void,
+        onSome: (redirectPort) =>
+          startRedirectServer(redirectPort, port, challenges),
+      });
+
+    if (Option.isSome(config.certFile) && Option.isSome(config.keyFile)) {
+      yield* redirect(Option.none());
+      yield* Effect.log(`Serving HTTPS with ${config.certFile.value}`);
+      return {
+        tls: {
+          cert: Bun.file(config.certFile.value),
+          key: Bun.file(config.keyFile.value),
+        },
+      };
+    }
+    if (config.acmeDomains.length === 0) return {};
+
+    yield* redirect(Option.some(80));
+    const domains = config.acmeDomains.join(", ");
+    const renew = obtainCertificate({
+      directoryUrl: config.acmeDirectory,
+      domains: config.acmeDomains,
+      email: Option.getOrNull(config.acmeEmail),
+      cacheDir: config.acmeCacheDir,
+      challenges,
+    }).pipe(
+      Effect.tap((cert) =>
+        Effect.log(
+          `Obtained a certificate for ${domains}, valid until ${new Date(cert.expiresAt).toISOString()}`
+        )
+      )
+    );
+    const cached = cachedCertificate(config.acmeCacheDir, config.acmeDomains);
+    const dueForRenewal = (cert: Certificate | null) =>
+      Effect.map(
+        Clock.currentTimeMillis,
+        (now) => cert === null || cert.expiresAt - now < RENEW_BEFORE_MS
+      );
+
+    const current = yield* cached;
+    const cert =
+      current !== null && !(yield* dueForRenewal(current))
+        ? current
+        : yield* renew;
+    const supervisor = yield* PipelineSupervisor;
+    const server = yield* serverOn(port);
+    yield* Effect.gen(function* () {
+      if (!(yield* dueForRenewal(yield* cached))) return;
+      const renewed = yield* renew;
+      (yield* server).reload({
+        tls: { cert: renewed.cert, key: renewed.key },
+      } as Parameters<Server["reload"]>[0]);
+      yield* Effect.log(`Serving the renewed certificate for ${domains}`);
+    }).pipe(
+      Effect.catchAll((e) => Effect.logError(e.message, e.cause)),
+      Effect.repeat(Schedule.spaced("1 day")),
+      Effect.delay("1 day"),
+      (loop) => supervisor.supervise("tls-renewal", loop),
+      Effect.forkScoped
+    );
+    yield* Effect.log(`Serving HTTPS for ${domains}`);
+    return { tls: { cert: cert.cert, key: cert.key } };
+  });
+
+// Tells browsers to only come back over HTTPS for `maxAge` seconds.
+export const hsts = (maxAge: number) =>
+  HttpMiddleware.make((app) =>
+    Effect.map(
+      app,
+      HttpServerResponse.setHeader(
+        "Strict-Transport-Security",
+        `max-age=${maxAge}; includeSubDomains`
+      )
+    )
+  );
@@ -0,0 +1,367 @@
+import { Data, type Effect, Option } from "effect";
+import type { AudioSourceId } from "./AudioSource.js";
+import {
+  type BroadcastMessage,
+  decodeBroadcastJson,
+  type Digest,
+} from "./Messages.js";
+import type { SpeakerSegment } from "./SpeakerSegments.js";
+import type { TaskId } from "./Tasks.js";
+
+export interface Transcript {
+  readonly responseId: string;
+  readonly task: TaskId;
+  readonly source: AudioSourceId | null;
+  // Show on air when the window was captured, if known.
+  readonly program: string | null;
+  readonly text: string;
+  readonly completedAt: number;
+  // When the window's first and last audio went out on air, if known.
+  readonly windowStart: number | null;
+  readonly windowEnd: number | null;
+  // Speaker turns, for transcribe responses; empty otherwise.
+  readonly segments: ReadonlyArray<SpeakerSegment>;
+}
+
+export interface TranscriptMatch extends Transcript {
+  // Matching excerpt, HTML-escaped, with hits wrapped in <mark></mark>.
+  readonly snippet: string;
+}
+
+// Backends wrap hits in these, which markSnippet turns into <mark> tags once
+// the rest of the excerpt is escaped: the text is the model's, not markup.
+export const HIT_START = "\uE000";
+export const HIT_END = "\uE001";
+
+export const markSnippet = (excerpt: string) =>
+  excerpt
+    .replaceAll("&", "&amp;")
+    .replaceAll("<", "&lt;")
+    .replaceAll(">", "&gt;")
+    .replaceAll('"', "&quot;")
+    .replaceAll(HIT_START, "<mark>")
+    .replaceAll(HIT_END, "</mark>");
+
+export interface TranscriptSearch {
+  readonly query: string;
+  readonly source?: AudioSourceId | undefined;
+  readonly program?: string | undefined;
+  readonly from?: number | undefined;
+  readonly to?: number | undefined;
+  readonly limit: number;
+}
+
+// Classification of a response, stored next to it once available.
+export interface TranscriptTags {
+  readonly topics: ReadonlyArray<string>;
+  readonly sentiment: Digest["sentiment"];
+}
+
+export interface TopicBucket {
+  // Start of the bucket, in ms since the epoch.
+  readonly start: number;
+  // Most frequent first.
+  readonly topics: ReadonlyArray<{ topic: string; count: number }>;
+  readonly sentiment: Record<Digest["sentiment"], number>;
+}
+
+interface BucketTally {
+  readonly topics: Array<{ topic: string; count: number }>;
+  readonly sentiment: Record<Digest["sentiment"], number>;
+}
+
+export interface TopicTimelineQuery {
+  readonly source?: AudioSourceId | undefined;
+  readonly from?: number | undefined;
+  readonly to?: number | undefined;
+  readonly bucketMs: number;
+}
+
+// Embedding of one chunk of a transcript, with what searches filter on.
+export interface EmbeddedChunk {
+  readonly responseId: string;
+  readonly source: AudioSourceId | null;
+  readonly program: string | null;
+  readonly completedAt: number;
+  readonly text: string;
+  readonly vector: Float32Array;
+}
+
+// A finished time-boxed listening session.
+export interface ListenSession {
+  readonly id: string;
+  readonly source: AudioSourceId;
+  readonly startedAt: number;
+  readonly endedAt: number;
+  // Whether it ran its full duration or was stopped early.
+  readonly reason: "expired" | "stopped";
+  // Text responses completed during the session.
+  readonly responses: number;
+  readonly summary: string | null;
+}
+
+// What one station covered during an hour.
+export interface StationCoverage {
+  readonly source: AudioSourceId;
+  // Tagged text responses of the hour.
+  readonly responses: number;
+  // Most frequent first.
+  readonly topics: ReadonlyArray<{ topic: string; count: number }>;
+  // Topics no other station covered that hour.
+  readonly exclusive: ReadonlyArray<string>;
+}
+
+// How the stations' coverage of the same hour differs, for media-bias
+// analysis.
+export interface CoverageDiff {
+  // Start of the hour, in ms since the epoch.
+  readonly hour: number;
+  readonly stations: ReadonlyArray<StationCoverage>;
+  // Topics covered by at least two stations.
+  readonly shared: ReadonlyArray<string>;
+  // How the stations framed the shared topics differently; null when it
+  // could not be written, in which case the diff isn't stored.
+  readonly framing: ReadonlyArray<{ topic: string; difference: string }> | null;
+  readonly createdAt: number;
+}
+
+// Pipeline KPIs over one snapshot period, for the reliability reports.
+// Latencies are counted per bucket of METRICS_LATENCY_BUCKETS_MS, the last
+// one for those over its highest bound, so periods add up.
+export interface MetricsSnapshot {
+  // End of the period, in ms since the epoch.
+  readonly at: number;
+  readonly periodMs: number;
+  // Whether audio was read at all during the period.
+  readonly processing: boolean;
+  readonly responses: number;
+  // From each response's creation to its end.
+  readonly durationBuckets: ReadonlyArray<number>;
+  // From the end of a response's window on air to its end, for those whose
+  // window is known.
+  readonly lagBuckets: ReadonlyArray<number>;
+  readonly bytesProcessed: number;
+  readonly chunksReceived: number;
+  readonly chunksDropped: number;
+  // Realigned or dropped, see ChunkCorruption. Absent from snapshots taken
+  // before it was counted.
+  readonly chunksCorrupted: number;
+  readonly errors: number;
+  // Restarts of supervised components.
+  readonly restarts: number;
+}
+
+// Upper bounds of the latency buckets.
+export const METRICS_LATENCY_BUCKETS_MS = [
+  500, 1_000, 2_000, 3_000, 5_000, 8_000, 13_000, 20_000, 30_000, 60_000,
+] as const;
+
+// A listener's rating of a stored response.
+export interface Feedback {
+  readonly responseId: string;
+  // From 1 (useless) to 5 (spot on).
+  readonly rating: number;
+  readonly comment: string | null;
+  readonly createdAt: number;
+}
+
+// Ratings of the responses of one task on one source.
+export interface FeedbackStats {
+  readonly source: AudioSourceId | null;
+  readonly task: TaskId;
+  readonly count: number;
+  readonly averageRating: number;
+  // Rated 1 or 2, and 4 or 5.
+  readonly low: number;
+  readonly high: number;
+  readonly comments: number;
+}
+
+// An airing of a fingerprinted segment, e.g. an ad or a jingle; what it is
+// follows its fingerprint's label.
+export interface RepeatedSegment {
+  readonly fingerprint: string;
+  readonly source: AudioSourceId;
+  // When it aired, if known.
+  readonly startedAt: number | null;
+  readonly endedAt: number | null;
+  readonly durationMs: number;
+  // Whether it was withheld from OpenAI.
+  readonly skipped: boolean;
+  readonly recordedAt: number;
+}
+
+export interface RepeatQuery {
+  readonly source?: AudioSourceId | undefined;
+  readonly fingerprint?: string | undefined;
+  readonly from?: number | undefined;
+  readonly to?: number | undefined;
+  readonly limit: number;
+}
+
+// A broadcast message kept for replay, keyed by what it is about so the
+// replicas relaying the same message keep it once.
+export interface LoggedBroadcast {
+  readonly key: string;
+  readonly at: number;
+  readonly message: BroadcastMessage;
+}
+
+// Logged rows back as messages; those no longer matching the schema, from an
+// older version, are skipped.
+export const fromBroadcastRows = (
+  rows: ReadonlyArray<{ key: string; at: number | string; json: string }>
+) =>
+  rows.flatMap((row) =>
+    Option.toArray(decodeBroadcastJson(row.json)).map(
+      (message): LoggedBroadcast => ({
+        key: row.key,
+        at: Number(row.at),
+        message,
+      })
+    )
+  );
+
+export class TranscriptStoreError extends Data.TaggedError(
+  "TranscriptStoreError"
+)<{ cause: unknown }> {}
+
+type Stored<A> = Effect.Effect<A, TranscriptStoreError>;
+
+// Where transcripts and what is derived from them are kept. Each backend
+// answers the same queries; see TRANSCRIPTS_BACKEND.
+export interface TranscriptBackend {
+  // A transcript already stored under the response id is kept as it is.
+  readonly insert: (transcript: Transcript) => Stored<void>;
+  // Tags can arrive after the transcript is stored, or for a response that
+  // is never stored; either way they are kept by response id.
+  readonly saveTags: (responseId: string, tags: TranscriptTags) => Stored<void>;
+  // Topic counts and sentiment per time bucket, oldest first. Buckets are
+  // aligned on the epoch so consecutive queries line up; those without
+  // tagged responses are left out.
+  readonly topicTimeline: (
+    query: TopicTimelineQuery
+  ) => Stored<ReadonlyArray<TopicBucket>>;
+  // Replaces the response's embeddings for the model, one per chunk.
+  readonly saveEmbeddings: (
+    responseId: string,
+    model: string,
+    chunks: ReadonlyArray<{ text: string; vector: Float32Array }>
+  ) => Stored<void>;
+  // Every stored chunk embedded with the model, to load the index.
+  readonly embeddings: (model: string) => Stored<ReadonlyArray<EmbeddedChunk>>;
+  // Most recent transcripts of the tasks without embeddings for the model,
+  // e.g. those stored before semantic search was enabled.
+  readonly unembedded: (
+    model: string,
+    tasks: ReadonlyArray<TaskId>,
+    limit: number
+  ) => Stored<ReadonlyArray<Transcript>>;
+  readonly byResponseIds: (
+    responseIds: ReadonlyArray<string>
+  ) => Stored<ReadonlyArray<Transcript>>;
+  // Transcripts of the tasks from the source completed in the range, oldest
+  // first.
+  readonly between: (params: {
+    source: AudioSourceId;
+    tasks: ReadonlyArray<TaskId>;
+    from: number;
+    to: number;
+  }) => Stored<ReadonlyArray<Transcript>>;
+  // A source's transcripts completed in the range, oldest first: when and
+  // during which show each one was, and one page of them in full.
+  readonly archive: (params: {
+    source: AudioSourceId;
+    from: number;
+    to: number;
+    task?: TaskId | undefined;
+    offset: number;
+    limit: number;
+  }) => Stored<{
+    index: ReadonlyArray<{ completedAt: number; program: string | null }>;
+    transcripts: ReadonlyArray<Transcript>;
+  }>;
+  // Every rating is kept, several listeners may rate the same response.
+  readonly saveFeedback: (feedback: Feedback) => Stored<void>;
+  // Ratings given in the range, by source and task, most rated first.
+  readonly feedbackStats: (params: {
+    from?: number | undefined;
+    to?: number | undefined;
+  }) => Stored<ReadonlyArray<FeedbackStats>>;
+  readonly saveRepeat: (segment: RepeatedSegment) => Stored<void>;
+  // Recorded in the range, most recent first.
+  readonly repeats: (
+    query: RepeatQuery
+  ) => Stored<ReadonlyArray<RepeatedSegment>>;
+  readonly logBroadcast: (entry: LoggedBroadcast) => Stored<void>;
+  // Logged at or after `since`, oldest first.
+  readonly broadcastsSince: (
+    since: number,
+    limit: number
+  ) => Stored<ReadonlyArray<LoggedBroadcast>>;
+  readonly pruneBroadcasts: (before: number) => Stored<void>;
+  readonly saveSession: (session: ListenSession) => Stored<void>;
+  // Most recent first.
+  readonly sessions: (limit: number) => Stored<ReadonlyArray<ListenSession>>;
+  readonly saveSnapshot: (snapshot: MetricsSnapshot) => Stored<void>;
+  // Taken in the range, oldest first.
+  readonly snapshots: (
+    from: number,
+    to: number
+  ) => Stored<ReadonlyArray<MetricsSnapshot>>;
+  // Replaces the diff of the same hour.
+  readonly saveCoverage: (diff: CoverageDiff) => Stored<void>;
+  readonly coverage: (hour: number) => Stored<CoverageDiff | null>;
+  // Most recent first.
+  readonly recent: (limit: number) => Stored<ReadonlyArray<Transcript>>;
+  // Most recent first, of the tasks and optionally one source.
+  readonly recentOf: (params: {
+    tasks: ReadonlyArray<TaskId>;
+    source?: AudioSourceId | undefined;
+    limit: number;
+  }) => Stored<ReadonlyArray<Transcript>>;
+  // Best matches first. An empty query matches nothing.
+  readonly search: (
+    params: TranscriptSearch
+  ) => Stored<ReadonlyArray<TranscriptMatch>>;
+}
+
+// Vectors are stored as the raw bytes of their float32 values. Blobs are
+// copied on the way out, as they may not be 4-byte aligned.
+export const toBlob = (vector: Float32Array) =>
+  new Uint8Array(vector.buffer, vector.byteOffset, vector.byteLength);
+
+export const fromBlob = (blob: Uint8Array) =>
+  new Float32Array(new Uint8Array(blob).buffer);
+
+// Puts per-bucket sentiment and topic counts together, oldest bucket first.
+// Topic rows are expected most frequent first within a bucket.
+export const timelineBuckets = (
+  sentimentRows: ReadonlyArray<{
+    start: number;
+    sentiment: Digest["sentiment"];
+    count: number;
+  }>,
+  topicRows: ReadonlyArray<{ start: number; topic: string; count: number }>
+): ReadonlyArray<TopicBucket> => {
+  const buckets = new Map<number, BucketTally>();
+  const bucket = (start: number) => {
+    const existing = buckets.get(start);
+    if (existing) return existing;
+    const created: BucketTally = {
+      topics: [],
+      sentiment: { positive: 0, neutral: 0, negative: 0 },
+    };
+    buckets.set(start, created);
+    return created;
+  };
+  for (const row of sentimentRows) {
+    bucket(row.start).sentiment[row.sentiment] = row.count;
+  }
+  for (const row of topicRows) {
+    bucket(row.start).topics.push({ topic: row.topic, count: row.count });
+  }
+  return Array.from(buckets.entries())
+    .sort(([a], [b]) => a - b)
+    .map(([start, b]): TopicBucket => ({ start, ...b }));
+};
@@ -0,0 +1,161 @@
+import { Clock, Config, Effect, Option, Schedule, Stream } from "effect";
+import { AudioSource } from "./AudioSource.js";
+import { Broadcaster } from "./Broadcaster.js";
+import type { BroadcastMessage } from "./Messages.js";
+import { makePostgresTranscripts } from "./PostgresTranscripts.js";
+import { makeS3Transcripts } from "./S3Transcripts.js";
+import { parseSpeakerSegments } from "./SpeakerSegments.js";
+import { makeSqliteTranscripts } from "./SqliteTranscripts.js";
+import type { TranscriptBackend } from "./TranscriptBackend.js";
+
+// Where transcripts are kept: a SQLite file by default (TRANSCRIPTS_DB),
+// PostgreSQL (TRANSCRIPTS_POSTGRES_URL) to share them between instances, or
+// JSONL objects in an S3 bucket (TRANSCRIPTS_S3_BUCKET under
+// TRANSCRIPTS_S3_PREFIX) to archive them.
+const TranscriptBackendConfig = Config.literal(
+  "sqlite",
+  "postgres",
+  "s3"
+)("TRANSCRIPTS_BACKEND").pipe(Config.withDefault("sqlite"));
+
+const openBackend = Effect.gen(function* () {
+  switch (yield* TranscriptBackendConfig) {
+    case "sqlite":
+      return yield* makeSqliteTranscripts(
+        yield* Config.string("TRANSCRIPTS_DB").pipe(
+          Config.withDefault("transcripts.db")
+        )
+      );
+    case "postgres":
+      return yield* makePostgresTranscripts(
+        yield* Config.redacted("TRANSCRIPTS_POSTGRES_URL")
+      );
+    case "s3":
+      return yield* makeS3Transcripts(
+        yield* Config.string("TRANSCRIPTS_S3_BUCKET"),
+        yield* Config.string("TRANSCRIPTS_S3_PREFIX").pipe(
+          Config.withDefault("transcripts/")
+        )
+      );
+  }
+});
+
+// Broadcast messages a client catching up is replayed, by what they are
+// about: finished responses and their translations, captions and comparisons,
+// not their deltas or passing status. Null for the others.
+export const broadcastKey = (msg: BroadcastMessage) => {
+  switch (msg.type) {
+    case "complete":
+      return `complete:${msg.responseId}`;
+    case "comparison":
+      return `comparison:${msg.responseId}`;
+    case "translation":
+      return `translation:${msg.responseId}:${msg.lang}`;
+    case "transcript":
+      return `transcript:${msg.itemId}`;
+    default:
+      return null;
+  }
+};
+
+// Persists completed responses and repeated segments from the broadcast
+// stream to the configured backend, which answers the searches and listings
+// built on them. The messages replayed to clients catching up are logged there too, for
+// BROADCAST_LOG_HOURS (default 24, 0 to keep none).
+export class TranscriptStore extends Effect.Service<TranscriptStore>()(
+  "TranscriptStore",
+  {
+    scoped: Effect.gen(function* () {
+      const broadcaster = yield* Broadcaster;
+      const audioSource = yield* AudioSource;
+      const backend: TranscriptBackend = yield* openBackend;
+      const logHours = yield* Config.number("BROADCAST_LOG_HOURS").pipe(
+        Config.withDefault(24)
+      );
+
+      const subscription = yield* broadcaster.subscribe;
+
+      const logBroadcast = (msg: BroadcastMessage) =>
+        Effect.gen(function* () {
+          const key = broadcastKey(msg);
+          if (logHours <= 0 || key === null) return;
+          yield* backend
+            .logBroadcast({
+              key,
+              at: yield* Clock.currentTimeMillis,
+              message: msg,
+            })
+            .pipe(
+              Effect.catchAll((e) =>
+                Effect.logError("Failed to log broadcast", e.cause)
+              )
+            );
+        });
+
+      if (logHours > 0) {
+        yield* Clock.currentTimeMillis.pipe(
+          Effect.flatMap((now) =>
+            backend.pruneBroadcasts(now - logHours * 60 * 60 * 1000)
+          ),
+          Effect.catchAll((e) =>
+            Effect.logError("Failed to prune the broadcast log", e.cause)
+          ),
+          Effect.repeat(Schedule.spaced("1 hour")),
+          Effect.forkScoped
+        );
+      }
+
+      yield* Stream.fromQueue(subscription).pipe(
+        Stream.runForEach((msg) =>
+          Effect.gen(function* () {
+            yield* logBroadcast(msg);
+            if (msg.type === "repeated_segment") {
+              yield* backend
+                .saveRepeat({
+                  fingerprint: msg.fingerprint,
+                  source: msg.source,
+                  startedAt: msg.startedAt,
+                  endedAt: msg.endedAt,
+                  durationMs: msg.durationMs,
+                  skipped: msg.skipped,
+                  recordedAt: yield* Clock.currentTimeMillis,
+                })
+                .pipe(
+                  Effect.catchAll((e) =>
+                    Effect.logError("Failed to store repeated segment", e.cause)
+                  )
+                );
+              return;
+            }
+            if (msg.type !== "complete" || msg.text === "") return;
+            yield* backend
+              .insert({
+                responseId: msg.responseId,
+                task: msg.task,
+                source:
+                  msg.source ??
+                  Option.getOrNull(yield* audioSource.currentSource),
+                program: msg.program ?? null,
+                text: msg.text,
+                completedAt: yield* Clock.currentTimeMillis,
+                windowStart: msg.windowStart ?? null,
+                windowEnd: msg.windowEnd ?? null,
+                segments:
+                  msg.task === "transcribe"
+                    ? parseSpeakerSegments(msg.text)
+                    : [],
+              })
+              .pipe(
+                Effect.catchAll((e) =>
+                  Effect.logError("Failed to store transcript", e.cause)
+                )
+              );
+          })
+        ),
+        Effect.forkScoped
+      );
+
+      return backend;
+    }),
+  }
+) {}
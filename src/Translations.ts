@@ -0,0 +1,133 @@
+import { Config, Effect, Queue, Ref, Schema, Stream } from "effect";
+import { AppConfig } from "./AppConfig.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { OpenAIRealtime } from "./OpenAIRealtime.js";
+import { type EventOf, PipelineEvents } from "./PipelineEvents.js";
+import { PipelineSupervisor } from "./PipelineSupervisor.js";
+import { RESPONSE_TASKS } from "./Tasks.js";
+
+// A BCP 47 language code as clients give it, e.g. en or pt-BR.
+export const LanguageCode = Schema.String.pipe(
+  Schema.pattern(/^[a-z]{2,3}(-[A-Za-z]{2,4})?$/)
+).annotations({ title: "Language Code" });
+
+const languageNames = new Intl.DisplayNames(["fr"], { type: "language" });
+
+const translationInstructions = (lang: string) =>
+  `Traduisez le texte suivant en ${languageNames.of(lang) ?? lang} (${lang}), fidelement, en gardant son ton et sa mise en forme. Repondez uniquement par la traduction, sans commentaire.`;
+
+// Languages asked for by the stream clients of this instance, in the order
+// they were first asked for, with how many clients want each.
+interface Wanted {
+  readonly lang: string;
+  readonly clients: number;
+}
+
+// Translates every completed text response into the languages stream clients
+// ask for with ?lang=, through a one-off text response on the same session,
+// and broadcasts each as a translation message. At most
+// TRANSLATION_MAX_LANGUAGES (default 3, 0 to disable) languages are
+// translated at once, the first asked for; the others wait for one to be
+// dropped by its last client. Responses are not translated into French while
+// no commentary language is configured, as they are written in it.
+export class Translations extends Effect.Service<Translations>()(
+  "Translations",
+  {
+    scoped: Effect.gen(function* () {
+      const maxLanguages = yield* Config.integer(
+        "TRANSLATION_MAX_LANGUAGES"
+      ).pipe(Config.withDefault(3));
+      const appConfig = yield* AppConfig;
+      const broadcaster = yield* Broadcaster;
+      const events = yield* PipelineEvents;
+      const openai = yield* OpenAIRealtime;
+      const supervisor = yield* PipelineSupervisor;
+      const wanted = yield* Ref.make<ReadonlyArray<Wanted>>([]);
+
+      const translate = (msg: EventOf<"ResponseCompleted">, lang: string) =>
+        openai.respondToText(translationInstructions(lang), msg.text).pipe(
+          Effect.flatMap((translated) =>
+            broadcaster.publish({
+              type: "translation",
+              responseId: msg.responseId,
+              task: msg.task,
+              source: msg.source,
+              lang,
+              text: translated.trim(),
+            })
+          ),
+          Effect.catchAll((e) =>
+            Effect.logWarning(
+              `Response ${msg.responseId} not translated into ${lang}`,
+              e
+            )
+          )
+        );
+
+      if (maxLanguages > 0) {
+        // Queued from the start, for the supervised loop below.
+        const completed =
+          yield* Queue.unbounded<EventOf<"ResponseCompleted">>();
+        yield* events.on("ResponseCompleted", (msg) =>
+          Queue.offer(completed, msg)
+        );
+        yield* Stream.fromQueue(completed).pipe(
+          Stream.runForEach((msg) =>
+            Effect.gen(function* () {
+              if (msg.text.trim() === "") return;
+              if (RESPONSE_TASKS[msg.task].format !== "text") return;
+              const { language } = yield* appConfig.get;
+              const langs = (yield* Ref.get(wanted))
+                .slice(0, maxLanguages)
+                .map((w) => w.lang)
+                .filter((lang) => language || lang.split("-")[0] !== "fr");
+              // In the background so a slow answer doesn't hold up the next
+              // responses.
+              yield* Effect.forEach(
+                langs,
+                (lang) => translate(msg, lang),
+                { concurrency: "unbounded", discard: true }
+              ).pipe(Effect.forkScoped);
+            })
+          ),
+          (loop) => supervisor.supervise("translations", loop),
+          Effect.forkScoped
+        );
+      } else {
+        yield* Effect.log("Translations disabled");
+      }
+
+      return {
+        // Has completed responses translated into `lang` for as long as the
+        // scope is open.
+        want: (lang: string) =>
+          Effect.acquireRelease(
+            Ref.update(wanted, (all) =>
+              all.some((w) => w.lang === lang)
+                ? all.map((w) =>
+                    w.lang === lang ? { ...w, clients: w.clients + 1 } : w
+                  )
+                : [...all, { lang, clients: 1 }]
+            ).pipe(
+              Effect.zipRight(Ref.get(wanted)),
+              Effect.tap((all) =>
+                all.findIndex((w) => w.lang === lang) >= maxLanguages
+                  ? Effect.logWarning(
+                      `Not translating into ${lang}: TRANSLATION_MAX_LANGUAGES already in use`
+                    )
+                  : Effect.void
+              )
+            ),
+            () =>
+              Ref.update(wanted, (all) =>
+                all
+                  .map((w) =>
+                    w.lang === lang ? { ...w, clients: w.clients - 1 } : w
+                  )
+                  .filter((w) => w.clients > 0)
+              )
+          ).pipe(Effect.asVoid),
+      } as const;
+    }),
+  }
+) {}
@@ -0,0 +1,118 @@
+import {
+  createECDH,
+  createPrivateKey,
+  hkdfSync,
+  randomBytes,
+  createCipheriv,
+  sign,
+} from "node:crypto";
+
+// Minimal Web Push sender: VAPID authentication (RFC 8292) and aes128gcm
+// payload encryption (RFC 8291), so no third-party library is needed.
+
+export interface PushSubscription {
+  readonly endpoint: string;
+  // base64url: the browser's P-256 public key and authentication secret.
+  readonly keys: { readonly p256dh: string; readonly auth: string };
+}
+
+export interface VapidKeys {
+  // base64url: uncompressed P-256 public key (65 bytes) and private scalar
+  // (32 bytes), as printed by `bunx web-push generate-vapid-keys`.
+  readonly publicKey: string;
+  readonly privateKey: string;
+  // Contact for push services, a mailto: or https: URL.
+  readonly subject: string;
+}
+
+const b64url = (data: Uint8Array | string) =>
+  Buffer.from(data).toString("base64url");
+
+const fromB64url = (text: string) => Buffer.from(text, "base64url");
+
+const hkdf = (
+  ikm: Uint8Array,
+  salt: Uint8Array,
+  info: Uint8Array,
+  length: number
+) => Buffer.from(hkdfSync("sha256", ikm, salt, info, length));
+
+// ES256 JWT authorizing this server to push to the endpoint's service.
+const vapidAuthorization = (endpoint: string, vapid: VapidKeys) => {
+  const publicKey = fromB64url(vapid.publicKey);
+  const key = createPrivateKey({
+    key: {
+      kty: "EC",
+      crv: "P-256",
+      d: vapid.privateKey,
+      x: b64url(publicKey.subarray(1, 33)),
+      y: b64url(publicKey.subarray(33, 65)),
+    },
+    format: "jwk",
+  });
+  const header = b64url(JSON.stringify({ typ: "JWT", alg: "ES256" }));
+  const claims = b64url(
+    JSON.stringify({
+      aud: new URL(endpoint).origin,
+      exp: Math.floor(Date.now() / 1000) + 12 * 3600,
+      sub: vapid.subject,
+    })
+  );
+  const signature = sign("sha256", Buffer.from(`${header}.${claims}`), {
+    key,
+    dsaEncoding: "ieee-p1363",
+  });
+  return `vapid t=${header}.${claims}.${b64url(signature)}, k=${vapid.publicKey}`;
+};
+
+// Encrypts the payload for one subscription as a single aes128gcm record.
+const encrypt = (subscription: PushSubscription, payload: string) => {
+  const uaPublic = fromB64url(subscription.keys.p256dh);
+  const authSecret = fromB64url(subscription.keys.auth);
+  const ecdh = createECDH("prime256v1");
+  const asPublic = ecdh.generateKeys();
+  const sharedSecret = ecdh.computeSecret(uaPublic);
+
+  const ikm = hkdf(
+    sharedSecret,
+    authSecret,
+    Buffer.concat([Buffer.from("WebPush: info\0"), uaPublic, asPublic]),
+    32
+  );
+  const salt = randomBytes(16);
+  const cek = hkdf(ikm, salt, Buffer.from("Content-Encoding: aes128gcm\0"), 16);
+  const nonce = hkdf(ikm, salt, Buffer.from("Content-Encoding: nonce\0"), 12);
+
+  const cipher = createCipheriv("aes-128-gcm", cek, nonce);
+  // 0x02 marks the last (and only) record, with no padding.
+  const ciphertext = Buffer.concat([
+    cipher.update(Buffer.concat([Buffer.from(payload), Buffer.from([2])])),
+    cipher.final(),
+    cipher.getAuthTag(),
+  ]);
+
+  const header = Buffer.alloc(21);
+  salt.copy(header, 0);
+  header.writeUInt32BE(4096, 16);
+  header[20] = asPublic.length;
+  return Buffer.concat([header, asPublic, ciphertext]);
+};
+
+// Request to hand to the subscription's push service. `ttl` is how long, in
+// seconds, the service keeps the message for an offline browser.
+export const pushRequest = (
+  subscription: PushSubscription,
+  vapid: VapidKeys,
+  payload: string,
+  options: { ttl: number; urgency: "normal" | "high" }
+) => ({
+  url: subscription.endpoint,
+  headers: {
+    Authorization: vapidAuthorization(subscription.endpoint, vapid),
+    "Content-Encoding": "aes128gcm",
+    "Content-Type": "application/octet-stream",
+    TTL: String(options.ttl),
+    Urgency: options.urgency,
+  },
+  body: encrypt(subscription, payload),
+});
@@ -0,0 +1,227 @@
+// Admin dashboard: polls the pipeline's stages, queues and last minute, and
+// sends the same requests as curl would to steer it. It doesn't open a
+// stream, so it doesn't count as a listener.
+
+const REFRESH_MS = 2000;
+
+const STATE_LABELS = {
+  running: "En marche",
+  paused: "En pause",
+  stopped: "Arrêté",
+};
+
+const loginForm = document.getElementById("login-form");
+const dashboard = document.getElementById("dashboard");
+const graphEl = document.getElementById("graph");
+const queuesEl = document.getElementById("queues");
+const kpisEl = document.getElementById("kpis");
+const sourceSelect = document.getElementById("source-select");
+const pauseButton = document.getElementById("pause-button");
+const promptForm = document.getElementById("prompt-form");
+const promptText = document.getElementById("prompt-text");
+const promptLanguage = document.getElementById("prompt-language");
+const errorEl = document.getElementById("error");
+
+let paused = false;
+let errorTimer = null;
+
+function showError(message) {
+  errorEl.textContent = message;
+  errorEl.hidden = false;
+  clearTimeout(errorTimer);
+  errorTimer = setTimeout(() => (errorEl.hidden = true), 5000);
+}
+
+async function getJson(path) {
+  const res = await fetch(path);
+  if (!res.ok) throw new Error(`${path}: ${res.status}`);
+  return res.json();
+}
+
+async function send(method, path, body) {
+  const res = await fetch(path, {
+    method,
+    headers: body ? { "Content-Type": "application/json" } : {},
+    body: body ? JSON.stringify(body) : undefined,
+  });
+  if (!res.ok) throw new Error(`${path}: ${res.status}`);
+  return res.json();
+}
+
+function tile(value, label, fill) {
+  const el = document.createElement("div");
+  el.innerHTML =
+    '<div class="tile-value"></div><div class="tile-label"></div>';
+  el.querySelector(".tile-value").textContent = value;
+  el.querySelector(".tile-label").textContent = label;
+  if (fill !== undefined) {
+    const meter = document.createElement("div");
+    meter.className = "meter";
+    meter.innerHTML = '<div class="meter-fill"></div>';
+    meter.firstChild.style.width = `${Math.round(fill * 100)}%`;
+    el.appendChild(meter);
+  }
+  return el;
+}
+
+function renderGraph(graph) {
+  graphEl.innerHTML = "";
+  graph.nodes.forEach((node, i) => {
+    if (i > 0) {
+      const arrow = document.createElement("div");
+      arrow.className = "arrow";
+      arrow.textContent = "→";
+      graphEl.appendChild(arrow);
+    }
+    const el = document.createElement("div");
+    el.className = `node ${node.state}`;
+    el.innerHTML =
+      '<div class="node-label"></div><div class="node-detail"></div>';
+    el.querySelector(".node-label").textContent = node.label;
+    el.querySelector(".node-detail").textContent =
+      node.detail ?? STATE_LABELS[node.state];
+    if (node.restarts > 0) {
+      const restarts = document.createElement("div");
+      restarts.className = "node-restarts";
+      restarts.textContent = `${node.restarts} redémarrage(s)`;
+      el.appendChild(restarts);
+    }
+    graphEl.appendChild(el);
+  });
+}
+
+function renderQueues(queues) {
+  const audio = queues.audio;
+  queuesEl.replaceChildren(
+    audio
+      ? tile(
+          `${audio.queued} / ${audio.capacity}`,
+          `Audio en attente (${audio.source})`,
+          audio.queued / audio.capacity
+        )
+      : tile("-", "Audio en attente"),
+    tile(queues.openai.running, "Réponses en cours"),
+    tile(queues.openai.waiting, "Commits en attente"),
+    tile(queues.clients.connected, "Clients connectés"),
+    tile(queues.clients.maxQueued, "Messages en attente (client le plus lent)"),
+    tile(queues.clients.dropped, "Messages perdus")
+  );
+}
+
+function renderKpis(kpis) {
+  const ms = (value) =>
+    value === null ? "-" : `${(value / 1000).toFixed(1)}s`;
+  kpisEl.replaceChildren(
+    tile(kpis.responses, "Réponses"),
+    tile(ms(kpis.meanDurationMs), "Durée moyenne"),
+    tile(ms(kpis.meanLagMs), "Retard moyen"),
+    tile(`${Math.round(kpis.bytesPerSecond / 1024)} Ko/s`, "Audio lu"),
+    tile(kpis.chunksDropped, "Morceaux perdus"),
+    tile(kpis.chunksCorrupted, "Morceaux corrompus"),
+    tile(kpis.errors, "Erreurs")
+  );
+}
+
+function renderSources(data) {
+  paused = data.paused;
+  pauseButton.textContent = paused ? "Reprendre" : "Pause";
+  sourceSelect.replaceChildren(
+    new Option("Aucune station", ""),
+    ...data.sources.map((source) => new Option(source.name, source.id))
+  );
+  sourceSelect.value = data.current ?? "";
+}
+
+async function refresh() {
+  try {
+    const [graph, queues, kpis] = await Promise.all([
+      getJson("debug/graph"),
+      getJson("debug/queues"),
+      getJson("debug/kpis"),
+    ]);
+    renderGraph(graph);
+    renderQueues(queues);
+    renderKpis(kpis);
+  } catch (err) {
+    console.error("Failed to refresh:", err);
+  }
+}
+
+async function loadControls() {
+  renderSources(await getJson("sources"));
+  const config = await getJson("config");
+  promptText.value = config.prompt;
+  promptLanguage.value = config.language ?? "";
+}
+
+sourceSelect.onchange = async () => {
+  try {
+    await send("POST", "sources", { source: sourceSelect.value || null });
+    renderSources(await getJson("sources"));
+    refresh();
+  } catch (err) {
+    showError("Changement de station impossible");
+  }
+};
+
+pauseButton.onclick = async () => {
+  try {
+    const state = await send(
+      "POST",
+      paused ? "processing/resume" : "processing/pause"
+    );
+    paused = state.paused;
+    pauseButton.textContent = paused ? "Reprendre" : "Pause";
+    refresh();
+  } catch (err) {
+    showError("Commande refusée");
+  }
+};
+
+promptForm.onsubmit = async (event) => {
+  event.preventDefault();
+  try {
+    const config = await send("PATCH", "config", {
+      prompt: promptText.value,
+      language: promptLanguage.value.trim() || null,
+    });
+    promptText.value = config.prompt;
+    promptLanguage.value = config.language ?? "";
+  } catch (err) {
+    showError("Consigne refusée");
+  }
+};
+
+loginForm.onsubmit = async (event) => {
+  event.preventDefault();
+  const res = await fetch("auth/login", {
+    method: "POST",
+    headers: { "Content-Type": "application/json" },
+    body: JSON.stringify({
+      username: document.getElementById("login-username").value,
+      password: document.getElementById("login-password").value,
+    }),
+  });
+  if (!res.ok) return showError("Identifiant ou mot de passe incorrect");
+  location.reload();
+};
+
+async function start() {
+  const me = await fetch("auth/me")
+    .then((res) => res.json())
+    .catch(() => ({ enabled: false, role: "admin" }));
+  if (me.enabled && me.role !== "admin") {
+    loginForm.hidden = false;
+    if (me.role === "viewer") showError("Réservé aux administrateurs");
+    return;
+  }
+  dashboard.hidden = false;
+  loadControls().catch((err) => {
+    console.error("Failed to load controls:", err);
+    showError("Chargement impossible");
+  });
+  refresh();
+  setInterval(refresh, REFRESH_MS);
+}
+
+start();
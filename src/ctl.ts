@@ -0,0 +1,173 @@
+import {
+  FetchHttpClient,
+  HttpApiClient,
+  HttpClient,
+  HttpClientRequest,
+  HttpClientResponse,
+} from "@effect/platform";
+import { BunRuntime } from "@effect/platform-bun";
+import {
+  Config,
+  Console,
+  Data,
+  Effect,
+  Option,
+  Redacted,
+  Schema,
+  Stream,
+} from "effect";
+import { FunnyRadioApi } from "./HttpApi.js";
+import { BroadcastMessage } from "./Messages.js";
+
+// Headless control of a running instance through its HTTP API, for servers
+// without a browser: `bun run ctl <command>`. RADIO_URL points at the
+// instance (defaults to http://localhost:3000); RADIO_TOKEN is the session
+// token to send when it has accounts on, from POST /auth/login.
+
+const USAGE = `Usage: bun run ctl <command>
+
+Commands:
+  sources              List sources and show the current one
+  set-source <id>      Select a source ("none" clears the selection)
+  pause                Stop sending audio to OpenAI
+  resume               Resume sending audio to OpenAI
+  stats                Show connected clients and their dropped messages
+  tail                 Print the message stream as it arrives`;
+
+class UsageError extends Data.TaggedError("UsageError")<{
+  message: string;
+}> {}
+
+const decodeMessage = Schema.decodeUnknownOption(
+  Schema.parseJson(BroadcastMessage)
+);
+
+const formatTime = (ms: number) => new Date(ms).toLocaleTimeString("fr-FR");
+
+// Deltas are written as they come and end with their response; other
+// messages get a line of their own.
+const printMessage = (msg: BroadcastMessage) =>
+  Effect.sync(() => {
+    switch (msg.type) {
+      case "delta":
+        process.stdout.write(msg.text);
+        return;
+      case "complete":
+        process.stdout.write("\n");
+        return;
+      case "level":
+        return;
+      case "error":
+        console.log(`[error] ${msg.code}: ${msg.message}`);
+        return;
+      default:
+        console.log(`[${msg.type}] ${JSON.stringify(msg)}`);
+    }
+  });
+
+const authenticated =
+  (token: Option.Option<Redacted.Redacted>) =>
+  (client: HttpClient.HttpClient) =>
+    Option.match(token, {
+      onNone: () => client,
+      onSome: (t) =>
+        HttpClient.mapRequest(client, HttpClientRequest.bearerToken(t)),
+    });
+
+const tail = (baseUrl: string, token: Option.Option<Redacted.Redacted>) =>
+  Effect.gen(function* () {
+    const client = authenticated(token)(yield* HttpClient.HttpClient);
+    const response = yield* client.get(`${baseUrl}/stream`);
+    if (response.status === 503) {
+      return yield* Console.log("No source selected, nothing to tail");
+    }
+    yield* HttpClientResponse.stream(Effect.succeed(response)).pipe(
+      Stream.decodeText(),
+      Stream.splitLines,
+      Stream.filterMap((line) =>
+        line.startsWith("data: ")
+          ? decodeMessage(line.slice("data: ".length))
+          : Option.none()
+      ),
+      Stream.takeUntil((msg) => msg.type === "server_shutdown"),
+      Stream.runForEach(printMessage)
+    );
+  }).pipe(Effect.scoped);
+
+const program = Effect.gen(function* () {
+  const baseUrl = yield* Config.string("RADIO_URL").pipe(
+    Config.withDefault("http://localhost:3000")
+  );
+  const token = yield* Config.option(Config.redacted("RADIO_TOKEN"));
+  const client = yield* HttpApiClient.make(FunnyRadioApi, {
+    baseUrl,
+    transformClient: authenticated(token),
+  });
+  const [command, ...args] = process.argv.slice(2);
+
+  switch (command) {
+    case "sources": {
+      const { sources, current, paused, sampleRate } =
+        yield* client.sources.getSources();
+      for (const source of sources) {
+        const marker = source.id === current ? "*" : " ";
+        yield* Console.log(`${marker} ${source.id.padEnd(16)} ${source.name}`);
+      }
+      if (current) {
+        yield* Console.log(
+          `\n${current}: ${paused ? "paused" : "processing"}` +
+            (sampleRate ? `, ${sampleRate} Hz` : "")
+        );
+      }
+      return;
+    }
+    case "set-source": {
+      const id = args[0];
+      if (!id) return yield* new UsageError({ message: "Missing source id" });
+      const { name } = yield* client.sources.setSource({
+        payload: { source: id === "none" ? null : id },
+      });
+      return yield* Console.log(
+        name ? `Source set to ${name}` : "Source cleared"
+      );
+    }
+    case "pause":
+    case "resume": {
+      const { paused } =
+        command === "pause"
+          ? yield* client.processing.pauseProcessing()
+          : yield* client.processing.resumeProcessing();
+      return yield* Console.log(
+        paused ? "Processing paused" : "Processing resumed"
+      );
+    }
+    case "stats": {
+      const { subscribers, evicted } =
+        yield* client.stream.getSubscriberStats();
+      for (const s of subscribers) {
+        yield* Console.log(
+          `#${s.id} ${s.kind} ${s.address ?? "-"} since ` +
+            `${formatTime(s.connectedAt)}: ${s.delivered} delivered, ` +
+            `${s.dropped} dropped, ${s.queued} queued`
+        );
+      }
+      return yield* Console.log(
+        `${subscribers.length} client(s), ${evicted} evicted`
+      );
+    }
+    case "tail":
+      return yield* tail(baseUrl, token);
+    default:
+      return yield* new UsageError({
+        message: command ? `Unknown command "${command}"` : "Missing command",
+      });
+  }
+}).pipe(
+  Effect.catchTag("UsageError", (e) =>
+    Console.error(`${e.message}\n\n${USAGE}`).pipe(
+      Effect.zipRight(Effect.sync(() => (process.exitCode = 2)))
+    )
+  )
+);
+
+program.pipe(Effect.provide(FetchHttpClient.layer), BunRuntime.runMain);
@@ -1,40 +1,120 @@
 import {
+  FetchHttpClient,
   HttpApiBuilder,
   HttpApiScalar,
   HttpMiddleware,
   HttpServer,
 } from "@effect/platform";
 import { BunContext, BunHttpServer, BunRuntime } from "@effect/platform-bun";
-import { Config, Effect, Layer, Context } from "effect";
+import { Config, Effect, Layer, Option } from "effect";
+import { Accounts, authorize } from "./Accounts.js";
+import { AppConfig } from "./AppConfig.js";
 import { AudioSource } from "./AudioSource.js";
+import { basePath, BasePathConfig } from "./BasePath.js";
+import { Broadcaster } from "./Broadcaster.js";
+import { cors, CorsConfig } from "./Cors.js";
 import { OpenAIRealtime } from "./OpenAIRealtime.js";
 import { runAudioProcessor } from "./AudioProcessor.js";
 import { FunnyRadioApiLive } from "./HttpApi.js";
+import { GrpcServerLive } from "./GrpcServer.js";
+import { makeServicesLive } from "./Services.js";
+import { hsts, TlsConfig, tlsServerOptions } from "./Tls.js";
 
-const HttpServerLive = Layer.unwrapEffect(
-  Config.port("PORT").pipe(
-    Config.withDefault(3000),
-    Effect.map((port) => BunHttpServer.layer({ port, idleTimeout: 0 }))
-  )
+// PORT overrides the port from the config file.
+const HttpServerLive = Layer.unwrapScoped(
+  Effect.gen(function* () {
+    const { port } = yield* AppConfig.pipe(Effect.flatMap((c) => c.get));
+    const envPort = yield* Config.option(Config.port("PORT"));
+    const serverPort = Option.getOrElse(envPort, () => port);
+    return BunHttpServer.layer({
+      port: serverPort,
+      idleTimeout: 0,
+      ...(yield* tlsServerOptions(serverPort)),
+    });
+  })
 );
 
-const HttpLive = HttpApiBuilder.serve(HttpMiddleware.logger).pipe(
+const HttpLive = Layer.unwrapEffect(
+  Effect.gen(function* () {
+    const { hstsMaxAge } = yield* TlsConfig;
+    const corsConfig = yield* CorsConfig;
+    const accounts = yield* Accounts;
+    const prefix = yield* BasePathConfig;
+    return HttpApiBuilder.serve((app) => {
+      // Inside CORS, so preflight requests are answered without a session.
+      const authorized = accounts.enabled ? authorize(accounts)(app) : app;
+      const shared =
+        corsConfig.origins.length > 0
+          ? cors(corsConfig)(authorized)
+          : authorized;
+      const secured = hstsMaxAge > 0 ? hsts(hstsMaxAge)(shared) : shared;
+      // Outermost, so the rest sees the paths without the prefix.
+      const routed = prefix === "" ? secured : basePath(prefix)(secured);
+      return HttpMiddleware.logger(routed);
+    });
+  })
+).pipe(
   Layer.provide(HttpApiScalar.layer({ path: "/docs" })),
   Layer.provide(FunnyRadioApiLive),
   HttpServer.withLogAddress,
   Layer.provide(HttpServerLive)
 );
 
-const ServicesLive = Layer.mergeAll(
-  AudioSource.Default.pipe(Layer.provide(BunContext.layer)),
-  OpenAIRealtime.Default
+const ServicesLive = makeServicesLive(
+  AudioSource.Default.pipe(
+    Layer.provide(Layer.mergeAll(BunContext.layer, FetchHttpClient.layer))
+  )
 );
 
-const AudioProcessingLive = Layer.scopedDiscard(
-  Effect.fork(runAudioProcessor)
+// AUDIO_PIPELINE=false runs an instance that only serves clients, for
+// replicas sharing messages through Redis with the one processing audio.
+const AudioProcessingLive = Layer.unwrapEffect(
+  Config.boolean("AUDIO_PIPELINE").pipe(
+    Config.withDefault(true),
+    Effect.map((enabled) =>
+      enabled
+        ? Layer.scopedDiscard(Effect.fork(runAudioProcessor))
+        : Layer.effectDiscard(
+            Effect.log("Audio pipeline disabled on this instance")
+          )
+    )
+  )
+).pipe(Layer.provide(FetchHttpClient.layer));
+
+// Runs on shutdown (SIGTERM/SIGINT) before the servers close: stops feeding
+// audio, gives in-flight responses SHUTDOWN_GRACE_SECONDS to finish, then
+// ends client streams with a server_shutdown message.
+const GracefulShutdownLive = Layer.scopedDiscard(
+  Effect.gen(function* () {
+    const grace = yield* Config.number("SHUTDOWN_GRACE_SECONDS").pipe(
+      Config.withDefault(10)
+    );
+    const openai = yield* OpenAIRealtime;
+    const broadcaster = yield* Broadcaster;
+
+    yield* Effect.addFinalizer(() =>
+      Effect.gen(function* () {
+        yield* Effect.log("Shutting down, waiting for in-flight responses");
+        yield* AudioSource.setProcessingPaused(true);
+        yield* openai.awaitIdle.pipe(
+          Effect.timeout(`${grace} seconds`),
+          Effect.catchTag("TimeoutException", () =>
+            Effect.logWarning(
+              "Shutdown grace period elapsed with responses still running"
+            )
+          )
+        );
+        yield* broadcaster.closeClients;
+      })
+    );
+  })
 );
 
-const AppLive = Layer.merge(HttpLive, AudioProcessingLive).pipe(
+// The shutdown layer is built after the servers so that it is released first.
+const AppLive = GracefulShutdownLive.pipe(
+  Layer.provideMerge(
+    Layer.mergeAll(HttpLive, GrpcServerLive, AudioProcessingLive)
+  ),
   Layer.provide(ServicesLive)
 );
 
@@ -0,0 +1,22 @@
+// Shows Web Push notifications (alerts and digests) while the page is closed.
+self.addEventListener("push", (event) => {
+  const data = event.data ? event.data.json() : {};
+  event.waitUntil(
+    self.registration.showNotification(data.title || "Funny Radio", {
+      body: data.body,
+      tag: data.tag,
+    })
+  );
+});
+
+// Brings back an open page, or opens one.
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  event.waitUntil(
+    self.clients
+      .matchAll({ type: "window", includeUncontrolled: true })
+      .then((clients) =>
+        clients.length > 0 ? clients[0].focus() : self.clients.openWindow("./")
+      )
+  );
+});